@@ -31,7 +31,8 @@ func genLDFlags(version string) string {
 	ldflagsStr = "-s -w -X github.com/minio/minfs/cmd.Version=" + version + " "
 	ldflagsStr = ldflagsStr + "-X github.com/minio/minfs/cmd.ReleaseTag=" + releaseTag(version) + " "
 	ldflagsStr = ldflagsStr + "-X github.com/minio/minfs/cmd.CommitID=" + commitID() + " "
-	ldflagsStr = ldflagsStr + "-X github.com/minio/minfs/cmd.ShortCommitID=" + commitID()[:12]
+	ldflagsStr = ldflagsStr + "-X github.com/minio/minfs/cmd.ShortCommitID=" + commitID()[:12] + " "
+	ldflagsStr = ldflagsStr + "-X github.com/minio/minfs/cmd.BuildDate=" + time.Now().UTC().Format(time.RFC3339)
 	return ldflagsStr
 }
 
@@ -25,4 +25,6 @@ var (
 	CommitID = "DEVELOPMENT.GOGET"
 	// ShortCommitID - first 12 characters from CommitID.
 	ShortCommitID = CommitID[:12]
+	// BuildDate - time of the build in time.RFC3339.
+	BuildDate = "DEVELOPMENT.GOGET"
 )
@@ -18,8 +18,10 @@
 package cmd
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 
@@ -39,6 +41,62 @@ var globalFlags = []cli.Flag{
 		Name:  "o",
 		Usage: "Fuse mount options.",
 	},
+	cli.BoolFlag{
+		Name:  "foreground, f",
+		Usage: "Serve in the foreground, the default under systemd. Otherwise minfs exits once the mount is serving.",
+	},
+	cli.BoolFlag{
+		Name:  "quiet, q",
+		Usage: "Only log errors.",
+	},
+	cli.BoolFlag{
+		Name:  "verbose, v",
+		Usage: "Log debug entries.",
+	},
+	cli.BoolFlag{
+		Name:  "vv",
+		Usage: "Log trace entries and the S3 requests, with the credentials redacted.",
+	},
+	cli.StringFlag{
+		Name:  "pid-file",
+		Usage: "Write the pid of the serving minfs to this file.",
+	},
+	cli.IntFlag{
+		Name:  "ready-fd",
+		Usage: "Write a line to this inherited file descriptor once the mount is serving, and close it.",
+	},
+	cli.StringFlag{
+		Name:  "config",
+		Usage: "Config file with mount options, " + defaultConfigFile + " is used if it exists.",
+	},
+	cli.BoolFlag{
+		Name:  "all-or-nothing",
+		Usage: "Unmount all mounts of the config file if one fails to mount, instead of serving the others.",
+	},
+	cli.BoolFlag{
+		Name:  "check",
+		Usage: "Check the config, the credentials, the target, the cache dir and FUSE without mounting, and exit.",
+	},
+	cli.BoolFlag{
+		Name:  "fsck",
+		Usage: "Check the meta DB of the unmounted target against the cache and the bucket, and exit.",
+	},
+	cli.BoolFlag{
+		Name:  "repair",
+		Usage: "Repair the problems found by --fsck.",
+	},
+	cli.BoolFlag{
+		Name:  "gc",
+		Usage: "Remove lost cache references and unreferenced cache files of the unmounted target, and exit.",
+	},
+	cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "Only report what --gc would remove.",
+	},
+	cli.StringFlag{
+		Name:  "export-meta",
+		Usage: "Write the meta DB of the unmounted target to a file and exit.",
+	},
 }
 
 // Help template for minfs.
@@ -60,7 +118,83 @@ FLAGS:
 CUSTOM Fuse mount options:
   - access-key{{ "\t" }}string key (overrides the settings in /etc/minfs/config.json)
   - secret-key{{ "\t" }}string key (overrides the settings in /etc/minfs/config.json)
+  - credentials{{ "\t" }}keyring:<service>/<account> reads the secret key of the access key account from the OS keyring, helper:<command> runs "<command> get" with the target URL on stdin for JSON credentials {"Username","Secret","SessionToken","Expiry"}, again before they expire
   - cabundle{{ "\t" }}string filepath
+  - uid, gid{{ "\t" }}owner of all files and directories, chown is ignored
+  - file-mode, dir-mode{{ "\t" }}octal permissions of the files without a mode set by create or chmod, or of all directories
+  - prefix-mode{{ "\t" }}prefix:mode, octal permissions of the files below the prefix instead of file-mode, e.g. bin/:0755, can be repeated
+  - umask{{ "\t" }}octal mask of the permissions of all entries, e.g. 022
+  - strict-attrs{{ "\t" }}fail chown of the owner set by uid or gid with EPERM
+  - insecure-skip-verify{{ "\t" }}don't verify the TLS certificate of the target, for self-signed labs
+  - region{{ "\t" }}region of the target, taken from AWS hosts and looked up otherwise
+  - ro{{ "\t" }}mount read-only, writes fail with EROFS and nothing is uploaded, with anonymous access if no keys are set
+  - scratch{{ "\t" }}keep all changes in the cache, written files are local-only and removals hide the remote entries, nothing is uploaded or removed remotely
+  - bucket-access{{ "\t" }}write access to the buckets: auto (default) checks the bucket policy or probes with an aborted upload at mount and every 15m, read-only or read-write force it, writes to read-only buckets fail with EACCES
+  - volname{{ "\t" }}name of the volume in Finder on macOS, the bucket by default
+  - noappledouble[=local|reject]{{ "\t" }}keep the ._* files of Finder in the cache only with local, or fail their creation with reject (default), remote ._* objects are hidden
+  - nods_store[=local|reject]{{ "\t" }}same for .DS_Store files
+  - cache-reuse{{ "\t" }}keep cached files and revalidate them on open
+  - no-open-check{{ "\t" }}don't check objects for changes by other clients on open, cached content might be stale
+  - conflict-policy{{ "\t" }}changes of files also changed or removed remotely: local-wins (default), remote-wins or conflict-copy
+  - atime{{ "\t" }}access time updates by reads: off, relatime (default) if older than the modification time or a day, or on, kept in the meta DB only, noatime, relatime and strictatime set these too
+  - no-verify-upload{{ "\t" }}only verify the size of uploads, for endpoints whose ETags are not MD5 digests
+  - checksum{{ "\t" }}checksum verifying transfers, one of crc32c, sha256 or none
+  - request-payer{{ "\t" }}set to requester to access requester pays buckets
+  - addressing{{ "\t" }}URL style of bucket requests: path, virtual or auto (default)
+  - part-size{{ "\t" }}part size of multipart uploads, e.g. 64MiB (default 128MiB)
+  - upload-concurrency{{ "\t" }}number of parts transferred concurrently (default 4)
+  - gc-interval{{ "\t" }}remove lost cache references and unreferenced cache files this often, 0 disables (default 1h)
+  - metrics-addr{{ "\t" }}serve Prometheus metrics at /metrics and the health at /healthz on this address, e.g. :9567
+  - pprof[=addr]{{ "\t" }}serve net/http/pprof profiles at /debug/pprof/ on this address, or on the metrics address
+  - health-remote{{ "\t" }}check that the bucket is reachable in the health endpoint
+  - log-level{{ "\t" }}level of log entries: error, warn, info (default), debug or trace with the S3 requests, see -q, -v and -vv
+  - log-format{{ "\t" }}format of log entries: console (default) or json
+  - log-target{{ "\t" }}where log entries go: stderr, syslog, journal or file:<path> (default file:/var/log/minfs.log)
+  - log-max-size{{ "\t" }}rotate the log file at this size, keeping 3 old files, 0 disables (default 64MiB)
+  - upload-workers{{ "\t" }}number of uploads, copies and moves run concurrently (default 4)
+  - async-uploads{{ "\t" }}return from close once the upload is queued, uploads are journaled and retried
+  - small-upload{{ "\t" }}uploads up to this size aren't queued behind larger ones, e.g. 1MiB (default 16MiB)
+  - no-dir-markers{{ "\t" }}don't create prefix/ marker objects for new directories, empty directories are lost on remount
+  - notifications{{ "\t" }}apply bucket notifications of changes by other clients (MinIO only)
+  - attr-timeout{{ "\t" }}time the kernel caches the attributes of entries, e.g. 1s (default 0, changes by other clients show right away)
+  - entry-timeout{{ "\t" }}time the kernel caches looked up names, e.g. 1h for build servers, 0 for shared buckets (default 1m, directories created by mkdir always 1m)
+  - writeback-cache{{ "\t" }}let the kernel buffer writes and send them in batches, sizes and times changed by writes arrive as setattr
+  - direct-io{{ "\t" }}bypass the page cache of the kernel for file content, shared mmap fails, can't be combined with writeback-cache
+  - dir-ttl{{ "\t" }}list directories again when their listing is older, e.g. 30s (default until unmount)
+  - evict-after{{ "\t" }}drop meta data of files not accessed for this long, e.g. 168h (default never)
+  - resync-interval{{ "\t" }}reconcile listed directories with the remote in the background, e.g. 15m
+  - resync-rate{{ "\t" }}listing requests per second of background resyncs (default 5)
+  - upload-retries{{ "\t" }}background retries of failed uploads before giving up (default 20)
+  - meta-store{{ "\t" }}backend of the meta data: bolt (default), badger for millions of entries, or memory
+  - import-meta{{ "\t" }}seed the meta DB from a file written by --export-meta of the same target
+  - compact-threshold{{ "\t" }}compact the meta DB at mount when this fraction is unused (default 0.5, 1 disables)
+  - meta-timeout{{ "\t" }}deadline of stat, list, remove and copy requests (default 1m)
+  - data-idle-timeout{{ "\t" }}abort transfers without progress for this long (default 30s)
+  - soft{{ "\t" }}fail operations with EIO once the endpoint is unreachable for longer than retry-timeout (default)
+  - hard{{ "\t" }}block operations while the endpoint is unreachable until it answers again, files served from the cache keep working
+  - intr{{ "\t" }}let signals interrupt the operations of hard mounts waiting for the endpoint
+  - retry-timeout{{ "\t" }}time soft mounts retry after the endpoint became unreachable (default 30s)
+  - lock-warn{{ "\t" }}log operations waiting longer for a file lock, with its holder (default 1s)
+  - lock-timeout{{ "\t" }}fail operations waiting longer for a file lock with EIO, 0 waits forever (default 5s)
+  - ready-timeout{{ "\t" }}time the mount has to answer a stat of its root before it's unmounted and fails (default 1m)
+  - shutdown-timeout{{ "\t" }}time SIGTERM waits for dirty files and queued uploads before unmounting, a second SIGTERM skips it (default 60s)
+  - slow-op{{ "\t" }}log FUSE operations running longer, with the remote call they wait for, 0 disables (default 5s)
+  - audit-log{{ "\t" }}record mutating operations with caller and outcome in this file, or syslog
+  - status-dir{{ "\t" }}serve the status, pending, config and errors files in the virtual .minfs directory
+  - dump-file{{ "\t" }}write the state dump on SIGUSR1 to this file instead of the log
+  - unsafe-faults[=rules]{{ "\t" }}inject faults for testing, e.g. s3:part:3:503;cache:read:*:eio, never on real data
+  - trace-endpoint{{ "\t" }}export OpenTelemetry traces over OTLP/HTTP, e.g. http://localhost:4318
+  - trace-sample{{ "\t" }}ratio of FUSE operations traced, between 0 and 1 (default 1)
+  - presign-expiry{{ "\t" }}default expiry of URLs in the minfs.presigned-url xattr, e.g. 24h
+  - buckets{{ "\t" }}colon separated list of buckets mounted as directories, or * for all buckets
+  - bucket-ops{{ "\t" }}create and remove buckets with mkdir and rmdir on the mount root, requires buckets=*
+  - create-bucket[=region]{{ "\t" }}create the bucket at mount time if it doesn't exist
+CONFIG FILE:
+  key = value lines of the mount options, and of target and mountpoint, in /etc/minfs/minfs.toml or the --config file.
+  access-key-file and secret-key-file read the key from a file only accessible by its owner. Mount options override
+  the environment (MINFS_OPTIONS, MINFS_ACCESS_KEY, MINFS_SECRET_KEY), which overrides the config file.
+  [mount.<name>] tables define several mounts served by one process, with their own mountpoint and target and
+  options overriding the top level. The mounts share the log, the connections, the upload workers and metrics-addr.
 EXAMPLE:
   ./minfs -o access-key=***,uid=1234,secret-key=***,cabundle=/path/to/cabundle.crt,insecure https://example.com:9010/mybucket  /mnt/mountpoint
 
@@ -93,11 +227,18 @@ func Main(args []string) {
 	// -- permissions
 	// -- uid / gid
 
+	minfs.Build = buildInfo()
+
 	// Set up app.
 	cli.HelpFlag = cli.BoolFlag{
 		Name:  "help, h",
 		Usage: "show help",
 	}
+	// -v is verbose
+	cli.VersionFlag = cli.BoolFlag{
+		Name:  "version, V",
+		Usage: "print the version",
+	}
 
 	app := cli.NewApp()
 	app.HideHelpCommand = true
@@ -107,68 +248,91 @@ func Main(args []string) {
 	app.Usage = "Fuse driver for Cloud Storage Server."
 	app.Description = `MinFS is a fuse driver for MinIO server.`
 	app.Flags = append(minfsFlags, globalFlags...)
+	app.Commands = []cli.Command{statusCmd, logLevelCmd, flushCmd, purgeCmd, compactCmd, faultCmd, versionCmd}
 	app.CustomAppHelpTemplate = minfsHelpTemplate
 	app.Before = func(c *cli.Context) error {
+		// commands talk to running processes
+		for _, cmd := range c.App.Commands {
+			if c.Args().First() == cmd.Name {
+				return nil
+			}
+		}
+
 		_, err := minfs.InitMinFSConfig()
 		if err != nil {
 			return fmt.Errorf("Unable to initialize minfs config %s", err)
 		}
-		if !c.Args().Present() {
-			cli.ShowAppHelpAndExit(c, 1)
+		if !c.Args().Present() && c.String("config") == "" {
+			if _, err := os.Stat(defaultConfigFile); err != nil {
+				cli.ShowAppHelpAndExit(c, 1)
+			}
 		}
 		return nil
 	}
 	app.Action = func(c *cli.Context) error {
-		opts := []func(*minfs.Config){}
-		for _, option := range strings.Split(c.String("o"), ",") {
-			vals := strings.Split(option, "=")
-			switch vals[0] {
-			case "uid":
-				if len(vals) == 1 {
-					return errors.New("Uid has no value")
-				}
-				val, err := strconv.Atoi(vals[1])
-				if err != nil {
-					return fmt.Errorf("Uid is not a valid value: %s", vals[1])
-				}
-				opts = append(opts, minfs.SetUID(uint32(val)))
-			case "gid":
-				if len(vals) == 1 {
-					return errors.New("Gid has no value")
-				}
-				val, err := strconv.Atoi(vals[1])
-				if err != nil {
-					return fmt.Errorf("Gid is not a valid value: %s", vals[1])
-				}
-				opts = append(opts, minfs.SetGID(uint32(val)))
-			case "cache":
-				if len(vals) == 1 {
-					return errors.New("Cache has no value")
-				}
-				opts = append(opts, minfs.CacheDir(vals[1]))
-			case "insecure":
-				opts = append(opts, minfs.Insecure())
-			case "debug":
-				opts = append(opts, minfs.Debug())
-			case "cabundle":
-				opts = append(opts, minfs.CABundle(vals[1]))
-			case "access-key":
-				opts = append(opts, minfs.AccessKey(vals[1]))
-			case "secret-key":
-				opts = append(opts, minfs.SecretKey(vals[1]))
-			}
+		fc, err := configOptions(c.String("config"), c.String("o"))
+		if err != nil {
+			return err
+		}
+		verbosity, err := verbosityOptions(c)
+		if err != nil {
+			return err
+		}
 
-			target := c.Args().Get(0)
-			mountpoint := c.Args().Get(1)
+		// the mounts of the config file, unless one is given
+		if !c.Args().Present() && len(fc.mounts) > 0 {
+			return serveGroup(c, fc, verbosity)
+		}
 
-			opts = append(opts, minfs.Mountpoint(mountpoint), minfs.Target(target))
+		target, mountpoint := fc.target, fc.mountpoint
+		if c.Args().Present() {
+			target = c.Args().Get(0)
+		}
+		if c.NArg() > 1 {
+			mountpoint = c.Args().Get(1)
+		}
+		if target == "" || mountpoint == "" {
+			cli.ShowAppHelpAndExit(c, 1)
 		}
+		opts := append(fc.opts, minfs.Mountpoint(mountpoint), minfs.Target(target))
+		opts = append(opts, verbosity...)
+
+		// SIGHUP reads the config file again, the target and the mount
+		// point stay those of the mount, the flags win over the file
+		opts = append(opts, minfs.Reload(func() ([]func(*minfs.Config), error) {
+			fc, err := configOptions(c.String("config"), c.String("o"))
+			if err != nil {
+				return nil, err
+			}
+			return append(append(fc.opts, minfs.Mountpoint(mountpoint), minfs.Target(target)), verbosity...), nil
+		}))
+
+		opts = append(opts, processOptions(c)...)
 
 		fs, err := minfs.New(opts...)
 		if err != nil {
 			return fmt.Errorf("Unable to initialize minfs %s", err)
 		}
 
+		if c.Bool("check") {
+			return runCheck(fs)
+		}
+
+		if c.Bool("fsck") {
+			return runFsck(fs, c.Bool("repair"))
+		}
+
+		if c.Bool("gc") {
+			return runGC(fs, c.Bool("dry-run"))
+		}
+
+		if path := c.String("export-meta"); path != "" {
+			if err = fs.ExportMetaFile(path); err != nil {
+				return fmt.Errorf("Unable to export the meta DB %s", err)
+			}
+			return nil
+		}
+
 		err = fs.Serve()
 		if err != nil {
 			return fmt.Errorf("Unable to serve minfs %s", err)
@@ -182,3 +346,131 @@ func Main(args []string) {
 		console.Fatalln(err)
 	}
 }
+
+// processOptions returns the options of the flags setting up the process.
+func processOptions(c *cli.Context) []func(*minfs.Config) {
+	var opts []func(*minfs.Config)
+	if path := c.String("pid-file"); path != "" {
+		opts = append(opts, minfs.PidFile(path))
+	}
+	if fd := c.Int("ready-fd"); fd != 0 {
+		opts = append(opts, minfs.ReadyFD(fd))
+	}
+	// systemd tracks the process it started
+	if !c.Bool("foreground") && os.Getenv("NOTIFY_SOCKET") == "" {
+		opts = append(opts, minfs.Background())
+	}
+	return opts
+}
+
+// serveGroup serves the mounts of the [mount.<name>] tables of the config
+// file from this process.
+func serveGroup(c *cli.Context, fc fileConfig, verbosity []func(*minfs.Config)) error {
+	if c.Bool("check") || c.Bool("fsck") || c.Bool("gc") || c.String("export-meta") != "" {
+		return errors.New("--check, --fsck, --gc and --export-meta need the target and mount point of a single mount")
+	}
+
+	var mounts []minfs.GroupMount
+	for _, m := range fc.mounts {
+		name, target, mountpoint := m.name, m.target, m.mountpoint
+		opts := append(m.opts, minfs.Mountpoint(mountpoint), minfs.Target(target))
+		opts = append(opts, verbosity...)
+
+		// SIGHUP reads the table of the mount again
+		opts = append(opts, minfs.Reload(func() ([]func(*minfs.Config), error) {
+			fc, err := configOptions(c.String("config"), c.String("o"))
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range fc.mounts {
+				if m.name == name {
+					return append(append(m.opts, minfs.Mountpoint(mountpoint), minfs.Target(target)), verbosity...), nil
+				}
+			}
+			return nil, fmt.Errorf("Mount %s is no longer in the config file", name)
+		}))
+
+		opts = append(opts, processOptions(c)...)
+		mounts = append(mounts, minfs.GroupMount{Name: name, Options: opts})
+	}
+
+	g, err := minfs.NewGroup(c.Bool("all-or-nothing"), mounts...)
+	if err != nil {
+		return fmt.Errorf("Unable to initialize minfs %s", err)
+	}
+	if err = g.Serve(); err != nil {
+		return fmt.Errorf("Unable to serve minfs %s", err)
+	}
+	return nil
+}
+
+// runCheck prints the outcome of each check, a failed check fails the
+// command.
+func runCheck(fs *minfs.MinFS) error {
+	report := fs.Check()
+	fmt.Print(report)
+
+	if n := report.Failed(); n > 0 {
+		return fmt.Errorf("%d of %d checks failed", n, len(report.Results))
+	}
+	return nil
+}
+
+// runFsck prints the report of the check as JSON, and a summary to
+// stderr. Unrepaired problems fail the command.
+func runFsck(fs *minfs.MinFS, repair bool) error {
+	report, err := fs.FsckOffline(repair)
+	if err != nil {
+		return fmt.Errorf("Unable to check the meta DB %s", err)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	fmt.Fprintln(os.Stderr, report.Summary())
+
+	if report.Problems() > 0 && !report.Repaired {
+		return errors.New("Meta DB check found problems, run with --repair to fix them")
+	}
+	return nil
+}
+
+// runGC prints the report of the garbage collection as JSON, and a
+// summary to stderr.
+func runGC(fs *minfs.MinFS, dryRun bool) error {
+	report, err := fs.GCOffline(dryRun)
+	if err != nil {
+		return fmt.Errorf("Unable to collect garbage %s", err)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	fmt.Fprintln(os.Stderr, report.Summary())
+	return nil
+}
+
+// parseSize parses a size in bytes with an optional KiB, MiB or GiB suffix.
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{
+		"KiB": 1 << 10,
+		"MiB": 1 << 20,
+		"GiB": 1 << 30,
+	} {
+		if strings.HasSuffix(s, suffix) {
+			s, multiplier = strings.TrimSuffix(s, suffix), m
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,59 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/minio/cli"
+	minfs "github.com/minio/minfs/fs"
+)
+
+var compactCmd = cli.Command{
+	Name:      "compact",
+	Usage:     "Compact the meta DB of a mount now.",
+	ArgsUsage: "mountpoint",
+	Action:    runCompact,
+}
+
+// runCompact asks the process serving the mount point given to compact
+// the meta DB of the mount.
+func runCompact(c *cli.Context) error {
+	if !c.Args().Present() {
+		return errors.New("Mount point missing, the meta DB of its mount is compacted")
+	}
+	abs, err := filepath.Abs(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	p, mountpoint, err := processOf(abs)
+	if err != nil {
+		return err
+	}
+
+	resp, err := minfs.QueryControl(p.Socket, minfs.ControlRequest{Command: "compact", Path: mountpoint})
+	if err != nil {
+		return fmt.Errorf("Unable to compact the meta DB of %s: %s", mountpoint, err)
+	}
+	if r := resp.Compacted; r != nil {
+		fmt.Printf("%s\tcompacted from %d to %d bytes in %s\n", mountpoint, r.Before, r.After, r.Duration)
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	minfs "github.com/minio/minfs/fs"
+)
+
+// defaultConfigFile is loaded when --config isn't given, if it exists.
+const defaultConfigFile = "/etc/minfs/minfs.toml"
+
+// secretFileKeys are the keys of which the value can be read from a file
+// given by the key with a -file suffix.
+var secretFileKeys = map[string]bool{
+	"access-key": true,
+	"secret-key": true,
+}
+
+// mountTablePrefix starts the tables of the config file defining mounts,
+// [mount.<name>].
+const mountTablePrefix = "mount."
+
+// validMountName matches the names of mount tables.
+var validMountName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// configEntry is a key of the config file, with the line it's on and the
+// mount table it's in, empty at the top level.
+type configEntry struct {
+	key   string
+	value string
+	line  int
+	mount string
+
+	// set for boolean values, which enable options without value
+	isBool bool
+}
+
+// parseConfigFile reads the entries of the config file at path, a subset
+// of TOML: key = value lines with strings, numbers, booleans and arrays
+// of strings, [mount.<name>] tables, and # comments. Keys are the mount
+// options, underscores may be used instead of dashes.
+func parseConfigFile(path string) ([]configEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		entries []configEntry
+		mount   string
+		seen    = map[string]int{}
+		tables  = map[string]int{}
+		scanner = bufio.NewScanner(f)
+	)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(stripComment(scanner.Text()))
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "[") {
+			table := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(text, "["), "]"))
+			if !strings.HasSuffix(text, "]") || !strings.HasPrefix(table, mountTablePrefix) {
+				return nil, fmt.Errorf("Config file %s line %d: only [mount.<name>] tables are supported", path, line)
+			}
+			mount = strings.TrimPrefix(table, mountTablePrefix)
+			if !validMountName.MatchString(mount) {
+				return nil, fmt.Errorf("Config file %s line %d: mount name %s may only have letters, digits, - and _", path, line, mount)
+			}
+			if first, ok := tables[mount]; ok {
+				return nil, fmt.Errorf("Config file %s line %d: mount %s already defined on line %d", path, line, mount, first)
+			}
+			tables[mount] = line
+			continue
+		}
+
+		i := strings.Index(text, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("Config file %s line %d: expected key = value", path, line)
+		}
+		key := strings.ReplaceAll(strings.Trim(strings.TrimSpace(text[:i]), `"`), "_", "-")
+		if key == "" {
+			return nil, fmt.Errorf("Config file %s line %d: key is empty", path, line)
+		}
+		if first, ok := seen[mount+"."+key]; ok {
+			return nil, fmt.Errorf("Config file %s line %d, key %s: already set on line %d", path, line, key, first)
+		}
+		seen[mount+"."+key] = line
+
+		value, isBool, err := parseConfigValue(strings.TrimSpace(text[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("Config file %s line %d, key %s: %s", path, line, key, err)
+		}
+		entries = append(entries, configEntry{key: key, value: value, line: line, mount: mount, isBool: isBool})
+	}
+	return entries, scanner.Err()
+}
+
+// stripComment removes a # comment which isn't part of a string.
+func stripComment(line string) string {
+	var (
+		quote   rune
+		escaped bool
+	)
+	for i, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseConfigValue returns the value as a mount option value, arrays are
+// joined with colons like the buckets option.
+func parseConfigValue(raw string) (value string, isBool bool, err error) {
+	switch {
+	case raw == "":
+		return "", false, fmt.Errorf("value is empty")
+	case raw == "true" || raw == "false":
+		return raw, true, nil
+	case strings.HasPrefix(raw, `"`):
+		value, err = strconv.Unquote(raw)
+		if err != nil {
+			return "", false, fmt.Errorf("%s is not a valid string", raw)
+		}
+		return value, false, nil
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return "", false, fmt.Errorf("%s is not a valid string", raw)
+		}
+		return raw[1 : len(raw)-1], false, nil
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return "", false, fmt.Errorf("%s is not a valid array, arrays must be on one line", raw)
+		}
+		var items []string
+		for _, item := range strings.Split(raw[1:len(raw)-1], ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			v, _, err := parseConfigValue(item)
+			if err != nil {
+				return "", false, err
+			}
+			items = append(items, v)
+		}
+		return strings.Join(items, ":"), false, nil
+	}
+	// numbers, and bare durations and sizes like 30s or 64MiB
+	return raw, false, nil
+}
+
+// readSecretFile returns the trimmed content of the file at path, which
+// may not be accessible by other users.
+func readSecretFile(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("Secret file %s is accessible by other users, restrict it with chmod 600", path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// fileConfig is the content of a config file.
+type fileConfig struct {
+	opts       []func(*minfs.Config)
+	target     string
+	mountpoint string
+
+	// mounts of the [mount.<name>] tables, in the order of the file
+	mounts []*mountConfig
+}
+
+// mountConfig is a mount of a [mount.<name>] table. Its options follow
+// those of the top level, which it overrides, the target defaults to the
+// one of the top level.
+type mountConfig struct {
+	name       string
+	opts       []func(*minfs.Config)
+	target     string
+	mountpoint string
+}
+
+// loadConfigFile returns the options of the config file at path, and the
+// target and mount point it sets.
+func loadConfigFile(path string) (fileConfig, error) {
+	var fc fileConfig
+
+	entries, err := parseConfigFile(path)
+	if err != nil {
+		return fc, err
+	}
+
+	mounts := map[string]*mountConfig{}
+	for _, e := range entries {
+		wrap := func(err error) error {
+			return fmt.Errorf("Config file %s line %d, key %s: %s", path, e.line, e.key, err)
+		}
+
+		// the entry sets the top level, or the mount of its table
+		opts, target, mountpoint := &fc.opts, &fc.target, &fc.mountpoint
+		if e.mount != "" {
+			m, ok := mounts[e.mount]
+			if !ok {
+				m = &mountConfig{name: e.mount}
+				mounts[e.mount] = m
+				fc.mounts = append(fc.mounts, m)
+			}
+			opts, target, mountpoint = &m.opts, &m.target, &m.mountpoint
+		}
+
+		switch {
+		case e.key == "target":
+			*target = e.value
+			continue
+		case e.key == "mountpoint":
+			*mountpoint = e.value
+			continue
+		case strings.HasSuffix(e.key, "-file") && secretFileKeys[strings.TrimSuffix(e.key, "-file")]:
+			secret, err := readSecretFile(e.value)
+			if err != nil {
+				return fc, wrap(err)
+			}
+			e.key, e.value = strings.TrimSuffix(e.key, "-file"), secret
+		}
+
+		option := e.key + "=" + e.value
+		if e.isBool {
+			if e.value == "false" {
+				continue
+			}
+			option = e.key
+		}
+
+		parsed, err := parseOptionList([]string{option})
+		if err != nil {
+			return fc, wrap(err)
+		}
+		*opts = append(*opts, parsed...)
+	}
+
+	for _, m := range fc.mounts {
+		if m.mountpoint == "" {
+			return fc, fmt.Errorf("Config file %s: mount %s has no mountpoint", path, m.name)
+		}
+		if m.target == "" {
+			m.target = fc.target
+		}
+		if m.target == "" {
+			return fc, fmt.Errorf("Config file %s: mount %s has no target", path, m.name)
+		}
+	}
+	return fc, nil
+}
+
+// envOptions returns the options set by the environment: the MINFS_OPTIONS
+// mount options and the MINFS_ACCESS_KEY and MINFS_SECRET_KEY credentials.
+func envOptions() ([]func(*minfs.Config), error) {
+	opts, err := parseMountOptions(os.Getenv("MINFS_OPTIONS"))
+	if err != nil {
+		return nil, fmt.Errorf("MINFS_OPTIONS: %s", err)
+	}
+	if v := os.Getenv("MINFS_ACCESS_KEY"); v != "" {
+		opts = append(opts, minfs.AccessKey(v))
+	}
+	if v := os.Getenv("MINFS_SECRET_KEY"); v != "" {
+		opts = append(opts, minfs.SecretKey(v))
+	}
+	return opts, nil
+}
+
+// configOptions returns the options of the config file, the environment
+// and the -o mount options in this order, so the mount options take
+// precedence over the environment and the environment over the file. The
+// config file is the one at path, or the default one if it exists.
+func configOptions(path, mountOptions string) (fileConfig, error) {
+	var fc fileConfig
+
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			path = defaultConfigFile
+		}
+	}
+	if path != "" {
+		var err error
+		if fc, err = loadConfigFile(path); err != nil {
+			return fc, err
+		}
+	}
+
+	env, err := envOptions()
+	if err != nil {
+		return fc, err
+	}
+
+	cli, err := parseMountOptions(mountOptions)
+	if err != nil {
+		return fc, err
+	}
+
+	// the tables of mounts override the top level, the environment and
+	// the mount options override both
+	for _, m := range fc.mounts {
+		opts := append([]func(*minfs.Config){}, fc.opts...)
+		opts = append(opts, m.opts...)
+		m.opts = append(append(opts, env...), cli...)
+	}
+	fc.opts = append(fc.opts, env...)
+	fc.opts = append(fc.opts, cli...)
+	return fc, nil
+}
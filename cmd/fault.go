@@ -0,0 +1,94 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/minio/cli"
+	minfs "github.com/minio/minfs/fs"
+)
+
+var faultCmd = cli.Command{
+	Name:      "fault",
+	Usage:     "Inject faults in a mount with the unsafe-faults option, e.g. s3:part:3:503, or list them.",
+	ArgsUsage: "mountpoint [rule...]",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "clear",
+			Usage: "Remove the fault rules of the mount first.",
+		},
+	},
+	Action: runFault,
+}
+
+// runFault sends the fault rules given to the process serving the mount
+// point given, and prints the rules of the mount.
+func runFault(c *cli.Context) error {
+	if !c.Args().Present() {
+		return errors.New("Mount point missing, the faults are injected in its mount")
+	}
+	abs, err := filepath.Abs(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	p, mountpoint, err := processOf(abs)
+	if err != nil {
+		return err
+	}
+
+	var reqs []minfs.ControlRequest
+	if c.Bool("clear") {
+		reqs = append(reqs, minfs.ControlRequest{Command: "clear-faults", Path: mountpoint})
+	}
+	for _, rule := range c.Args().Tail() {
+		reqs = append(reqs, minfs.ControlRequest{Command: "fault", Path: mountpoint, Fault: rule})
+	}
+	if len(reqs) == 0 {
+		// nothing to change, the rules are listed
+		reqs = append(reqs, minfs.ControlRequest{Command: "fault", Path: mountpoint})
+	}
+
+	var faults map[string]uint64
+	for _, req := range reqs {
+		resp, err := minfs.QueryControl(p.Socket, req)
+		if err != nil {
+			return fmt.Errorf("Unable to inject faults in %s: %s", mountpoint, err)
+		}
+		if resp.Error != "" {
+			return fmt.Errorf("Unable to inject faults in %s: %s", mountpoint, resp.Error)
+		}
+		faults = resp.Faults
+	}
+
+	rules := make([]string, 0, len(faults))
+	for rule := range faults {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	for _, rule := range rules {
+		fmt.Printf("%s\t%s\tmatched %d calls\n", mountpoint, rule, faults[rule])
+	}
+	if len(rules) == 0 {
+		fmt.Printf("%s\tno faults\n", mountpoint)
+	}
+	return nil
+}
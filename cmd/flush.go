@@ -0,0 +1,131 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/cli"
+	minfs "github.com/minio/minfs/fs"
+)
+
+var flushCmd = cli.Command{
+	Name:      "flush",
+	Usage:     "Upload the changed files below a path of a mount now, and wait for them.",
+	ArgsUsage: "path",
+	Action: func(c *cli.Context) error {
+		return runPathCommand(c, minfs.ControlRequest{Command: "flush"})
+	},
+}
+
+var purgeCmd = cli.Command{
+	Name:      "purge",
+	Usage:     "Drop the cached meta data and content of the files below a path of a mount, except open and changed files.",
+	ArgsUsage: "path",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "force-discard",
+			Usage: "Purge files with changes which aren't uploaded too, the changes are lost.",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		return runPathCommand(c, minfs.ControlRequest{Command: "purge", Force: c.Bool("force-discard")})
+	},
+}
+
+// runPathCommand sends req for the path given to the process serving the
+// mount of the path, and prints the result of each file.
+func runPathCommand(c *cli.Context, req minfs.ControlRequest) error {
+	if !c.Args().Present() {
+		return fmt.Errorf("Path missing, the %s applies to the files below it", req.Command)
+	}
+	abs, err := filepath.Abs(c.Args().First())
+	if err != nil {
+		return err
+	}
+	req.Path = abs
+
+	p, mountpoint, err := processOf(abs)
+	if err != nil {
+		return err
+	}
+
+	resp, err := minfs.QueryControl(p.Socket, req)
+	if err != nil {
+		return fmt.Errorf("Unable to %s %s: %s", req.Command, abs, err)
+	}
+
+	failed := 0
+	for _, r := range resp.Results {
+		path := filepath.Join(mountpoint, r.Path)
+		if r.Error != "" {
+			fmt.Printf("%s\t%s: %s\n", path, r.Result, r.Error)
+		} else {
+			fmt.Printf("%s\t%s\n", path, r.Result)
+		}
+		if r.Result == "failed" || r.Result == "skipped" {
+			failed++
+		}
+	}
+
+	if len(resp.Results) == 0 {
+		if req.Command == "flush" {
+			fmt.Printf("Nothing to upload below %s\n", abs)
+		} else {
+			fmt.Printf("Nothing cached below %s\n", abs)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed or were skipped", failed, len(resp.Results))
+	}
+	return nil
+}
+
+// processOf returns the minfs process serving the mount of the absolute
+// path, and its mount point.
+func processOf(abs string) (processStatus, string, error) {
+	processes, err := queryProcesses("")
+	if err != nil {
+		return processStatus{}, "", err
+	}
+	if len(processes) == 0 {
+		return processStatus{}, "", errors.New("No minfs is running")
+	}
+
+	var (
+		found      processStatus
+		mountpoint string
+	)
+	for _, p := range processes {
+		for _, m := range p.Mounts {
+			mp := filepath.Clean(m.Mountpoint)
+			if len(mp) <= len(mountpoint) {
+				continue
+			}
+			if abs == mp || strings.HasPrefix(abs, strings.TrimSuffix(mp, "/")+"/") {
+				found, mountpoint = p, mp
+			}
+		}
+	}
+	if mountpoint == "" {
+		return processStatus{}, "", fmt.Errorf("No minfs serves %s", abs)
+	}
+	return found, mountpoint, nil
+}
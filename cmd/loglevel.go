@@ -0,0 +1,104 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/minio/cli"
+	minfs "github.com/minio/minfs/fs"
+)
+
+var logLevelCmd = cli.Command{
+	Name:      "log-level",
+	Usage:     "Change the log level of the minfs processes of the user until the config is reloaded.",
+	ArgsUsage: "error|warn|info|debug|trace [mountpoint]",
+	Action:    runLogLevel,
+}
+
+// runLogLevel asks the control socket of each minfs process serving the
+// mount point given, or of all processes, to change the level of its log.
+// The mounts of a process share the log.
+func runLogLevel(c *cli.Context) error {
+	if !c.Args().Present() {
+		return errors.New("Log level missing, one of error, warn, info, debug or trace")
+	}
+	level := c.Args().First()
+
+	var mountpoint string
+	if c.NArg() > 1 {
+		abs, err := filepath.Abs(c.Args().Get(1))
+		if err != nil {
+			return err
+		}
+		mountpoint = abs
+	}
+
+	processes, err := queryProcesses(mountpoint)
+	if err != nil {
+		return err
+	}
+	if len(processes) == 0 {
+		if mountpoint != "" {
+			return fmt.Errorf("No minfs serves %s", mountpoint)
+		}
+		return errors.New("No minfs is running")
+	}
+
+	var failed int
+	for _, p := range processes {
+		resp, err := minfs.QueryControl(p.Socket, minfs.ControlRequest{Command: "log-level", Level: level})
+		if err == nil && resp.Error != "" {
+			err = errors.New(resp.Error)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to change the log level of pid %d: %s\n", p.Pid, err)
+			failed++
+			continue
+		}
+		for _, m := range resp.Mounts {
+			fmt.Printf("%s\t%s, pid %d\n", m.Mountpoint, m.LogLevel, p.Pid)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Unable to change the log level of %d of %d processes", failed, len(processes))
+	}
+	return nil
+}
+
+// verbosityOptions returns the option of the -q, -v and -vv flags, which
+// override the log-level of the config file.
+func verbosityOptions(c *cli.Context) ([]func(*minfs.Config), error) {
+	verbose := c.Bool("verbose") || c.Bool("vv")
+	if c.Bool("quiet") && verbose {
+		return nil, errors.New("-q can't be combined with -v or -vv")
+	}
+
+	switch {
+	case c.Bool("vv"):
+		return []func(*minfs.Config){minfs.LogLevel("trace")}, nil
+	case c.Bool("verbose"):
+		return []func(*minfs.Config){minfs.LogLevel("debug")}, nil
+	case c.Bool("quiet"):
+		return []func(*minfs.Config){minfs.LogLevel("error")}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,97 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/minio/cli"
+	minfs "github.com/minio/minfs/fs"
+)
+
+// logLevelOf returns the log level set by the options.
+func logLevelOf(opts []func(*minfs.Config)) string {
+	var cfg minfs.Config
+	for _, optionFn := range opts {
+		optionFn(&cfg)
+	}
+	m := regexp.MustCompile(`logLevel:(\w*)`).FindStringSubmatch(fmt.Sprintf("%+v", cfg))
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+func TestVerbosityOptions(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "minfs.toml")
+	if err := ioutil.WriteFile(config, []byte("log-level = warn\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		args  []string
+		level string
+		err   bool
+	}{
+		// the level of the config file, info without one
+		{nil, "warn", false},
+		{[]string{"-q"}, "error", false},
+		{[]string{"--quiet"}, "error", false},
+		{[]string{"-v"}, "debug", false},
+		{[]string{"--verbose"}, "debug", false},
+		{[]string{"-vv"}, "trace", false},
+		{[]string{"-v", "-vv"}, "trace", false},
+		{[]string{"-q", "-v"}, "", true},
+		{[]string{"-q", "-vv"}, "", true},
+	}
+
+	for _, testCase := range testCases {
+		// the app resolves the short names of the flags
+		var verbosity []func(*minfs.Config)
+		app := cli.NewApp()
+		app.HideVersion = true
+		app.Flags = globalFlags
+		app.Action = func(c *cli.Context) (err error) {
+			verbosity, err = verbosityOptions(c)
+			return err
+		}
+		err := app.Run(append([]string{"minfs"}, testCase.args...))
+		if testCase.err {
+			if err == nil {
+				t.Errorf("expected %v to be refused", testCase.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expected %v to be accepted, got %v", testCase.args, err)
+			continue
+		}
+
+		// the flags override the config file
+		fc, err := configOptions(config, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if level := logLevelOf(append(fc.opts, verbosity...)); level != testCase.level {
+			t.Errorf("expected %v to log at %s, got %s", testCase.args, testCase.level, level)
+		}
+	}
+}
@@ -0,0 +1,529 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	minfs "github.com/minio/minfs/fs"
+)
+
+// ignoredMountOptions are the standard options of mount(8) and fstab which
+// are handled by mount(8), the kernel or systemd, or are the defaults of
+// minfs.
+var ignoredMountOptions = map[string]bool{
+	"defaults":   true,
+	"rw":         true,
+	"auto":       true,
+	"noauto":     true,
+	"user":       true,
+	"nouser":     true,
+	"users":      true,
+	"owner":      true,
+	"group":      true,
+	"_netdev":    true,
+	"nofail":     true,
+	"dev":        true,
+	"nodev":      true,
+	"suid":       true,
+	"nosuid":     true,
+	"exec":       true,
+	"noexec":     true,
+	"async":      true,
+	"norelatime": true,
+	"nodiratime": true,
+}
+
+// ignoredMountOption tells if the option name is passed by mount(8) or
+// fstab and has no meaning to minfs, x- options are comments for other
+// programs like systemd.
+func ignoredMountOption(name string) bool {
+	return ignoredMountOptions[name] || strings.HasPrefix(name, "x-") || name == "comment"
+}
+
+// parseMountOptions returns the config options of the comma separated
+// mount options, given as key=value or key. Unknown options are rejected.
+func parseMountOptions(options string) ([]func(*minfs.Config), error) {
+	return parseOptionList(strings.Split(options, ","))
+}
+
+// parseOptionList returns the config options of the mount options.
+func parseOptionList(options []string) ([]func(*minfs.Config), error) {
+	opts := []func(*minfs.Config){}
+	for _, option := range options {
+		if option == "" {
+			continue
+		}
+		vals := strings.SplitN(option, "=", 2)
+		name := vals[0]
+		switch name {
+		case "uid":
+			if len(vals) == 1 {
+				return nil, errors.New("Uid has no value")
+			}
+			val, err := strconv.Atoi(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("Uid is not a valid value: %s", vals[1])
+			}
+			opts = append(opts, minfs.SetUID(uint32(val)))
+		case "gid":
+			if len(vals) == 1 {
+				return nil, errors.New("Gid has no value")
+			}
+			val, err := strconv.Atoi(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("Gid is not a valid value: %s", vals[1])
+			}
+			opts = append(opts, minfs.SetGID(uint32(val)))
+		case "file-mode", "dir-mode", "umask":
+			if len(vals) == 1 {
+				return nil, fmt.Errorf("Mount option %s has no value", name)
+			}
+			val, err := strconv.ParseUint(vals[1], 8, 32)
+			if err != nil || val > 0777 {
+				return nil, fmt.Errorf("Mount option %s is not a valid octal mode: %s", name, vals[1])
+			}
+			switch name {
+			case "file-mode":
+				opts = append(opts, minfs.FileMode(os.FileMode(val)))
+			case "dir-mode":
+				opts = append(opts, minfs.DirMode(os.FileMode(val)))
+			default:
+				opts = append(opts, minfs.Umask(os.FileMode(val)))
+			}
+		case "prefix-mode":
+			if len(vals) == 1 {
+				return nil, errors.New("Prefix mode has no value")
+			}
+			// arrays of the config file are joined with colons
+			parts := strings.Split(vals[1], ":")
+			if len(parts)%2 != 0 {
+				return nil, fmt.Errorf("Prefix mode is not prefix:mode: %s", vals[1])
+			}
+			for i := 0; i < len(parts); i += 2 {
+				val, err := strconv.ParseUint(parts[i+1], 8, 32)
+				if err != nil || val > 0777 {
+					return nil, fmt.Errorf("Prefix mode is not a valid octal mode: %s", parts[i+1])
+				}
+				opts = append(opts, minfs.PrefixMode(parts[i], os.FileMode(val)))
+			}
+		case "strict-attrs":
+			opts = append(opts, minfs.StrictAttrs())
+		case "cache":
+			if len(vals) == 1 {
+				return nil, errors.New("Cache has no value")
+			}
+			opts = append(opts, minfs.CacheDir(vals[1]))
+		case "cache-reuse":
+			opts = append(opts, minfs.CacheReuse())
+		case "no-open-check":
+			opts = append(opts, minfs.NoOpenCheck())
+		case "bucket-access":
+			if len(vals) == 1 {
+				return nil, errors.New("Bucket access has no value")
+			}
+			opts = append(opts, minfs.BucketAccess(vals[1]))
+		case "conflict-policy":
+			if len(vals) == 1 {
+				return nil, errors.New("Conflict policy has no value")
+			}
+			opts = append(opts, minfs.ConflictPolicy(vals[1]))
+		case "atime":
+			// mount(8) passes atime without value, the kernel default
+			if len(vals) == 2 {
+				opts = append(opts, minfs.Atime(vals[1]))
+			}
+		case "noatime":
+			opts = append(opts, minfs.Atime("off"))
+		case "relatime":
+			opts = append(opts, minfs.Atime("relatime"))
+		case "strictatime":
+			opts = append(opts, minfs.Atime("on"))
+		case "no-verify-upload":
+			opts = append(opts, minfs.NoVerifyUploads())
+		case "checksum":
+			if len(vals) == 1 {
+				return nil, errors.New("Checksum has no value")
+			}
+			opts = append(opts, minfs.Checksum(vals[1]))
+		case "request-payer":
+			if len(vals) == 1 {
+				return nil, errors.New("Request payer has no value")
+			}
+			opts = append(opts, minfs.RequestPayer(vals[1]))
+		case "addressing":
+			if len(vals) == 1 {
+				return nil, errors.New("Addressing has no value")
+			}
+			opts = append(opts, minfs.Addressing(vals[1]))
+		case "part-size":
+			if len(vals) == 1 {
+				return nil, errors.New("Part size has no value")
+			}
+			val, err := parseSize(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("Part size is not a valid size: %s", vals[1])
+			}
+			opts = append(opts, minfs.PartSize(val))
+		case "gc-interval":
+			if len(vals) == 1 {
+				return nil, errors.New("GC interval has no value")
+			}
+			val, err := time.ParseDuration(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("GC interval is not a valid duration: %s", vals[1])
+			}
+			opts = append(opts, minfs.GCInterval(val))
+		case "metrics-addr":
+			if len(vals) == 1 {
+				return nil, errors.New("Metrics address has no value")
+			}
+			opts = append(opts, minfs.MetricsAddr(vals[1]))
+		case "log-level":
+			if len(vals) == 1 {
+				return nil, errors.New("Log level has no value")
+			}
+			opts = append(opts, minfs.LogLevel(vals[1]))
+		case "log-format":
+			if len(vals) == 1 {
+				return nil, errors.New("Log format has no value")
+			}
+			opts = append(opts, minfs.LogFormat(vals[1]))
+		case "log-target":
+			if len(vals) == 1 {
+				return nil, errors.New("Log target has no value")
+			}
+			opts = append(opts, minfs.LogTarget(vals[1]))
+		case "log-max-size":
+			if len(vals) == 1 {
+				return nil, errors.New("Log max size has no value")
+			}
+			val, err := parseSize(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("Log max size is not a valid size: %s", vals[1])
+			}
+			opts = append(opts, minfs.LogMaxSize(val))
+		case "upload-workers":
+			if len(vals) == 1 {
+				return nil, errors.New("Upload workers has no value")
+			}
+			val, err := strconv.Atoi(vals[1])
+			if err != nil || val < 1 {
+				return nil, fmt.Errorf("Upload workers is not a valid value: %s", vals[1])
+			}
+			opts = append(opts, minfs.UploadWorkers(val))
+		case "pprof":
+			addr := ""
+			if len(vals) == 2 {
+				addr = vals[1]
+			}
+			opts = append(opts, minfs.Pprof(addr))
+		case "health-remote":
+			opts = append(opts, minfs.HealthRemote())
+		case "async-uploads":
+			opts = append(opts, minfs.AsyncUploads())
+		case "small-upload":
+			if len(vals) == 1 {
+				return nil, errors.New("Small upload has no value")
+			}
+			val, err := parseSize(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("Small upload is not a valid size: %s", vals[1])
+			}
+			opts = append(opts, minfs.SmallUpload(val))
+		case "upload-concurrency":
+			if len(vals) == 1 {
+				return nil, errors.New("Upload concurrency has no value")
+			}
+			val, err := strconv.Atoi(vals[1])
+			if err != nil || val < 1 {
+				return nil, fmt.Errorf("Upload concurrency is not a valid value: %s", vals[1])
+			}
+			opts = append(opts, minfs.UploadConcurrency(uint(val)))
+		case "meta-timeout", "data-idle-timeout":
+			if len(vals) == 1 {
+				return nil, fmt.Errorf("%s has no value", vals[0])
+			}
+			val, err := time.ParseDuration(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid duration: %s", vals[0], vals[1])
+			}
+			if vals[0] == "meta-timeout" {
+				opts = append(opts, minfs.MetaTimeout(val))
+			} else {
+				opts = append(opts, minfs.DataIdleTimeout(val))
+			}
+		case "soft":
+			opts = append(opts, minfs.Soft())
+		case "hard":
+			opts = append(opts, minfs.Hard())
+		case "intr":
+			opts = append(opts, minfs.Intr())
+		case "retry-timeout":
+			if len(vals) == 1 {
+				return nil, errors.New("Retry timeout has no value")
+			}
+			val, err := time.ParseDuration(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("Retry timeout is not a valid duration: %s", vals[1])
+			}
+			opts = append(opts, minfs.RetryTimeout(val))
+		case "ready-timeout":
+			if len(vals) == 1 {
+				return nil, errors.New("Ready timeout has no value")
+			}
+			val, err := time.ParseDuration(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("Ready timeout is not a valid duration: %s", vals[1])
+			}
+			opts = append(opts, minfs.ReadyTimeout(val))
+		case "attr-timeout", "entry-timeout":
+			if len(vals) == 1 {
+				return nil, fmt.Errorf("%s has no value", vals[0])
+			}
+			val, err := time.ParseDuration(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid duration: %s", vals[0], vals[1])
+			}
+			if vals[0] == "attr-timeout" {
+				opts = append(opts, minfs.AttrTimeout(val))
+			} else {
+				opts = append(opts, minfs.EntryTimeout(val))
+			}
+		case "writeback-cache":
+			opts = append(opts, minfs.WritebackCache())
+		case "direct-io":
+			opts = append(opts, minfs.DirectIO())
+		case "slow-op":
+			if len(vals) == 1 {
+				return nil, errors.New("Slow operation threshold has no value")
+			}
+			val, err := time.ParseDuration(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("Slow operation threshold is not a valid duration: %s", vals[1])
+			}
+			opts = append(opts, minfs.SlowOp(val))
+		case "shutdown-timeout":
+			if len(vals) == 1 {
+				return nil, errors.New("Shutdown timeout has no value")
+			}
+			val, err := time.ParseDuration(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("Shutdown timeout is not a valid duration: %s", vals[1])
+			}
+			opts = append(opts, minfs.ShutdownTimeout(val))
+		case "audit-log":
+			if len(vals) == 1 {
+				return nil, errors.New("Audit log has no value")
+			}
+			opts = append(opts, minfs.AuditLog(vals[1]))
+		case "status-dir":
+			opts = append(opts, minfs.StatusDir())
+		case "dump-file":
+			if len(vals) == 1 {
+				return nil, errors.New("Dump file has no value")
+			}
+			opts = append(opts, minfs.DumpFile(vals[1]))
+		case "unsafe-faults":
+			// rules are separated by semicolons, options by commas
+			var rules []string
+			if len(vals) > 1 && vals[1] != "" {
+				rules = strings.Split(vals[1], ";")
+			}
+			opts = append(opts, minfs.UnsafeFaults(rules...))
+		case "trace-endpoint":
+			if len(vals) == 1 {
+				return nil, errors.New("Trace endpoint has no value")
+			}
+			opts = append(opts, minfs.TraceEndpoint(vals[1]))
+		case "trace-sample":
+			if len(vals) == 1 {
+				return nil, errors.New("Trace sample has no value")
+			}
+			val, err := strconv.ParseFloat(vals[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("Trace sample is not a valid value: %s", vals[1])
+			}
+			opts = append(opts, minfs.TraceSample(val))
+		case "lock-warn", "lock-timeout":
+			if len(vals) == 1 {
+				return nil, fmt.Errorf("%s has no value", vals[0])
+			}
+			val, err := time.ParseDuration(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a valid duration: %s", vals[0], vals[1])
+			}
+			if vals[0] == "lock-warn" {
+				opts = append(opts, minfs.LockWarn(val))
+			} else {
+				opts = append(opts, minfs.LockTimeout(val))
+			}
+		case "upload-retries":
+			if len(vals) == 1 {
+				return nil, errors.New("Upload retries has no value")
+			}
+			val, err := strconv.Atoi(vals[1])
+			if err != nil || val < 0 {
+				return nil, fmt.Errorf("Upload retries is not a valid value: %s", vals[1])
+			}
+			opts = append(opts, minfs.UploadRetries(val))
+		case "meta-store":
+			if len(vals) == 1 {
+				return nil, errors.New("Meta store has no value")
+			}
+			opts = append(opts, minfs.MetaStore(vals[1]))
+		case "import-meta":
+			if len(vals) == 1 {
+				return nil, errors.New("Import meta has no value")
+			}
+			opts = append(opts, minfs.ImportMetaFrom(vals[1]))
+		case "compact-threshold":
+			if len(vals) == 1 {
+				return nil, errors.New("Compact threshold has no value")
+			}
+			val, err := strconv.ParseFloat(vals[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("Compact threshold is not a valid value: %s", vals[1])
+			}
+			opts = append(opts, minfs.CompactThreshold(val))
+		case "presign-expiry":
+			if len(vals) == 1 {
+				return nil, errors.New("Presign expiry has no value")
+			}
+			val, err := time.ParseDuration(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("Presign expiry is not a valid duration: %s", vals[1])
+			}
+			opts = append(opts, minfs.PresignExpiry(val))
+		case "dir-ttl":
+			if len(vals) == 1 {
+				return nil, errors.New("Directory TTL has no value")
+			}
+			val, err := time.ParseDuration(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("Directory TTL is not a valid duration: %s", vals[1])
+			}
+			opts = append(opts, minfs.DirTTL(val))
+		case "evict-after":
+			if len(vals) == 1 {
+				return nil, errors.New("Evict after has no value")
+			}
+			val, err := time.ParseDuration(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("Evict after is not a valid duration: %s", vals[1])
+			}
+			opts = append(opts, minfs.EvictAfter(val))
+		case "resync-interval":
+			if len(vals) == 1 {
+				return nil, errors.New("Resync interval has no value")
+			}
+			val, err := time.ParseDuration(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("Resync interval is not a valid duration: %s", vals[1])
+			}
+			opts = append(opts, minfs.ResyncInterval(val))
+		case "resync-rate":
+			if len(vals) == 1 {
+				return nil, errors.New("Resync rate has no value")
+			}
+			val, err := strconv.Atoi(vals[1])
+			if err != nil {
+				return nil, fmt.Errorf("Resync rate is not a valid value: %s", vals[1])
+			}
+			opts = append(opts, minfs.ResyncRate(val))
+		case "notifications":
+			opts = append(opts, minfs.Notifications())
+		case "no-dir-markers":
+			opts = append(opts, minfs.NoDirMarkers())
+		case "insecure", "insecure-skip-verify":
+			opts = append(opts, minfs.Insecure())
+		case "region":
+			if len(vals) == 1 {
+				return nil, errors.New("Region has no value")
+			}
+			opts = append(opts, minfs.Region(vals[1]))
+		case "debug":
+			opts = append(opts, minfs.Debug())
+		case "cabundle":
+			if len(vals) == 1 {
+				return nil, errors.New("CA bundle has no value")
+			}
+			opts = append(opts, minfs.CABundle(vals[1]))
+		case "access-key":
+			if len(vals) == 1 {
+				return nil, errors.New("Access key has no value")
+			}
+			opts = append(opts, minfs.AccessKey(vals[1]))
+		case "secret-key":
+			if len(vals) == 1 {
+				return nil, errors.New("Secret key has no value")
+			}
+			opts = append(opts, minfs.SecretKey(vals[1]))
+		case "credentials":
+			if len(vals) == 1 {
+				return nil, errors.New("Credentials has no value")
+			}
+			opts = append(opts, minfs.Credentials(vals[1]))
+		case "buckets":
+			if len(vals) == 1 {
+				return nil, errors.New("Buckets has no value")
+			}
+			opts = append(opts, minfs.Buckets(strings.Split(vals[1], ":")...))
+		case "bucket-ops":
+			opts = append(opts, minfs.BucketOps())
+		case "ro":
+			opts = append(opts, minfs.ReadOnly())
+		case "scratch":
+			opts = append(opts, minfs.Scratch())
+		case "volname":
+			if len(vals) == 1 {
+				return nil, errors.New("Volume name has no value")
+			}
+			opts = append(opts, minfs.VolName(vals[1]))
+		case "noappledouble", "nods_store", "nods-store":
+			mode := "reject"
+			if len(vals) > 1 {
+				mode = vals[1]
+			}
+			if vals[0] == "noappledouble" {
+				opts = append(opts, minfs.NoAppleDouble(mode))
+			} else {
+				opts = append(opts, minfs.NoDSStore(mode))
+			}
+		case "allow-other", "allow_other":
+			opts = append(opts, minfs.AllowOther())
+		case "allow-root", "allow_root":
+			opts = append(opts, minfs.AllowRoot())
+		case "create-bucket":
+			region := ""
+			if len(vals) > 1 {
+				region = vals[1]
+			}
+			opts = append(opts, minfs.CreateBucket(region))
+		default:
+			if !ignoredMountOption(name) {
+				return nil, fmt.Errorf("Unknown mount option %s", name)
+			}
+		}
+	}
+	return opts, nil
+}
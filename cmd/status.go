@@ -0,0 +1,169 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/cli"
+	minfs "github.com/minio/minfs/fs"
+)
+
+var statusCmd = cli.Command{
+	Name:      "status",
+	Usage:     "Show the mounts served by the minfs processes of the user.",
+	ArgsUsage: "[mountpoint]",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the status as JSON.",
+		},
+	},
+	Action: runStatus,
+}
+
+// processStatus is the status of the mounts of a process.
+type processStatus struct {
+	Pid    int                 `json:"pid"`
+	Socket string              `json:"socket"`
+	Mounts []minfs.MountStatus `json:"mounts"`
+}
+
+// runStatus asks the control socket of each minfs process for its mounts,
+// limited to the mount at the mount point given.
+func runStatus(c *cli.Context) error {
+	var mountpoint string
+	if c.Args().Present() {
+		abs, err := filepath.Abs(c.Args().First())
+		if err != nil {
+			return err
+		}
+		mountpoint = abs
+	}
+
+	processes, err := queryProcesses(mountpoint)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		if processes == nil {
+			processes = []processStatus{}
+		}
+		data, err := json.MarshalIndent(processes, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	} else {
+		for _, p := range processes {
+			for _, m := range p.Mounts {
+				printMountStatus(p.Pid, m)
+			}
+		}
+	}
+
+	if mountpoint != "" && len(processes) == 0 {
+		return fmt.Errorf("No minfs serves %s", mountpoint)
+	}
+	if mountpoint == "" && len(processes) == 0 && !c.Bool("json") {
+		return errors.New("No minfs is running")
+	}
+	return nil
+}
+
+// queryProcesses asks the control socket of each minfs process for its
+// mounts, and returns those serving the mount point, or all without one.
+func queryProcesses(mountpoint string) ([]processStatus, error) {
+	sockets, err := minfs.ControlSockets()
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []processStatus
+	for _, socket := range sockets {
+		resp, err := minfs.QueryControl(socket, minfs.ControlRequest{Command: "status"})
+		if err == minfs.ErrStaleSocket {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to query %s: %s\n", socket, err)
+			continue
+		}
+
+		p := processStatus{Pid: resp.Pid, Socket: socket, Mounts: []minfs.MountStatus{}}
+		for _, m := range resp.Mounts {
+			if mountpoint == "" || filepath.Clean(m.Mountpoint) == mountpoint {
+				p.Mounts = append(p.Mounts, m)
+			}
+		}
+		if mountpoint == "" || len(p.Mounts) > 0 {
+			processes = append(processes, p)
+		}
+	}
+	return processes, nil
+}
+
+// printMountStatus prints the status of a mount as a block of lines.
+func printMountStatus(pid int, m minfs.MountStatus) {
+	mode := "rw"
+	if m.ReadOnly {
+		mode = "ro"
+	} else if m.Scratch {
+		mode = "scratch"
+	}
+	fmt.Printf("%s\t%s (%s), pid %d, up %s\n", m.Mountpoint, m.Target, mode, pid, m.Uptime)
+	fmt.Printf("  version\t%s, commit %s\n", m.MinFS.Version, m.MinFS.CommitID)
+	fmt.Printf("  log\t\t%s\n", m.LogLevel)
+	fmt.Printf("  cache\t\t%s in %d files, %s dirty\n", formatSize(int64(m.CacheBytes)), m.CacheFiles, formatSize(int64(m.DirtyBytes)))
+	if m.Scratch {
+		fmt.Printf("  local\t\t%d changes, nothing is uploaded\n", m.LocalChanges)
+	}
+	fmt.Printf("  uploads\t%d queued, %d running, %d pending, %d failed\n", m.QueuedUploads, m.RunningUploads, m.PendingUploads, m.FailedUploads)
+	fmt.Printf("  transfers\t%s/s down, %s/s up\n", formatSize(int64(m.DownloadRate)), formatSize(int64(m.UploadRate)))
+	if len(m.Errors) > 0 {
+		fmt.Println("  errors")
+		for _, e := range m.Errors {
+			msg := e.Errno
+			if e.Error != "" {
+				msg += " " + strings.Replace(e.Error, "\n", " ", -1)
+			}
+			fmt.Printf("    %s %s %s: %s\n", e.Time.Local().Format(time.Stamp), e.Op, e.Path, msg)
+		}
+	}
+	fmt.Println()
+}
+
+// formatSize formats bytes with a KiB, MiB or GiB suffix, like parseSize
+// parses them.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,72 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+
+	"github.com/minio/cli"
+	minfs "github.com/minio/minfs/fs"
+)
+
+var versionCmd = cli.Command{
+	Name:  "version",
+	Usage: "Print the version, commit and build date of minfs.",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the version as JSON.",
+		},
+	},
+	Action: runVersion,
+}
+
+// buildInfo returns the version of the build from its ldflags.
+func buildInfo() minfs.BuildInfo {
+	return minfs.BuildInfo{
+		Version:   Version,
+		CommitID:  CommitID,
+		BuildDate: BuildDate,
+	}
+}
+
+// runVersion prints the version of the build, to be quoted in support
+// tickets.
+func runVersion(c *cli.Context) error {
+	if c.Bool("json") {
+		data, err := json.MarshalIndent(struct {
+			minfs.BuildInfo
+			ReleaseTag string `json:"releaseTag"`
+			GoVersion  string `json:"goVersion"`
+			Platform   string `json:"platform"`
+		}{buildInfo(), ReleaseTag, runtime.Version(), runtime.GOOS + "/" + runtime.GOARCH}, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	fmt.Printf("Version:    %s\n", Version)
+	fmt.Printf("Release:    %s\n", ReleaseTag)
+	fmt.Printf("Commit:     %s\n", CommitID)
+	fmt.Printf("Build date: %s\n", BuildDate)
+	fmt.Printf("Go:         %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return nil
+}
@@ -487,11 +487,12 @@ func (d *minfsDriver) mountVolume(v mountInfo) error {
 		bucketPath = v.config.endpoint + "/" + v.config.bucket
 	}
 
-	cmd := fmt.Sprintf("mount -t minfs %s %s", bucketPath, v.mountPoint)
+	// containers access the mount as other users
+	cmd := fmt.Sprintf("mount -t minfs -o allow-other %s %s", bucketPath, v.mountPoint)
 	if v.config.opts != "" {
 		// mount command for minfs.
 		// ex:  mount -t minfs https://play.minio.io:9000/testbucket /testbucket
-		cmd = fmt.Sprintf("mount -t minfs -o %s %s %s", v.config.opts, bucketPath, v.mountPoint)
+		cmd = fmt.Sprintf("mount -t minfs -o allow-other,%s %s %s", v.config.opts, bucketPath, v.mountPoint)
 	}
 
 	logrus.Debug(cmd)
@@ -0,0 +1,50 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package minfs
+
+import (
+	"fmt"
+
+	minio "github.com/minio/minio-go/v6"
+)
+
+// bucketLookups maps the addressing option to the bucket lookup of the
+// minio client.
+var bucketLookups = map[string]minio.BucketLookupType{
+	"auto":    minio.BucketLookupAuto,
+	"virtual": minio.BucketLookupDNS,
+	"path":    minio.BucketLookupPath,
+}
+
+// addressingURL returns the URL style and the URL of the bucket as the
+// configured addressing would request it.
+func (mfs *MinFS) addressingURL(bucket string) (string, string) {
+	target := mfs.config.target
+	switch mfs.config.addressing {
+	case "virtual":
+		return "virtual-host-style", fmt.Sprintf("%s://%s.%s/", target.Scheme, bucket, target.Host)
+	case "path":
+		return "path-style", fmt.Sprintf("%s://%s/%s/", target.Scheme, target.Host, bucket)
+	}
+	return "automatic", fmt.Sprintf("%s://%s/", target.Scheme, target.Host)
+}
+
+// addressingError names the URL style used when accessing the bucket
+// failed, as misconfigured addressing shows up as DNS or signature errors.
+func (mfs *MinFS) addressingError(bucket string, err error) error {
+	style, u := mfs.addressingURL(bucket)
+	return fmt.Errorf("Unable to access bucket %s using %s URL %s: %s", bucket, style, u, err)
+}
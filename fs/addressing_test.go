@@ -0,0 +1,114 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio-go/v6"
+)
+
+// addressTransport records the host and path of the requests, and sends
+// them to the fake server whatever the host, like a DNS entry of the
+// virtual hosts would.
+type addressTransport struct {
+	s3 *fakeS3
+
+	m        sync.Mutex
+	requests []string
+}
+
+func (t *addressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.m.Lock()
+	t.requests = append(t.requests, req.URL.Host+req.URL.Path)
+	t.m.Unlock()
+
+	r := cloneRequest(req)
+	u := *req.URL
+	u.Host = t.s3.Listener.Addr().String()
+	r.URL = &u
+	r.Host = req.URL.Host
+	return newTransport(&tls.Config{}).RoundTrip(r)
+}
+
+func TestAddressing(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "dir/file", []byte("file"))
+	host := s3.Listener.Addr().String()
+
+	testCases := []struct {
+		addressing string
+		expected   []string
+	}{
+		{"path", []string{host + "/" + testBucket + "/", host + "/" + testBucket + "/dir/file"}},
+		{"virtual", []string{testBucket + "." + host + "/", testBucket + "." + host + "/dir/file"}},
+
+		// the virtual hosts of an IP address don't resolve
+		{"auto", []string{host + "/" + testBucket + "/", host + "/" + testBucket + "/dir/file"}},
+	}
+
+	for _, testCase := range testCases {
+		mfs := newLockTestFS(t, Target(s3.URL+"/"+testBucket), Region("us-east-1"), Addressing(testCase.addressing))
+		if err := mfs.connect(); err != nil {
+			t.Fatal(err)
+		}
+		transport := &addressTransport{s3: s3}
+		mfs.api.SetCustomTransport(transport)
+
+		if exists, err := mfs.api.BucketExists(testBucket); err != nil || !exists {
+			t.Fatalf("%s: expected the bucket to exist, got %t, %v", testCase.addressing, exists, err)
+		}
+		obj, err := mfs.api.GetObject(testBucket, "dir/file", minio.GetObjectOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(obj)
+		if err != nil || string(data) != "file" {
+			t.Errorf("%s: expected file, got %q, %v", testCase.addressing, data, err)
+		}
+		obj.Close()
+
+		if strings.Join(transport.requests, " ") != strings.Join(testCase.expected, " ") {
+			t.Errorf("%s: expected the requests %v, got %v", testCase.addressing, testCase.expected, transport.requests)
+		}
+	}
+}
+
+// TestAddressingProbe mounts with virtual-host-style addressing, which the
+// fake server doesn't resolve, the mount fails naming the URL tried once
+// the lookups are given up.
+func TestAddressingProbe(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+
+	_, err := startTestMount(t, s3, t.TempDir(), Addressing("virtual"), RetryTimeout(500*time.Millisecond))
+	expected := "using virtual-host-style URL http://" + testBucket + "." + s3.Listener.Addr().String() + "/"
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Fatalf("expected the mount to fail %s, got %v", expected, err)
+	}
+
+	if _, err = startTestMount(t, s3, t.TempDir(), Addressing("path")); err != nil {
+		t.Errorf("expected the path-style mount to succeed, got %v", err)
+	}
+}
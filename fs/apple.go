@@ -0,0 +1,82 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"path"
+	"strings"
+
+	"bazil.org/fuse"
+)
+
+// The handling of the files Finder creates next to others, ._* AppleDouble
+// files with the extended attributes and .DS_Store files with the view
+// settings. By default they are uploaded like other files.
+const (
+	// appleFilesLocal keeps them in the cache and the meta DB only.
+	appleFilesLocal = "local"
+
+	// appleFilesReject fails their creation with EPERM.
+	appleFilesReject = "reject"
+)
+
+// validAppleFiles returns true if mode handles the Finder files.
+func validAppleFiles(mode string) bool {
+	return mode == "" || mode == appleFilesLocal || mode == appleFilesReject
+}
+
+// appleFiles returns how the Finder file name is handled, empty if it
+// isn't one or it's uploaded.
+func (cfg *Config) appleFiles(name string) string {
+	switch {
+	case strings.HasPrefix(name, "._"):
+		return cfg.appleDouble
+	case name == ".DS_Store":
+		return cfg.dsStore
+	}
+	return ""
+}
+
+// filtered returns true if the name of the entry at fullPath is handled
+// by noappledouble or nods_store, the remote entries of these names are
+// left alone.
+func (mfs *MinFS) filtered(fullPath string) bool {
+	return mfs.config.appleFiles(path.Base(fullPath)) != ""
+}
+
+// hiddenEntry returns true if the entry o named name is hidden from
+// listings and lookups, remote entries of filtered names listed before
+// the filter was set.
+func (dir *Dir) hiddenEntry(name string, o interface{}) bool {
+	if dir.mfs.config.appleFiles(name) == "" {
+		return false
+	}
+	file, ok := o.(File)
+	return !ok || !file.LocalOnly
+}
+
+// createFiltered returns EPERM if the Finder file name is rejected, and
+// whether it's local-only instead.
+func (dir *Dir) createFiltered(name string) (local bool, err error) {
+	switch dir.mfs.config.appleFiles(name) {
+	case appleFilesReject:
+		return false, fuse.EPERM
+	case appleFilesLocal:
+		return true, nil
+	}
+	return false, nil
+}
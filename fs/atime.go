@@ -0,0 +1,155 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"path"
+	"sync"
+	"time"
+
+	"github.com/minio/minfs/meta"
+)
+
+// Updates of the access time of files by reads. The access time is only
+// kept in the meta DB, storing it in the object metadata would rewrite
+// the objects.
+const (
+	// atimeOff never updates the access time.
+	atimeOff = "off"
+
+	// atimeRelatime updates the access time if it's older than the
+	// modification time or a day, like relatime of Linux.
+	atimeRelatime = "relatime"
+
+	// atimeOn updates the access time on each read.
+	atimeOn = "on"
+)
+
+const (
+	// relatimeInterval is the age of the access time updated by reads of
+	// relatime mounts.
+	relatimeInterval = 24 * time.Hour
+
+	// atimeFlushInterval is the interval the updated access times are
+	// written to the meta DB at.
+	atimeFlushInterval = 30 * time.Second
+)
+
+// atimeBatch collects the access times updated by reads, these are
+// written to the meta DB together instead of a transaction per read.
+type atimeBatch struct {
+	m sync.Mutex
+
+	// updated files by path
+	files map[string]*File
+}
+
+// atime returns the access time of the file, the modification time if
+// it was never accessed.
+func (f *File) atime() time.Time {
+	if f.Atime.IsZero() {
+		return f.Mtime
+	}
+	return f.Atime
+}
+
+// accessed updates the access time of the file read by a handle, as set
+// by the atime option.
+func (f *File) accessed() {
+	now := time.Now().UTC()
+	switch f.mfs.config.atime {
+	case atimeOff:
+		return
+	case atimeRelatime:
+		atime := f.atime()
+		if atime.After(f.Mtime) && now.Sub(atime) < relatimeInterval {
+			return
+		}
+	}
+
+	f.Atime = now
+
+	// unlinked files have no entry to store it in
+	if f.unlinked {
+		return
+	}
+
+	b := &f.mfs.atimes
+	b.m.Lock()
+	if b.files == nil {
+		b.files = map[string]*File{}
+	}
+	b.files[f.FullPath()] = f
+	b.m.Unlock()
+}
+
+// flushAtimes writes the access times updated since the last flush to
+// the meta DB.
+func (mfs *MinFS) flushAtimes() error {
+	b := &mfs.atimes
+	b.m.Lock()
+	files := b.files
+	b.files = nil
+	b.m.Unlock()
+
+	if len(files) == 0 {
+		return nil
+	}
+
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		for _, f := range files {
+			var current File
+			if err := f.bucket(tx).Get(path.Base(f.Path), &current); err != nil {
+				// removed meanwhile
+				continue
+			}
+			if !f.Atime.After(current.Atime) {
+				continue
+			}
+			current.Atime = f.Atime
+			if err := f.bucket(tx).Put(path.Base(f.Path), &current); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// startAtimes writes the updated access times to the meta DB in the
+// background, until unmount.
+func (mfs *MinFS) startAtimes() {
+	if mfs.config.atime == atimeOff {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(atimeFlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-mfs.listenerDoneCh:
+				return
+			case <-ticker.C:
+			}
+
+			if err := mfs.flushAtimes(); err != nil {
+				mfs.log.Error("Unable to store the access times", F("error", err))
+			}
+		}
+	}()
+}
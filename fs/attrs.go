@@ -0,0 +1,84 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"os"
+	"strings"
+
+	"bazil.org/fuse"
+)
+
+// prefixMode is the permissions of the files below prefix.
+type prefixMode struct {
+	prefix string
+	mode   os.FileMode
+}
+
+// reportedAttr applies the owner override and umask of the mount to the
+// attributes of an entry, which the kernel caches for attr-timeout.
+func (cfg *Config) reportedAttr(a *fuse.Attr) {
+	a.Valid = cfg.attrTimeout
+	if cfg.uidSet {
+		a.Uid = cfg.uid
+	}
+	if cfg.gidSet {
+		a.Gid = cfg.gid
+	}
+	a.Mode &^= cfg.umask
+}
+
+// overriddenAttrs tells which of the owner of a file changed by req is
+// overridden by the mount.
+func (cfg *Config) overriddenAttrs(req *fuse.SetattrRequest) (uid, gid bool) {
+	return req.Valid.Uid() && cfg.uidSet, req.Valid.Gid() && cfg.gidSet
+}
+
+// defaultFileMode returns the permissions of the file at fullPath without
+// a mode of its own.
+func (cfg *Config) defaultFileMode(fullPath string) os.FileMode {
+	mode, longest := cfg.fileMode, -1
+	if mode == 0 {
+		mode = cfg.mode
+	}
+	for _, pm := range cfg.prefixModes {
+		if strings.HasPrefix(fullPath, pm.prefix) && len(pm.prefix) > longest {
+			mode, longest = pm.mode, len(pm.prefix)
+		}
+	}
+	return mode
+}
+
+// mode returns the mode of the file, the default of the mount unless it
+// was set by create or chmod, without write bits in read-only buckets.
+func (f *File) mode() os.FileMode {
+	mask := f.mfs.writeMask(f.BucketName())
+	if f.ModeSet {
+		return f.Mode &^ mask
+	}
+	return (f.Mode&^os.ModePerm | f.mfs.config.defaultFileMode(f.FullPath())) &^ mask
+}
+
+// mode returns the mode of the directory, with the permissions of the
+// mount if set, without write bits in read-only buckets.
+func (dir *Dir) mode() os.FileMode {
+	mask := dir.mfs.writeMask(dir.BucketName())
+	if dir.mfs.config.dirMode == 0 {
+		return dir.Mode &^ mask
+	}
+	return (dir.Mode&^os.ModePerm | dir.mfs.config.dirMode) &^ mask
+}
@@ -0,0 +1,189 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// auditQueue is the number of audit events buffered for writing, events
+// recorded while the buffer is full are dropped.
+const auditQueue = 1024
+
+// AuditEvent is a mutating operation of the mount.
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	Path    string    `json:"path"`
+	NewPath string    `json:"newPath,omitempty"`
+
+	// caller of the operation
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+	PID uint32 `json:"pid"`
+
+	Size  *uint64 `json:"size,omitempty"`
+	ETag  string  `json:"etag,omitempty"`
+	Mode  string  `json:"mode,omitempty"`
+	Owner string  `json:"owner,omitempty"`
+	Xattr string  `json:"xattr,omitempty"`
+
+	// ok or the error of the operation
+	Outcome string `json:"outcome"`
+}
+
+// auditLog writes the audit events in the background, so a slow audit
+// target doesn't hold up operations.
+type auditLog struct {
+	w      io.WriteCloser
+	events chan AuditEvent
+
+	dropped  uint64
+	reported uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newAuditLog returns the audit log appending JSON lines to the file at
+// target, or sending them to syslog if target is syslog.
+func newAuditLog(target string) (*auditLog, error) {
+	var w io.WriteCloser
+	var err error
+	if target == "syslog" {
+		w, err = syslog.New(syslog.LOG_INFO|syslog.LOG_AUTHPRIV, "minfs")
+	} else {
+		w, err = os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open the audit log %s: %s", target, err)
+	}
+
+	return &auditLog{
+		w:      w,
+		events: make(chan AuditEvent, auditQueue),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// record queues the event, or drops it when the buffer is full.
+func (a *auditLog) record(ev AuditEvent) {
+	select {
+	case a.events <- ev:
+	default:
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
+
+// run writes the queued events until stopped. Dropped events are written
+// as a dropped event before the next one.
+func (a *auditLog) run(log Logger) {
+	defer close(a.done)
+
+	write := func(ev AuditEvent) {
+		if dropped := atomic.LoadUint64(&a.dropped); dropped != a.reported {
+			log.Warn("Audit events dropped, the audit log can't keep up", F("dropped", dropped-a.reported))
+			a.write(log, AuditEvent{
+				Time:    time.Now().UTC(),
+				Op:      "dropped",
+				Outcome: fmt.Sprintf("%d events dropped", dropped-a.reported),
+			})
+			a.reported = dropped
+		}
+		a.write(log, ev)
+	}
+
+	for {
+		select {
+		case ev := <-a.events:
+			write(ev)
+		case <-a.stop:
+			for {
+				select {
+				case ev := <-a.events:
+					write(ev)
+				default:
+					a.w.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *auditLog) write(log Logger, ev AuditEvent) {
+	data, err := json.Marshal(ev)
+	if err == nil {
+		_, err = a.w.Write(append(data, '\n'))
+	}
+	if err != nil {
+		log.Error("Unable to write the audit log", F("error", err))
+	}
+}
+
+// close writes the queued events and closes the audit log.
+func (a *auditLog) close() {
+	close(a.stop)
+	<-a.done
+}
+
+// audit records the operation of the caller in hdr with its outcome err,
+// without audit log nothing is recorded.
+func (mfs *MinFS) audit(ev AuditEvent, hdr *fuse.Header, err error) {
+	if mfs.auditLog == nil {
+		return
+	}
+
+	ev.Time = time.Now().UTC()
+	ev.UID, ev.GID, ev.PID = hdr.Uid, hdr.Gid, hdr.Pid
+	ev.Outcome = "ok"
+	if err != nil {
+		ev.Outcome = err.Error()
+	}
+	mfs.auditLog.record(ev)
+}
+
+// auditDropped returns the number of audit events dropped.
+func (mfs *MinFS) auditDropped() uint64 {
+	if mfs.auditLog == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&mfs.auditLog.dropped)
+}
+
+// startAudit writes the audit events in the background.
+func (mfs *MinFS) startAudit() {
+	if mfs.auditLog != nil {
+		go mfs.auditLog.run(mfs.log)
+	}
+}
+
+// stopAudit writes the remaining audit events.
+func (mfs *MinFS) stopAudit() {
+	if mfs.auditLog != nil {
+		mfs.auditLog.close()
+	}
+}
@@ -0,0 +1,292 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	minio "github.com/minio/minio-go/v6"
+)
+
+const (
+	// bucketAccessAuto detects if the credentials can write to the
+	// buckets, at mount and every bucketAccessInterval.
+	bucketAccessAuto = "auto"
+	// bucketAccessReadOnly presents the buckets read-only.
+	bucketAccessReadOnly = "read-only"
+	// bucketAccessReadWrite presents the buckets writable, failed writes
+	// are only noticed on upload.
+	bucketAccessReadWrite = "read-write"
+)
+
+// bucketAccessInterval is the interval the write access to the buckets is
+// checked again, policies change while mounted.
+const bucketAccessInterval = 15 * time.Minute
+
+// errAccessDenied is returned by mutating operations of buckets the
+// credentials can't write to.
+var errAccessDenied = fuse.Errno(syscall.EACCES)
+
+// bucketPolicy is the part of a bucket policy which grants or denies
+// writes.
+type bucketPolicy struct {
+	Statement []struct {
+		Effect    string
+		Principal interface{}
+		Action    interface{}
+		Resource  interface{}
+	}
+}
+
+// policyStrings returns the strings of a policy element, which is a
+// string or an array of them.
+func policyStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var strs []string
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		return strs
+	case map[string]interface{}:
+		// {"AWS": ...} principals
+		var strs []string
+		for _, s := range v {
+			strs = append(strs, policyStrings(s)...)
+		}
+		return strs
+	}
+	return nil
+}
+
+// policyMatch matches s against the pattern of a policy, where * matches
+// any characters, including slashes.
+func policyMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// policyWritable tells if the statements of the policy applying to
+// everyone allow or deny uploads of key, decided is false if none does.
+// Grants of the credentials themselves can't be told from the policy.
+func policyWritable(policy, bucket, key string) (writable, decided bool) {
+	var p bucketPolicy
+	if err := json.Unmarshal([]byte(policy), &p); err != nil {
+		return false, false
+	}
+
+	resource := "arn:aws:s3:::" + bucket + "/" + key
+	for _, st := range p.Statement {
+		everyone := false
+		for _, principal := range policyStrings(st.Principal) {
+			everyone = everyone || principal == "*"
+		}
+		if !everyone {
+			continue
+		}
+
+		matches := false
+		for _, action := range policyStrings(st.Action) {
+			matches = matches || policyMatch(strings.ToLower(action), "s3:putobject")
+		}
+		if !matches {
+			continue
+		}
+
+		matches = false
+		for _, r := range policyStrings(st.Resource) {
+			matches = matches || policyMatch(r, resource)
+		}
+		if !matches {
+			continue
+		}
+
+		// an explicit deny wins over any allow
+		if st.Effect == "Deny" {
+			return false, true
+		}
+		writable, decided = true, true
+	}
+	return writable, decided
+}
+
+// bucketWritable tells if the credentials can upload to the bucket, from
+// its policy if it can be read and decides it, or from starting and
+// aborting a multipart upload otherwise. ok is false if neither tells.
+func (mfs *MinFS) bucketWritable(bucket string) (writable, ok bool) {
+	key := ".minfs-access-" + nextSuffix()
+	if !mfs.config.multiBucket() && mfs.config.basePath != "" {
+		key = path.Join(mfs.config.basePath, key)
+	}
+
+	if policy, err := mfs.api.GetBucketPolicy(bucket); err == nil && policy != "" {
+		if writable, decided := policyWritable(policy, bucket, key); decided {
+			return writable, true
+		}
+	}
+
+	// nothing is stored until the upload is completed
+	core := minio.Core{Client: mfs.api}
+	uploadID, err := core.NewMultipartUpload(bucket, key, minio.PutObjectOptions{})
+	if err != nil {
+		switch minio.ToErrorResponse(err).Code {
+		case "AccessDenied", "AllAccessDisabled":
+			return false, true
+		}
+		return false, false
+	}
+	if err = core.AbortMultipartUpload(bucket, key, uploadID); err != nil {
+		mfs.log.Warn("Unable to abort the upload checking write access", F("bucket", bucket), F("key", key), F("error", err))
+	}
+	return true, true
+}
+
+// checkWriteAccess records which of the mounted buckets the credentials
+// can't write to. Buckets which can't be checked keep their state.
+func (mfs *MinFS) checkWriteAccess() {
+	buckets, err := mfs.mountedBuckets()
+	if err != nil {
+		mfs.log.Warn("Unable to check the write access to the buckets", F("error", err))
+		return
+	}
+
+	old, _ := mfs.readOnlyBuckets.Load().(map[string]bool)
+	readOnly := map[string]bool{}
+	for _, bucket := range buckets {
+		writable, ok := mfs.bucketWritable(bucket)
+		if !ok {
+			writable = !old[bucket]
+		}
+		if !writable {
+			readOnly[bucket] = true
+		}
+		// old holds the buckets read-only before
+		if old[bucket] == writable {
+			if writable {
+				mfs.log.Info("Bucket is writable again", F("bucket", bucket))
+			} else {
+				mfs.log.Warn("Bucket is read-only for the credentials, writes fail with EACCES", F("bucket", bucket))
+			}
+		}
+	}
+	mfs.readOnlyBuckets.Store(readOnly)
+}
+
+// startWriteAccess checks the write access to the buckets at mount, and
+// every bucketAccessInterval until unmounted, unless it's set by the
+// bucket-access option or nothing is written remotely.
+func (mfs *MinFS) startWriteAccess() {
+	if mfs.config.bucketAccess != bucketAccessAuto || mfs.config.readOnly || mfs.config.scratch {
+		return
+	}
+	mfs.checkWriteAccess()
+
+	go func() {
+		ticker := time.NewTicker(bucketAccessInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-mfs.listenerDoneCh:
+				return
+			case <-ticker.C:
+			}
+			mfs.checkWriteAccess()
+		}
+	}()
+}
+
+// bucketReadOnly tells if the credentials can't write to the bucket, or
+// the bucket-access option presents it read-only. The root of a multi
+// bucket mount has no bucket.
+func (mfs *MinFS) bucketReadOnly(bucket string) bool {
+	switch {
+	case mfs.config.scratch || bucket == "":
+		return false
+	case mfs.config.bucketAccess == bucketAccessReadOnly:
+		return true
+	}
+	readOnly, _ := mfs.readOnlyBuckets.Load().(map[string]bool)
+	return readOnly[bucket]
+}
+
+// denyWrite returns the error of changes to the bucket, EROFS on
+// read-only mounts and EACCES for buckets the credentials can't write to.
+func (mfs *MinFS) denyWrite(bucket string) error {
+	if mfs.config.readOnly {
+		return errReadOnly
+	}
+	if mfs.bucketReadOnly(bucket) {
+		return errAccessDenied
+	}
+	return nil
+}
+
+// writeMask returns the permission bits removed from the entries of the
+// bucket, the write bits of read-only buckets.
+func (mfs *MinFS) writeMask(bucket string) os.FileMode {
+	if mfs.bucketReadOnly(bucket) {
+		return 0222
+	}
+	return 0
+}
+
+// Access denies write access to the entries of read-only buckets. The
+// kernel checks the other access against the reported mode.
+func (dir *Dir) Access(ctx context.Context, req *fuse.AccessRequest) (err error) {
+	defer mapErrno(&err)
+
+	if req.Mask&2 != 0 && dir.mfs.bucketReadOnly(dir.BucketName()) {
+		return errAccessDenied
+	}
+	return nil
+}
+
+// Access denies write access to files of read-only buckets.
+func (f *File) Access(ctx context.Context, req *fuse.AccessRequest) (err error) {
+	defer mapErrno(&err)
+
+	if req.Mask&2 != 0 && f.mfs.bucketReadOnly(f.BucketName()) {
+		return errAccessDenied
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"net/http"
+	"runtime"
+)
+
+// BuildInfo is the version of the minfs build.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	CommitID  string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+}
+
+// Build is the version of the running minfs, set by the command from the
+// ldflags of the build.
+var Build = BuildInfo{
+	Version:   "DEVELOPMENT.GOGET",
+	CommitID:  "DEVELOPMENT.GOGET",
+	BuildDate: "DEVELOPMENT.GOGET",
+}
+
+// userAgent returns the User-Agent of the S3 requests, so servers can tell
+// minfs traffic from other clients.
+func userAgent() string {
+	return "MinFS/" + Build.Version + " (" + runtime.GOOS + "; " + runtime.GOARCH + ")"
+}
+
+// userAgentTransport sets the User-Agent of minfs on every request, it
+// isn't signed.
+type userAgentTransport struct {
+	http.RoundTripper
+}
+
+// RoundTrip - sets the User-Agent and executes the request.
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper shouldn't modify the request.
+	r := cloneRequest(req)
+	r.Header.Set("User-Agent", userAgent())
+	return t.RoundTripper.RoundTrip(r)
+}
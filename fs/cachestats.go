@@ -0,0 +1,241 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minfs/meta"
+)
+
+// Reasons cache files are removed for
+const (
+	// a new version of the object replaced the cache file
+	evictReplaced = "replaced"
+	// the object was changed or removed by another client
+	evictRemoteChanged = "remote-changed"
+	// the handle was closed and the cache file isn't reused
+	evictCloseDrop = "close-drop"
+	// nothing referred to the cache file anymore
+	evictGC = "gc"
+	// removed by minfs purge
+	evictPurge = "purge"
+)
+
+// evictReasons are the reasons of removals, in the order of the metrics.
+var evictReasons = []string{evictReplaced, evictRemoteChanged, evictCloseDrop, evictGC, evictPurge}
+
+// cacheAges are the upper bounds of the age buckets of cache files, by
+// the time they were last written.
+var cacheAges = []struct {
+	label string
+	age   time.Duration
+}{
+	{"1h", time.Hour},
+	{"1d", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+	{"older", 0},
+}
+
+// cacheEvictions counts the removed cache files and their bytes by reason.
+type cacheEvictions struct {
+	m     sync.Mutex
+	count map[string]uint64
+	bytes map[string]uint64
+
+	// busy counts unreferenced cache files kept as they were open
+	busy uint64
+}
+
+func (ce *cacheEvictions) add(reason string, size int64) {
+	ce.m.Lock()
+	defer ce.m.Unlock()
+
+	if ce.count == nil {
+		ce.count, ce.bytes = map[string]uint64{}, map[string]uint64{}
+	}
+	ce.count[reason]++
+	ce.bytes[reason] += uint64(size)
+}
+
+func (ce *cacheEvictions) skipBusy() {
+	ce.m.Lock()
+	ce.busy++
+	ce.m.Unlock()
+}
+
+// CacheStats is the composition of the cache dir and the removals of
+// cache files since the mount.
+type CacheStats struct {
+	// Files and Bytes are the number and size of the cache files.
+	Files int
+	Bytes uint64
+
+	// DirtyBytes is the size of the cache files of dirty handles and
+	// queued or pending uploads, CleanBytes the size of the others.
+	DirtyBytes uint64
+	CleanBytes uint64
+
+	// BytesByAge is the size of the cache files by the age bucket of
+	// their last write, 1h, 1d, 7d, 30d or older.
+	BytesByAge map[string]uint64
+
+	// Evictions and EvictedBytes count the removed cache files by reason.
+	Evictions    map[string]uint64
+	EvictedBytes map[string]uint64
+
+	// EvictionsBusy counts unreferenced cache files which weren't removed
+	// as they were open or uploading.
+	EvictionsBusy uint64
+}
+
+// removeCacheFile removes the cache file at cachePath and counts it as
+// evicted for reason.
+func (mfs *MinFS) removeCacheFile(cachePath, reason string) error {
+	info, err := os.Stat(cachePath)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(cachePath); err != nil {
+		return err
+	}
+	mfs.evictions.add(reason, info.Size())
+	mfs.notifyEviction(Eviction{CachePath: cachePath, Reason: reason, Bytes: info.Size()})
+	return nil
+}
+
+// dirtyCacheFiles returns the cache files with content not uploaded yet.
+func (mfs *MinFS) dirtyCacheFiles() map[string]bool {
+	files := map[string]bool{}
+
+	mfs.m.Lock()
+	for _, fh := range mfs.handles {
+		if fh != nil && fh.dirty {
+			files[fh.cachePath] = true
+		}
+	}
+	mfs.m.Unlock()
+
+	mfs.syncQueue.m.Lock()
+	for _, lane := range [][]queuedOp{mfs.syncQueue.small, mfs.syncQueue.large} {
+		for _, op := range lane {
+			if put, ok := op.req.(*PutOperation); ok {
+				files[put.Source] = true
+			}
+		}
+	}
+	for _, put := range mfs.syncQueue.inflight {
+		files[put.Source] = true
+	}
+	mfs.syncQueue.m.Unlock()
+
+	if mfs.db != nil {
+		mfs.db.View(func(tx *meta.Tx) error {
+			b := tx.Bucket(pendingBucket).ReadOnly()
+			return b.ForEach(func(k string, _ interface{}) error {
+				var p pendingUpload
+				if b.Get(k, &p) == nil {
+					files[p.Source] = true
+				}
+				return nil
+			})
+		})
+	}
+	return files
+}
+
+// cacheStats returns the composition of the cache dir and the eviction
+// counters.
+func (mfs *MinFS) cacheStats() CacheStats {
+	stats := CacheStats{BytesByAge: map[string]uint64{}}
+	for _, a := range cacheAges {
+		stats.BytesByAge[a.label] = 0
+	}
+
+	dirty := mfs.dirtyCacheFiles()
+	entries, _ := os.ReadDir(mfs.config.cache)
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), "cache.db") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		size := uint64(info.Size())
+		stats.Files++
+		stats.Bytes += size
+		if dirty[path.Join(mfs.config.cache, entry.Name())] {
+			stats.DirtyBytes += size
+		} else {
+			stats.CleanBytes += size
+		}
+
+		age := time.Since(info.ModTime())
+		for _, a := range cacheAges {
+			if a.age == 0 || age < a.age {
+				stats.BytesByAge[a.label] += size
+				break
+			}
+		}
+	}
+
+	mfs.evictions.m.Lock()
+	stats.Evictions, stats.EvictedBytes = map[string]uint64{}, map[string]uint64{}
+	for reason, n := range mfs.evictions.count {
+		stats.Evictions[reason] = n
+		stats.EvictedBytes[reason] = mfs.evictions.bytes[reason]
+	}
+	stats.EvictionsBusy = mfs.evictions.busy
+	mfs.evictions.m.Unlock()
+
+	return stats
+}
+
+// writeCacheMetrics writes the composition of the cache and the eviction
+// counters.
+func writeCacheMetrics(mw metricsWriter, stats CacheStats) {
+	mw.header("minfs_cache_files", "gauge", "Number of files in the cache dir.")
+	mw.sample("minfs_cache_files", float64(stats.Files))
+
+	mw.header("minfs_cache_state_bytes", "gauge", "Size of the cache files with and without content to upload.")
+	mw.sample("minfs_cache_state_bytes", float64(stats.CleanBytes), "state", "clean")
+	mw.sample("minfs_cache_state_bytes", float64(stats.DirtyBytes), "state", "dirty")
+
+	mw.header("minfs_cache_age_bytes", "gauge", "Size of the cache files by the age of their last write.")
+	for _, a := range cacheAges {
+		mw.sample("minfs_cache_age_bytes", float64(stats.BytesByAge[a.label]), "age", a.label)
+	}
+
+	mw.header("minfs_cache_evictions_total", "counter", "Cache files removed by reason.")
+	for _, reason := range evictReasons {
+		mw.sample("minfs_cache_evictions_total", float64(stats.Evictions[reason]), "reason", reason)
+	}
+	mw.header("minfs_cache_evicted_bytes_total", "counter", "Size of the cache files removed by reason.")
+	for _, reason := range evictReasons {
+		mw.sample("minfs_cache_evicted_bytes_total", float64(stats.EvictedBytes[reason]), "reason", reason)
+	}
+
+	mw.header("minfs_cache_evictions_busy_total", "counter", "Unreferenced cache files kept as they were open or uploading.")
+	mw.sample("minfs_cache_evictions_busy_total", float64(stats.EvictionsBusy))
+}
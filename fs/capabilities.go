@@ -0,0 +1,219 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package minfs
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	minio "github.com/minio/minio-go/v6"
+)
+
+// capability is an optional API of the backend, S3 compatible backends
+// don't necessarily implement all of them.
+type capability uint32
+
+const (
+	capMultiDelete capability = 1 << iota
+	capListObjectsV2
+)
+
+var capabilityNames = map[capability]string{
+	capMultiDelete:   "multi-delete",
+	capListObjectsV2: "list-objects-v2",
+}
+
+// supports returns true unless the backend rejected the capability.
+func (mfs *MinFS) supports(c capability) bool {
+	return atomic.LoadUint32(&mfs.unsupported)&uint32(c) == 0
+}
+
+// unsupportedBy returns true when err shows that the backend doesn't
+// implement the capability, which is then disabled for the mount.
+func (mfs *MinFS) unsupportedBy(c capability, err error) bool {
+	switch minio.ToErrorResponse(err).Code {
+	case "NotImplemented", "MethodNotAllowed":
+	default:
+		return false
+	}
+
+	for {
+		old := atomic.LoadUint32(&mfs.unsupported)
+		if old&uint32(c) != 0 {
+			return true
+		}
+		if atomic.CompareAndSwapUint32(&mfs.unsupported, old, old|uint32(c)) {
+			break
+		}
+	}
+
+	mfs.log.Printf("Backend doesn't support %s, falling back: %s\n", capabilityNames[c], err)
+	return true
+}
+
+// Capabilities returns the optional APIs which weren't rejected by the
+// backend.
+func (mfs *MinFS) Capabilities() []string {
+	caps := []string{}
+	for _, c := range []capability{capMultiDelete, capListObjectsV2} {
+		if mfs.supports(c) {
+			caps = append(caps, capabilityNames[c])
+		}
+	}
+	return caps
+}
+
+// probeCapabilities detects the capabilities which can be checked without
+// side effects, the others are detected on first use.
+func (mfs *MinFS) probeCapabilities() {
+	bucket := mfs.config.bucket
+	if mfs.config.multiBucket() && !mfs.config.allBuckets() {
+		bucket = mfs.config.buckets[0]
+	}
+
+	if bucket != "" {
+		core := minio.Core{Client: mfs.api}
+		if _, err := core.ListObjectsV2(bucket, "", "", false, "/", 1, ""); err != nil {
+			mfs.unsupportedBy(capListObjectsV2, err)
+		}
+	}
+
+	mfs.log.Printf("Backend capabilities: %s\n", strings.Join(mfs.Capabilities(), ", "))
+}
+
+// listPage is a page of a listing using a delimiter.
+type listPage struct {
+	Contents       []minio.ObjectInfo
+	CommonPrefixes []minio.CommonPrefix
+	Next           string
+	IsTruncated    bool
+}
+
+// listObjectsPage lists a page of the prefix starting at token, which is a
+// continuation token for ListObjectsV2 and a marker for ListObjects.
+func (mfs *MinFS) listObjectsPage(bucket, prefix, token string, maxKeys int) (listPage, error) {
+	page, err := mfs.listObjectsPageQuoted(bucket, prefix, token, maxKeys)
+
+	// Unlike the other requests the listings of the core API keep the
+	// quotes of the ETags, which are compared with those of StatObject.
+	for i := range page.Contents {
+		page.Contents[i].ETag = strings.Trim(page.Contents[i].ETag, `"`)
+	}
+	return page, err
+}
+
+func (mfs *MinFS) listObjectsPageQuoted(bucket, prefix, token string, maxKeys int) (listPage, error) {
+	core := minio.Core{Client: mfs.api}
+
+	if mfs.supports(capListObjectsV2) {
+		result, err := core.ListObjectsV2(bucket, prefix, token, false, "/", maxKeys, "")
+		if err == nil {
+			return listPage{
+				Contents:       result.Contents,
+				CommonPrefixes: result.CommonPrefixes,
+				Next:           result.NextContinuationToken,
+				IsTruncated:    result.IsTruncated,
+			}, nil
+		} else if !mfs.unsupportedBy(capListObjectsV2, err) {
+			return listPage{}, err
+		}
+		// The continuation token isn't a valid marker.
+		token = ""
+	}
+
+	result, err := core.ListObjects(bucket, prefix, token, "/", maxKeys)
+	if err != nil {
+		return listPage{}, err
+	}
+
+	page := listPage{
+		Contents:       result.Contents,
+		CommonPrefixes: result.CommonPrefixes,
+		Next:           result.NextMarker,
+		IsTruncated:    result.IsTruncated,
+	}
+
+	// NextMarker is only returned with a delimiter, otherwise the last
+	// key is the marker.
+	if page.IsTruncated && page.Next == "" {
+		if n := len(result.Contents); n > 0 {
+			page.Next = result.Contents[n-1].Key
+		}
+		if n := len(result.CommonPrefixes); n > 0 && result.CommonPrefixes[n-1].Prefix > page.Next {
+			page.Next = result.CommonPrefixes[n-1].Prefix
+		}
+	}
+
+	return page, nil
+}
+
+// listObjects lists all objects below prefix recursively.
+func (mfs *MinFS) listObjects(bucket, prefix string, doneCh <-chan struct{}) <-chan minio.ObjectInfo {
+	if mfs.supports(capListObjectsV2) {
+		return mfs.api.ListObjectsV2(bucket, prefix, true, doneCh)
+	}
+	return mfs.api.ListObjects(bucket, prefix, true, doneCh)
+}
+
+// removeObjects deletes the keys, using single deletes when the backend
+// doesn't support multi-object deletes. The errors of keys which failed to
+// delete are returned.
+func (mfs *MinFS) removeObjects(ctx context.Context, bucket string, keys []string) map[string]error {
+	failed := map[string]error{}
+
+	if mfs.supports(capMultiDelete) {
+		objectsCh := make(chan string, len(keys))
+		for _, key := range keys {
+			objectsCh <- key
+		}
+		close(objectsCh)
+
+		unsupported := false
+		for rerr := range mfs.api.RemoveObjectsWithContext(ctx, bucket, objectsCh) {
+			failed[rerr.ObjectName] = rerr.Err
+			if mfs.unsupportedBy(capMultiDelete, rerr.Err) {
+				unsupported = true
+			}
+		}
+
+		if !unsupported {
+			return failed
+		}
+
+		// try the keys rejected with the multi-object delete again
+		keys = keys[:0:0]
+		for key := range failed {
+			keys = append(keys, key)
+		}
+		failed = map[string]error{}
+	}
+
+	for _, key := range keys {
+		select {
+		case <-ctx.Done():
+			failed[key] = ctx.Err()
+			continue
+		default:
+		}
+
+		if err := mfs.api.RemoveObject(bucket, key); err != nil {
+			failed[key] = err
+		}
+	}
+
+	return failed
+}
@@ -0,0 +1,254 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/minio/minfs/meta"
+	"github.com/minio/minio-go/v6/pkg/credentials"
+)
+
+// minCacheFree is the free space of the cache dir below which the check
+// fails.
+const minCacheFree = 1 << 30
+
+// CheckResult is the outcome of an item of the check of a mount.
+type CheckResult struct {
+	Item   string `json:"item"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// CheckReport is the outcome of the check of a mount.
+type CheckReport struct {
+	Results []CheckResult `json:"results"`
+}
+
+// add records the outcome of item, failed with err unless it's nil.
+func (r *CheckReport) add(item string, err error, detail string) {
+	res := CheckResult{Item: item, OK: err == nil, Detail: detail}
+	if err != nil {
+		res.Detail = err.Error()
+	}
+	r.Results = append(r.Results, res)
+}
+
+// Failed returns the number of failed items.
+func (r CheckReport) Failed() int {
+	n := 0
+	for _, res := range r.Results {
+		if !res.OK {
+			n++
+		}
+	}
+	return n
+}
+
+// Check runs the checks of the mount startup without mounting: the
+// credentials, the endpoint and the buckets, the cache dir and the meta
+// DB, the mount point and FUSE. Nothing is created or changed. The config
+// is valid, New checked it already.
+func (mfs *MinFS) Check() CheckReport {
+	var r CheckReport
+	r.add("config", nil, fmt.Sprintf("%s://%s/%s on %s", mfs.config.target.Scheme, mfs.config.target.Host, mfs.volumeName(), mfs.config.mountpoint))
+
+	mfs.checkCredentials(&r)
+	if err := mfs.connect(); err != nil {
+		r.add("endpoint", err, "")
+	} else {
+		mfs.checkBucketAccess(&r)
+	}
+
+	mfs.checkCache(&r)
+	mfs.checkMountpoint(&r)
+	r.add("fuse", checkFuse(mfs.config.allowOther || mfs.config.allowRoot), "available")
+	return r
+}
+
+// checkCredentials resolves the credentials requests are signed with.
+func (mfs *MinFS) checkCredentials(r *CheckReport) {
+	v, err := (&liveCredentials{mfs: mfs}).Retrieve()
+	var from string
+	if source := mfs.cfg().credentialSource; source != "" {
+		kind, _, _ := parseCredentialSource(source)
+		from = ", retrieved from the " + kind
+	}
+	switch {
+	case err != nil:
+		r.add("credentials", err, "")
+	case v.SignerType == credentials.SignatureAnonymous:
+		r.add("credentials", nil, "none set, anonymous access")
+	case v.SessionToken != "":
+		r.add("credentials", nil, "access key, secret key and session token set"+from)
+	default:
+		r.add("credentials", nil, "access key and secret key set"+from)
+	}
+}
+
+// checkBucketAccess checks that the endpoint answers and that the buckets
+// exist and can be listed, and reports their object lock status.
+func (mfs *MinFS) checkBucketAccess(r *CheckReport) {
+	missing, err := mfs.missingBuckets()
+	if err != nil {
+		r.add("endpoint", err, "")
+		return
+	}
+	r.add("endpoint", nil, fmt.Sprintf("%s://%s answers, %s addressing", mfs.config.target.Scheme, mfs.config.target.Host, mfs.config.addressing))
+
+	if mfs.config.allBuckets() {
+		r.add("buckets", nil, "all buckets visible to the credentials are mounted")
+		return
+	}
+
+	buckets, _ := mfs.mountedBuckets()
+	for _, bucket := range buckets {
+		item := "bucket " + bucket
+		if containsString(missing, bucket) {
+			if mfs.config.createBucket {
+				r.add(item, nil, "doesn't exist, created on mount")
+			} else {
+				r.add(item, fmt.Errorf("Bucket %s does not exist", bucket), "")
+			}
+			continue
+		}
+
+		if _, err := mfs.listObjectsPage(bucket, "", "", 1); err != nil {
+			r.add(item, fmt.Errorf("Unable to list bucket %s: %s", bucket, err), "")
+			continue
+		}
+		// object lock needs versioning, the client can't read the
+		// versioning status otherwise
+		status := "exists and can be listed, object lock disabled"
+		if mfs.bucketObjectLock(bucket) {
+			status = "exists and can be listed, object lock and versioning enabled"
+		}
+		r.add(item, nil, status)
+	}
+}
+
+// checkCache checks that the cache dir is writable with enough free space,
+// and that the meta DB can be opened and migrated.
+func (mfs *MinFS) checkCache(r *CheckReport) {
+	dir := mfs.config.cache
+	err := func() error {
+		f, err := ioutil.TempFile(dir, ".check")
+		if err != nil {
+			return fmt.Errorf("Cache dir %s isn't writable: %s", dir, err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+
+		var st syscall.Statfs_t
+		if err = syscall.Statfs(dir, &st); err != nil {
+			return err
+		}
+		if free := uint64(st.Bavail) * uint64(st.Bsize); free < minCacheFree {
+			return fmt.Errorf("Cache dir %s has %d MiB free, less than %d MiB", dir, free>>20, minCacheFree>>20)
+		}
+		return nil
+	}()
+	r.add("cache dir", err, dir+" is writable with enough free space")
+
+	if mfs.config.metaStore == "memory" {
+		r.add("meta DB", nil, "kept in memory")
+		return
+	}
+	dbPath := mfs.metaPath()
+	if _, err = os.Stat(dbPath); os.IsNotExist(err) {
+		r.add("meta DB", nil, dbPath+" doesn't exist, created on mount")
+		return
+	}
+
+	var version int
+	err = func() error {
+		if _, err := mfs.openMeta(true); err != nil {
+			return err
+		}
+		defer mfs.db.Close()
+
+		if err := mfs.db.View(func(tx *meta.Tx) (err error) {
+			version, err = readSchemaVersion(tx)
+			return err
+		}); err != nil {
+			return err
+		}
+		return checkSchemaVersion(version, dbPath)
+	}()
+	detail := fmt.Sprintf("%s has schema version %d", dbPath, version)
+	if err == nil && version < schemaVersion {
+		detail += fmt.Sprintf(", migrated to %d on mount", schemaVersion)
+	}
+	r.add("meta DB", err, detail)
+}
+
+// checkMountpoint checks that the mount point is a directory, a stale
+// mount is recovered on mount.
+func (mfs *MinFS) checkMountpoint(r *CheckReport) {
+	mountpoint := mfs.config.mountpoint
+	if staleMount(mountpoint) {
+		r.add("mount point", nil, mountpoint+" is a stale mount, unmounted on mount")
+		return
+	}
+
+	fi, err := os.Stat(mountpoint)
+	if err == nil && !fi.IsDir() {
+		err = fmt.Errorf("Mount point %s is not a directory", mountpoint)
+	}
+	r.add("mount point", err, mountpoint+" is a directory")
+}
+
+// checkFuse checks that the FUSE device and fusermount are available, and
+// that fusermount allows allow-other and allow-root if these are set.
+func checkFuse(allowOther bool) error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+
+	f, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("FUSE device isn't available, load the fuse module: %s", err)
+	}
+	f.Close()
+
+	if _, err = exec.LookPath("fusermount"); err != nil {
+		return fmt.Errorf("fusermount isn't installed: %s", err)
+	}
+	if allowOther {
+		return checkUserAllowOther(fuseConf, os.Geteuid())
+	}
+	return nil
+}
+
+// String formats the report as a line per item.
+func (r CheckReport) String() string {
+	var b strings.Builder
+	for _, res := range r.Results {
+		status := "PASS"
+		if !res.OK {
+			status = "FAIL"
+		}
+		fmt.Fprintf(&b, "%s  %-16s %s\n", status, res.Item, res.Detail)
+	}
+	return b.String()
+}
@@ -0,0 +1,123 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+
+	minio "github.com/minio/minio-go/v6"
+)
+
+// checksumMetaKey is the user metadata key prefix of the checksum stored
+// with uploads, followed by the algorithm.
+const checksumMetaKey = "minfs-checksum-"
+
+// errChecksumMismatch is returned when downloaded content doesn't match
+// the checksum reported by the remote.
+var errChecksumMismatch = errors.New("Checksum mismatch")
+
+// errShortDownload is returned when the response ends before the whole
+// content of the object is downloaded.
+var errShortDownload = errors.New("Download ended early")
+
+// retryDownload returns true if the download failing with err is retried
+// once.
+func retryDownload(err error) bool {
+	return err == errChecksumMismatch || err == errShortDownload
+}
+
+// validChecksum returns true if the checksum algorithm is supported.
+func validChecksum(algorithm string) bool {
+	switch algorithm {
+	case "", "none", "crc32c", "sha256":
+		return true
+	}
+	return false
+}
+
+// newChecksum returns the hash of the checksum algorithm, nil if no
+// checksums are used.
+func newChecksum(algorithm string) hash.Hash {
+	switch algorithm {
+	case "crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case "sha256":
+		return sha256.New()
+	}
+	return nil
+}
+
+// encodeChecksum encodes the checksum the way S3 represents checksums.
+func encodeChecksum(sum []byte) string {
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+// readerChecksum returns the encoded checksum of the content of r.
+func readerChecksum(r io.Reader, algorithm string) (string, error) {
+	hasher := newChecksum(algorithm)
+	if hasher == nil {
+		return "", nil
+	}
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return encodeChecksum(hasher.Sum(nil)), nil
+}
+
+// objectChecksum returns the checksum of the object as reported by the
+// remote, either the native checksum or the checksum stored at upload.
+// An empty string is returned when the remote has no checksum of the
+// whole content.
+func objectChecksum(objInfo minio.ObjectInfo, algorithm string) string {
+	if v := objInfo.Metadata.Get("X-Amz-Checksum-" + algorithm); v != "" && !compositeChecksum(objInfo, v) {
+		return v
+	}
+	return objInfo.Metadata.Get("X-Amz-Meta-" + checksumMetaKey + algorithm)
+}
+
+// compositeChecksum tells if the native checksum v of the object is the
+// checksum of the part checksums of a multipart upload, followed by
+// -<parts>, which can't be compared with the checksum of the content.
+func compositeChecksum(objInfo minio.ObjectInfo, v string) bool {
+	if strings.EqualFold(objInfo.Metadata.Get("X-Amz-Checksum-Type"), "COMPOSITE") {
+		return true
+	}
+
+	// base64 has no dashes
+	i := strings.LastIndex(v, "-")
+	if i < 0 {
+		return false
+	}
+	_, err := strconv.Atoi(v[i+1:])
+	return err == nil
+}
+
+// getObjectOptions returns the options for object downloads.
+func (mfs *MinFS) getObjectOptions() minio.GetObjectOptions {
+	opts := minio.GetObjectOptions{}
+	if newChecksum(mfs.config.checksum) != nil {
+		opts.Set("x-amz-checksum-mode", "ENABLED")
+	}
+	return opts
+}
@@ -0,0 +1,56 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	minio "github.com/minio/minio-go/v6"
+)
+
+func TestObjectChecksum(t *testing.T) {
+	sum, err := readerChecksum(strings.NewReader("hello"), "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		headers  map[string]string
+		expected string
+	}{
+		{"none", nil, ""},
+		{"native", map[string]string{"X-Amz-Checksum-Sha256": sum}, sum},
+		{"stored", map[string]string{"X-Amz-Meta-Minfs-Checksum-Sha256": sum}, sum},
+		{"composite", map[string]string{"X-Amz-Checksum-Sha256": "KrVm0Qg1X1ALBFnNXz8YWqsXvn3uvg4DS3sHPhHMVPs=-3"}, ""},
+		{"composite type", map[string]string{"X-Amz-Checksum-Sha256": "KrVm0Qg1X1ALBFnNXz8YWqsXvn3uvg4DS3sHPhHMVPs=", "X-Amz-Checksum-Type": "COMPOSITE"}, ""},
+		{"composite and stored", map[string]string{"X-Amz-Checksum-Sha256": "KrVm0Qg1X1ALBFnNXz8YWqsXvn3uvg4DS3sHPhHMVPs=-12", "X-Amz-Meta-Minfs-Checksum-Sha256": sum}, sum},
+		{"full object type", map[string]string{"X-Amz-Checksum-Sha256": sum, "X-Amz-Checksum-Type": "FULL_OBJECT"}, sum},
+	}
+
+	for _, testCase := range testCases {
+		objInfo := minio.ObjectInfo{Metadata: http.Header{}}
+		for k, v := range testCase.headers {
+			objInfo.Metadata.Set(k, v)
+		}
+		if got := objectChecksum(objInfo, "sha256"); got != testCase.expected {
+			t.Errorf("%s: expected checksum %q, got %q", testCase.name, testCase.expected, got)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package minfs
+
+import (
+	"time"
+
+	"github.com/minio/minfs/meta"
+)
+
+const (
+	// defaultCompactThreshold is the unused fraction of the meta DB
+	// compacted at mount time.
+	defaultCompactThreshold = 0.5
+
+	// compactMinSize is the size below which the meta DB isn't compacted
+	// at mount time.
+	compactMinSize = 16 * 1024 * 1024
+)
+
+// compactOnMount compacts the meta DB if it's fragmented beyond the
+// configured threshold.
+func (mfs *MinFS) compactOnMount() error {
+	fragmentation, size, err := mfs.db.Fragmentation()
+	if err == meta.ErrCompactUnsupported {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if size < compactMinSize || fragmentation < mfs.config.compactThreshold {
+		return nil
+	}
+
+	mfs.log.Printf("Meta DB is %.0f%% unused, compacting...\n", fragmentation*100)
+	_, err = mfs.CompactMeta()
+	return err
+}
+
+// CompactResult is the size of the meta DB before and after compacting.
+type CompactResult struct {
+	Before   int64  `json:"before"`
+	After    int64  `json:"after"`
+	Duration string `json:"duration"`
+}
+
+// CompactMeta rewrites the meta DB with only the live data, transactions
+// are held off while compacting.
+func (mfs *MinFS) CompactMeta() (CompactResult, error) {
+	start := time.Now()
+
+	_, before, _ := mfs.db.Fragmentation()
+	if err := mfs.db.Compact(); err != nil {
+		return CompactResult{}, err
+	}
+	_, after, _ := mfs.db.Fragmentation()
+
+	result := CompactResult{Before: before, After: after, Duration: time.Since(start).Round(time.Millisecond).String()}
+	mfs.log.Printf("Compacted meta DB from %d to %d bytes in %s.\n", before, after, result.Duration)
+	return result, nil
+}
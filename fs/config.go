@@ -19,11 +19,13 @@ package minfs
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/minio/minio/pkg/console"
 )
@@ -34,19 +36,223 @@ type Config struct {
 	basePath string
 
 	cache       string
+	cacheReuse  bool
 	accountID   string
-	accessKey   string
-	secretKey   string
-	secretToken string
+	accessKey   secret
+	secretKey   secret
+	secretToken secret
 	target      *url.URL
+	targetErr   error
+	region      string
 	mountpoint  string
 	insecure    bool
 	debug       bool
 	ca_bundle   string
 
+	// credentialSource is keyring:<service>/<account> or
+	// helper:<command>, sourced are the credentials retrieved from it
+	credentialSource string
+	sourced          *sourcedCredentials
+
+	// mount read-only, nothing is uploaded or changed remotely.
+	readOnly bool
+
+	// keep all changes of the mount local to the cache, see scratch.go.
+	scratch bool
+
+	// write access to the buckets presented: auto, read-only or
+	// read-write, see bucketaccess.go.
+	bucketAccess string
+
+	// volname is the name of the volume in Finder, the bucket by
+	// default. appleDouble and dsStore handle the ._* and .DS_Store files
+	// of Finder, see apple.go.
+	volname     string
+	appleDouble string
+	dsStore     string
+
+	// serve in a detached child, the parent exits once it's mounted;
+	// pidFile is written with the pid of the serving process.
+	background bool
+	pidFile    string
+
+	// the mount fails unless the kernel answers a stat of its root
+	// within readyTimeout, readyFD is written once it does.
+	readyTimeout time.Duration
+	readyFD      int
+
+	// let other users, or root, access the mount. Unprivileged mounts
+	// need user_allow_other in /etc/fuse.conf for either.
+	allowOther bool
+	allowRoot  bool
+
+	verifyUploads bool
+	checksum      string
+	requestPayer  string
+	presignExpiry time.Duration
+	addressing    string
+
+	partSize          int64
+	uploadConcurrency uint
+
+	metaTimeout     time.Duration
+	dataIdleTimeout time.Duration
+
+	// hard mounts wait for an unreachable endpoint, interrupts abort the
+	// waiting operations with intr. Soft mounts fail the operations once
+	// the endpoint is unreachable for longer than retryTimeout.
+	hard         bool
+	intr         bool
+	retryTimeout time.Duration
+
+	// retries of failed uploads before giving up.
+	uploadRetries int
+
+	// backend of the meta DB, bolt or memory.
+	metaStore string
+
+	// unused fraction of the meta DB compacted at mount time.
+	compactThreshold float64
+
+	// export of the meta DB imported at mount time.
+	importMeta string
+
+	// apply bucket notifications of changes by other clients.
+	notifications bool
+
+	// compare the ETag of objects with the remote when opened.
+	openCheck bool
+
+	// time directory listings are used before listing the remote
+	// again, zero keeps them until unmount.
+	dirTTL time.Duration
+
+	// times the kernel caches attributes and names, see kernelcache.go.
+	// writebackCache lets the kernel batch writes, directIO bypasses the
+	// page cache.
+	attrTimeout    time.Duration
+	entryTimeout   time.Duration
+	writebackCache bool
+	directIO       bool
+
+	// file entries not accessed for this long are evicted from the meta
+	// DB, zero keeps them.
+	evictAfter time.Duration
+
+	// resolves changes of both the local file and the remote object,
+	// one of local-wins, remote-wins or conflict-copy.
+	conflictPolicy string
+
+	// updates of the access time by reads, one of off, relatime or on.
+	atime string
+
+	// interval of background resyncs with the remote listing, zero
+	// disables them, and their rate of listing requests per second.
+	resyncInterval time.Duration
+	resyncRate     int
+
+	// create directory markers for new directories, which keeps empty
+	// directories across remounts.
+	dirMarkers bool
+
+	// buckets mounted as top-level directories, a single "*" entry
+	// mounts all buckets visible to the credentials.
+	buckets   []string
+	bucketOps bool
+
+	// create missing buckets at mount time in createBucketRegion.
+	createBucket       bool
+	createBucketRegion string
+
+	// interval of garbage collections of lost cache references and
+	// unreferenced cache files, zero disables them.
+	gcInterval time.Duration
+
+	// address of the listener serving Prometheus metrics and the health
+	// endpoint, empty disables them. The health check of the remote is
+	// only done with healthRemote.
+	metricsAddr  string
+	healthRemote bool
+
+	// serve the profiling handlers of net/http/pprof, on pprofAddr or
+	// without one on the metrics listener.
+	pprof     bool
+	pprofAddr string
+
+	// level and format (console or json) of log entries.
+	logLevel  string
+	logFormat string
+
+	// sink of log entries, stderr, syslog, journal or file:<path>, files
+	// are rotated at logMaxSize.
+	logTarget  string
+	logMaxSize int64
+
+	// number of workers of uploads, copies and moves, with asyncUploads
+	// flushes return once the upload is queued.
+	uploadWorkers int
+	asyncUploads  bool
+
+	// uploads up to this size are scheduled on the lane of small
+	// operations, which has reserved workers.
+	smallUpload int64
+
+	// waits for the lock of a path longer than lockWarn are logged and
+	// fail after lockTimeout, zero waits forever.
+	lockWarn    time.Duration
+	lockTimeout time.Duration
+
+	// dirty files and queued uploads are flushed on SIGTERM for up to
+	// shutdownTimeout before unmounting.
+	shutdownTimeout time.Duration
+
+	// FUSE operations running longer than slowOp are logged, zero
+	// disables the watchdog.
+	slowOp time.Duration
+
+	// file the audit events are appended to, or syslog; empty disables
+	// the audit log.
+	auditLog string
+
+	// serve the virtual status directory at the mount root.
+	statusDir bool
+
+	// file the state dump is written to on SIGUSR1, empty writes it to
+	// the log.
+	dumpFile string
+
+	// OTLP/HTTP endpoint spans are exported to, with the ratio of
+	// operations traced; empty disables tracing.
+	traceEndpoint string
+	traceSample   float64
+
+	// receives the events of the mount, nil without.
+	notifier Notifier
+
+	// returns the options of the config on SIGHUP, nil ignores SIGHUP.
+	reload func() ([]func(*Config), error)
+
+	// inject the faults of faultRules and of the control interface, for
+	// testing failure handling only.
+	faults     bool
+	faultRules []string
+
 	uid  uint32
 	gid  uint32
 	mode os.FileMode
+
+	// owner reported for all entries instead of the stored one once set,
+	// chown is ignored or fails with strictAttrs. The permissions of
+	// entries without a mode of their own are those of the longest
+	// matching prefix mode, or fileMode and dirMode. All modes are masked
+	// by umask.
+	uidSet      bool
+	gidSet      bool
+	fileMode    os.FileMode
+	dirMode     os.FileMode
+	prefixModes []prefixMode
+	umask       os.FileMode
+	strictAttrs bool
 }
 
 // AccessConfig - access credentials and version of `config.json`.
@@ -118,31 +324,56 @@ func Mountpoint(mountpoint string) func(*Config) {
 // Target url target option for Config
 func Target(target string) func(*Config) {
 	return func(cfg *Config) {
-		if u, err := url.Parse(target); err == nil {
-			cfg.target = u
-
-			if len(u.Path) > 1 {
-				parts := strings.Split(u.Path[1:], "/")
-				if len(parts) >= 0 {
-					cfg.bucket = parts[0]
-				}
-				if len(parts) >= 1 {
-					cfg.basePath = path.Join(parts[1:]...)
-				}
+		u, err := parseEndpoint(target)
+		if err != nil {
+			cfg.targetErr = err
+			return
+		}
+
+		cfg.target = u
+		if cfg.region == "" {
+			cfg.region = endpointRegion(u)
+		}
+
+		if len(u.Path) > 1 {
+			parts := strings.Split(u.Path[1:], "/")
+			if len(parts) >= 0 {
+				cfg.bucket = parts[0]
+			}
+			if len(parts) >= 1 {
+				cfg.basePath = path.Join(parts[1:]...)
 			}
 		}
 	}
 }
 
+// Region - sets the region of the target, by default the region of AWS
+// endpoints is taken from the host and looked up for other endpoints.
+func Region(region string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.region = region
+	}
+}
+
 func AccessKey(path string) func(*Config) {
 	return func(cfg *Config) {
-		cfg.accessKey = path
+		cfg.accessKey = secret(path)
 	}
 }
 
 func SecretKey(path string) func(*Config) {
 	return func(cfg *Config) {
-		cfg.secretKey = path
+		cfg.secretKey = secret(path)
+	}
+}
+
+// Credentials - retrieves the credentials from source instead, the secret
+// key of the access key account from the OS keyring with
+// keyring:<service>/<account>, or the output of a credential helper with
+// helper:<command>, run again before they expire.
+func Credentials(source string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.credentialSource = source
 	}
 }
 
@@ -153,17 +384,588 @@ func CacheDir(path string) func(*Config) {
 	}
 }
 
-// SetGID - sets a custom gid for the mount.
+// CacheReuse - keep cache files after release and revalidate them
+// against the remote on the next open.
+func CacheReuse() func(*Config) {
+	return func(cfg *Config) {
+		cfg.cacheReuse = true
+	}
+}
+
+// NoVerifyUploads - only verify the size of uploads, for endpoints where
+// ETags are not MD5 digests.
+func NoVerifyUploads() func(*Config) {
+	return func(cfg *Config) {
+		cfg.verifyUploads = false
+	}
+}
+
+// Checksum - sets the checksum algorithm verifying transfers, one of
+// crc32c, sha256 or none.
+func Checksum(algorithm string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.checksum = algorithm
+	}
+}
+
+// RequestPayer - acknowledge the charges of requester pays buckets, the
+// only supported payer is requester.
+func RequestPayer(payer string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.requestPayer = payer
+	}
+}
+
+// PresignExpiry - sets the default expiry of presigned URLs.
+func PresignExpiry(expiry time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.presignExpiry = expiry
+	}
+}
+
+// Addressing - sets the URL style of bucket requests, one of path,
+// virtual or auto.
+func Addressing(style string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.addressing = style
+	}
+}
+
+// PartSize - sets the part size of multipart uploads and copies.
+func PartSize(size int64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.partSize = size
+	}
+}
+
+// UploadConcurrency - sets the number of parts transferred concurrently.
+func UploadConcurrency(n uint) func(*Config) {
+	return func(cfg *Config) {
+		cfg.uploadConcurrency = n
+	}
+}
+
+// Notifications - listen for bucket notifications to pick up changes made
+// by other clients.
+func Notifications() func(*Config) {
+	return func(cfg *Config) {
+		cfg.notifications = true
+	}
+}
+
+// NoDirMarkers - don't create marker objects for new directories, empty
+// directories then only exist until the cache is removed.
+func NoDirMarkers() func(*Config) {
+	return func(cfg *Config) {
+		cfg.dirMarkers = false
+	}
+}
+
+// MetaTimeout - sets the deadline of metadata requests, like stat, list,
+// remove and copy.
+func MetaTimeout(timeout time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.metaTimeout = timeout
+	}
+}
+
+// DataIdleTimeout - aborts downloads and uploads which haven't transferred
+// any bytes for the duration.
+func DataIdleTimeout(timeout time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.dataIdleTimeout = timeout
+	}
+}
+
+// Hard - blocks operations while the endpoint is unreachable, until it
+// answers again.
+func Hard() func(*Config) {
+	return func(cfg *Config) {
+		cfg.hard = true
+	}
+}
+
+// Soft - fails operations once the endpoint is unreachable for longer than
+// the retry timeout, the default.
+func Soft() func(*Config) {
+	return func(cfg *Config) {
+		cfg.hard = false
+	}
+}
+
+// Intr - lets interrupts abort the operations of hard mounts waiting for the
+// endpoint.
+func Intr() func(*Config) {
+	return func(cfg *Config) {
+		cfg.intr = true
+	}
+}
+
+// RetryTimeout - sets the time soft mounts retry requests after the
+// endpoint became unreachable.
+func RetryTimeout(timeout time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.retryTimeout = timeout
+	}
+}
+
+// UploadRetries - sets the number of background retries of a failed upload
+// before giving up, the cache file is kept when giving up.
+func UploadRetries(n int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.uploadRetries = n
+	}
+}
+
+// MetaStore - sets the backend of the meta DB, bolt and badger keep the
+// meta data in the cache directory, memory loses it on unmount.
+func MetaStore(store string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.metaStore = store
+	}
+}
+
+// CompactThreshold - compact the meta DB at mount time when this fraction
+// of it is unused, 1 disables compacting.
+func CompactThreshold(threshold float64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.compactThreshold = threshold
+	}
+}
+
+// ImportMetaFrom - seeds the meta DB at mount time from an export of the
+// same endpoint and bucket.
+func ImportMetaFrom(path string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.importMeta = path
+	}
+}
+
+// ResyncInterval - reconciles the meta DB with the remote listing in the
+// background at the interval.
+func ResyncInterval(interval time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.resyncInterval = interval
+	}
+}
+
+// ResyncRate - sets the listing requests per second of background resyncs.
+func ResyncRate(rate int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.resyncRate = rate
+	}
+}
+
+// NoOpenCheck - doesn't compare the ETag of objects with the remote when
+// they are opened, cached content might be stale.
+func NoOpenCheck() func(*Config) {
+	return func(cfg *Config) {
+		cfg.openCheck = false
+	}
+}
+
+// ConflictPolicy - sets how local changes of objects changed by another
+// client at the same time are resolved: local-wins, remote-wins or
+// conflict-copy.
+func ConflictPolicy(policy string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.conflictPolicy = policy
+	}
+}
+
+// Atime - sets how reads update the access time of files: off never,
+// relatime if it's older than the modification time or a day, on
+// always. It's only kept in the meta DB.
+func Atime(mode string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.atime = mode
+	}
+}
+
+// DirTTL - lists directories on the remote again when their listing is
+// older than ttl.
+func DirTTL(ttl time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.dirTTL = ttl
+	}
+}
+
+// AttrTimeout - sets the time the kernel caches the attributes of
+// entries.
+func AttrTimeout(timeout time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.attrTimeout = timeout
+	}
+}
+
+// EntryTimeout - sets the time the kernel caches the names looked up.
+func EntryTimeout(timeout time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.entryTimeout = timeout
+	}
+}
+
+// WritebackCache - lets the kernel buffer writes in the page cache and
+// send them in batches.
+func WritebackCache() func(*Config) {
+	return func(cfg *Config) {
+		cfg.writebackCache = true
+	}
+}
+
+// DirectIO - bypasses the page cache of the kernel for reads and writes
+// of files.
+func DirectIO() func(*Config) {
+	return func(cfg *Config) {
+		cfg.directIO = true
+	}
+}
+
+// EvictAfter - removes file entries which weren't accessed for the period
+// from the meta DB, they are looked up on the remote again when accessed.
+func EvictAfter(period time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.evictAfter = period
+	}
+}
+
+// GCInterval - sets the interval of garbage collections of the meta DB
+// and the cache dir, zero disables them.
+func GCInterval(interval time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.gcInterval = interval
+	}
+}
+
+// MetricsAddr - serves Prometheus metrics at /metrics and the health of
+// the mount at /healthz on addr.
+func MetricsAddr(addr string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.metricsAddr = addr
+	}
+}
+
+// LogLevel - sets the level of log entries written, one of error, warn,
+// info, debug or trace. The trace level also logs the redacted S3 wire
+// trace.
+func LogLevel(level string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.logLevel = level
+	}
+}
+
+// LogFormat - sets the format of log entries, console or json.
+func LogFormat(format string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.logFormat = format
+	}
+}
+
+// LogTarget - sets where log entries are written, stderr, syslog, journal
+// or file:<path>.
+func LogTarget(target string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.logTarget = target
+	}
+}
+
+// LogMaxSize - sets the size at which log files are rotated, 0 disables
+// rotation.
+func LogMaxSize(size int64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.logMaxSize = size
+	}
+}
+
+// Pprof - serves the profiles of net/http/pprof at /debug/pprof/ on addr,
+// or on the metrics listener if addr is empty.
+func Pprof(addr string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.pprof = true
+		cfg.pprofAddr = addr
+	}
+}
+
+// HealthRemote - checks that the bucket is reachable in the health
+// endpoint.
+func HealthRemote() func(*Config) {
+	return func(cfg *Config) {
+		cfg.healthRemote = true
+	}
+}
+
+// UploadWorkers - sets the number of uploads, copies and moves run
+// concurrently.
+func UploadWorkers(workers int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.uploadWorkers = workers
+	}
+}
+
+// ReadOnly - mounts read-only, mutating operations fail with EROFS and no
+// upload workers are started.
+func ReadOnly() func(*Config) {
+	return func(cfg *Config) {
+		cfg.readOnly = true
+	}
+}
+
+// BucketAccess - sets the write access to the buckets presented: auto
+// checks if the credentials can write to them, read-only and read-write
+// force it.
+func BucketAccess(access string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.bucketAccess = access
+	}
+}
+
+// Scratch - keeps all changes local, files written or created are kept in
+// the cache and removals hide the remote entries. Nothing is uploaded or
+// removed remotely.
+func Scratch() func(*Config) {
+	return func(cfg *Config) {
+		cfg.scratch = true
+	}
+}
+
+// VolName - sets the name of the volume shown by Finder on macOS.
+func VolName(name string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.volname = name
+	}
+}
+
+// NoAppleDouble - keeps the ._* files of Finder local with local, or
+// rejects their creation with reject, instead of uploading them.
+func NoAppleDouble(mode string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.appleDouble = mode
+	}
+}
+
+// NoDSStore - keeps the .DS_Store files of Finder local with local, or
+// rejects their creation with reject, instead of uploading them.
+func NoDSStore(mode string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.dsStore = mode
+	}
+}
+
+// Background - serves the mount in a detached child process, Serve returns
+// in the parent once the mount answers requests, or with the error of the
+// child.
+func Background() func(*Config) {
+	return func(cfg *Config) {
+		cfg.background = true
+	}
+}
+
+// PidFile - writes the pid of the serving process to path, it's removed on
+// unmount.
+func PidFile(path string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.pidFile = path
+	}
+}
+
+// ReadyTimeout - sets the time the mount has to answer a stat of its root
+// through the kernel, it's unmounted and fails otherwise.
+func ReadyTimeout(timeout time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.readyTimeout = timeout
+	}
+}
+
+// ReadyFD - writes a line to the inherited file descriptor fd once the
+// mount is ready, and closes it. It's closed without a line if the mount
+// fails, like the notification fd of s6.
+func ReadyFD(fd int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.readyFD = fd
+	}
+}
+
+// AllowOther - lets other users than the one mounting access the mount,
+// their access is checked against the mode by the kernel.
+func AllowOther() func(*Config) {
+	return func(cfg *Config) {
+		cfg.allowOther = true
+	}
+}
+
+// AllowRoot - lets root access the mount of another user.
+func AllowRoot() func(*Config) {
+	return func(cfg *Config) {
+		cfg.allowRoot = true
+	}
+}
+
+// AsyncUploads - flushes return once the upload is queued, the upload is
+// journaled and retried like failed uploads.
+func AsyncUploads() func(*Config) {
+	return func(cfg *Config) {
+		cfg.asyncUploads = true
+	}
+}
+
+// SmallUpload - uploads up to size are small, these aren't queued behind
+// large uploads.
+func SmallUpload(size int64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.smallUpload = size
+	}
+}
+
+// LockWarn - logs operations waiting longer for the lock of a path, with
+// the holder of the lock.
+func LockWarn(threshold time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.lockWarn = threshold
+	}
+}
+
+// LockTimeout - fails operations waiting longer for the lock of a path
+// with EIO, zero waits forever.
+func LockTimeout(timeout time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.lockTimeout = timeout
+	}
+}
+
+// SlowOp - logs FUSE operations running longer than threshold, with the
+// remote call they are blocked on, zero disables it.
+func SlowOp(threshold time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.slowOp = threshold
+	}
+}
+
+// ShutdownTimeout - time SIGTERM waits for dirty files and queued uploads
+// before unmounting, files not uploaded by then are uploaded on the next
+// mount.
+func ShutdownTimeout(timeout time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.shutdownTimeout = timeout
+	}
+}
+
+// AuditLog - records the mutating operations with their caller and
+// outcome as JSON lines in the file at target, or in syslog if target is
+// syslog.
+func AuditLog(target string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.auditLog = target
+	}
+}
+
+// StatusDir - serves the read-only status, pending, config and errors files in
+// the virtual .minfs directory at the mount root.
+func StatusDir() func(*Config) {
+	return func(cfg *Config) {
+		cfg.statusDir = true
+	}
+}
+
+// DumpFile - writes the state dump to path on SIGUSR1, instead of to the
+// log.
+func DumpFile(path string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.dumpFile = path
+	}
+}
+
+// Notify - delivers the transfers, cache evictions and errors to n, see
+// Notifier for the delivery guarantees.
+func Notify(n Notifier) func(*Config) {
+	return func(cfg *Config) {
+		cfg.notifier = n
+	}
+}
+
+// Reload - reloads the config from the options returned by fn on SIGHUP,
+// only the settings which can change while mounted are applied.
+func Reload(fn func() ([]func(*Config), error)) func(*Config) {
+	return func(cfg *Config) {
+		cfg.reload = fn
+	}
+}
+
+// UnsafeFaults - enables fault injection with the initial rules, see
+// faultRule. Never use it for data you care about.
+func UnsafeFaults(rules ...string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.faults = true
+		cfg.faultRules = rules
+	}
+}
+
+// TraceEndpoint - exports spans of FUSE operations, meta transactions and
+// S3 requests to the OTLP/HTTP endpoint.
+func TraceEndpoint(endpoint string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.traceEndpoint = endpoint
+	}
+}
+
+// TraceSample - sets the ratio of FUSE operations traced, between 0 and 1.
+func TraceSample(ratio float64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.traceSample = ratio
+	}
+}
+
+// SetGID - sets a custom gid for the mount, reported for all entries.
 func SetGID(gid uint32) func(*Config) {
 	return func(cfg *Config) {
 		cfg.gid = gid
+		cfg.gidSet = true
 	}
 }
 
-// SetUID - sets a custom uid for the mount.
+// SetUID - sets a custom uid for the mount, reported for all entries.
 func SetUID(uid uint32) func(*Config) {
 	return func(cfg *Config) {
 		cfg.uid = uid
+		cfg.uidSet = true
+	}
+}
+
+// FileMode - sets the permissions of files without a mode set by create or
+// chmod, like the files found on the remote.
+func FileMode(mode os.FileMode) func(*Config) {
+	return func(cfg *Config) {
+		cfg.fileMode = mode
+	}
+}
+
+// DirMode - sets the permissions of directories found on the remote or
+// created by mkdir.
+func DirMode(mode os.FileMode) func(*Config) {
+	return func(cfg *Config) {
+		cfg.dirMode = mode
+	}
+}
+
+// PrefixMode - sets the permissions of the files below prefix without a
+// mode of their own, instead of FileMode. The longest matching prefix wins.
+func PrefixMode(prefix string, mode os.FileMode) func(*Config) {
+	return func(cfg *Config) {
+		cfg.prefixModes = append(cfg.prefixModes, prefixMode{prefix: strings.TrimPrefix(prefix, "/"), mode: mode})
+	}
+}
+
+// Umask - masks the permissions reported for all entries.
+func Umask(mask os.FileMode) func(*Config) {
+	return func(cfg *Config) {
+		cfg.umask = mask
+	}
+}
+
+// StrictAttrs - fails chown of the owner set by SetUID and SetGID with
+// EPERM, instead of ignoring it.
+func StrictAttrs() func(*Config) {
+	return func(cfg *Config) {
+		cfg.strictAttrs = true
 	}
 }
 
@@ -187,6 +989,42 @@ func CABundle(bundlefile string) func(*Config) {
 	}
 }
 
+// Buckets - mount the listed buckets as top-level directories, use "*"
+// to mount all buckets visible to the credentials.
+func Buckets(buckets ...string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.buckets = buckets
+	}
+}
+
+// BucketOps - map mkdir and rmdir of top-level directories to bucket
+// creation and removal when mounting all buckets.
+func BucketOps() func(*Config) {
+	return func(cfg *Config) {
+		cfg.bucketOps = true
+	}
+}
+
+// CreateBucket - create the bucket in region at mount time if it
+// doesn't exist, an empty region uses the server default.
+func CreateBucket(region string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.createBucket = true
+		cfg.createBucketRegion = region
+	}
+}
+
+// multiBucket returns true if the mount root lists buckets.
+func (cfg *Config) multiBucket() bool {
+	return len(cfg.buckets) > 0
+}
+
+// allBuckets returns true if all buckets visible to the credentials
+// should be mounted.
+func (cfg *Config) allBuckets() bool {
+	return len(cfg.buckets) == 1 && cfg.buckets[0] == "*"
+}
+
 // Validates the config for sane values.
 func (cfg *Config) validate() error {
 	// check if mountpoint exists
@@ -194,10 +1032,217 @@ func (cfg *Config) validate() error {
 		return errors.New("Mountpoint not set")
 	}
 
+	if cfg.targetErr != nil {
+		return cfg.targetErr
+	}
+
 	if cfg.target == nil {
 		return errors.New("Target not set")
 	}
 
+	if !validChecksum(cfg.checksum) {
+		return fmt.Errorf("Unsupported checksum algorithm %s", cfg.checksum)
+	}
+
+	if cfg.requestPayer != "" {
+		if cfg.requestPayer != "requester" {
+			return fmt.Errorf("Unsupported request payer %s", cfg.requestPayer)
+		}
+		// Streaming signatures used on plain http can't be signed again
+		// with the request payer header.
+		if cfg.target.Scheme != "https" {
+			return errors.New("Request payer requires a https target")
+		}
+	}
+
+	if cfg.credentialSource != "" {
+		if _, _, err := parseCredentialSource(cfg.credentialSource); err != nil {
+			return err
+		}
+	}
+
+	if _, err := parseLevel(cfg.logLevel); err != nil {
+		return err
+	}
+
+	if cfg.logFormat != "console" && cfg.logFormat != "json" {
+		return fmt.Errorf("Unsupported log format %s", cfg.logFormat)
+	}
+
+	if err := parseLogTarget(cfg.logTarget); err != nil {
+		return err
+	}
+
+	if cfg.logMaxSize < 0 {
+		return errors.New("Log max size cannot be negative")
+	}
+
+	if _, ok := bucketLookups[cfg.addressing]; !ok {
+		return fmt.Errorf("Unsupported addressing %s", cfg.addressing)
+	}
+
+	if cfg.partSize < minPartSize || cfg.partSize > maxPartSize {
+		return fmt.Errorf("Part size must be between %d and %d bytes", minPartSize, maxPartSize)
+	}
+
+	if cfg.uploadConcurrency == 0 {
+		return errors.New("Upload concurrency must be at least 1")
+	}
+
+	switch cfg.bucketAccess {
+	case bucketAccessAuto, bucketAccessReadOnly, bucketAccessReadWrite:
+	default:
+		return fmt.Errorf("Unsupported bucket access %s", cfg.bucketAccess)
+	}
+
+	switch cfg.conflictPolicy {
+	case conflictLocalWins, conflictRemoteWins, conflictCopy:
+	default:
+		return fmt.Errorf("Unsupported conflict policy %s", cfg.conflictPolicy)
+	}
+
+	switch cfg.atime {
+	case atimeOff, atimeRelatime, atimeOn:
+	default:
+		return fmt.Errorf("Unsupported atime %s", cfg.atime)
+	}
+
+	switch cfg.metaStore {
+	case "bolt", "badger", "memory":
+	default:
+		return fmt.Errorf("Unsupported meta store %s", cfg.metaStore)
+	}
+
+	if cfg.dirTTL < 0 {
+		return errors.New("Directory TTL can't be negative")
+	}
+
+	if cfg.attrTimeout < 0 || cfg.entryTimeout < 0 {
+		return errors.New("Attr and entry timeouts can't be negative")
+	}
+
+	if cfg.writebackCache && cfg.directIO {
+		return errors.New("Writeback cache can't be combined with direct-io, which bypasses the cache")
+	}
+
+	modes := []os.FileMode{cfg.fileMode, cfg.dirMode, cfg.umask}
+	for _, pm := range cfg.prefixModes {
+		if pm.prefix == "" {
+			return errors.New("Prefix mode has an empty prefix")
+		}
+		modes = append(modes, pm.mode)
+	}
+	for _, mode := range modes {
+		if mode&^os.ModePerm != 0 {
+			return fmt.Errorf("Mode %o has bits other than the permissions", uint32(mode))
+		}
+	}
+
+	if cfg.allowOther && cfg.allowRoot {
+		return errors.New("Mount options allow-other and allow-root can't be combined")
+	}
+
+	if cfg.readOnly && (cfg.createBucket || cfg.bucketOps || cfg.asyncUploads) {
+		return errors.New("Read-only mounts can't create buckets or upload")
+	}
+
+	// a bucket created on a mount of listed buckets isn't mounted, and
+	// is dropped by the next listing of the root
+	if cfg.bucketOps && !cfg.allBuckets() {
+		return errors.New("Bucket operations require mounting all buckets")
+	}
+
+	if cfg.scratch && (cfg.readOnly || cfg.createBucket || cfg.bucketOps || cfg.asyncUploads) {
+		return errors.New("Scratch mounts can't be read-only, create buckets or upload")
+	}
+
+	if !validAppleFiles(cfg.appleDouble) || !validAppleFiles(cfg.dsStore) {
+		return errors.New("noappledouble and nods_store must be local or reject")
+	}
+
+	if cfg.evictAfter < 0 {
+		return errors.New("Eviction period can't be negative")
+	}
+
+	if cfg.gcInterval < 0 {
+		return errors.New("Garbage collection interval can't be negative")
+	}
+
+	if cfg.uploadWorkers < 1 {
+		return errors.New("Upload workers must be at least 1")
+	}
+
+	if cfg.smallUpload < 0 {
+		return errors.New("Small upload size can't be negative")
+	}
+
+	if cfg.lockWarn < 0 || cfg.lockTimeout < 0 {
+		return errors.New("Lock timeouts can't be negative")
+	}
+
+	if cfg.pprof && cfg.pprofAddr == "" && cfg.metricsAddr == "" {
+		return errors.New("Profiling requires a metrics address or an address of its own")
+	}
+
+	if cfg.slowOp < 0 {
+		return errors.New("Slow operation threshold can't be negative")
+	}
+
+	if cfg.shutdownTimeout < 0 {
+		return errors.New("Shutdown timeout can't be negative")
+	}
+
+	if cfg.traceEndpoint != "" {
+		if _, err := traceEndpoint(cfg.traceEndpoint); err != nil {
+			return err
+		}
+	}
+
+	if cfg.traceSample < 0 || cfg.traceSample > 1 {
+		return errors.New("Trace sample ratio must be between 0 and 1")
+	}
+
+	for _, rule := range cfg.faultRules {
+		if _, err := parseFault(rule); err != nil {
+			return err
+		}
+	}
+
+	if cfg.resyncInterval < 0 {
+		return errors.New("Resync interval can't be negative")
+	}
+	if cfg.resyncRate <= 0 {
+		return errors.New("Resync rate must be at least 1")
+	}
+
+	if cfg.compactThreshold < 0 || cfg.compactThreshold > 1 {
+		return errors.New("Compact threshold must be between 0 and 1")
+	}
+
+	if cfg.metaTimeout <= 0 || cfg.dataIdleTimeout <= 0 || cfg.retryTimeout <= 0 || cfg.readyTimeout <= 0 {
+		return errors.New("Timeouts must be positive")
+	}
+
+	// 0 to 2 are the standard streams
+	if cfg.readyFD != 0 && cfg.readyFD < 3 {
+		return errors.New("Ready fd must be 3 or above")
+	}
+
+	if cfg.intr && !cfg.hard {
+		return errors.New("The intr option only applies to hard mounts")
+	}
+
+	if cfg.presignExpiry <= 0 || cfg.presignExpiry > maxPresignExpiry {
+		return fmt.Errorf("Presign expiry must be between 1s and %s", maxPresignExpiry)
+	}
+
+	if cfg.multiBucket() {
+		if cfg.bucket != "" {
+			return errors.New("Bucket in target can not be combined with buckets option")
+		}
+		return nil
+	}
+
 	if cfg.bucket == "" {
 		return errors.New("Bucket not set")
 	}
@@ -0,0 +1,174 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v6"
+)
+
+// Policies resolving conflicts between local changes and changes of the
+// remote object since it was opened.
+const (
+	// conflictLocalWins overwrites the remote changes.
+	conflictLocalWins = "local-wins"
+
+	// conflictRemoteWins discards the local changes.
+	conflictRemoteWins = "remote-wins"
+
+	// conflictCopy uploads the local changes next to the object.
+	conflictCopy = "conflict-copy"
+)
+
+// conflictName returns the name of the conflict copy of the file name.
+func conflictName(name string) string {
+	return name + ".conflict-" + time.Now().UTC().Format("20060102T150405Z")
+}
+
+// resolveConflict compares the remote object with the version the local
+// changes are based on, and applies the conflict policy when the object
+// was changed by another client. It returns true if the local changes
+// should be uploaded.
+func (fh *FileHandle) resolveConflict(ctx context.Context) (bool, error) {
+	f := fh.f
+
+	objInfo, err := f.mfs.api.StatObjectWithContext(ctx, f.BucketName(), f.RemotePath(), minio.StatObjectOptions{})
+	if isNotFound(err) && fh.baseETag != "" {
+		return fh.resolveRemoval(ctx)
+	}
+	if err != nil {
+		// new, or the remote is unavailable and the upload fails the
+		// same way
+		return true, nil
+	}
+
+	if strings.EqualFold(objInfo.ETag, fh.baseETag) {
+		return true, nil
+	}
+
+	atomic.AddUint64(&f.mfs.stats.Conflicts, 1)
+
+	switch f.mfs.config.conflictPolicy {
+	case conflictRemoteWins:
+		f.mfs.log.Printf("Conflict on %s: discarding the local changes of ETag %s, the remote has ETag %s.\n", f.RemotePath(), fh.baseETag, objInfo.ETag)
+	case conflictCopy:
+		name := conflictName(f.Path)
+		if err = fh.uploadConflictCopy(ctx, name); err != nil {
+			return false, err
+		}
+		f.mfs.log.Printf("Conflict on %s: uploaded the local changes of ETag %s to %s, the remote has ETag %s.\n", f.RemotePath(), fh.baseETag, name, objInfo.ETag)
+	default:
+		f.mfs.log.Printf("Conflict on %s: overwriting ETag %s with the local changes of ETag %s.\n", f.RemotePath(), objInfo.ETag, fh.baseETag)
+		return true, nil
+	}
+
+	// the file has the remote content again
+	f.Size = uint64(objInfo.Size)
+	f.ETag = objInfo.ETag
+	f.LastModified = objInfo.LastModified
+	f.Mtime = objInfo.LastModified
+	f.Chgtime = objInfo.LastModified
+	f.setStatAttrs(objInfo)
+	if f.CachePath != "" && f.CachePath != fh.cachePath {
+		f.mfs.removeCacheFile(f.CachePath, evictRemoteChanged)
+	}
+	f.CachePath = ""
+	f.CacheETag = ""
+	fh.baseETag = objInfo.ETag
+	return false, nil
+}
+
+// resolveRemoval applies the conflict policy to the local changes of a
+// file whose object was removed by another client. Unless the local
+// changes win, the file is removed locally too, its open handles keep
+// working like those of a file removed while open.
+func (fh *FileHandle) resolveRemoval(ctx context.Context) (bool, error) {
+	f := fh.f
+
+	atomic.AddUint64(&f.mfs.stats.Conflicts, 1)
+
+	switch f.mfs.config.conflictPolicy {
+	case conflictRemoteWins:
+		f.mfs.log.Printf("Conflict on %s: discarding the local changes of ETag %s, the object was removed.\n", f.RemotePath(), fh.baseETag)
+	case conflictCopy:
+		name := conflictName(f.Path)
+		if err := fh.uploadConflictCopy(ctx, name); err != nil {
+			return false, err
+		}
+		f.mfs.log.Printf("Conflict on %s: uploaded the local changes of ETag %s to %s, the object was removed.\n", f.RemotePath(), fh.baseETag, name)
+	default:
+		f.mfs.log.Printf("Conflict on %s: uploading the local changes of ETag %s again, the object was removed.\n", f.RemotePath(), fh.baseETag)
+		return true, nil
+	}
+
+	fullPath := f.FullPath()
+	if err := f.mfs.update(ctx, func(tx *meta.Tx) error {
+		if err := f.mfs.cancelUploads(tx, fullPath, f.BucketName(), f.RemotePath()); err != nil {
+			return err
+		}
+		if err := f.dir.bucket(tx).Delete(path.Base(f.Path)); err != nil {
+			return err
+		}
+		return f.mfs.releaseInode(tx, fullPath)
+	}); err != nil {
+		return false, err
+	}
+
+	f.mfs.unlinkOpen(f, f.mfs.openHandles(fullPath), false)
+	f.mfs.invalidateEntry(f.dir.FullPath(), path.Base(f.Path))
+	return false, nil
+}
+
+// uploadConflictCopy uploads the cache file of the handle as name, next to
+// the file.
+func (fh *FileHandle) uploadConflictCopy(ctx context.Context, name string) error {
+	f := fh.f
+
+	info, err := fh.File.Stat()
+	if err != nil {
+		return err
+	}
+
+	target := path.Join(f.dir.RemotePath(), name)
+	sr := newPutOp(f.BucketName(), fh.cachePath, target, info.Size())
+	if err = f.mfs.sync(&sr); err != nil {
+		return err
+	}
+	if err = <-sr.Error; err != nil {
+		return err
+	}
+
+	objInfo, err := f.mfs.api.StatObjectWithContext(ctx, f.BucketName(), target, minio.StatObjectOptions{})
+	if err != nil {
+		return err
+	}
+
+	if err = f.mfs.update(ctx, func(tx *meta.Tx) error {
+		return f.dir.storeFile(f.dir.bucket(tx), tx, name, objInfo)
+	}); err != nil {
+		return err
+	}
+
+	f.mfs.invalidateEntry(f.dir.FullPath(), name)
+	return nil
+}
@@ -0,0 +1,420 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// rateInterval is the interval of the samples of the transfer rates.
+	rateInterval = 5 * time.Second
+
+	// recentErrors is the number of last errors in the status of a mount.
+	recentErrors = 10
+)
+
+// ControlRequest is a request to the control socket, a JSON object per
+// line. Command is status, log-level changing the level of the log to
+// Level until the config is reloaded, flush and purge of the files below
+// the absolute Path, see FlushPath and PurgePath, or compact of the meta
+// DB of the mount of Path. Force discards the changes of purged files.
+// Command fault adds the rule Fault, if any, to the mount of Path, see
+// faultRule, and clear-faults removes its rules, both answer its rules.
+type ControlRequest struct {
+	Command string `json:"command"`
+	Level   string `json:"level,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Force   bool   `json:"force,omitempty"`
+	Fault   string `json:"fault,omitempty"`
+}
+
+// ControlResponse is the JSON object answering a request, on a line.
+type ControlResponse struct {
+	Error   string        `json:"error,omitempty"`
+	Pid     int           `json:"pid"`
+	Mounts  []MountStatus `json:"mounts,omitempty"`
+	Results []PathResult  `json:"results,omitempty"`
+
+	Compacted *CompactResult `json:"compacted,omitempty"`
+
+	// Faults are the fault rules and the number of calls they matched.
+	Faults map[string]uint64 `json:"faults,omitempty"`
+}
+
+// MountStatus is the status of a mount served by the process.
+type MountStatus struct {
+	MinFS      BuildInfo `json:"minfs"`
+	Mountpoint string    `json:"mountpoint"`
+	Target     string    `json:"target"`
+	Volume     string    `json:"volume"`
+	ReadOnly   bool      `json:"readOnly"`
+	Scratch    bool      `json:"scratch"`
+	LogLevel   string    `json:"logLevel"`
+	Started    time.Time `json:"started"`
+	Uptime     string    `json:"uptime"`
+
+	CacheBytes uint64 `json:"cacheBytes"`
+	CacheFiles int    `json:"cacheFiles"`
+	DirtyBytes uint64 `json:"dirtyBytes"`
+
+	// LocalChanges is the number of local changes of a scratch mount.
+	LocalChanges int `json:"localChanges,omitempty"`
+
+	QueuedUploads  int `json:"queuedUploads"`
+	RunningUploads int `json:"runningUploads"`
+	PendingUploads int `json:"pendingUploads"`
+	FailedUploads  int `json:"failedUploads"`
+
+	// bytes per second over the last rate interval
+	DownloadRate float64 `json:"downloadRate"`
+	UploadRate   float64 `json:"uploadRate"`
+
+	// the last errors, the latest first
+	Errors []PathError `json:"errors,omitempty"`
+}
+
+// PathError is the last error of a path.
+type PathError struct {
+	Path string
+	LastError
+}
+
+// transferRates are the bytes transferred per second by a mount.
+type transferRates struct {
+	m        sync.Mutex
+	down, up float64
+}
+
+// startRates samples the transferred bytes every rate interval.
+func (mfs *MinFS) startRates() {
+	go func() {
+		ticker := time.NewTicker(rateInterval)
+		defer ticker.Stop()
+
+		stats := mfs.Stats()
+		for {
+			select {
+			case <-mfs.listenerDoneCh:
+				return
+			case <-ticker.C:
+			}
+
+			prev := stats
+			stats = mfs.Stats()
+			mfs.rates.m.Lock()
+			mfs.rates.down = float64(stats.BytesDownloaded-prev.BytesDownloaded) / rateInterval.Seconds()
+			mfs.rates.up = float64(stats.BytesUploaded-prev.BytesUploaded) / rateInterval.Seconds()
+			mfs.rates.m.Unlock()
+		}
+	}()
+}
+
+// MountStatus returns the status of the mount.
+func (mfs *MinFS) MountStatus() MountStatus {
+	stats := mfs.Stats()
+	pending, gaveUp := mfs.pendingCounts()
+
+	mfs.rates.m.Lock()
+	down, up := mfs.rates.down, mfs.rates.up
+	mfs.rates.m.Unlock()
+
+	localChanges, _ := mfs.localChanges()
+
+	return MountStatus{
+		MinFS:          Build,
+		Mountpoint:     mfs.config.mountpoint,
+		Target:         mfs.config.target.Host + "/" + mfs.volumeName(),
+		Volume:         mfs.volumeName(),
+		ReadOnly:       mfs.config.readOnly,
+		Scratch:        mfs.config.scratch,
+		LogLevel:       mfs.cfg().logLevel,
+		Started:        mfs.started,
+		Uptime:         time.Since(mfs.started).Round(time.Second).String(),
+		CacheBytes:     stats.Cache.Bytes,
+		CacheFiles:     stats.Cache.Files,
+		DirtyBytes:     mfs.dirtyBytes(),
+		LocalChanges:   localChanges,
+		QueuedUploads:  stats.SyncQueue.Small + stats.SyncQueue.Large,
+		RunningUploads: stats.SyncQueue.Running,
+		PendingUploads: pending - gaveUp,
+		FailedUploads:  gaveUp,
+		DownloadRate:   down,
+		UploadRate:     up,
+		Errors:         mfs.recentErrors(recentErrors),
+	}
+}
+
+// recentErrors returns the last n errors, the latest first.
+func (mfs *MinFS) recentErrors(n int) []PathError {
+	mfs.lastErrors.m.Lock()
+	errs := make([]PathError, 0, len(mfs.lastErrors.byPath))
+	for p, e := range mfs.lastErrors.byPath {
+		errs = append(errs, PathError{p, e})
+	}
+	mfs.lastErrors.m.Unlock()
+
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Time.After(errs[j].Time)
+	})
+	if len(errs) > n {
+		errs = errs[:n]
+	}
+	return errs
+}
+
+// ControlDir returns the dir of the control sockets of the processes of
+// the user, /run/minfs for root.
+func ControlDir() string {
+	if os.Geteuid() == 0 {
+		return "/run/minfs"
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "minfs")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("minfs-%d", os.Geteuid()))
+}
+
+// controlServer answers the requests of the control socket of the
+// process about its mounts.
+type controlServer struct {
+	l      net.Listener
+	path   string
+	mounts func() []*MinFS
+	log    *logger
+}
+
+// startControl listens on the control socket of the process, only the
+// user can connect to it.
+func startControl(mounts func() []*MinFS, log *logger) (*controlServer, error) {
+	dir := ControlDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create the control socket dir %s: %s", dir, err)
+	}
+	// another user might have created the dir in the shared temp dir
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() || fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("Control socket dir %s must be owned by the user and not accessible by others", dir)
+	}
+
+	path := filepath.Join(dir, strconv.Itoa(os.Getpid())+".sock")
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen on the control socket %s: %s", path, err)
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	s := &controlServer{l: l, path: path, mounts: mounts, log: log}
+	go s.serve()
+	return s, nil
+}
+
+func (s *controlServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle answers the requests of conn until it's closed.
+func (s *controlServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req ControlRequest
+		resp := ControlResponse{Pid: os.Getpid()}
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = "Invalid request: " + err.Error()
+		} else {
+			s.answer(req, &resp)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (s *controlServer) answer(req ControlRequest, resp *ControlResponse) {
+	switch req.Command {
+	case "status":
+		for _, mfs := range s.mounts() {
+			resp.Mounts = append(resp.Mounts, mfs.MountStatus())
+		}
+	case "log-level":
+		// the mounts share the log
+		for _, mfs := range s.mounts() {
+			if err := mfs.SetLogLevel(req.Level); err != nil {
+				resp.Error = err.Error()
+				return
+			}
+			resp.Mounts = append(resp.Mounts, mfs.MountStatus())
+		}
+	case "flush", "purge":
+		mfs, fullPath := s.mountOf(req.Path)
+		if mfs == nil {
+			resp.Error = fmt.Sprintf("No mount of pid %d serves %s", os.Getpid(), req.Path)
+			return
+		}
+
+		var err error
+		if req.Command == "flush" {
+			resp.Results, err = mfs.FlushPath(fullPath)
+		} else {
+			resp.Results, err = mfs.PurgePath(fullPath, req.Force)
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		resp.Mounts = append(resp.Mounts, mfs.MountStatus())
+	case "compact":
+		mfs, _ := s.mountOf(req.Path)
+		if mfs == nil {
+			resp.Error = fmt.Sprintf("No mount of pid %d serves %s", os.Getpid(), req.Path)
+			return
+		}
+
+		result, err := mfs.CompactMeta()
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Compacted = &result
+		}
+		resp.Mounts = append(resp.Mounts, mfs.MountStatus())
+	case "fault", "clear-faults":
+		mfs, _ := s.mountOf(req.Path)
+		if mfs == nil {
+			resp.Error = fmt.Sprintf("No mount of pid %d serves %s", os.Getpid(), req.Path)
+			return
+		}
+
+		var err error
+		switch {
+		case req.Command == "clear-faults":
+			err = mfs.ClearFaults()
+		case req.Fault != "":
+			err = mfs.InjectFault(req.Fault)
+		case mfs.faults == nil:
+			err = errFaultsDisabled
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		resp.Faults = mfs.Faults()
+	default:
+		resp.Error = fmt.Sprintf("Unknown command %s", req.Command)
+	}
+}
+
+// mountOf returns the mount serving the absolute path, and the path
+// relative to its mount point.
+func (s *controlServer) mountOf(p string) (*MinFS, string) {
+	var (
+		found   *MinFS
+		longest = -1
+		rel     string
+	)
+	p = filepath.Clean(p)
+	for _, mfs := range s.mounts() {
+		mountpoint := filepath.Clean(mfs.config.mountpoint)
+		if len(mountpoint) <= longest {
+			continue
+		}
+		if p == mountpoint {
+			found, longest, rel = mfs, len(mountpoint), ""
+		} else if strings.HasPrefix(p, strings.TrimSuffix(mountpoint, "/")+"/") {
+			found, longest, rel = mfs, len(mountpoint), strings.TrimPrefix(p, strings.TrimSuffix(mountpoint, "/")+"/")
+		}
+	}
+	return found, rel
+}
+
+// close stops listening and removes the socket.
+func (s *controlServer) close() {
+	s.l.Close()
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		s.log.Warn("Unable to remove the control socket", F("path", s.path), F("error", err))
+	}
+}
+
+// ControlSockets returns the control sockets of the processes of the user.
+func ControlSockets() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(ControlDir(), "*.sock"))
+	sort.Strings(paths)
+	return paths, err
+}
+
+// QueryControl sends req to the control socket at path. Nothing listens
+// on the sockets of processes which are gone, these are removed and
+// ErrStaleSocket is returned.
+func QueryControl(path string, req ControlRequest) (ControlResponse, error) {
+	var resp ControlResponse
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		if pid, perr := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".sock")); perr == nil && !processAlive(pid) {
+			os.Remove(path)
+			return resp, ErrStaleSocket
+		}
+		return resp, err
+	}
+	defer conn.Close()
+
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return resp, err
+	}
+	if err = json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		return resp, err
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// ErrStaleSocket is returned by QueryControl for sockets of processes
+// which are gone.
+var ErrStaleSocket = errors.New("Control socket of a process which is gone")
+
+// processAlive tells if the process pid exists.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
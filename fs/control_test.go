@@ -0,0 +1,103 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// queryTestControl sends req to the control server of the mounts over a
+// pipe, like QueryControl.
+func queryTestControl(t *testing.T, req ControlRequest, mounts ...*testMount) ControlResponse {
+	t.Helper()
+
+	s := &controlServer{log: mounts[0].log, mounts: func() []*MinFS {
+		var mfss []*MinFS
+		for _, m := range mounts {
+			mfss = append(mfss, m.MinFS)
+		}
+		return mfss
+	}}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handle(server)
+
+	if err := json.NewEncoder(client).Encode(req); err != nil {
+		t.Fatal(err)
+	}
+	var resp ControlResponse
+	if err := json.NewDecoder(bufio.NewReader(client)).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestControlCompact(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+
+	m := newTestMount(t, s3, t.TempDir())
+	memory := newTestMount(t, s3, t.TempDir(), MetaStore("memory"))
+
+	// churn leaves unused pages behind
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("file-%d", i)
+		m.writeFile(name, []byte(strings.Repeat("x", i)))
+		if i%2 == 0 {
+			if err := m.remove(name, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	resp := queryTestControl(t, ControlRequest{Command: "compact", Path: filepath.Join(m.config.mountpoint, "file-1")}, m, memory)
+	if resp.Error != "" {
+		t.Fatalf("expected the meta DB to be compacted, got %s", resp.Error)
+	}
+	if resp.Compacted == nil || resp.Compacted.Before <= 0 || resp.Compacted.After <= 0 || resp.Compacted.After > resp.Compacted.Before {
+		t.Fatalf("expected the sizes before and after compacting, got %+v", resp.Compacted)
+	}
+	if len(resp.Mounts) != 1 || resp.Mounts[0].Mountpoint != m.config.mountpoint {
+		t.Errorf("expected the status of the compacted mount, got %+v", resp.Mounts)
+	}
+
+	// the meta data is kept, and the mount keeps working
+	if got := m.readFile("file-3"); string(got) != "xxx" {
+		t.Errorf("expected xxx after compacting, got %q", got)
+	}
+	if _, err := m.lookup("file-2"); err == nil {
+		t.Errorf("expected file-2 to stay removed after compacting")
+	}
+	m.writeFile("after", []byte("after"))
+
+	resp = queryTestControl(t, ControlRequest{Command: "compact", Path: memory.config.mountpoint}, m, memory)
+	if resp.Error == "" || resp.Compacted != nil {
+		t.Errorf("expected compacting the memory store to fail, got %+v", resp)
+	}
+
+	resp = queryTestControl(t, ControlRequest{Command: "compact", Path: "/elsewhere"}, m, memory)
+	if !strings.HasPrefix(resp.Error, "No mount") {
+		t.Errorf("expected no mount of /elsewhere, got %+v", resp)
+	}
+}
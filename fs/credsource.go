@@ -0,0 +1,215 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// credentialsTimeout bounds a keyring lookup or a run of the
+	// credential helper, which might wait for the keyring to be unlocked.
+	credentialsTimeout = 30 * time.Second
+
+	// credentialsRefresh is how long before they expire credentials of
+	// the helper are retrieved again.
+	credentialsRefresh = time.Minute
+)
+
+// sourcedCredentials are the credentials retrieved from the credential
+// source of the mount.
+type sourcedCredentials struct {
+	accessKey, secretKey, secretToken secret
+
+	// zero if they don't expire
+	expiry time.Time
+}
+
+// stale returns true if the credentials expire within the refresh time.
+func (c *sourcedCredentials) stale() bool {
+	return !c.expiry.IsZero() && time.Until(c.expiry) < credentialsRefresh
+}
+
+// helperCredentials are written by the credential helper to stdout, like
+// those of docker credential helpers, Username being the access key.
+type helperCredentials struct {
+	Username     string
+	Secret       string
+	SessionToken string    `json:",omitempty"`
+	Expiry       time.Time `json:",omitempty"`
+}
+
+// parseCredentialSource splits keyring:<service>/<account> and
+// helper:<command> into the kind and the rest.
+func parseCredentialSource(source string) (kind, rest string, err error) {
+	i := strings.Index(source, ":")
+	if i > 0 {
+		kind, rest = source[:i], source[i+1:]
+	}
+	switch {
+	case kind == "keyring" && strings.Index(rest, "/") > 0 && !strings.HasSuffix(rest, "/"):
+		return kind, rest, nil
+	case kind == "helper" && rest != "":
+		return kind, rest, nil
+	}
+	return "", "", fmt.Errorf("Credentials %s must be keyring:<service>/<account> or helper:<command>", source)
+}
+
+// retrieveCredentials returns the credentials of source for the target.
+func retrieveCredentials(source, target string) (*sourcedCredentials, error) {
+	kind, rest, err := parseCredentialSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), credentialsTimeout)
+	defer cancel()
+
+	if kind == "keyring" {
+		i := strings.Index(rest, "/")
+		return keyringCredentials(ctx, rest[:i], rest[i+1:])
+	}
+	return helperCredentialsOf(ctx, rest, target)
+}
+
+// keyringCredentials reads the secret key of the access key account from
+// the OS keyring, the Secret Service by secret-tool of libsecret on Linux
+// and the Keychain by security on macOS.
+func keyringCredentials(ctx context.Context, service, account string) (*sourcedCredentials, error) {
+	var args []string
+	switch runtime.GOOS {
+	case "linux":
+		args = []string{"secret-tool", "lookup", "service", service, "account", account}
+	case "darwin":
+		args = []string{"security", "find-generic-password", "-s", service, "-a", account, "-w"}
+	default:
+		return nil, fmt.Errorf("No OS keyring is supported on %s, use a credential helper", runtime.GOOS)
+	}
+
+	out, err := runCredentialCommand(ctx, "Keyring", args, "")
+	if err != nil {
+		return nil, err
+	}
+	secretKey := strings.TrimRight(string(out), "\r\n")
+	if secretKey == "" {
+		return nil, fmt.Errorf("Keyring has no secret for service %s and account %s", service, account)
+	}
+	return &sourcedCredentials{accessKey: secret(account), secretKey: secret(secretKey)}, nil
+}
+
+// helperCredentialsOf runs the credential helper command with get, the
+// target URL on stdin, and reads the credentials from its stdout.
+func helperCredentialsOf(ctx context.Context, command, target string) (*sourcedCredentials, error) {
+	out, err := runCredentialCommand(ctx, "Credential helper", []string{command, "get"}, target+"\n")
+	if err != nil {
+		return nil, err
+	}
+
+	var hc helperCredentials
+	if err = json.Unmarshal(out, &hc); err != nil {
+		return nil, fmt.Errorf("Credential helper %s returned invalid credentials: %s", command, err)
+	}
+	if hc.Username == "" || hc.Secret == "" {
+		return nil, fmt.Errorf("Credential helper %s returned no Username or Secret", command)
+	}
+	return &sourcedCredentials{
+		accessKey:   secret(hc.Username),
+		secretKey:   secret(hc.Secret),
+		secretToken: secret(hc.SessionToken),
+		expiry:      hc.Expiry,
+	}, nil
+}
+
+// runCredentialCommand runs args with stdin and returns its stdout. A
+// missing program and a failing one, for a locked keyring or a refused
+// request, are told apart by the error.
+func runCredentialCommand(ctx context.Context, what string, args []string, stdin string) ([]byte, error) {
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s %s not found: %s", what, args[0], err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args[1:]...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s %s timed out after %s", what, args[0], credentialsTimeout)
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			// docker credential helpers report errors on stdout
+			msg = strings.TrimSpace(stdout.String())
+		}
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("%s %s denied access: %s", what, args[0], msg)
+	}
+	return stdout.Bytes(), nil
+}
+
+// sourcedCredentials returns the credentials of the credential source of
+// cfg, retrieved again once cfg was reloaded or they are about to expire.
+func (mfs *MinFS) sourcedCredentials(cfg *Config) (*Config, error) {
+	if cfg.sourced != nil && !cfg.sourced.stale() {
+		return cfg, nil
+	}
+
+	mfs.credentialsM.Lock()
+	defer mfs.credentialsM.Unlock()
+
+	// another request might have retrieved them meanwhile
+	if cur := mfs.cfg(); cur.credentialSource == cfg.credentialSource && cur.sourced != nil && !cur.sourced.stale() {
+		return cur, nil
+	}
+
+	target := cfg.target.Scheme + "://" + cfg.target.Host
+	creds, err := retrieveCredentials(cfg.credentialSource, target)
+	if err != nil {
+		return nil, err
+	}
+
+	mfs.reloadM.Lock()
+	defer mfs.reloadM.Unlock()
+
+	cur := mfs.cfg()
+	if cur.credentialSource != cfg.credentialSource {
+		return nil, errors.New("Credential source changed by a reload meanwhile")
+	}
+	next := *cur
+	next.sourced = creds
+	mfs.live.Store(&next)
+	mfs.log.setFormat(next.logFormat, mfs.scrubber())
+
+	fields := []Field{F("source", cfg.credentialSource)}
+	if !creds.expiry.IsZero() {
+		fields = append(fields, F("expiry", creds.expiry))
+	}
+	mfs.log.Info("Credentials retrieved", fields...)
+	return &next, nil
+}
@@ -0,0 +1,202 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	daemon "github.com/sevlyar/go-daemon"
+)
+
+// daemonReadyEnv is the unix socket the child of a background mount
+// reports on, once it's serving or has failed.
+const daemonReadyEnv = "_MINFS_READY_SOCKET"
+
+const (
+	daemonReadyMsg = "ready"
+	daemonErrorMsg = "error: "
+)
+
+// daemonReported is set once the child reported to its parent.
+var daemonReported sync.Once
+
+// daemonReport sends msg to the parent of a background mount, which exits
+// then. Only the first report is sent.
+func daemonReport(msg string) {
+	socket := os.Getenv(daemonReadyEnv)
+	if socket == "" {
+		return
+	}
+
+	daemonReported.Do(func() {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintln(conn, msg)
+	})
+}
+
+// readyFDReported is set once the ready fd was written or closed.
+var readyFDReported sync.Once
+
+// reportReadyFD writes a line to the ready fd if the mount is ready, and
+// closes it. The child of a background mount doesn't inherit the fd, its
+// parent reports once the child did.
+func reportReadyFD(fd int, ready bool) {
+	if fd == 0 || daemon.WasReborn() {
+		return
+	}
+
+	readyFDReported.Do(func() {
+		f := os.NewFile(uintptr(fd), "ready-fd")
+		defer f.Close()
+		if ready {
+			fmt.Fprintln(f, daemonReadyMsg)
+		}
+	})
+}
+
+// daemonReady tells the parent that the mount is serving, the mounts of
+// a group once all are serving or failed.
+func (mfs *MinFS) daemonReady() {
+	if mfs.group != nil {
+		mfs.group.mounted(mfs, nil)
+		return
+	}
+	daemonReport(daemonReadyMsg)
+	reportReadyFD(mfs.config.readyFD, true)
+}
+
+// daemonExited tells the parent why the mount failed, unless it's been
+// told that it's serving already.
+func (mfs *MinFS) daemonExited(err error) {
+	reportReadyFD(mfs.config.readyFD, false)
+	if err == nil {
+		err = errors.New("Unmounted before serving")
+	}
+	// the message is a single line
+	daemonReport(daemonErrorMsg + strings.Replace(mfs.scrub(err.Error()), "\n", " ", -1))
+}
+
+// daemonContext returns the context of the background mount, its output
+// goes to the log file if there is one.
+func (mfs *MinFS) daemonContext() *daemon.Context {
+	ctx := &daemon.Context{
+		PidFileName: mfs.config.pidFile,
+		PidFilePerm: 0644,
+		LogFilePerm: 0640,
+		WorkDir:     "./",
+		Umask:       027,
+		Args:        os.Args,
+	}
+	if strings.HasPrefix(mfs.config.logTarget, "file:") {
+		ctx.LogFileName = strings.TrimPrefix(mfs.config.logTarget, "file:")
+	}
+	return ctx
+}
+
+// startDaemon starts the child serving the mount detached from the
+// terminal, and waits until it serves or fails.
+func (mfs *MinFS) startDaemon(ctx *daemon.Context) (err error) {
+	defer func() {
+		reportReadyFD(mfs.config.readyFD, err == nil)
+	}()
+
+	dir, err := ioutil.TempDir("", "minfs")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "ready.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	ctx.Env = append(os.Environ(), daemonReadyEnv+"="+socket)
+	child, err := ctx.Reborn()
+	if err != nil {
+		return fmt.Errorf("Unable to start minfs in the background %s", err)
+	}
+
+	reported := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		msg, _ := bufio.NewReader(conn).ReadString('\n')
+		reported <- strings.TrimSuffix(msg, "\n")
+	}()
+
+	exited := make(chan error, 1)
+	go func() {
+		state, err := child.Wait()
+		if err == nil && !state.Success() {
+			err = errors.New(state.String())
+		}
+		exited <- err
+	}()
+
+	select {
+	case msg := <-reported:
+		if msg == daemonReadyMsg {
+			mfs.log.Info("Serving in the background", F("pid", child.Pid), F("mountpoint", mfs.config.mountpoint))
+			return nil
+		}
+		return errors.New(strings.TrimPrefix(msg, daemonErrorMsg))
+	case err := <-exited:
+		// exited without a word, e.g. killed
+		if err != nil {
+			return fmt.Errorf("Background minfs exited before serving: %s", err)
+		}
+		return errors.New("Background minfs exited before serving")
+	}
+}
+
+// writePidFile writes the pid of the process to the pid file, if set.
+func (mfs *MinFS) writePidFile() error {
+	if mfs.config.pidFile == "" {
+		return nil
+	}
+	return ioutil.WriteFile(mfs.config.pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// removePidFile removes the pid file, if set.
+func (mfs *MinFS) removePidFile() {
+	if mfs.config.pidFile == "" {
+		return
+	}
+	if err := os.Remove(mfs.config.pidFile); err != nil && !os.IsNotExist(err) {
+		mfs.log.Warn("Unable to remove the pid file", F("path", mfs.config.pidFile), F("error", err))
+	}
+}
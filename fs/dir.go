@@ -21,6 +21,8 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"bazil.org/fuse"
@@ -55,15 +57,51 @@ type Dir struct {
 	Crtime   time.Time
 	Flags    uint32 // see chflags(2)
 
-	scanned bool
+	// LocalOnly is set on directories created on scratch mounts, their
+	// remote prefix isn't listed.
+	LocalOnly bool
+
+	// scanned is set with the time of the listing once the dir is listed,
+	// partial is set if entries of the listing were evicted since
+	scanned    bool
+	scannedAt  time.Time
+	scannedGen uint64
+	partial    bool
+}
+
+// Lookups can use a listing with evicted entries, full listings can't.
+func (dir *Dir) needsScan(full bool) bool {
+	if !dir.scanned || dir.mfs.listingExpired(dir.scannedAt) {
+		return true
+	}
+	return full && (dir.partial || dir.scannedGen != atomic.LoadUint64(&dir.mfs.evictGen))
+}
+
+// markScanned records the dir is listed by the listing at time t.
+func (dir *Dir) markScanned(t time.Time, partial bool) {
+	dir.scanned, dir.scannedAt, dir.partial = true, t, partial
+	dir.scannedGen = atomic.LoadUint64(&dir.mfs.evictGen)
 }
 
-func (dir *Dir) needsScan() bool {
-	return !dir.scanned
+// listingExpired returns true if a listing of the time is older than the
+// directory TTL, or from before the mount.
+func (mfs *MinFS) listingExpired(t time.Time) bool {
+	if !t.After(mfs.started) {
+		return true
+	}
+	ttl := mfs.cfg().dirTTL
+	return ttl > 0 && time.Since(t) > ttl
+}
+
+// Forget lets go of the dir node, the kernel has no references left.
+func (dir *Dir) Forget() {
+	dir.mfs.forgetDir(dir)
 }
 
 // Attr returns the attributes for the directory
 func (dir *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
+	defer dir.mfs.config.reportedAttr(a)
+
 	*a = fuse.Attr{
 		Inode:  dir.Inode,
 		Size:   dir.Size,
@@ -71,7 +109,7 @@ func (dir *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 		Mtime:  dir.Mtime,
 		Ctime:  dir.Chgtime,
 		Crtime: dir.Crtime,
-		Mode:   dir.Mode,
+		Mode:   dir.mode(),
 		Uid:    dir.UID,
 		Gid:    dir.GID,
 		Flags:  dir.Flags,
@@ -80,31 +118,91 @@ func (dir *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 	return nil
 }
 
-// Lookup returns the file node, and scans the current dir if necessary
-func (dir *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	if err := dir.scan(ctx); err != nil {
+// Setattr keeps the times and the chflags(2) flags of the directory, set
+// by Finder on macOS, other attributes aren't changed.
+func (dir *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	defer mapErrno(&err)
+
+	dir.mfs.opPath(ctx, dir.FullPath())
+	if err := dir.mfs.denyWrite(dir.BucketName()); err != nil {
+		return err
+	}
+
+	if req.Valid.Atime() {
+		dir.Atime = req.Atime
+	}
+	if req.Valid.Mtime() {
+		dir.Mtime = req.Mtime
+	}
+	if req.Valid.Chgtime() {
+		dir.Chgtime = req.Chgtime
+	}
+	if req.Valid.Crtime() {
+		dir.Crtime = req.Crtime
+	}
+	if req.Valid.Bkuptime() {
+		dir.Bkuptime = req.Bkuptime
+	}
+	if req.Valid.Flags() {
+		dir.Flags = req.Flags
+	}
+
+	// the root isn't stored
+	if dir.dir == nil {
+		return nil
+	}
+	return dir.mfs.update(ctx, func(tx *meta.Tx) error {
+		return dir.store(tx)
+	})
+}
+
+// Lookup returns the node of the entry, which the kernel caches for
+// entry-timeout.
+func (dir *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (_ fs.Node, err error) {
+	defer mapErrno(&err)
+
+	resp.EntryValid = dir.mfs.config.entryTimeout
+	return dir.lookup(ctx, req.Name)
+}
+
+// lookup returns the file node, and scans the current dir if necessary
+func (dir *Dir) lookup(ctx context.Context, name string) (fs.Node, error) {
+	dir.mfs.opPath(ctx, path.Join(dir.FullPath(), name))
+
+	if dir.isStatusDir(name) {
+		return &statusDir{mfs: dir.mfs}, nil
+	}
+
+	if err := dir.scan(ctx, false); err != nil {
 		return nil, err
 	}
 
 	// we are not statting each object here because of performance reasons
 	var o interface{} // meta.Object
-	if err := dir.mfs.db.View(func(tx *meta.Tx) error {
-		b := dir.bucket(tx)
-		return b.Get(name, &o)
+	if err := dir.mfs.view(ctx, func(tx *meta.Tx) error {
+		return dir.readBucket(tx).Get(name, &o)
 	}); err == nil {
-	} else if meta.IsNoSuchObject(err) {
-		return nil, fuse.ENOENT
+	} else if isNotFound(err) {
+		return dir.lookupEvicted(ctx, name)
 	} else if err != nil {
 		return nil, err
 	}
 
+	if dir.hiddenEntry(name, o) {
+		return nil, fuse.ENOENT
+	}
+
 	if file, ok := o.(File); ok {
 		file.mfs = dir.mfs
 		file.dir = dir
+		if err := file.touch(); err != nil {
+			return nil, err
+		}
 		return &file, nil
 	} else if subdir, ok := o.(Dir); ok {
 		subdir.mfs = dir.mfs
 		subdir.dir = dir
+		dir.mfs.trackDir(&subdir)
 		return &subdir, nil
 	}
 
@@ -113,9 +211,31 @@ func (dir *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 
 // RemotePath returns the full path including parent paths for current dir on the remote
 func (dir *Dir) RemotePath() string {
+	if dir.mfs.config.multiBucket() {
+		// The first path element is the bucket.
+		parts := strings.SplitN(dir.FullPath(), "/", 2)
+		if len(parts) < 2 {
+			return ""
+		}
+		return parts[1]
+	}
 	return path.Join(dir.mfs.config.basePath, dir.FullPath())
 }
 
+// BucketName returns the remote bucket the current dir is stored in,
+// for the root of a multi bucket mount this is empty.
+func (dir *Dir) BucketName() string {
+	if !dir.mfs.config.multiBucket() {
+		return dir.mfs.config.bucket
+	}
+	return strings.SplitN(dir.FullPath(), "/", 2)[0]
+}
+
+// isBucketRoot returns true if the dir lists buckets instead of objects.
+func (dir *Dir) isBucketRoot() bool {
+	return dir.dir == nil && dir.mfs.config.multiBucket()
+}
+
 // FullPath returns the full path including parent paths for current dir
 func (dir *Dir) FullPath() string {
 	fullPath := ""
@@ -135,14 +255,25 @@ func (dir *Dir) FullPath() string {
 }
 
 func (dir *Dir) storeFile(bucket *meta.Bucket, tx *meta.Tx, baseKey string, objInfo minio.ObjectInfo) error {
+	// local changes of scratch mounts aren't replaced by the remote
+	if dir.mfs.shadowed(tx, path.Join(dir.FullPath(), baseKey)) {
+		return nil
+	}
+
 	var f File
 	err := bucket.Get(baseKey, &f)
 	if err == nil {
+		// the local content of a pending upload replaces the object
+		if _, ok := dir.mfs.pendingTx(tx, path.Join(dir.FullPath(), baseKey)); ok {
+			return nil
+		}
+
 		// Object already exists and accessible, update values as needed.
 		f.dir = dir
 		f.mfs = dir.mfs
 		f.Size = uint64(objInfo.Size)
 		f.ETag = objInfo.ETag
+		f.LastModified = objInfo.LastModified
 		if objInfo.LastModified.After(f.Chgtime) {
 			f.Chgtime = objInfo.LastModified
 		}
@@ -155,10 +286,13 @@ func (dir *Dir) storeFile(bucket *meta.Bucket, tx *meta.Tx, baseKey string, objI
 		if objInfo.LastModified.After(f.Atime) {
 			f.Atime = objInfo.LastModified
 		}
-	} else if meta.IsNoSuchObject(err) {
+		if err = f.store(tx); err != nil {
+			return err
+		}
+	} else if isNotFound(err) {
 		// Object not found, allocate a new inode.
 		var seq uint64
-		seq, err = dir.mfs.NextSequence(tx)
+		seq, err = dir.mfs.inode(tx, path.Join(dir.FullPath(), baseKey))
 		if err != nil {
 			return err
 		}
@@ -175,6 +309,8 @@ func (dir *Dir) storeFile(bucket *meta.Bucket, tx *meta.Tx, baseKey string, objI
 			Mtime:   objInfo.LastModified,
 			Atime:   objInfo.LastModified,
 			ETag:    objInfo.ETag,
+
+			LastModified: objInfo.LastModified,
 		}
 		if err = f.store(tx); err != nil {
 			return err
@@ -185,16 +321,20 @@ func (dir *Dir) storeFile(bucket *meta.Bucket, tx *meta.Tx, baseKey string, objI
 }
 
 func (dir *Dir) storeDir(bucket *meta.Bucket, tx *meta.Tx, baseKey string, objInfo minio.ObjectInfo) error {
+	if dir.mfs.shadowed(tx, path.Join(dir.FullPath(), baseKey)) {
+		return nil
+	}
+
 	var d Dir
 	err := bucket.Get(baseKey, &d)
 	if err == nil {
 		// Prefix already exists and accessible, update values as needed.
 		d.dir = dir
 		d.mfs = dir.mfs
-	} else if meta.IsNoSuchObject(err) {
+	} else if isNotFound(err) {
 		// Prefix not found allocate a new inode and create a new directory.
 		var seq uint64
-		seq, err = dir.mfs.NextSequence(tx)
+		seq, err = dir.mfs.inode(tx, path.Join(dir.FullPath(), baseKey))
 		if err != nil {
 			return err
 		}
@@ -219,9 +359,27 @@ func (dir *Dir) storeDir(bucket *meta.Bucket, tx *meta.Tx, baseKey string, objIn
 	return err
 }
 
-func (dir *Dir) scan(ctx context.Context) error {
-	if !dir.needsScan() {
-		return nil
+// scanBuckets populates the root of a multi bucket mount with a
+// directory for every mounted bucket. Each bucket directory has its own
+// meta bucket, which keeps the paths of different buckets apart.
+func (dir *Dir) scanBuckets(ctx context.Context) error {
+	var buckets []minio.BucketInfo
+	if dir.mfs.config.allBuckets() {
+		var err error
+		done := dir.mfs.opRemote(ctx, "ListBuckets")
+		buckets, err = dir.mfs.api.ListBucketsWithContext(ctx)
+		done()
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, name := range dir.mfs.config.buckets {
+			buckets = append(buckets, minio.BucketInfo{Name: name})
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
 	tx, err := dir.mfs.db.Begin(true)
@@ -233,88 +391,298 @@ func (dir *Dir) scan(ctx context.Context) error {
 
 	b := dir.bucket(tx)
 
-	objects := map[string]interface{}{}
-
-	// we'll compare the current bucket contents against our cache folder, and update the cache
+	stale := map[string]bool{}
 	if err := b.ForEach(func(k string, o interface{}) error {
-		if k[len(k)-1] != '/' {
-			objects[k] = &o
-		}
+		stale[k] = true
 		return nil
 	}); err != nil {
 		return err
 	}
 
+	for _, bucketInfo := range buckets {
+		delete(stale, bucketInfo.Name)
+
+		if err := dir.storeDir(b, tx, bucketInfo.Name, minio.ObjectInfo{
+			LastModified: bucketInfo.CreationDate,
+		}); err != nil {
+			return err
+		}
+	}
+
+	// cache housekeeping
+	for k := range stale {
+		b.Delete(k)
+		b.DeleteBucket(k + "/")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	dir.markScanned(time.Now().UTC(), false)
+	return nil
+}
+
+// listPageSize is the maximum number of entries fetched per listing request.
+const listPageSize = 1000
+
+// dirShards is the number of meta buckets the entries of directories
+// with more than a page of entries are spread across.
+const dirShards = 256
+
+// listing is the state of the remote listing of a directory, stored
+// in the meta bucket of the directory.
+type listing struct {
+	// Token is the continuation token of the next page to fetch.
+	Token string
+
+	// Complete is set when all pages have been fetched.
+	Complete bool
+	Time     time.Time
+
+	// Evicted is set when entries of the listing were evicted, these are
+	// looked up on the remote on access.
+	Evicted bool
+}
+
+// With full set the listing must have all entries, otherwise a listing
+// with evicted entries is sufficient.
+func (dir *Dir) scan(ctx context.Context, full bool) error {
+	if !dir.needsScan(full) {
+		return nil
+	}
+
+	// the remote doesn't have local-only directories
+	if dir.LocalOnly {
+		dir.markScanned(time.Now().UTC(), false)
+		return nil
+	}
+
+	if dir.isBucketRoot() {
+		return dir.scanBuckets(ctx)
+	}
+
+	var state listing
+	if err := dir.mfs.view(ctx, func(tx *meta.Tx) error {
+		return dir.readBucket(tx).GetMeta("listing", &state)
+	}); err != nil && !isNotFound(err) {
+		return err
+	}
+
+	// Listings completed during this mount are valid until the TTL.
+	if state.Complete && !dir.mfs.listingExpired(state.Time) && !(full && state.Evicted) {
+		dir.markScanned(state.Time, state.Evicted)
+		return nil
+	}
+
+	// an expired listing serves the lookups while the endpoint is
+	// unreachable
+	listed := state
+	if listed.Complete && !(full && listed.Evicted) && dir.mfs.unreachable() {
+		dir.markScanned(listed.Time, listed.Evicted)
+		return nil
+	}
+
+	// Stale entries can only be detected by a listing that started at
+	// the first page, a listing resumed from a cursor hasn't seen all keys
+	// and starts over once it reaches the last page.
+	if state.Complete {
+		state = listing{}
+	}
+	fromStart := state.Token == ""
+	seen := map[string]bool{}
+
 	prefix := dir.RemotePath()
 	if prefix != "" {
 		prefix = prefix + "/"
 	}
 
-	// The channel will abort the ListObjectsV2 request.
-	doneCh := make(chan struct{})
-	defer close(doneCh)
-
-	ch := dir.mfs.api.ListObjectsV2(dir.mfs.config.bucket, prefix, false, doneCh)
-
-loop:
-	for {
+	for !state.Complete {
 		select {
 		case <-ctx.Done():
-			break loop
-		case objInfo, ok := <-ch:
-			if !ok {
-				break loop
+			return fuse.EINTR
+		default:
+		}
+
+		// Only the immediate children and common prefixes are returned
+		// using the delimiter.
+		done := dir.mfs.opRemote(ctx, "ListObjects "+dir.BucketName()+"/"+prefix)
+		result, err := dir.mfs.listObjectsPage(dir.BucketName(), prefix, state.Token, listPageSize)
+		done()
+		if err != nil {
+			if listed.Complete && !(full && listed.Evicted) && dir.mfs.unreachable() {
+				dir.markScanned(listed.Time, listed.Evicted)
+				return nil
 			}
-			key := objInfo.Key[len(prefix):]
-			baseKey := path.Base(key)
+			return err
+		}
+
+		tx, err := dir.mfs.db.Begin(true)
+		if err != nil {
+			return err
+		}
 
-			// object still exists
-			objects[baseKey] = nil
+		b := dir.bucket(tx)
 
-			if strings.HasSuffix(key, "/") {
-				dir.storeDir(b, tx, baseKey, objInfo)
-			} else {
-				dir.storeFile(b, tx, baseKey, objInfo)
+		// unsharded buckets of huge directories are migrated on the
+		// next listing
+		if result.IsTruncated {
+			if err := b.Shard(dirShards); err != nil {
+				tx.Rollback()
+				return err
 			}
 		}
-	}
 
-	// cache housekeeping
-	for k, o := range objects {
-		if o == nil {
-			continue
+		for _, objInfo := range result.Contents {
+			baseKey := objInfo.Key[len(prefix):]
+			if baseKey == "" {
+				// the directory marker of the current dir
+				continue
+			}
+
+			// shadowed by the virtual status directory
+			if name, _ := dirMarker(baseKey); dir.isStatusDir(name) || dir.isStatusDir(baseKey) {
+				continue
+			}
+
+			if name, ok := dirMarker(baseKey); ok {
+				seen[name] = true
+				if err := dir.storeDir(b, tx, name, objInfo); err != nil {
+					tx.Rollback()
+					return err
+				}
+				continue
+			}
+
+			seen[baseKey] = true
+			if err := dir.storeFile(b, tx, baseKey, objInfo); err != nil {
+				tx.Rollback()
+				return err
+			}
 		}
 
-		// purge from cache
-		b.Delete(k)
+		for _, commonPrefix := range result.CommonPrefixes {
+			baseKey := strings.TrimSuffix(commonPrefix.Prefix[len(prefix):], "/")
+			if dir.isStatusDir(baseKey) {
+				continue
+			}
 
-		if _, ok := o.(Dir); !ok {
-			continue
+			seen[baseKey] = true
+			if err := dir.storeDir(b, tx, baseKey, minio.ObjectInfo{Key: commonPrefix.Prefix}); err != nil {
+				tx.Rollback()
+				return err
+			}
 		}
 
-		b.DeleteBucket(k + "/")
+		state.Token = result.Next
+		switch {
+		case result.IsTruncated:
+		case !fromStart:
+			// the pages before the cursor were listed by an earlier
+			// scan, the deletions among them are found from the start
+			state = listing{}
+			fromStart = true
+			seen = map[string]bool{}
+		default:
+			state = listing{
+				Complete: true,
+				Time:     time.Now().UTC(),
+			}
+
+			if err := dir.purgeUnseen(tx, b, seen); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+
+		if err := b.PutMeta("listing", state); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		_, commit := dir.mfs.startSpan(ctx, "meta.Commit")
+		err = tx.Commit()
+		commit.finish(err)
+		if err != nil {
+			return err
+		}
 	}
 
-	if err := tx.Commit(); err != nil {
+	dir.markScanned(state.Time, false)
+	return nil
+}
+
+// invalidateListing forces the next scan to list the remote again.
+func (dir *Dir) invalidateListing(tx *meta.Tx) error {
+	dir.scanned = false
+	return dir.bucket(tx).DeleteMeta("listing")
+}
+
+// purgeUnseen removes the cached entries which are not in seen, except
+// the entries created locally which aren't uploaded yet.
+func (dir *Dir) purgeUnseen(tx *meta.Tx, b *meta.Bucket, seen map[string]bool) error {
+	dirty := dir.mfs.dirtyPaths()
+
+	var stale []string
+	if err := b.ForEach(func(k string, o interface{}) error {
+		if seen[k] {
+			return nil
+		}
+
+		fullPath := path.Join(dir.FullPath(), k)
+		if _, pending := dir.mfs.pendingTx(tx, fullPath); pending || dirty[fullPath] || dir.mfs.shadowed(tx, fullPath) {
+			return nil
+		}
+		if _, ok := o.(Dir); ok && dir.mfs.hasLocalChanges(tx, fullPath, dirty) {
+			return nil
+		}
+
+		stale = append(stale, k)
+		return nil
+	}); err != nil {
 		return err
 	}
 
-	dir.scanned = true
+	// cache housekeeping
+	for _, k := range stale {
+		// purge from cache
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+		b.DeleteBucket(k + "/")
+		if err := dir.mfs.releaseInode(tx, path.Join(dir.FullPath(), k)); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // ReadDirAll will return all files in current dir
-func (dir *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	if err := dir.scan(ctx); err != nil {
+func (dir *Dir) ReadDirAll(ctx context.Context) (_ []fuse.Dirent, err error) {
+	defer mapErrno(&err)
+
+	dir.mfs.opPath(ctx, dir.FullPath())
+
+	if err := dir.scan(ctx, true); err != nil {
 		return nil, err
 	}
 
 	var entries = []fuse.Dirent{}
+	if dir.isStatusDir(statusDirName) {
+		entries = append(entries, fuse.Dirent{Inode: statusInode, Name: statusDirName, Type: fuse.DT_Dir})
+	}
 
 	// update cache folder with bucket list
-	if err := dir.mfs.db.View(func(tx *meta.Tx) error {
-		return dir.bucket(tx).ForEach(func(k string, o interface{}) error {
-			if file, ok := o.(File); ok {
+	if err := dir.mfs.view(ctx, func(tx *meta.Tx) error {
+		return dir.readBucket(tx).ForEach(func(k string, o interface{}) error {
+			// huge directories are read for a while
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if dir.isStatusDir(k) || dir.hiddenEntry(k, o) {
+				return nil
+			} else if file, ok := o.(File); ok {
 				file.dir = dir
 				entries = append(entries, file.Dirent())
 			} else if subdir, ok := o.(Dir); ok {
@@ -333,6 +701,15 @@ func (dir *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	return entries, nil
 }
 
+// readBucket returns the read-only meta bucket of the dir, for View
+// transactions.
+func (dir *Dir) readBucket(tx *meta.Tx) meta.ReadBucket {
+	if dir.dir == nil {
+		return tx.Bucket("minio/").ReadOnly()
+	}
+	return dir.dir.readBucket(tx).Bucket(dir.Path + "/")
+}
+
 func (dir *Dir) bucket(tx *meta.Tx) *meta.Bucket {
 	// Root folder.
 	if dir.dir == nil {
@@ -345,7 +722,46 @@ func (dir *Dir) bucket(tx *meta.Tx) *meta.Bucket {
 }
 
 // Mkdir will make a new directory below current dir
-func (dir *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+func (dir *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (_ fs.Node, err error) {
+	defer mapErrno(&err)
+
+	dir.mfs.opPath(ctx, path.Join(dir.FullPath(), req.Name))
+	defer func() {
+		dir.mfs.audit(AuditEvent{Op: "mkdir", Path: path.Join(dir.FullPath(), req.Name), Mode: req.Mode.String()}, &req.Header, err)
+	}()
+
+	// directories aren't kept local, Finder doesn't create any
+	if dir.isStatusDir(req.Name) || dir.mfs.filtered(req.Name) {
+		return nil, fuse.EPERM
+	}
+
+	if err := dir.mfs.denyWrite(dir.BucketName()); err != nil {
+		return nil, err
+	}
+
+	if dir.mfs.stopping() {
+		return nil, errStopping
+	}
+
+	if !dir.isBucketRoot() {
+		if err := dir.checkKey(req.Name, true); err != nil {
+			return nil, err
+		}
+	}
+
+	if dir.isBucketRoot() {
+		if !dir.mfs.config.bucketOps {
+			return nil, fuse.EPERM
+		}
+		if err := dir.mfs.api.MakeBucketWithContext(ctx, req.Name, ""); err != nil {
+			return nil, err
+		}
+	} else if dir.mfs.config.dirMarkers && !dir.mfs.config.scratch {
+		if err := dir.putDirMarker(ctx, req.Name); err != nil {
+			return nil, err
+		}
+	}
+
 	subdir := Dir{
 		dir: dir,
 		mfs: dir.mfs,
@@ -360,6 +776,8 @@ func (dir *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, err
 		Crtime:  time.Now(),
 		Mtime:   time.Now(),
 		Atime:   time.Now(),
+
+		LocalOnly: dir.mfs.config.scratch,
 	}
 
 	tx, err := dir.mfs.db.Begin(true)
@@ -369,6 +787,16 @@ func (dir *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, err
 
 	defer tx.Rollback()
 
+	if subdir.Inode, err = dir.mfs.inode(tx, subdir.FullPath()); err != nil {
+		return nil, err
+	}
+
+	if subdir.LocalOnly {
+		if err := dir.mfs.markLocal(tx, subdir.FullPath()); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := subdir.store(tx); err != nil {
 		return nil, err
 	}
@@ -378,42 +806,177 @@ func (dir *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, err
 		return nil, err
 	}
 
+	dir.mfs.trackDir(&subdir)
 	return &subdir, nil
 }
 
 // Remove will delete a file or directory from current directory
-func (dir *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	if err := dir.mfs.wait(path.Join(dir.FullPath(), req.Name)); err != nil {
+func (dir *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
+	defer mapErrno(&err)
+
+	dir.mfs.opPath(ctx, path.Join(dir.FullPath(), req.Name))
+	defer func() {
+		dir.mfs.audit(AuditEvent{Op: "remove", Path: path.Join(dir.FullPath(), req.Name)}, &req.Header, err)
+	}()
+
+	if err := dir.mfs.denyWrite(dir.BucketName()); err != nil {
 		return err
 	}
 
-	tx, err := dir.mfs.db.Begin(true)
+	if dir.isStatusDir(req.Name) || (dir.isBucketRoot() && (!req.Dir || !dir.mfs.config.bucketOps)) {
+		return fuse.EPERM
+	}
+
+	// removing an open file doesn't wait for it to be closed, its handles
+	// keep working until then
+	wait := dir.mfs.wait
+	if !req.Dir && len(dir.mfs.openHandles(path.Join(dir.FullPath(), req.Name))) > 0 {
+		wait = func(ctx context.Context, path string) (func(), error) {
+			return dir.mfs.turn(ctx, path)
+		}
+	}
+	done, err := wait(ctx, path.Join(dir.FullPath(), req.Name))
 	if err != nil {
 		return err
 	}
+	defer done()
 
-	defer tx.Rollback()
+	// directories are removed once empty, the remote may have children
+	// which weren't listed yet
+	if req.Dir && !dir.isBucketRoot() && !dir.mfs.config.scratch {
+		if err := dir.remoteEmpty(req.Name); err != nil {
+			return err
+		}
+	}
 
-	b := dir.bucket(tx)
+	var (
+		file    File
+		handles []*FileHandle
 
-	var o interface{}
-	if err := b.Get(req.Name, &o); meta.IsNoSuchObject(err) {
-		return fuse.ENOENT
-	} else if err != nil {
+		// entries of scratch mounts which may exist remotely are hidden
+		remote = true
+	)
+	if err := dir.mfs.update(ctx, func(tx *meta.Tx) error {
+		b := dir.bucket(tx)
+
+		var o interface{}
+		if err := b.Get(req.Name, &o); isNotFound(err) {
+			return fuse.ENOENT
+		} else if err != nil {
+			return err
+		}
+
+		if f, ok := o.(File); ok {
+			file = f
+			file.mfs = dir.mfs
+			file.dir = dir
+			if err := file.checkRetention(); err != nil {
+				return err
+			}
+			handles = dir.mfs.openHandles(file.FullPath())
+
+			// uploads finishing after the removal would bring the object back
+			if err := dir.mfs.cancelUploads(tx, file.FullPath(), file.BucketName(), file.RemotePath()); err != nil {
+				return err
+			}
+			remote = !file.LocalOnly || file.ETag != ""
+		} else if subdir, ok := o.(Dir); ok {
+			if !dir.isBucketRoot() {
+				if err := metaEmpty(b.Bucket(req.Name + "/")); err != nil {
+					return err
+				}
+			}
+			remote = !subdir.LocalOnly
+		}
+		return nil
+	}); err != nil {
 		return err
-	} else if err := b.Delete(req.Name); err != nil {
+	}
+
+	// The remote is updated outside of the transactions, so removals of
+	// the files of a directory are batched, see removeObject.
+	switch {
+	case dir.mfs.config.scratch:
+	case dir.isBucketRoot():
+		if err := dir.mfs.api.RemoveBucket(req.Name); err != nil {
+			return err
+		}
+	case req.Dir:
+		if remote {
+			if err := dir.mfs.removeObject(dir.BucketName(), path.Join(dir.RemotePath(), req.Name)+"/"); err != nil {
+				return err
+			}
+		}
+		if err := dir.removeHadoopMarker(req.Name); err != nil {
+			return err
+		}
+	case remote && len(handles) == 0:
+		// not for local Finder files, they only exist in the cache
+		if err := dir.mfs.removeObject(dir.BucketName(), path.Join(dir.RemotePath(), req.Name)); err != nil {
+			return err
+		}
+	}
+
+	if err := dir.mfs.update(ctx, func(tx *meta.Tx) error {
+		b := dir.bucket(tx)
+		if err := b.Delete(req.Name); err != nil {
+			return err
+		}
+		if req.Dir {
+			b.DeleteBucket(req.Name + "/")
+		}
+
+		if dir.mfs.config.scratch {
+			if err := dir.mfs.scratchRemove(tx, path.Join(dir.FullPath(), req.Name), remote); err != nil {
+				return err
+			}
+		}
+
+		// the remote confirmed the removal, or it's done at the last close
+		return dir.mfs.releaseInode(tx, path.Join(dir.FullPath(), req.Name))
+	}); err != nil {
 		return err
 	}
 
-	if req.Dir {
-		b.DeleteBucket(req.Name + "/")
+	if len(handles) > 0 {
+		dir.mfs.unlinkOpen(&file, handles, remote && !dir.mfs.config.scratch)
 	}
+	return nil
+}
+
+// errNotEmpty is returned when removing a directory with entries.
+var errNotEmpty = fuse.Errno(syscall.ENOTEMPTY)
 
-	if err := dir.mfs.api.RemoveObject(dir.mfs.config.bucket, path.Join(dir.RemotePath(), req.Name)); err != nil {
+// remoteEmpty returns ENOTEMPTY if the remote has objects below the
+// directory name other than its marker.
+func (dir *Dir) remoteEmpty(name string) error {
+	prefix := path.Join(dir.RemotePath(), name) + "/"
+
+	// the marker sorts first, a second key is a child
+	page, err := dir.mfs.listObjectsPage(dir.BucketName(), prefix, "", 2)
+	if err != nil {
 		return err
 	}
+	for _, objInfo := range page.Contents {
+		if objInfo.Key != prefix {
+			return errNotEmpty
+		}
+	}
+	if len(page.CommonPrefixes) > 0 {
+		return errNotEmpty
+	}
+	return nil
+}
 
-	return tx.Commit()
+// metaEmpty returns ENOTEMPTY if the meta bucket of a directory has
+// entries.
+func metaEmpty(b *meta.Bucket) error {
+	if b.InnerBucket == nil {
+		return nil
+	}
+	return b.ForEach(func(string, interface{}) error {
+		return errNotEmpty
+	})
 }
 
 // store the dir object in cache
@@ -438,10 +1001,40 @@ func (dir *Dir) Dirent() fuse.Dirent {
 
 // Create will return a new empty file in current dir, if the file is currently locked, it will
 // wait for the lock to be freed.
-func (dir *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
-	if err := dir.mfs.wait(path.Join(dir.FullPath(), req.Name)); err != nil {
+func (dir *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (_ fs.Node, _ fs.Handle, err error) {
+	defer mapErrno(&err)
+
+	dir.mfs.opPath(ctx, path.Join(dir.FullPath(), req.Name))
+	defer func() {
+		dir.mfs.audit(AuditEvent{Op: "create", Path: path.Join(dir.FullPath(), req.Name), Mode: req.Mode.String()}, &req.Header, err)
+	}()
+
+	if dir.isBucketRoot() || dir.isStatusDir(req.Name) {
+		return nil, nil, fuse.EPERM
+	}
+
+	if err := dir.mfs.denyWrite(dir.BucketName()); err != nil {
+		return nil, nil, err
+	}
+
+	local, err := dir.createFiltered(req.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := dir.checkKey(req.Name, false); err != nil {
+		return nil, nil, err
+	}
+
+	if dir.mfs.stopping() {
+		return nil, nil, errStopping
+	}
+
+	done, err := dir.mfs.wait(ctx, path.Join(dir.FullPath(), req.Name))
+	if err != nil {
 		return nil, nil, err
 	}
+	defer done()
 
 	tx, err := dir.mfs.db.Begin(true)
 	if err != nil {
@@ -458,7 +1051,10 @@ func (dir *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.
 	if gerr := b.Get(name, &f); gerr == nil {
 		f.mfs = dir.mfs
 		f.dir = dir
-	} else if i, nerr := dir.mfs.NextSequence(tx); nerr != nil {
+		if err := f.checkRetention(); err != nil {
+			return nil, nil, err
+		}
+	} else if i, nerr := dir.mfs.inode(tx, path.Join(dir.FullPath(), name)); nerr != nil {
 		return nil, nil, nerr
 	} else {
 		f = File{
@@ -468,7 +1064,8 @@ func (dir *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.
 			Size:    uint64(0),
 			Inode:   i,
 			Path:    req.Name,
-			Mode:    req.Mode, // dir.mfs.config.mode, // should we use same mode for scan?
+			Mode:    req.Mode,
+			ModeSet: true,
 			UID:     dir.mfs.config.uid,
 			GID:     dir.mfs.config.gid,
 			Chgtime: time.Now().UTC(),
@@ -489,11 +1086,20 @@ func (dir *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.
 	if fh, err = dir.mfs.Acquire(&f); err != nil {
 		return nil, nil, err
 	}
-	fh.dirty = true
+	fh.setDirty(true)
+	fh.flags = req.Flags
 	if fh.cachePath, err = dir.mfs.NewCachePath(); err != nil {
 		return nil, nil, err
 	}
-	if fh.File, err = os.OpenFile(fh.cachePath, int(req.Flags), dir.mfs.config.mode); err != nil {
+	if fh.File, err = os.OpenFile(fh.cachePath, dir.mfs.config.cacheFileFlags(req.Flags), dir.mfs.config.mode); err != nil {
+		return nil, nil, err
+	}
+	if dir.mfs.config.scratch || local {
+		if err = f.setLocal(tx, fh.cachePath); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err = dir.mfs.journalTx(tx, fh); err != nil {
 		return nil, nil, err
 	}
 
@@ -501,13 +1107,57 @@ func (dir *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.
 	if err = tx.Commit(); err != nil {
 		return nil, nil, err
 	}
+	dir.mfs.forgetUnlinked(f.FullPath())
 
 	resp.Handle = fuse.HandleID(fh.handle)
+	resp.Flags |= dir.mfs.config.openFlags()
+	resp.EntryValid = dir.mfs.config.entryTimeout
 	return &f, fh, nil
 }
 
 // Rename will rename files
-func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node) error {
+func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node) (err error) {
+	defer mapErrno(&err)
+
+	dir.mfs.opPath(ctx, path.Join(dir.FullPath(), req.OldName))
+
+	if err := dir.mfs.denyWrite(dir.BucketName()); err != nil {
+		return err
+	}
+
+	newDir, ok := nd.(*Dir)
+	if !ok || dir.isStatusDir(req.OldName) || newDir.isStatusDir(req.NewName) {
+		return fuse.EPERM
+	}
+	defer func() {
+		dir.mfs.audit(AuditEvent{Op: "rename", Path: path.Join(dir.FullPath(), req.OldName), NewPath: path.Join(newDir.FullPath(), req.NewName)}, &req.Header, err)
+	}()
+
+	if dir.isBucketRoot() || newDir.isBucketRoot() {
+		return fuse.EPERM
+	}
+
+	// Objects can't be moved between buckets, let the caller fall back
+	// to copy and delete.
+	if dir.BucketName() != newDir.BucketName() {
+		return fuse.Errno(syscall.EXDEV)
+	}
+
+	// neither can objects become local Finder files or the other way
+	// round
+	if !dir.mfs.config.scratch && (dir.mfs.filtered(req.OldName) || dir.mfs.filtered(req.NewName)) {
+		if _, err := newDir.createFiltered(req.NewName); err != nil {
+			return err
+		}
+		return fuse.Errno(syscall.EXDEV)
+	}
+
+	done, err := dir.mfs.turn(ctx, path.Join(dir.FullPath(), req.OldName), path.Join(newDir.FullPath(), req.NewName))
+	if err != nil {
+		return err
+	}
+	defer done()
+
 	tx, err := dir.mfs.db.Begin(true)
 	if err != nil {
 		return err
@@ -517,13 +1167,20 @@ func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node)
 
 	b := dir.bucket(tx)
 
-	newDir := nd.(*Dir)
-
 	var o interface{}
 	if err := b.Get(req.OldName, &o); err != nil {
 		return err
 	} else if file, ok := o.(File); ok {
 		file.dir = dir
+		file.mfs = dir.mfs
+
+		if err := file.checkRetention(); err != nil {
+			return err
+		}
+
+		if err := newDir.checkKey(req.NewName, false); err != nil {
+			return err
+		}
 
 		if err := b.Delete(file.Path); err != nil {
 			return err
@@ -531,21 +1188,44 @@ func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node)
 
 		oldPath := file.RemotePath()
 
+		// scratch mounts move a local copy of the content, the old path
+		// is hidden
+		if dir.mfs.config.scratch {
+			remote := !file.LocalOnly || file.ETag != ""
+			if err := file.makeLocal(true); err != nil {
+				return err
+			}
+			if err := dir.mfs.scratchRemove(tx, file.FullPath(), remote); err != nil {
+				return err
+			}
+			file.ETag = ""
+		}
+
 		file.Path = req.NewName
 		file.dir = newDir
 		file.mfs = dir.mfs
 
-		sr := newMoveOp(oldPath, file.RemotePath())
-		if err := dir.mfs.sync(&sr); err == nil {
-		} else if meta.IsNoSuchObject(err) {
-			return fuse.ENOENT
-		} else if err != nil {
-			return err
+		if dir.mfs.config.scratch {
+			if err := dir.mfs.markLocal(tx, file.FullPath()); err != nil {
+				return err
+			}
+		} else {
+			sr := newMoveOp(dir.BucketName(), oldPath, file.RemotePath())
+			if err := dir.mfs.sync(&sr); err == nil {
+			} else if isNotFound(err) {
+				return fuse.ENOENT
+			} else if err != nil {
+				return err
+			}
+
+			// we'll wait for the request to be uploaded and synced, before
+			// releasing the file
+			if err := <-sr.Error; err != nil {
+				return err
+			}
 		}
 
-		// we'll wait for the request to be uploaded and synced, before
-		// releasing the file
-		if err := <-sr.Error; err != nil {
+		if err := dir.mfs.moveInodes(tx, path.Join(dir.FullPath(), req.OldName), file.FullPath()); err != nil {
 			return err
 		}
 
@@ -554,9 +1234,25 @@ func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node)
 		}
 
 	} else if subdir, ok := o.(Dir); ok {
+		// the caller copies and removes the entries of the directory
+		// instead
+		if dir.mfs.config.scratch {
+			return fuse.Errno(syscall.EXDEV)
+		}
+
+		// no object is moved unless all keys fit
+		if err := newDir.checkKey(req.NewName, true); err != nil {
+			return err
+		}
+		if err := dir.checkMovedKeys(path.Join(dir.RemotePath(), req.OldName), path.Join(newDir.RemotePath(), req.NewName)); err != nil {
+			return err
+		}
+
 		// rescan in case of abort / partial / failure
 		// this will repair the cache
-		dir.scanned = false
+		if err := dir.invalidateListing(tx); err != nil {
+			return err
+		}
 
 		if err := b.Delete(req.OldName); err != nil {
 			return err
@@ -566,7 +1262,9 @@ func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node)
 			return err
 		}
 
-		newDir.scanned = false
+		if err := newDir.invalidateListing(tx); err != nil {
+			return err
+		}
 
 		// fusebug?
 		// the cached node is still invalid, contains the old name
@@ -579,6 +1277,10 @@ func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node)
 		subdir.dir = newDir
 		subdir.mfs = dir.mfs
 
+		if err := dir.mfs.moveInodes(tx, path.Join(dir.FullPath(), req.OldName), subdir.FullPath()); err != nil {
+			return err
+		}
+
 		if err := subdir.store(tx); err != nil {
 			return err
 		}
@@ -588,7 +1290,7 @@ func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node)
 		doneCh := make(chan struct{})
 		defer close(doneCh)
 
-		ch := dir.mfs.api.ListObjectsV2(dir.mfs.config.bucket, oldPath+"/", true, doneCh)
+		ch := dir.mfs.listObjects(dir.BucketName(), oldPath+"/", doneCh)
 	loop:
 		for {
 			select {
@@ -600,10 +1302,14 @@ func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node)
 				}
 
 				newPath := path.Join(newDir.RemotePath(), req.NewName, message.Key[len(oldPath):])
+				if strings.HasSuffix(message.Key, "/") {
+					// keep directory markers
+					newPath += "/"
+				}
 
-				sr := newMoveOp(message.Key, newPath)
+				sr := newMoveOp(dir.BucketName(), message.Key, newPath)
 				if err := dir.mfs.sync(&sr); err == nil {
-				} else if meta.IsNoSuchObject(err) {
+				} else if isNotFound(err) {
 					return fuse.ENOENT
 				} else if err != nil {
 					return err
@@ -621,5 +1327,9 @@ func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node)
 	}
 
 	// Commit the transaction and check for error.
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	dir.mfs.forgetUnlinked(path.Join(newDir.FullPath(), req.NewName))
+	return nil
 }
@@ -0,0 +1,206 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+)
+
+// BenchmarkConcurrentStat looks up and stats the files of a directory
+// from several readers at once. The lookups take View transactions, which
+// don't wait for each other, the time per stat drops with the readers.
+// Run with go test -run - -bench ConcurrentStat ./fs.
+func BenchmarkConcurrentStat(b *testing.B) {
+	const files = 10000
+
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	for i := 0; i < files; i++ {
+		s3.put(testBucket, fmt.Sprintf("dir/file-%d", i), []byte("file"))
+	}
+
+	// the files are listed once, the lookups don't go remote afterwards
+	m := newTestMount(b, s3, b.TempDir(), ResyncInterval(time.Hour))
+	dir := m.dir("dir")
+	if _, err := dir.ReadDirAll(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, readers := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("readers-%d", readers), func(b *testing.B) {
+			var (
+				wg   sync.WaitGroup
+				errs = make(chan error, readers)
+			)
+			requests := s3.requests()
+			b.ResetTimer()
+			for r := 0; r < readers; r++ {
+				wg.Add(1)
+				go func(r int) {
+					defer wg.Done()
+					for i := r; i < b.N; i += readers {
+						node, err := dir.Lookup(context.Background(), &fuse.LookupRequest{Name: fmt.Sprintf("file-%d", i*7919%files)}, &fuse.LookupResponse{})
+						if err == nil {
+							err = node.Attr(context.Background(), &fuse.Attr{})
+						}
+						if err != nil {
+							errs <- err
+							return
+						}
+					}
+				}(r)
+			}
+			wg.Wait()
+			b.StopTimer()
+
+			close(errs)
+			for err := range errs {
+				b.Fatal(err)
+			}
+			if n := s3.requests() - requests; n != 0 {
+				b.Fatalf("expected the lookups to be answered from the meta DB, got %d requests", n)
+			}
+		})
+	}
+}
+
+// TestDirShardMigration grows a directory listed unsharded past a page of
+// entries, its bucket is sharded by the next listing and the entries
+// stored before are kept.
+func TestDirShardMigration(t *testing.T) {
+	const files = listPageSize + 100
+
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	for i := 0; i < 10; i++ {
+		s3.put(testBucket, fmt.Sprintf("dir/file-%d", i), []byte("file"))
+	}
+	s3.put(testBucket, "dir/sub/file", []byte("file"))
+
+	cache := t.TempDir()
+	m := newTestMount(t, s3, cache)
+	sharded := func(m *testMount, dir *Dir) bool {
+		var ok bool
+		if err := m.db.View(func(tx *meta.Tx) error {
+			ok = dir.bucket(tx).Sharded()
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	dir := m.dir("dir")
+	if _, err := dir.ReadDirAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if sharded(m, dir) {
+		t.Fatalf("expected the bucket of a small directory not to be sharded")
+	}
+	if _, err := m.lookup("dir/sub/file"); err != nil {
+		t.Fatal(err)
+	}
+	inode := m.inodeOf("dir/file-0")
+
+	for i := 10; i < files; i++ {
+		s3.put(testBucket, fmt.Sprintf("dir/file-%d", i), []byte("file"))
+	}
+
+	// the listing of the last mount is expired by the next one
+	m = m.remount()
+	dir = m.dir("dir")
+	entries, err := dir.ReadDirAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != files+1 {
+		t.Errorf("expected %d entries, got %d", files+1, len(entries))
+	}
+	if !sharded(m, dir) {
+		t.Fatalf("expected the bucket to be sharded by the truncated listing")
+	}
+
+	// the entries stored unsharded are found in the shards
+	if n := m.inodeOf("dir/file-0"); n != inode {
+		t.Errorf("expected file-0 to keep inode %d, got %d", inode, n)
+	}
+	requests := s3.requests()
+	for _, name := range []string{"dir/file-0", "dir/file-9", fmt.Sprintf("dir/file-%d", files-1), "dir/sub"} {
+		if _, err := m.lookup(name); err != nil {
+			t.Errorf("expected %s to be found, got %v", name, err)
+		}
+	}
+	if n := s3.requests() - requests; n != 0 {
+		t.Errorf("expected the lookups to be answered from the shards, got %d requests", n)
+	}
+	if got := m.readFile("dir/sub/file"); string(got) != "file" {
+		t.Errorf("expected the nested directory to be kept, got %q", got)
+	}
+}
+
+// TestDirResumedListing interrupts the listing of a directory after the
+// first page, an object of that page is removed before the listing is
+// resumed from the saved cursor, its entry is purged nonetheless.
+func TestDirResumedListing(t *testing.T) {
+	const files = listPageSize + 10
+
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	for i := 0; i < files; i++ {
+		s3.put(testBucket, fmt.Sprintf("dir/file-%04d", i), []byte("file"))
+	}
+
+	m := newTestMount(t, s3, t.TempDir())
+	s3.setIntercept(func(op string, w http.ResponseWriter, r *http.Request) bool {
+		if op != "ListObjectsV2" || r.URL.Query().Get("continuation-token") == "" {
+			return false
+		}
+		fakeError(w, http.StatusForbidden, "AccessDenied", "AccessDenied")
+		return true
+	})
+	dir := m.dir("dir")
+	if _, err := dir.ReadDirAll(context.Background()); err == nil {
+		t.Fatalf("expected the interrupted listing to fail")
+	}
+	s3.setIntercept(nil)
+
+	s3.remove(testBucket, "dir/file-0000")
+	entries, err := dir.ReadDirAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != files-1 {
+		t.Errorf("expected %d entries, got %d", files-1, len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Name == "file-0000" {
+			t.Errorf("expected the removed object to be purged by the resumed listing")
+		}
+	}
+	if _, err := m.lookup("dir/file-0000"); err != fuse.Errno(syscall.ENOENT) {
+		t.Errorf("expected the lookup of the removed object to fail with ENOENT, got %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/minio/minfs/meta"
+)
+
+const (
+	// dumpLockWait is how long the dump tries to take a lock before it
+	// skips the state guarded by it, which may be the cause of a hang.
+	dumpLockWait = 100 * time.Millisecond
+
+	// dumpTimeout is how long the dump waits for the meta DB.
+	dumpTimeout = 2 * time.Second
+)
+
+// tryLock takes m if it's released within dumpLockWait.
+func tryLock(m *sync.Mutex) bool {
+	deadline := time.Now().Add(dumpLockWait)
+	for !m.TryLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// withTimeout runs fn and returns false if it didn't finish within
+// dumpTimeout, fn keeps running in the background then.
+func withTimeout(fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(dumpTimeout):
+		return false
+	}
+}
+
+// startDump writes a dump of the internal state on SIGUSR1 until the
+// listener is done.
+func (mfs *MinFS) startDump() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+
+	go func() {
+		defer signal.Stop(sigCh)
+
+		for {
+			select {
+			case <-mfs.listenerDoneCh:
+				return
+			case <-sigCh:
+				mfs.writeDump()
+			}
+		}
+	}()
+}
+
+// writeDump writes the dump to the dump file, or to the log without one.
+func (mfs *MinFS) writeDump() {
+	var buf bytes.Buffer
+	mfs.dump(&buf)
+	dump := mfs.scrub(buf.String())
+
+	if mfs.config.dumpFile == "" {
+		mfs.log.Printf("State dump:\n%s", dump)
+		return
+	}
+
+	if err := ioutil.WriteFile(mfs.config.dumpFile, []byte(dump), 0600); err != nil {
+		mfs.log.Error("Unable to write the state dump", F("path", mfs.config.dumpFile), F("error", err))
+		return
+	}
+	mfs.log.Printf("State dump written to %s.\n", mfs.config.dumpFile)
+}
+
+// dump writes the open handles, the operations in flight and the locks
+// they wait for, the uploads, the cache usage and the meta DB stats. State
+// guarded by locks held for long is skipped.
+func (mfs *MinFS) dump(w io.Writer) {
+	fmt.Fprintf(w, "MinFS state at %s, mounted %s since %s\n", time.Now().UTC().Format(time.RFC3339), mfs.config.mountpoint, mfs.started.Format(time.RFC3339))
+
+	fmt.Fprintln(w, "\nOpen handles:")
+	if tryLock(&mfs.m) {
+		for _, fh := range mfs.handles {
+			if fh == nil {
+				continue
+			}
+			fmt.Fprintf(w, "  %d %s flags=%s dirty=%t cache=%s\n", fh.handle, fh.f.FullPath(), fh.flags, fh.dirty, fh.cachePath)
+		}
+		mfs.m.Unlock()
+	} else {
+		fmt.Fprintln(w, "  skipped, the handle table is locked")
+	}
+
+	fmt.Fprintln(w, "\nOperations in flight:")
+	if tryLock(&mfs.opsM) {
+		ops := make([]OpInfo, 0, len(mfs.ops))
+		for _, s := range mfs.ops {
+			ops = append(ops, s.info())
+		}
+		mfs.opsM.Unlock()
+
+		sort.Slice(ops, func(i, j int) bool { return ops[i].Since.Before(ops[j].Since) })
+		for _, op := range ops {
+			fmt.Fprintf(w, "  %d %s for %s path=%s remote=%s: %s\n", op.ID, op.Op, time.Since(op.Since).Round(time.Millisecond), op.Path, op.Remote, op.Request)
+		}
+	} else {
+		fmt.Fprintln(w, "  skipped, the operation table is locked")
+	}
+
+	fmt.Fprintln(w, "\nLocks and waiters:")
+	for i := range mfs.locks.stripes {
+		st := &mfs.locks.stripes[i]
+		if !tryLock(&st.m) {
+			fmt.Fprintf(w, "  stripe %d skipped, it's locked\n", i)
+			continue
+		}
+		for path, l := range st.paths {
+			holder := "none"
+			if l.holder != nil {
+				holder = fmt.Sprintf("%s since %s", l.holder.Holder, l.holder.Since.Format(time.RFC3339))
+			}
+			turn := ""
+			if l.owner != nil {
+				turn = ", an operation has its turn"
+			}
+			fmt.Fprintf(w, "  %s held by %s, %d waiting%s\n", path, holder, len(l.waiters), turn)
+		}
+		st.m.Unlock()
+	}
+
+	fmt.Fprintln(w, "\nUpload queue:")
+	if tryLock(&mfs.syncQueue.m) {
+		q := mfs.syncQueue
+		fmt.Fprintf(w, "  %d small and %d large queued, %d running on %d workers\n", len(q.small), len(q.large), q.running, q.general-q.retire+q.reservedN)
+		for key := range q.inflight {
+			fmt.Fprintf(w, "  uploading %s\n", key)
+		}
+		q.m.Unlock()
+	} else {
+		fmt.Fprintln(w, "  skipped, the queue is locked")
+	}
+
+	fmt.Fprintln(w, "\nUpload progress:")
+	if tryLock(&mfs.uploadsM) {
+		trackers := make([]*uploadTracker, 0, len(mfs.uploads))
+		for _, t := range mfs.uploads {
+			trackers = append(trackers, t)
+		}
+		mfs.uploadsM.Unlock()
+
+		for _, t := range trackers {
+			p := t.progress()
+			state := "running"
+			if p.Error != "" {
+				state = "failed: " + p.Error
+			} else if !p.Finished.IsZero() {
+				state = "finished"
+			}
+			fmt.Fprintf(w, "  %s/%s %d of %d bytes (%.0f%%) in %s, %s\n", p.Bucket, p.Object, p.Sent, p.Total, p.Percent(), p.Elapsed().Round(time.Millisecond), state)
+		}
+	} else {
+		fmt.Fprintln(w, "  skipped, the upload table is locked")
+	}
+
+	fmt.Fprintln(w, "\nPending uploads:")
+	var pending bytes.Buffer
+	if !withTimeout(func() {
+		mfs.db.View(func(tx *meta.Tx) error {
+			b := tx.Bucket(pendingBucket).ReadOnly()
+			return b.ForEach(func(k string, _ interface{}) error {
+				var p pendingUpload
+				if b.Get(k, &p) == nil {
+					fmt.Fprintf(&pending, "  %s %d bytes from %s, %d attempts, gave up=%t, next %s\n", k, p.Length, p.Source, p.Attempts, p.GaveUp, p.NextAttempt.Format(time.RFC3339))
+				}
+				return nil
+			})
+		})
+	}) {
+		fmt.Fprintln(w, "  skipped, the meta DB didn't respond")
+	} else {
+		w.Write(pending.Bytes())
+	}
+
+	fmt.Fprintln(w, "\nCache:")
+	fmt.Fprintf(w, "  %d bytes in %s\n", mfs.cacheBytes(), mfs.config.cache)
+
+	fmt.Fprintln(w, "\nMeta DB:")
+	var fragmentation float64
+	var size int64
+	var err error
+	if !withTimeout(func() {
+		fragmentation, size, err = mfs.db.Fragmentation()
+	}) {
+		fmt.Fprintln(w, "  skipped, the meta DB didn't respond")
+	} else if err != nil {
+		fmt.Fprintf(w, "  %s\n", err)
+	} else {
+		fmt.Fprintf(w, "  %d bytes, %.0f%% unused\n", size, fragmentation*100)
+	}
+}
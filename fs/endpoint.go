@@ -0,0 +1,86 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package minfs
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// parseEndpoint parses and validates the target URL, like
+// https://minio.internal:9000/bucket or http://[::1]:9000/bucket.
+func parseEndpoint(target string) (*url.URL, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("Target %s is not a valid URL: %s", target, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+	case "":
+		return nil, fmt.Errorf("Target %s has no scheme, use http:// or https://", target)
+	default:
+		return nil, fmt.Errorf("Target %s has unsupported scheme %s, use http or https", target, u.Scheme)
+	}
+
+	if u.User != nil {
+		return nil, fmt.Errorf("Target %s contains credentials, use the access-key and secret-key options", u.Redacted())
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("Target %s has no host", target)
+	}
+
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("Target %s has invalid port %s", target, port)
+		}
+	} else if strings.HasSuffix(u.Host, ":") {
+		return nil, fmt.Errorf("Target %s has an empty port", target)
+	}
+
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("Target %s can't have a query or fragment", target)
+	}
+
+	return u, nil
+}
+
+// endpointRegion returns the region of AWS S3 endpoints, like
+// s3.eu-west-1.amazonaws.com, other endpoints have their region looked up.
+func endpointRegion(u *url.URL) string {
+	host := u.Hostname()
+	if net.ParseIP(host) != nil || !strings.HasSuffix(host, ".amazonaws.com") {
+		return ""
+	}
+
+	labels := strings.Split(strings.TrimSuffix(host, ".amazonaws.com"), ".")
+	for i, label := range labels {
+		switch {
+		case strings.HasPrefix(label, "s3-") && label != "s3-external-1":
+			return strings.TrimPrefix(label, "s3-")
+		case label == "s3" || label == "s3-fips" || label == "dualstack":
+			if i+1 < len(labels) && labels[i+1] != "dualstack" {
+				return labels[i+1]
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,292 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// S3 error classes, the causes of errors of FUSE operations
+const (
+	s3Timeout      = "timeout"
+	s3Connection   = "connection"
+	s3SlowDown     = "slowdown"
+	s3ServerError  = "server-error"
+	s3AccessDenied = "access-denied"
+	s3NotFound     = "not-found"
+	s3ClientError  = "client-error"
+)
+
+// classifyS3 returns the error class of an S3 request, empty if it
+// succeeded.
+func classifyS3(resp *http.Response, err error) string {
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() || err == context.DeadlineExceeded {
+			return s3Timeout
+		}
+		return s3Connection
+	}
+
+	switch code := resp.StatusCode; {
+	case code < 400:
+		return ""
+	case code == http.StatusServiceUnavailable:
+		return s3SlowDown
+	case code >= 500:
+		return s3ServerError
+	case code == http.StatusForbidden:
+		return s3AccessDenied
+	case code == http.StatusNotFound:
+		return s3NotFound
+	default:
+		return s3ClientError
+	}
+}
+
+// classifyMessage returns the S3 error class of the message of an error
+// returned by an operation, empty if it doesn't look like an S3 error.
+func classifyMessage(msg string) string {
+	switch lower := strings.ToLower(msg); {
+	case lower == "":
+		return ""
+	case strings.Contains(lower, "timeout"), strings.Contains(lower, "deadline exceeded"):
+		return s3Timeout
+	case strings.Contains(lower, "connection"), strings.Contains(lower, "no such host"), strings.Contains(lower, "eof"):
+		return s3Connection
+	case strings.Contains(lower, "reduce your request rate"), strings.Contains(lower, "slow down"):
+		return s3SlowDown
+	case strings.Contains(lower, "access denied"):
+		return s3AccessDenied
+	case strings.Contains(lower, "internal error"), strings.Contains(lower, "service unavailable"):
+		return s3ServerError
+	}
+	return ""
+}
+
+// counterMap is a set of counters created on first use, counted
+// atomically.
+type counterMap struct {
+	m sync.RWMutex
+	c map[[2]string]*uint64
+}
+
+func (cm *counterMap) inc(a, b string) {
+	key := [2]string{a, b}
+
+	cm.m.RLock()
+	c := cm.c[key]
+	cm.m.RUnlock()
+
+	if c == nil {
+		cm.m.Lock()
+		if c = cm.c[key]; c == nil {
+			if cm.c == nil {
+				cm.c = map[[2]string]*uint64{}
+			}
+			c = new(uint64)
+			cm.c[key] = c
+		}
+		cm.m.Unlock()
+	}
+	atomic.AddUint64(c, 1)
+}
+
+// snapshot returns the counts by the first and second key.
+func (cm *counterMap) snapshot() map[string]map[string]uint64 {
+	cm.m.RLock()
+	defer cm.m.RUnlock()
+
+	counts := map[string]map[string]uint64{}
+	for key, c := range cm.c {
+		if counts[key[0]] == nil {
+			counts[key[0]] = map[string]uint64{}
+		}
+		counts[key[0]][key[1]] = atomic.LoadUint64(c)
+	}
+	return counts
+}
+
+func (cm *counterMap) reset() {
+	cm.m.Lock()
+	cm.c = nil
+	cm.m.Unlock()
+}
+
+// errorCounters count the errors returned to the kernel and the S3
+// errors.
+type errorCounters struct {
+	// by FUSE operation and errno
+	ops counterMap
+	// by errno and the class of the S3 error causing it
+	causes counterMap
+	// by class and HTTP method
+	s3 counterMap
+}
+
+// ErrorStats are the counts of errors since the mount or the last reset.
+type ErrorStats struct {
+	// ByOp counts the errors returned to the kernel by FUSE operation and
+	// errno.
+	ByOp map[string]map[string]uint64
+
+	// ByCause counts the errors returned to the kernel by errno and the
+	// class of the S3 error they were mapped from.
+	ByCause map[string]map[string]uint64
+
+	// S3 counts the failed S3 requests by error class and method.
+	S3 map[string]map[string]uint64
+}
+
+func (ec *errorCounters) stats() ErrorStats {
+	return ErrorStats{
+		ByOp:    ec.ops.snapshot(),
+		ByCause: ec.causes.snapshot(),
+		S3:      ec.s3.snapshot(),
+	}
+}
+
+// ResetErrors sets the error counters to zero.
+func (mfs *MinFS) ResetErrors() {
+	mfs.errors.ops.reset()
+	mfs.errors.causes.reset()
+	mfs.errors.s3.reset()
+}
+
+// countError counts the error errno of the FUSE operation op, with the
+// class of the S3 error causing it.
+func (mfs *MinFS) countError(op, errno, cause string) {
+	mfs.errors.ops.inc(op, errno)
+	if cause != "" {
+		mfs.errors.causes.inc(errno, cause)
+	}
+}
+
+// errorTransport counts the failed S3 requests by error class, and
+// records the class as the cause of errors of the operation sending them.
+type errorTransport struct {
+	http.RoundTripper
+
+	mfs *MinFS
+}
+
+func (t *errorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+
+	if class := classifyS3(resp, err); class != "" {
+		t.mfs.errors.s3.inc(class, req.Method)
+
+		// a missing object is the answer to a lookup, not the
+		// cause of an error
+		if class != s3NotFound {
+			var requestID, hostID string
+			if resp != nil {
+				requestID, hostID = resp.Header.Get("X-Amz-Request-Id"), resp.Header.Get("X-Amz-Id-2")
+			}
+
+			t.mfs.opsM.Lock()
+			if s := opFromContext(req.Context()); s != nil {
+				s.cause, s.s3RequestID, s.s3HostID = class, requestID, hostID
+			}
+			if requestID != "" {
+				t.mfs.lastS3Failure = s3Failure{at: time.Now(), requestID: requestID, hostID: hostID}
+			}
+			t.mfs.opsM.Unlock()
+		}
+	}
+	return resp, err
+}
+
+// writeErrorMetrics writes the error counters.
+func (mfs *MinFS) writeErrorMetrics(mw metricsWriter) {
+	errs := mfs.errors.stats()
+
+	write := func(name, kind, help, label1, label2 string, counts map[string]map[string]uint64) {
+		mw.header(name, kind, help)
+
+		var keys []string
+		for a, byB := range counts {
+			for b := range byB {
+				keys = append(keys, a+"\x00"+b)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			parts := strings.SplitN(k, "\x00", 2)
+			mw.sample(name, float64(counts[parts[0]][parts[1]]), label1, parts[0], label2, parts[1])
+		}
+	}
+
+	write("minfs_fuse_errors_total", "counter", "Errors returned to the kernel by FUSE operation and errno.", "op", "errno", errs.ByOp)
+	write("minfs_fuse_error_causes_total", "counter", "Errors returned to the kernel by errno and the S3 error class causing them.", "errno", "cause", errs.ByCause)
+	write("minfs_s3_errors_total", "counter", "Failed S3 requests by error class and method.", "class", "method", errs.S3)
+}
+
+// errorSummaryInterval is how often the errors since the last summary are
+// logged.
+const errorSummaryInterval = 15 * time.Minute
+
+// errorSummary returns the number of errors returned to the kernel and the
+// counts by operation and errno, as op/errno=count sorted by op.
+func (ec *errorCounters) errorSummary() (total uint64, byOp string) {
+	var parts []string
+	for op, byErrno := range ec.ops.snapshot() {
+		for errno, n := range byErrno {
+			total += n
+			parts = append(parts, fmt.Sprintf("%s/%s=%d", op, errno, n))
+		}
+	}
+	sort.Strings(parts)
+	return total, strings.Join(parts, " ")
+}
+
+// logErrorSummary logs the error counts if they changed since last, and
+// returns the current total.
+func (mfs *MinFS) logErrorSummary(last uint64) uint64 {
+	total, byOp := mfs.errors.errorSummary()
+	if total == last {
+		return total
+	}
+	mfs.log.Info("Error summary", F("errors", total), F("by_op", byOp))
+	return total
+}
+
+// startErrorSummary logs the error counts periodically while they change.
+func (mfs *MinFS) startErrorSummary() {
+	go func() {
+		ticker := time.NewTicker(errorSummaryInterval)
+		defer ticker.Stop()
+
+		var last uint64
+		for {
+			select {
+			case <-mfs.listenerDoneCh:
+				return
+			case <-ticker.C:
+			}
+			last = mfs.logErrorSummary(last)
+		}
+	}()
+}
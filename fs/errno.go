@@ -0,0 +1,145 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v6"
+)
+
+// s3Errnos are the errnos of the S3 error codes, other codes are mapped
+// by their status.
+var s3Errnos = map[string]fuse.Errno{
+	"NoSuchKey":    fuse.ENOENT,
+	"NoSuchBucket": fuse.ENOENT,
+	"NoSuchUpload": fuse.ENOENT,
+
+	"AccessDenied":          fuse.Errno(syscall.EACCES),
+	"AllAccessDisabled":     fuse.Errno(syscall.EACCES),
+	"InvalidAccessKeyId":    fuse.Errno(syscall.EACCES),
+	"SignatureDoesNotMatch": fuse.Errno(syscall.EACCES),
+
+	// minio-go and the retries of the transport are done by then
+	"SlowDown":           fuse.Errno(syscall.EAGAIN),
+	"ServiceUnavailable": fuse.Errno(syscall.EAGAIN),
+
+	"QuotaExceeded":                  fuse.Errno(syscall.EDQUOT),
+	"XMinioAdminBucketQuotaExceeded": fuse.Errno(syscall.EDQUOT),
+
+	"EntityTooLarge": fuse.Errno(syscall.EFBIG),
+
+	"InvalidObjectName":       fuse.Errno(syscall.EINVAL),
+	"XMinioInvalidObjectName": fuse.Errno(syscall.EINVAL),
+	"KeyTooLongError":         fuse.Errno(syscall.ENAMETOOLONG),
+
+	"RequestTimeout": fuse.Errno(syscall.ETIMEDOUT),
+}
+
+// errnoOf returns the errno err is answered to the kernel with. Errors of
+// unknown cause are EIO.
+func errnoOf(err error) fuse.Errno {
+	switch e := err.(type) {
+	case fuse.ErrorNumber:
+		return e.Errno()
+	case syscall.Errno:
+		return fuse.Errno(e)
+	case *os.PathError:
+		return errnoOf(e.Err)
+	case *os.LinkError:
+		return errnoOf(e.Err)
+	case *os.SyscallError:
+		return errnoOf(e.Err)
+	case *url.Error:
+		if e.Timeout() {
+			return fuse.Errno(syscall.ETIMEDOUT)
+		}
+		return errnoOf(e.Err)
+	case net.Error:
+		if e.Timeout() {
+			return fuse.Errno(syscall.ETIMEDOUT)
+		}
+		return fuse.EIO
+	}
+
+	switch {
+	case err == context.DeadlineExceeded:
+		return fuse.Errno(syscall.ETIMEDOUT)
+	case err == context.Canceled:
+		return fuse.EINTR
+	case err == meta.ErrNoSuchObject || err.Error() == meta.ErrNoSuchObject.Error():
+		// compared by message as well, in case it was wrapped
+		return fuse.ENOENT
+	}
+
+	resp := minio.ToErrorResponse(err)
+	if errno, ok := s3Errnos[resp.Code]; ok {
+		return errno
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return fuse.ENOENT
+	case http.StatusForbidden:
+		return fuse.Errno(syscall.EACCES)
+	case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+		return fuse.Errno(syscall.EAGAIN)
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return fuse.Errno(syscall.ETIMEDOUT)
+	}
+	return fuse.EIO
+}
+
+// errnoError is an error with the errno it's answered with, the message
+// of the error is kept for the logs.
+type errnoError struct {
+	error
+	errno fuse.Errno
+}
+
+func (e errnoError) Errno() fuse.Errno {
+	return e.errno
+}
+
+// toErrno returns err with the errno it maps to, nil if err is nil.
+func toErrno(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(fuse.ErrorNumber); ok {
+		return err
+	}
+	return errnoError{err, errnoOf(err)}
+}
+
+// mapErrno maps the error of a FUSE handler to its errno, the handlers
+// defer it with their named error result.
+func mapErrno(err *error) {
+	*err = toErrno(*err)
+}
+
+// isNotFound tells if err is a missing object, entry or bucket, in the
+// meta DB or on the remote.
+func isNotFound(err error) bool {
+	return err != nil && errnoOf(err) == fuse.ENOENT
+}
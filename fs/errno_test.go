@@ -0,0 +1,152 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v6"
+)
+
+// timeoutError is a net.Error of a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrnoOf(t *testing.T) {
+	s3Error := func(code string, status int) error {
+		return minio.ErrorResponse{Code: code, Message: code, StatusCode: status, BucketName: testBucket, Key: "file"}
+	}
+
+	testCases := []struct {
+		name  string
+		err   error
+		errno fuse.Errno
+	}{
+		{"NoSuchKey", s3Error("NoSuchKey", http.StatusNotFound), fuse.ENOENT},
+		{"NoSuchBucket", s3Error("NoSuchBucket", http.StatusNotFound), fuse.ENOENT},
+		{"NoSuchUpload", s3Error("NoSuchUpload", http.StatusNotFound), fuse.ENOENT},
+		{"AccessDenied", s3Error("AccessDenied", http.StatusForbidden), fuse.Errno(syscall.EACCES)},
+		{"AllAccessDisabled", s3Error("AllAccessDisabled", http.StatusForbidden), fuse.Errno(syscall.EACCES)},
+		{"InvalidAccessKeyId", s3Error("InvalidAccessKeyId", http.StatusForbidden), fuse.Errno(syscall.EACCES)},
+		{"SignatureDoesNotMatch", s3Error("SignatureDoesNotMatch", http.StatusForbidden), fuse.Errno(syscall.EACCES)},
+		{"SlowDown", s3Error("SlowDown", http.StatusServiceUnavailable), fuse.Errno(syscall.EAGAIN)},
+		{"ServiceUnavailable", s3Error("ServiceUnavailable", http.StatusServiceUnavailable), fuse.Errno(syscall.EAGAIN)},
+		{"QuotaExceeded", s3Error("QuotaExceeded", http.StatusForbidden), fuse.Errno(syscall.EDQUOT)},
+		{"XMinioAdminBucketQuotaExceeded", s3Error("XMinioAdminBucketQuotaExceeded", http.StatusBadRequest), fuse.Errno(syscall.EDQUOT)},
+		{"EntityTooLarge", s3Error("EntityTooLarge", http.StatusBadRequest), fuse.Errno(syscall.EFBIG)},
+		{"InvalidObjectName", s3Error("InvalidObjectName", http.StatusBadRequest), fuse.Errno(syscall.EINVAL)},
+		{"XMinioInvalidObjectName", s3Error("XMinioInvalidObjectName", http.StatusBadRequest), fuse.Errno(syscall.EINVAL)},
+		{"KeyTooLongError", s3Error("KeyTooLongError", http.StatusBadRequest), fuse.Errno(syscall.ENAMETOOLONG)},
+		{"RequestTimeout", s3Error("RequestTimeout", http.StatusBadRequest), fuse.Errno(syscall.ETIMEDOUT)},
+
+		// codes without an errno are mapped by their status
+		{"unknown code not found", s3Error("XCustomMissing", http.StatusNotFound), fuse.ENOENT},
+		{"unknown code forbidden", s3Error("XCustomDenied", http.StatusForbidden), fuse.Errno(syscall.EACCES)},
+		{"unknown code too many requests", s3Error("XCustomThrottled", http.StatusTooManyRequests), fuse.Errno(syscall.EAGAIN)},
+		{"unknown code gateway timeout", s3Error("XCustomTimeout", http.StatusGatewayTimeout), fuse.Errno(syscall.ETIMEDOUT)},
+		{"unknown code", s3Error("InternalError", http.StatusInternalServerError), fuse.EIO},
+		{"unknown code bad request", s3Error("MalformedXML", http.StatusBadRequest), fuse.EIO},
+
+		// timeouts of the transport and the requests
+		{"url timeout", &url.Error{Op: "Get", URL: "http://localhost/bucket/file", Err: timeoutError{}}, fuse.Errno(syscall.ETIMEDOUT)},
+		{"net timeout", timeoutError{}, fuse.Errno(syscall.ETIMEDOUT)},
+		{"deadline", context.DeadlineExceeded, fuse.Errno(syscall.ETIMEDOUT)},
+		{"url refused", &url.Error{Op: "Get", URL: "http://localhost/bucket/file", Err: syscall.ECONNREFUSED}, fuse.Errno(syscall.ECONNREFUSED)},
+		{"canceled", context.Canceled, fuse.EINTR},
+
+		// local errors keep their errno
+		{"errno", syscall.ENOSPC, fuse.Errno(syscall.ENOSPC)},
+		{"path error", &os.PathError{Op: "open", Path: "cache", Err: syscall.EMFILE}, fuse.Errno(syscall.EMFILE)},
+		{"fuse errno", fuse.Errno(syscall.EROFS), fuse.Errno(syscall.EROFS)},
+		{"meta", meta.ErrNoSuchObject, fuse.ENOENT},
+		{"wrapped meta", errors.New(meta.ErrNoSuchObject.Error()), fuse.ENOENT},
+		{"unknown", errors.New("unknown"), fuse.EIO},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if errno := errnoOf(testCase.err); errno != testCase.errno {
+				t.Errorf("expected %v, got %v", syscall.Errno(testCase.errno), syscall.Errno(errno))
+			}
+
+			// the handlers answer with the errno and keep the message
+			err := toErrno(testCase.err)
+			en, ok := err.(fuse.ErrorNumber)
+			if !ok || en.Errno() != testCase.errno {
+				t.Errorf("expected the handler error to have errno %v, got %v", syscall.Errno(testCase.errno), err)
+			}
+			if err.Error() != testCase.err.Error() {
+				t.Errorf("expected the message %q to be kept, got %q", testCase.err.Error(), err.Error())
+			}
+		})
+	}
+
+	if toErrno(nil) != nil {
+		t.Errorf("expected no error for nil")
+	}
+}
+
+// TestErrnoRemote checks the errors answered by the server reach the
+// handlers with their errno.
+func TestErrnoRemote(t *testing.T) {
+	testCases := []struct {
+		code   string
+		status int
+		errno  fuse.Errno
+	}{
+		{"AccessDenied", http.StatusForbidden, fuse.Errno(syscall.EACCES)},
+		{"NoSuchKey", http.StatusNotFound, fuse.ENOENT},
+		{"QuotaExceeded", http.StatusForbidden, fuse.Errno(syscall.EDQUOT)},
+		{"InvalidObjectName", http.StatusBadRequest, fuse.Errno(syscall.EINVAL)},
+		{"MalformedXML", http.StatusBadRequest, fuse.EIO},
+	}
+
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "file", []byte("file"))
+
+	m := newTestMount(t, s3, t.TempDir())
+	for _, testCase := range testCases {
+		t.Run(testCase.code, func(t *testing.T) {
+			s3.setIntercept(func(op string, w http.ResponseWriter, r *http.Request) bool {
+				if op != "GetObject" {
+					return false
+				}
+				fakeError(w, testCase.status, testCase.code, testCase.code)
+				return true
+			})
+			defer s3.setIntercept(nil)
+
+			_, err := m.open("file", fuse.OpenReadOnly)
+			en, ok := err.(fuse.ErrorNumber)
+			if !ok || en.Errno() != testCase.errno {
+				t.Errorf("expected the open to fail with %v, got %v", syscall.Errno(testCase.errno), err)
+			}
+		})
+	}
+}
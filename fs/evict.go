@@ -0,0 +1,224 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v6"
+)
+
+const (
+	// minEvictInterval and maxEvictInterval bound the interval of
+	// eviction passes.
+	minEvictInterval = time.Minute
+	maxEvictInterval = time.Hour
+)
+
+// touchInterval is the minimum time between updates of the last access of
+// an entry, a fraction of the eviction period.
+func (mfs *MinFS) touchInterval() time.Duration {
+	return mfs.config.evictAfter / 10
+}
+
+// touch records the access of the file, at most once per touch interval.
+func (f *File) touch() error {
+	if f.mfs.config.evictAfter <= 0 || time.Since(f.Accessed) < f.mfs.touchInterval() {
+		return nil
+	}
+
+	f.Accessed = time.Now().UTC()
+	return f.mfs.db.Update(func(tx *meta.Tx) error {
+		var current File
+		if err := f.bucket(tx).Get(f.Path, &current); err != nil {
+			// removed meanwhile
+			return nil
+		}
+		current.Accessed = f.Accessed
+		return f.bucket(tx).Put(f.Path, &current)
+	})
+}
+
+// lookupEvicted looks up the file name on the remote if entries of the
+// dir were evicted or purged.
+func (dir *Dir) lookupEvicted(ctx context.Context, name string) (fs.Node, error) {
+	if dir.isBucketRoot() {
+		return nil, fuse.ENOENT
+	}
+
+	var state listing
+	if err := dir.mfs.view(ctx, func(tx *meta.Tx) error {
+		if dir.mfs.shadowed(tx, path.Join(dir.FullPath(), name)) {
+			return fuse.ENOENT
+		}
+		return dir.readBucket(tx).GetMeta("listing", &state)
+	}); err != nil || !state.Evicted {
+		return nil, fuse.ENOENT
+	}
+
+	objInfo, err := dir.mfs.api.StatObjectWithContext(ctx, dir.BucketName(), path.Join(dir.RemotePath(), name), minio.StatObjectOptions{})
+	if isNotFound(err) {
+		return nil, fuse.ENOENT
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f File
+	if err = dir.mfs.update(ctx, func(tx *meta.Tx) error {
+		b := dir.bucket(tx)
+		if err := dir.storeFile(b, tx, name, objInfo); err != nil {
+			return err
+		}
+		return b.Get(name, &f)
+	}); err != nil {
+		return nil, err
+	}
+
+	f.mfs, f.dir = dir.mfs, dir
+	return &f, nil
+}
+
+// startEviction removes the entries not accessed for the eviction period
+// in the background, until unmount.
+func (mfs *MinFS) startEviction() {
+	if mfs.config.evictAfter <= 0 {
+		return
+	}
+
+	interval := mfs.config.evictAfter / 4
+	if interval < minEvictInterval {
+		interval = minEvictInterval
+	} else if interval > maxEvictInterval {
+		interval = maxEvictInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-mfs.listenerDoneCh:
+				return
+			case <-ticker.C:
+			}
+
+			evicted, err := mfs.evict()
+			if err != nil {
+				mfs.log.Println("Eviction failed:", err)
+			}
+			if evicted > 0 {
+				atomic.AddUint64(&mfs.stats.Evicted, uint64(evicted))
+				atomic.AddUint64(&mfs.evictGen, 1)
+				mfs.log.Printf("Evicted %d entries not accessed for %s.\n", evicted, mfs.config.evictAfter)
+			}
+		}
+	}()
+}
+
+// evict removes the clean file entries without cache file which weren't
+// accessed for the eviction period, one directory per transaction. The
+// listings of the directories are marked as having evicted entries.
+func (mfs *MinFS) evict() (int, error) {
+	evicted := 0
+	queue := [][]string{nil}
+
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+
+		select {
+		case <-mfs.listenerDoneCh:
+			return evicted, nil
+		default:
+		}
+
+		dirty := mfs.dirtyPaths()
+		if err := mfs.db.Update(func(tx *meta.Tx) error {
+			b := metaDirBucket(tx, dir)
+			if b.InnerBucket == nil {
+				return nil
+			}
+
+			var (
+				stale   []string
+				touched = map[string]File{}
+			)
+			if err := b.ForEach(func(k string, o interface{}) error {
+				fullPath := path.Join(append(append([]string{}, dir...), k)...)
+
+				switch v := o.(type) {
+				case Dir:
+					queue = append(queue, append(dir[:len(dir):len(dir)], k))
+				case File:
+					if v.Accessed.IsZero() {
+						// from before eviction, starts the period
+						v.Accessed = time.Now().UTC()
+						touched[k] = v
+						return nil
+					}
+					if time.Since(v.Accessed) < mfs.config.evictAfter || v.CachePath != "" || dirty[fullPath] {
+						return nil
+					}
+					if _, pending := mfs.pendingTx(tx, fullPath); pending {
+						return nil
+					}
+					stale = append(stale, k)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			for k, f := range touched {
+				if err := b.Put(k, &f); err != nil {
+					return err
+				}
+			}
+
+			if len(stale) == 0 {
+				return nil
+			}
+
+			for _, k := range stale {
+				// the inode is kept, the path still exists
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			evicted += len(stale)
+
+			var state listing
+			if err := b.GetMeta("listing", &state); err != nil {
+				// not listed completely, lookups stat the remote
+				state = listing{}
+			}
+			state.Evicted = true
+			return b.PutMeta("listing", state)
+		}); err != nil {
+			return evicted, err
+		}
+	}
+
+	return evicted, nil
+}
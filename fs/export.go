@@ -0,0 +1,422 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v6"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// exportFormat identifies meta DB exports, exportVersion is the version of
+// the stream layout.
+const (
+	exportFormat  = "minfs-meta"
+	exportVersion = 1
+)
+
+// exportBuckets are the top-level meta buckets written to exports, pending
+// uploads and local changes come first so the import knows which files are
+// newer locally.
+var exportBuckets = []string{pendingBucket, scratchBucket, inodeBucket, "minio/"}
+
+// exportHeader is the first line of an export, it identifies the mount the
+// meta data belongs to.
+type exportHeader struct {
+	Format   string   `json:"format"`
+	Version  int      `json:"version"`
+	Schema   int      `json:"schema"`
+	Endpoint string   `json:"endpoint"`
+	Bucket   string   `json:"bucket,omitempty"`
+	BasePath string   `json:"basePath,omitempty"`
+	Buckets  []string `json:"buckets,omitempty"`
+	Sequence uint64   `json:"sequence"`
+}
+
+// exportRecord is a key of the meta DB, the value is the msgpack encoded
+// entry. Nested buckets are written before their keys.
+type exportRecord struct {
+	Path   []string `json:"path"`
+	Key    string   `json:"key"`
+	Bucket bool     `json:"bucket,omitempty"`
+	Value  []byte   `json:"value,omitempty"`
+}
+
+// exportHeader returns the header describing the current mount.
+func (mfs *MinFS) exportHeader() exportHeader {
+	return exportHeader{
+		Format:   exportFormat,
+		Version:  exportVersion,
+		Schema:   schemaVersion,
+		Endpoint: mfs.config.target.Host,
+		Bucket:   mfs.config.bucket,
+		BasePath: mfs.config.basePath,
+		Buckets:  mfs.config.buckets,
+	}
+}
+
+// checkHeader returns an error if the export was made of another mount.
+func (mfs *MinFS) checkHeader(h exportHeader) error {
+	want := mfs.exportHeader()
+	switch {
+	case h.Format != exportFormat:
+		return errors.New("Not a minfs meta DB export")
+	case h.Version != exportVersion:
+		return fmt.Errorf("Meta DB export version %d is not supported", h.Version)
+	case h.Schema != schemaVersion:
+		return fmt.Errorf("Meta DB export has schema version %d, this minfs imports version %d", h.Schema, schemaVersion)
+	case h.Endpoint != want.Endpoint:
+		return fmt.Errorf("Meta DB export is of endpoint %s, not %s", h.Endpoint, want.Endpoint)
+	case h.Bucket != want.Bucket || h.BasePath != want.BasePath || strings.Join(h.Buckets, ":") != strings.Join(want.Buckets, ":"):
+		return fmt.Errorf("Meta DB export is of bucket %s, not %s", path.Join(h.Bucket, h.BasePath, strings.Join(h.Buckets, ":")), path.Join(want.Bucket, want.BasePath, strings.Join(want.Buckets, ":")))
+	}
+	return nil
+}
+
+// ExportMeta writes the meta DB to w as a stream of JSON lines, the first
+// line is the header identifying the mount.
+func (mfs *MinFS) ExportMeta(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	if err := mfs.db.View(func(tx *meta.Tx) error {
+		h := mfs.exportHeader()
+		if b := tx.Bucket("minio/"); b.InnerBucket != nil {
+			h.Sequence = b.Sequence()
+		}
+		if err := enc.Encode(h); err != nil {
+			return err
+		}
+
+		for _, name := range exportBuckets {
+			b := tx.Bucket(name)
+			if b.InnerBucket == nil {
+				continue
+			}
+			if err := exportBucket(enc, []string{name}, b.InnerBucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// exportBucket writes the keys of b and its nested buckets.
+func exportBucket(enc *json.Encoder, p []string, b meta.StoreBucket) error {
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			if err := enc.Encode(exportRecord{Path: p, Key: string(k), Bucket: true}); err != nil {
+				return err
+			}
+			return exportBucket(enc, append(p[:len(p):len(p)], string(k)), b.Bucket(k))
+		}
+		return enc.Encode(exportRecord{Path: p, Key: string(k), Value: v})
+	})
+}
+
+// ExportMetaFile writes the meta DB of an unmounted minfs to path, see
+// ExportMeta.
+func (mfs *MinFS) ExportMetaFile(filePath string) (err error) {
+	if mfs.config.metaStore == "memory" {
+		return errors.New("Meta store memory is lost at unmount, there is nothing to export")
+	}
+
+	if _, err = os.Stat(mfs.metaPath()); err != nil {
+		return err
+	}
+
+	if _, err = mfs.openMeta(true); err != nil {
+		return err
+	}
+	defer mfs.db.Close()
+
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err = mfs.ExportMeta(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ImportMeta replaces the files and directories of the meta DB with an
+// export of the same endpoint and bucket, local pending uploads are kept.
+// Entries of the export are checked against the remote, files
+// changed by others since the export take the remote ETag and size. Imports
+// are refused while the mount is serving, unless quiesce is set, in which
+// case the import waits for the writers of the meta DB.
+func (mfs *MinFS) ImportMeta(r io.Reader, quiesce bool) error {
+	if mfs.fuseServer() != nil {
+		if !quiesce {
+			return errors.New("Meta DB import refused while the mount is serving writes, quiesce the mount to import anyway")
+		}
+		if mfs.hasDirtyHandles() {
+			return errors.New("Meta DB import refused while files are open for writing")
+		}
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var h exportHeader
+	if err := dec.Decode(&h); err != nil {
+		return fmt.Errorf("Meta DB export has no valid header: %s", err)
+	}
+	if err := mfs.checkHeader(h); err != nil {
+		return err
+	}
+
+	remote, err := mfs.remoteObjects()
+	if err != nil {
+		return err
+	}
+
+	var records int
+	if err = mfs.db.Update(func(tx *meta.Tx) error {
+		for _, name := range []string{inodeBucket, "minio/"} {
+			if b := tx.Bucket(name); b.InnerBucket != nil {
+				if err := clearBucket(b.InnerBucket); err != nil {
+					return err
+				}
+			}
+		}
+
+		for {
+			var rec exportRecord
+			if err := dec.Decode(&rec); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("Meta DB export is corrupt after %d records: %s", records, err)
+			}
+			records++
+
+			if err := mfs.importRecord(tx, rec, remote); err != nil {
+				return err
+			}
+		}
+
+		root, err := tx.CreateBucketIfNotExists("minio/")
+		if err != nil {
+			return err
+		}
+		if err = root.PutMeta("schema", schemaVersion); err != nil {
+			return err
+		}
+		if root.Sequence() >= h.Sequence {
+			return nil
+		}
+		return root.SetSequence(h.Sequence)
+	}); err != nil {
+		return err
+	}
+
+	// tracked directories list the remote again on the next lookup
+	mfs.m.Lock()
+	for _, dir := range mfs.dirs {
+		dir.scanned = false
+	}
+	mfs.m.Unlock()
+
+	mfs.log.Printf("Imported %d meta DB records of %s.\n", records, h.Endpoint)
+	return nil
+}
+
+// clearBucket removes the keys and nested buckets of b.
+func clearBucket(b meta.StoreBucket) error {
+	var keys [][]byte
+	if err := b.ForEach(func(k, v []byte) error {
+		keys = append(keys, append([]byte{}, k...))
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if b.Bucket(k) != nil {
+			if err := b.DeleteBucket(k); err != nil {
+				return err
+			}
+		} else if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importMetaFile imports the export at filePath, see ImportMeta.
+func (mfs *MinFS) importMetaFile(filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return mfs.ImportMeta(f, false)
+}
+
+// hasDirtyHandles returns true if a file has unflushed writes.
+func (mfs *MinFS) hasDirtyHandles() bool {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	for _, fh := range mfs.handles {
+		if fh != nil && fh.dirty {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteObjects lists the objects of the mounted buckets, keyed by their
+// path in the mount.
+func (mfs *MinFS) remoteObjects() (map[string]minio.ObjectInfo, error) {
+	buckets, err := mfs.mountedBuckets()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := ""
+	if !mfs.config.multiBucket() && mfs.config.basePath != "" {
+		prefix = mfs.config.basePath + "/"
+	}
+
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	objects := map[string]minio.ObjectInfo{}
+	for _, bucket := range buckets {
+		for objInfo := range mfs.listObjects(bucket, prefix, doneCh) {
+			if objInfo.Err != nil {
+				return nil, objInfo.Err
+			}
+
+			key := strings.TrimPrefix(objInfo.Key, prefix)
+			if mfs.config.multiBucket() {
+				key = path.Join(bucket, key)
+			}
+			objects[key] = objInfo
+		}
+	}
+	return objects, nil
+}
+
+// importRecord stores the record, unless a newer remote state or local
+// state exists. Listings are not imported so directories are listed again.
+func (mfs *MinFS) importRecord(tx *meta.Tx, rec exportRecord, remote map[string]minio.ObjectInfo) error {
+	if len(rec.Path) == 0 || rec.Key == "" {
+		return errors.New("Meta DB export has a record without a key")
+	}
+
+	b, err := tx.CreateBucketIfNotExists(rec.Path[0])
+	if err != nil {
+		return err
+	}
+	for _, name := range rec.Path[1:] {
+		if b, err = b.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+
+	if rec.Bucket {
+		_, err = b.CreateBucketIfNotExists(rec.Key)
+		return err
+	}
+
+	if rec.Key == "\x00listing" {
+		return nil
+	}
+
+	if rec.Path[0] == pendingBucket {
+		var p pendingUpload
+		if err = msgpack.Unmarshal(rec.Value, &p); err != nil {
+			return err
+		}
+		if _, err = os.Stat(p.Source); err != nil {
+			mfs.log.Printf("Skipping the pending upload of %s, its cache file %s is missing.\n", rec.Key, p.Source)
+			return nil
+		}
+		return b.InnerBucket.Put([]byte(rec.Key), rec.Value)
+	}
+
+	var o interface{}
+	if err = msgpack.Unmarshal(rec.Value, &o); err != nil {
+		return fmt.Errorf("Meta DB export has a corrupt entry %s: %s", rec.Key, err)
+	}
+
+	file, ok := o.(File)
+	if !ok {
+		return b.InnerBucket.Put([]byte(rec.Key), rec.Value)
+	}
+
+	var parts []string
+	for _, name := range rec.Path[1:] {
+		if !meta.IsShard(name) {
+			parts = append(parts, name)
+		}
+	}
+	fullPath := path.Join(append(parts, rec.Key)...)
+
+	// uploads left to retry and local-only files are newer than the
+	// remote
+	if _, pending := mfs.pendingTx(tx, fullPath); pending || file.LocalOnly {
+		return b.Put(rec.Key, file)
+	}
+
+	objInfo, ok := remote[fullPath]
+	if !ok {
+		// removed since the export
+		return nil
+	}
+
+	if objInfo.ETag != file.ETag {
+		file.ETag = objInfo.ETag
+		file.LastModified = objInfo.LastModified
+		file.Size = uint64(objInfo.Size)
+		file.Mtime = objInfo.LastModified
+		file.StatETag = ""
+	}
+	if file.CacheETag != file.ETag {
+		file.CachePath = ""
+		file.CacheETag = ""
+	} else if _, err = os.Stat(file.CachePath); err != nil {
+		file.CachePath = ""
+		file.CacheETag = ""
+	}
+
+	return b.Put(rec.Key, file)
+}
+
+// pendingTx returns the pending upload of the file at path within tx.
+func (mfs *MinFS) pendingTx(tx *meta.Tx, fullPath string) (pendingUpload, bool) {
+	var p pendingUpload
+	err := tx.Bucket(pendingBucket).Get(fullPath, &p)
+	return p, err == nil
+}
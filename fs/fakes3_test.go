@@ -0,0 +1,774 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeS3 is an in-memory S3 server of the requests minfs sends, the
+// requests are counted by operation and can be intercepted by tests.
+type fakeS3 struct {
+	*httptest.Server
+
+	m        sync.Mutex
+	buckets  map[string]map[string]*fakeObject
+	uploads  map[string]*fakeUpload
+	counts   map[string]int
+	uploadID int
+
+	// intercept is called before each request is answered, it answers
+	// the request itself by returning true.
+	intercept func(op string, w http.ResponseWriter, r *http.Request) bool
+}
+
+// fakeObject is an object of the fake server.
+type fakeObject struct {
+	data     []byte
+	etag     string
+	modified time.Time
+	header   http.Header
+}
+
+// fakeUpload is a multipart upload of the fake server.
+type fakeUpload struct {
+	bucket, key string
+	header      http.Header
+	parts       map[int][]byte
+}
+
+// newFakeS3 starts a fake server with the buckets.
+func newFakeS3(buckets ...string) *fakeS3 {
+	s := &fakeS3{
+		buckets: map[string]map[string]*fakeObject{},
+		uploads: map[string]*fakeUpload{},
+		counts:  map[string]int{},
+	}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = map[string]*fakeObject{}
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// newFakeS3TLS starts a fake server with the buckets serving https, its
+// certificate is only accepted by mounts with Insecure.
+func newFakeS3TLS(buckets ...string) *fakeS3 {
+	s := newFakeS3(buckets...)
+	s.Server.Close()
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// put stores the object as if another client uploaded it, and returns
+// its ETag.
+func (s *fakeS3) put(bucket, key string, data []byte) string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	o := newFakeObject(data, http.Header{})
+	s.buckets[bucket][key] = o
+	return o.etag
+}
+
+// get returns the content of the object, false if it doesn't exist.
+func (s *fakeS3) get(bucket, key string) ([]byte, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	o, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	return o.data, true
+}
+
+// stat returns the ETag and modification time of the object, false if
+// it doesn't exist.
+func (s *fakeS3) stat(bucket, key string) (string, time.Time, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	o, ok := s.buckets[bucket][key]
+	if !ok {
+		return "", time.Time{}, false
+	}
+	return o.etag, o.modified, true
+}
+
+// remove removes the object as if another client removed it.
+func (s *fakeS3) remove(bucket, key string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	delete(s.buckets[bucket], key)
+}
+
+// keys returns the keys of the bucket in order.
+func (s *fakeS3) keys(bucket string) []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var keys []string
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// count returns the number of requests of the operation.
+func (s *fakeS3) count(op string) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.counts[op]
+}
+
+// requests returns the number of requests of all operations.
+func (s *fakeS3) requests() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var n int
+	for _, c := range s.counts {
+		n += c
+	}
+	return n
+}
+
+// setIntercept replaces the interception of requests.
+func (s *fakeS3) setIntercept(fn func(op string, w http.ResponseWriter, r *http.Request) bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.intercept = fn
+}
+
+// takeDown closes the server and its connections, requests are refused
+// until bringBack.
+func (s *fakeS3) takeDown() {
+	s.Server.Close()
+}
+
+// bringBack serves again at the address of the server taken down.
+func (s *fakeS3) bringBack() error {
+	l, err := net.Listen("tcp", s.Listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	s.Server = &httptest.Server{Listener: l, Config: &http.Server{Handler: http.HandlerFunc(s.serve)}}
+	s.Start()
+	return nil
+}
+
+func newFakeObject(data []byte, header http.Header) *fakeObject {
+	sum := md5.Sum(data)
+	return &fakeObject{
+		data:     data,
+		etag:     hex.EncodeToString(sum[:]),
+		modified: time.Now().UTC().Truncate(time.Second),
+		header:   header,
+	}
+}
+
+// operation returns the S3 operation of the request.
+func operation(r *http.Request, bucket, key string) string {
+	q := r.URL.Query()
+	switch {
+	case bucket == "":
+		return "ListBuckets"
+	case key == "":
+		switch {
+		case r.Method == http.MethodHead:
+			return "HeadBucket"
+		case r.Method == http.MethodPut:
+			return "MakeBucket"
+		case r.Method == http.MethodDelete:
+			return "RemoveBucket"
+		case r.Method == http.MethodPost && hasQuery(q, "delete"):
+			return "RemoveObjects"
+		case hasQuery(q, "location"):
+			return "GetBucketLocation"
+		case hasQuery(q, "object-lock"):
+			return "GetObjectLockConfig"
+		case hasQuery(q, "policy"):
+			return "GetBucketPolicy"
+		case hasQuery(q, "uploads"):
+			return "ListMultipartUploads"
+		case q.Get("list-type") == "2":
+			return "ListObjectsV2"
+		}
+		return "ListObjects"
+	}
+
+	switch {
+	case r.Method == http.MethodHead:
+		return "HeadObject"
+	case r.Method == http.MethodDelete && hasQuery(q, "uploadId"):
+		return "AbortMultipartUpload"
+	case r.Method == http.MethodDelete:
+		return "DeleteObject"
+	case r.Method == http.MethodPost && hasQuery(q, "uploads"):
+		return "NewMultipartUpload"
+	case r.Method == http.MethodPost && hasQuery(q, "uploadId"):
+		return "CompleteMultipartUpload"
+	case r.Method == http.MethodPut && hasQuery(q, "partNumber"):
+		return "PutObjectPart"
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		return "CopyObject"
+	case r.Method == http.MethodPut:
+		return "PutObject"
+	case hasQuery(q, "retention"):
+		return "GetObjectRetention"
+	case hasQuery(q, "legal-hold"):
+		return "GetObjectLegalHold"
+	}
+	return "GetObject"
+}
+
+func hasQuery(q url.Values, name string) bool {
+	_, ok := q[name]
+	return ok
+}
+
+// virtualBucket returns the bucket named by the host of virtual-host-style
+// requests, empty for path-style requests.
+func (s *fakeS3) virtualBucket(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	i := strings.Index(host, ".")
+	if i < 0 {
+		return ""
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.buckets[host[:i]]; !ok {
+		return ""
+	}
+	return host[:i]
+}
+
+func (s *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	if bucket := s.virtualBucket(r); bucket != "" {
+		p = bucket + "/" + p
+	}
+	parts := strings.SplitN(p, "/", 2)
+	bucket, key := parts[0], ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	op := operation(r, bucket, key)
+
+	s.m.Lock()
+	s.counts[op]++
+	intercept := s.intercept
+	s.m.Unlock()
+
+	if intercept != nil && intercept(op, w, r) {
+		return
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = readBody(r); err != nil {
+			fakeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	objects, ok := s.buckets[bucket]
+	if bucket != "" && !ok && op != "MakeBucket" {
+		fakeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	switch op {
+	case "ListBuckets":
+		s.listBuckets(w)
+	case "HeadBucket", "GetBucketLocation":
+		if op == "GetBucketLocation" {
+			writeXML(w, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+			}{})
+		}
+	case "MakeBucket":
+		if ok {
+			fakeError(w, http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded")
+			return
+		}
+		s.buckets[bucket] = map[string]*fakeObject{}
+	case "RemoveBucket":
+		if len(objects) > 0 {
+			fakeError(w, http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty")
+			return
+		}
+		delete(s.buckets, bucket)
+		w.WriteHeader(http.StatusNoContent)
+	case "GetObjectLockConfig":
+		fakeError(w, http.StatusNotFound, "ObjectLockConfigurationNotFoundError", "Object Lock configuration does not exist for this bucket")
+	case "GetBucketPolicy":
+		fakeError(w, http.StatusNotFound, "NoSuchBucketPolicy", "The bucket policy does not exist")
+	case "ListMultipartUploads":
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"ListMultipartUploadsResult"`
+			Bucket  string
+		}{Bucket: bucket})
+	case "ListObjects", "ListObjectsV2":
+		s.listObjects(w, r, bucket, objects, op == "ListObjectsV2")
+	case "RemoveObjects":
+		s.removeObjects(w, body, objects)
+	case "HeadObject", "GetObject":
+		s.getObject(w, r, objects, key, op == "HeadObject")
+	case "PutObject":
+		o := newFakeObject(body, requestMeta(r.Header))
+		objects[key] = o
+		w.Header().Set("ETag", `"`+o.etag+`"`)
+	case "CopyObject":
+		s.copyObject(w, r, objects, key)
+	case "DeleteObject":
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case "NewMultipartUpload":
+		s.uploadID++
+		id := strconv.Itoa(s.uploadID)
+		s.uploads[id] = &fakeUpload{bucket: bucket, key: key, header: requestMeta(r.Header), parts: map[int][]byte{}}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadID string `xml:"UploadId"`
+		}{Bucket: bucket, Key: key, UploadID: id})
+	case "PutObjectPart":
+		s.putObjectPart(w, r, body)
+	case "CompleteMultipartUpload":
+		s.completeMultipartUpload(w, r, objects, key)
+	case "AbortMultipartUpload":
+		delete(s.uploads, r.URL.Query().Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case "GetObjectRetention", "GetObjectLegalHold":
+		fakeError(w, http.StatusNotFound, "NoSuchObjectLockConfiguration", "The specified object does not have a ObjectLock configuration")
+	default:
+		fakeError(w, http.StatusNotImplemented, "NotImplemented", "A header you provided implies functionality that is not implemented")
+	}
+}
+
+// readBody returns the body of the request, decoding the chunks of
+// streaming signatures.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		return ioutil.ReadAll(r.Body)
+	}
+
+	var (
+		data bytes.Buffer
+		br   = bufio.NewReader(r.Body)
+	)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.CopyN(&data, br, size); err != nil {
+			return nil, err
+		}
+		if _, err = br.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data.Bytes(), nil
+		}
+	}
+}
+
+// requestMeta returns the metadata of the object stored by the request.
+func requestMeta(h http.Header) http.Header {
+	meta := http.Header{}
+	for k, v := range h {
+		if strings.HasPrefix(k, "X-Amz-Meta-") || k == "Content-Type" || k == "Content-Encoding" || k == "Cache-Control" {
+			meta[k] = v
+		}
+	}
+	return meta
+}
+
+func (s *fakeS3) listBuckets(w http.ResponseWriter) {
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	result := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{}
+
+	var names []string
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result.Buckets = append(result.Buckets, bucket{Name: name, CreationDate: "2020-01-02T15:04:05.000Z"})
+	}
+	writeXML(w, result)
+}
+
+type fakeContent struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type fakePrefix struct {
+	Prefix string
+}
+
+type fakeListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	Marker                string `xml:",omitempty"`
+	NextMarker            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	Contents              []fakeContent
+	CommonPrefixes        []fakePrefix
+}
+
+// listObjects answers listings of both versions, their continuation
+// tokens are the last key returned.
+func (s *fakeS3) listObjects(w http.ResponseWriter, r *http.Request, bucket string, objects map[string]*fakeObject, v2 bool) {
+	q := r.URL.Query()
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+
+	maxKeys := 1000
+	if v := q.Get("max-keys"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	after := q.Get("marker")
+	if v2 {
+		after = q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			after = token
+		}
+	}
+
+	var keys []string
+	for k := range objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	result := fakeListResult{
+		Name:      bucket,
+		Prefix:    prefix,
+		Delimiter: delimiter,
+		MaxKeys:   maxKeys,
+	}
+	if v2 {
+		result.ContinuationToken = q.Get("continuation-token")
+	} else {
+		result.Marker = q.Get("marker")
+	}
+
+	last, seen := "", map[string]bool{}
+	for _, k := range keys {
+		entry := k
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				entry = k[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if entry <= after || seen[entry] || strings.HasPrefix(after, entry) && entry != k {
+			continue
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		seen[entry] = true
+		result.KeyCount++
+		last = entry
+
+		if entry != k {
+			result.CommonPrefixes = append(result.CommonPrefixes, fakePrefix{entry})
+			continue
+		}
+		o := objects[k]
+		result.Contents = append(result.Contents, fakeContent{
+			Key:          k,
+			LastModified: o.modified.Format("2006-01-02T15:04:05.000Z"),
+			ETag:         `"` + o.etag + `"`,
+			Size:         int64(len(o.data)),
+			StorageClass: "STANDARD",
+		})
+	}
+
+	if result.IsTruncated {
+		if v2 {
+			result.NextContinuationToken = last
+		} else {
+			result.NextMarker = last
+		}
+	}
+	writeXML(w, result)
+}
+
+func (s *fakeS3) removeObjects(w http.ResponseWriter, body []byte, objects map[string]*fakeObject) {
+	var req struct {
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := xml.Unmarshal(body, &req); err != nil {
+		fakeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	type deleted struct {
+		Key string
+	}
+	result := struct {
+		XMLName xml.Name  `xml:"DeleteResult"`
+		Deleted []deleted `xml:"Deleted"`
+	}{}
+	for _, o := range req.Objects {
+		delete(objects, o.Key)
+		result.Deleted = append(result.Deleted, deleted{o.Key})
+	}
+	writeXML(w, result)
+}
+
+// getObject answers stats and downloads, with ranges and If-Match.
+func (s *fakeS3) getObject(w http.ResponseWriter, r *http.Request, objects map[string]*fakeObject, key string, head bool) {
+	o, ok := objects[key]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if match := strings.Trim(r.Header.Get("If-Match"), `"`); match != "" && match != o.etag {
+		fakeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+		return
+	}
+
+	data, status := o.data, http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" && !head {
+		var start, end int64 = 0, int64(len(o.data)) - 1
+		bounds := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+		start, _ = strconv.ParseInt(bounds[0], 10, 64)
+		if len(bounds) == 2 && bounds[1] != "" {
+			if n, err := strconv.ParseInt(bounds[1], 10, 64); err == nil && n < end {
+				end = n
+			}
+		}
+		if start > end {
+			fakeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+			return
+		}
+		data, status = o.data[start:end+1], http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(o.data)))
+	}
+
+	for k, v := range o.header {
+		w.Header()[k] = v
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("ETag", `"`+o.etag+`"`)
+	w.Header().Set("Last-Modified", o.modified.Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if !head {
+		w.Write(data)
+	}
+}
+
+// source returns the object of the copy source of the request.
+func (s *fakeS3) source(r *http.Request) (*fakeObject, bool) {
+	src, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return nil, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(src, "/"), "/", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	o, ok := s.buckets[parts[0]][parts[1]]
+	return o, ok
+}
+
+func (s *fakeS3) copyObject(w http.ResponseWriter, r *http.Request, objects map[string]*fakeObject, key string) {
+	src, ok := s.source(r)
+	if !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if match := strings.Trim(r.Header.Get("X-Amz-Copy-Source-If-Match"), `"`); match != "" && match != src.etag {
+		fakeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+		return
+	}
+
+	header := src.header
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		header = requestMeta(r.Header)
+	}
+	o := newFakeObject(src.data, header)
+	objects[key] = o
+
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: `"` + o.etag + `"`, LastModified: o.modified.Format("2006-01-02T15:04:05.000Z")})
+}
+
+func (s *fakeS3) putObjectPart(w http.ResponseWriter, r *http.Request, body []byte) {
+	q := r.URL.Query()
+	upload, ok := s.uploads[q.Get("uploadId")]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist.")
+		return
+	}
+	n, _ := strconv.Atoi(q.Get("partNumber"))
+
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		src, ok := s.source(r)
+		if !ok {
+			fakeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		body = src.data
+		if rng := r.Header.Get("X-Amz-Copy-Source-Range"); rng != "" {
+			var start, end int
+			fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+			body = src.data[start : end+1]
+		}
+	}
+	upload.parts[n] = body
+
+	sum := md5.Sum(body)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		writeXML(w, struct {
+			XMLName      xml.Name `xml:"CopyPartResult"`
+			ETag         string
+			LastModified string
+		}{ETag: etag, LastModified: time.Now().UTC().Format("2006-01-02T15:04:05.000Z")})
+		return
+	}
+	w.Header().Set("ETag", etag)
+}
+
+func (s *fakeS3) completeMultipartUpload(w http.ResponseWriter, r *http.Request, objects map[string]*fakeObject, key string) {
+	id := r.URL.Query().Get("uploadId")
+	upload, ok := s.uploads[id]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist.")
+		return
+	}
+	delete(s.uploads, id)
+
+	var numbers []int
+	for n := range upload.parts {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	var data, sums []byte
+	for _, n := range numbers {
+		data = append(data, upload.parts[n]...)
+		sum := md5.Sum(upload.parts[n])
+		sums = append(sums, sum[:]...)
+	}
+
+	o := newFakeObject(data, upload.header)
+	sum := md5.Sum(sums)
+	o.etag = fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(numbers))
+	objects[key] = o
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: upload.bucket, Key: key, ETag: `"` + o.etag + `"`})
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+// fakeError answers the request with the S3 error.
+func fakeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	data, _ := xml.Marshal(struct {
+		XMLName   xml.Name `xml:"Error"`
+		Code      string
+		Message   string
+		RequestID string `xml:"RequestId"`
+	}{Code: code, Message: message, RequestID: "FAKE"})
+	w.Write(data)
+}
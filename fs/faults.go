@@ -0,0 +1,350 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// Fault targets, the operations of which faults are injected in
+const (
+	faultS3    = "s3"
+	faultCache = "cache"
+)
+
+// faultOps are the operations of the fault targets, * matches all.
+var faultOps = map[string][]string{
+	faultS3:    {"list", "head", "get", "put", "part", "copy", "create-multipart", "complete", "delete", "post"},
+	faultCache: {"read", "write"},
+}
+
+// faultRule fails the matching calls, or delays or corrupts them. Rules
+// are written as
+//
+//	<target>:<op>:<call>:<action>
+//
+// where call is the number of the matching call starting at 1, N+ for
+// the Nth call and later or * for all, and action one of an HTTP status,
+// reset, corrupt, eio or delay:<duration>. For example s3:part:3:503
+// fails the third uploaded part with 503 Service Unavailable.
+type faultRule struct {
+	spec   string
+	target string
+	op     string
+	call   uint64
+	later  bool
+
+	status  int
+	reset   bool
+	corrupt bool
+	eio     bool
+	delay   time.Duration
+
+	calls uint64
+}
+
+// parseFault returns the rule of spec.
+func parseFault(spec string) (*faultRule, error) {
+	parts := strings.SplitN(spec, ":", 4)
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("Fault %s is not of the form target:op:call:action", spec)
+	}
+	r := &faultRule{spec: spec, target: parts[0], op: parts[1]}
+
+	ops, ok := faultOps[r.target]
+	if !ok {
+		return nil, fmt.Errorf("Fault %s has unsupported target %s", spec, r.target)
+	}
+	if r.op != "*" && !containsString(ops, r.op) {
+		return nil, fmt.Errorf("Fault %s has unsupported operation %s, use one of %s", spec, r.op, strings.Join(ops, ", "))
+	}
+
+	switch call := parts[2]; {
+	case call == "*":
+		r.call, r.later = 1, true
+	default:
+		r.later = strings.HasSuffix(call, "+")
+		n, err := strconv.ParseUint(strings.TrimSuffix(call, "+"), 10, 64)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("Fault %s has invalid call %s", spec, call)
+		}
+		r.call = n
+	}
+
+	switch action := parts[3]; {
+	case action == "reset" && r.target == faultS3:
+		r.reset = true
+	case action == "corrupt" && r.target == faultS3:
+		r.corrupt = true
+	case action == "eio" && r.target == faultCache:
+		r.eio = true
+	case strings.HasPrefix(action, "delay:"):
+		d, err := time.ParseDuration(strings.TrimPrefix(action, "delay:"))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("Fault %s has invalid delay %s", spec, action)
+		}
+		r.delay = d
+	default:
+		status, err := strconv.Atoi(action)
+		if err != nil || r.target != faultS3 || status < 400 || status > 599 {
+			return nil, fmt.Errorf("Fault %s has unsupported action %s", spec, action)
+		}
+		r.status = status
+	}
+	return r, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// faultInjector holds the fault rules of a mount, it's nil unless fault
+// injection is enabled.
+type faultInjector struct {
+	m     sync.Mutex
+	rules []*faultRule
+}
+
+// match counts the call of op on target for the matching rules, and
+// returns the first rule firing.
+func (fi *faultInjector) match(target, op string) *faultRule {
+	if fi == nil {
+		return nil
+	}
+
+	fi.m.Lock()
+	defer fi.m.Unlock()
+
+	var fired *faultRule
+	for _, r := range fi.rules {
+		if r.target != target || (r.op != "*" && r.op != op) {
+			continue
+		}
+		r.calls++
+		if fired == nil && (r.calls == r.call || (r.later && r.calls > r.call)) {
+			fired = r
+		}
+	}
+	return fired
+}
+
+// errFaultsDisabled is returned when programming faults of a mount without
+// fault injection.
+var errFaultsDisabled = errors.New("Fault injection is not enabled, mount with the unsafe-faults option")
+
+// InjectFault adds the fault rule spec, see faultRule for the syntax.
+func (mfs *MinFS) InjectFault(spec string) error {
+	if mfs.faults == nil {
+		return errFaultsDisabled
+	}
+
+	r, err := parseFault(spec)
+	if err != nil {
+		return err
+	}
+
+	mfs.faults.m.Lock()
+	mfs.faults.rules = append(mfs.faults.rules, r)
+	mfs.faults.m.Unlock()
+
+	mfs.log.Warn("Fault injected", F("fault", spec))
+	return nil
+}
+
+// ClearFaults removes all fault rules.
+func (mfs *MinFS) ClearFaults() error {
+	if mfs.faults == nil {
+		return errFaultsDisabled
+	}
+
+	mfs.faults.m.Lock()
+	mfs.faults.rules = nil
+	mfs.faults.m.Unlock()
+	return nil
+}
+
+// Faults returns the fault rules and the number of calls they matched.
+func (mfs *MinFS) Faults() map[string]uint64 {
+	if mfs.faults == nil {
+		return nil
+	}
+
+	mfs.faults.m.Lock()
+	defer mfs.faults.m.Unlock()
+
+	faults := map[string]uint64{}
+	for _, r := range mfs.faults.rules {
+		faults[r.spec] += r.calls
+	}
+	return faults
+}
+
+// cacheFault returns the error injected in the cache file operation op,
+// after sleeping the injected delay.
+func (mfs *MinFS) cacheFault(op string) error {
+	r := mfs.faults.match(faultCache, op)
+	if r == nil {
+		return nil
+	}
+	if r.delay > 0 {
+		time.Sleep(r.delay)
+		return nil
+	}
+	return fuse.EIO
+}
+
+// s3Op returns the fault operation of an S3 request.
+func s3Op(req *http.Request) string {
+	q := req.URL.Query()
+
+	switch req.Method {
+	case http.MethodHead:
+		return "head"
+	case http.MethodDelete:
+		return "delete"
+	case http.MethodGet:
+		for _, k := range []string{"list-type", "prefix", "delimiter", "marker", "uploads"} {
+			if _, ok := q[k]; ok {
+				return "list"
+			}
+		}
+		return "get"
+	case http.MethodPut:
+		if q.Get("partNumber") != "" {
+			return "part"
+		}
+		if req.Header.Get("X-Amz-Copy-Source") != "" {
+			return "copy"
+		}
+		return "put"
+	case http.MethodPost:
+		if _, ok := q["uploads"]; ok {
+			return "create-multipart"
+		}
+		if q.Get("uploadId") != "" {
+			return "complete"
+		}
+	}
+	return "post"
+}
+
+// faultCodes are the S3 error codes of injected statuses.
+var faultCodes = map[int]string{
+	http.StatusForbidden:           "AccessDenied",
+	http.StatusNotFound:            "NoSuchKey",
+	http.StatusInternalServerError: "InternalError",
+	http.StatusServiceUnavailable:  "SlowDown",
+}
+
+// faultTransport injects the faults of S3 requests.
+type faultTransport struct {
+	http.RoundTripper
+
+	faults *faultInjector
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := t.faults.match(faultS3, s3Op(req))
+	if r == nil {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	switch {
+	case r.delay > 0:
+		select {
+		case <-time.After(r.delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	case r.reset:
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	case r.status != 0:
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return faultResponse(req, r.status), nil
+	}
+
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err == nil && r.corrupt {
+		resp.Body = &corruptReader{ReadCloser: resp.Body}
+	}
+	return resp, err
+}
+
+// faultResponse returns an S3 error response with status.
+func faultResponse(req *http.Request, status int) *http.Response {
+	code, ok := faultCodes[status]
+	if !ok {
+		code = "InjectedFault"
+	}
+
+	var body []byte
+	if req.Method != http.MethodHead {
+		body = []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>%s</Code><Message>Injected fault</Message><RequestId>minfs-fault</RequestId></Error>`, code))
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/xml")
+	header.Set("X-Amz-Request-Id", "minfs-fault")
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// corruptReader flips the bits of the first byte read.
+type corruptReader struct {
+	io.ReadCloser
+
+	done bool
+}
+
+func (r *corruptReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && !r.done {
+		p[0] ^= 0xff
+		r.done = true
+	}
+	return n, err
+}
@@ -0,0 +1,341 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestParseFault(t *testing.T) {
+	testCases := []struct {
+		spec  string
+		valid bool
+	}{
+		{"s3:part:3:503", true},
+		{"s3:get:1:corrupt", true},
+		{"s3:*:2+:reset", true},
+		{"s3:put:*:delay:100ms", true},
+		{"cache:read:1:eio", true},
+		{"cache:write:*:delay:1s", true},
+		{"s3:part:3", false},
+		{"disk:read:1:eio", false},
+		{"s3:rename:1:503", false},
+		{"s3:get:0:503", false},
+		{"s3:get:x:503", false},
+		{"s3:get:1:200", false},
+		{"s3:get:1:eio", false},
+		{"cache:read:1:503", false},
+		{"cache:read:1:corrupt", false},
+		{"s3:get:1:delay:-1s", false},
+	}
+
+	for _, testCase := range testCases {
+		_, err := parseFault(testCase.spec)
+		if testCase.valid && err != nil {
+			t.Errorf("expected %s to be valid, got %v", testCase.spec, err)
+		} else if !testCase.valid && err == nil {
+			t.Errorf("expected %s to be invalid", testCase.spec)
+		}
+	}
+}
+
+func TestFaultCalls(t *testing.T) {
+	testCases := []struct {
+		spec  string
+		fired []bool
+	}{
+		{"s3:get:2:503", []bool{false, true, false, false}},
+		{"s3:get:2+:503", []bool{false, true, true, true}},
+		{"s3:get:*:503", []bool{true, true, true, true}},
+	}
+
+	for _, testCase := range testCases {
+		r, err := parseFault(testCase.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi := &faultInjector{rules: []*faultRule{r}}
+		for i, fired := range testCase.fired {
+			// calls of other operations don't count
+			if fi.match(faultS3, "put") != nil || fi.match(faultCache, "read") != nil {
+				t.Errorf("expected %s to match get calls only", testCase.spec)
+			}
+			if got := fi.match(faultS3, "get") != nil; got != fired {
+				t.Errorf("expected %s to fire %t on call %d, got %t", testCase.spec, fired, i+1, got)
+			}
+		}
+	}
+
+	var fi *faultInjector
+	if fi.match(faultS3, "get") != nil {
+		t.Errorf("expected no faults without fault injection")
+	}
+}
+
+// TestFaultPartFailed fails the third part of a multipart upload with
+// 503, the parts aren't retried by the client, the upload is retried in
+// the background and completes.
+func TestFaultPartFailed(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+
+	m := newTestMount(t, s3, t.TempDir(), PartSize(minPartSize), UploadConcurrency(1), UnsafeFaults("s3:part:3:503"))
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4*minPartSize/16)
+	_, fh, err := m.create("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.write(fh, 0, data)
+	if err = m.close(fh); err == nil {
+		t.Fatalf("expected the upload to fail")
+	}
+	if _, ok := s3.get(testBucket, "file"); ok {
+		t.Fatalf("expected no object of the failed upload")
+	}
+	if n := s3.count("PutObjectPart"); n != 2 {
+		t.Errorf("expected the upload to stop at the failed part, got %d parts", n)
+	}
+
+	p, ok := m.pending("file")
+	if !ok {
+		t.Fatalf("expected a pending upload of the failed upload")
+	}
+	if err = m.uploadPending("file", p); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, ok := s3.get(testBucket, "file"); !ok || !bytes.Equal(got, data) {
+		t.Fatalf("expected the object to be uploaded, got %d bytes", len(got))
+	}
+	if n := m.Faults()["s3:part:3:503"]; n != 7 {
+		t.Errorf("expected the 3 parts of the failed upload and the 4 of the retry to be matched, got %d calls", n)
+	}
+	if _, ok := m.pending("file"); ok {
+		t.Errorf("expected the pending upload to be removed")
+	}
+}
+
+// TestFaultUploadRecovered fails the uploads of a file, the changes are
+// kept as pending upload and uploaded once the remote recovers.
+func TestFaultUploadRecovered(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+
+	m := newTestMount(t, s3, t.TempDir(), UnsafeFaults("s3:put:*:403"))
+
+	_, fh, err := m.create("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.write(fh, 0, []byte("changes"))
+	if err = m.close(fh); err == nil {
+		t.Fatalf("expected the upload to fail")
+	} else if en, ok := err.(fuse.ErrorNumber); !ok || en.Errno() != fuse.Errno(syscall.EACCES) {
+		t.Errorf("expected the close to fail with EACCES, got %v", err)
+	}
+	if _, ok := s3.get(testBucket, "file"); ok {
+		t.Fatalf("expected no object while the uploads fail")
+	}
+
+	p, ok := m.pending("file")
+	if !ok {
+		t.Fatalf("expected a pending upload of the failed upload")
+	}
+	if err = m.uploadPending("file", p); err == nil {
+		t.Fatalf("expected the retry to fail while the fault is injected")
+	}
+	if p, _ = m.pending("file"); p.Attempts != 1 || p.GaveUp {
+		t.Errorf("expected the retry to be counted, got %+v", p)
+	}
+
+	// the remote recovers
+	if err = m.ClearFaults(); err != nil {
+		t.Fatal(err)
+	}
+	p, _ = m.pending("file")
+	if err = m.uploadPending("file", p); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, ok := s3.get(testBucket, "file"); !ok || string(got) != "changes" {
+		t.Errorf("expected the changes to be uploaded, got %q", got)
+	}
+	if _, ok := m.pending("file"); ok {
+		t.Errorf("expected the pending upload to be removed")
+	}
+	if n := m.Stats().UploadRetries; n != 1 {
+		t.Errorf("expected 1 upload retry, got %d", n)
+	}
+}
+
+// TestFaultCorruptDownload corrupts the first download of a file, the
+// checksum mismatch is detected and the download retried.
+func TestFaultCorruptDownload(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+
+	cache := t.TempDir()
+	m := newTestMount(t, s3, cache, Checksum("sha256"))
+	data := []byte("checksummed content")
+	m.writeFile("file", data)
+	m.stop()
+
+	m = newTestMount(t, s3, t.TempDir(), Checksum("sha256"), UnsafeFaults())
+
+	// the first get of the mount would be the bucket location otherwise
+	if err := m.InjectFault("s3:get:1:corrupt"); err != nil {
+		t.Fatal(err)
+	}
+	gets := s3.count("GetObject")
+	if got := m.readFile("file"); !bytes.Equal(got, data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+	if n := s3.count("GetObject") - gets; n != 2 {
+		t.Errorf("expected the corrupted download to be retried once, got %d downloads", n)
+	}
+	if !strings.Contains(m.logs.String(), "unexpected checksum") {
+		t.Errorf("expected the checksum mismatch to be logged")
+	}
+}
+
+// TestFaultCacheRead fails a read of the cache file with EIO, the next
+// read succeeds.
+func TestFaultCacheRead(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "file", []byte("file"))
+
+	m := newTestMount(t, s3, t.TempDir(), UnsafeFaults("cache:read:1:eio"))
+
+	fh, err := m.open("file", fuse.OpenReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.close(fh)
+
+	err = fh.Read(context.Background(), &fuse.ReadRequest{Size: 16}, &fuse.ReadResponse{})
+	if en, ok := err.(fuse.ErrorNumber); !ok || en.Errno() != fuse.EIO {
+		t.Fatalf("expected the read to fail with EIO, got %v", err)
+	}
+	if got := m.read(fh); string(got) != "file" {
+		t.Errorf("expected the next read to succeed, got %q", got)
+	}
+}
+
+// TestFaultConflictCopy fails the upload of the conflict copy of a file
+// changed by another client, the local changes stay dirty and the next
+// flush uploads the copy.
+func TestFaultConflictCopy(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "file", []byte("base"))
+
+	m := newTestMount(t, s3, t.TempDir(), ConflictPolicy(conflictCopy), UnsafeFaults("s3:put:1:403"))
+
+	fh, err := m.open("file", fuse.OpenReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.write(fh, 0, []byte("ours"))
+	s3.put(testBucket, "file", []byte("theirs"))
+
+	if err = fh.Flush(context.Background(), &fuse.FlushRequest{}); err == nil {
+		t.Fatalf("expected the upload of the conflict copy to fail")
+	}
+	if !fh.dirty {
+		t.Errorf("expected the local changes to stay dirty")
+	}
+
+	if err = m.close(fh); err != nil {
+		t.Fatal(err)
+	}
+
+	var copies []string
+	for _, key := range s3.keys(testBucket) {
+		if strings.HasPrefix(key, "file.conflict-") {
+			copies = append(copies, key)
+		}
+	}
+	if len(copies) != 1 {
+		t.Fatalf("expected a conflict copy, got %v", s3.keys(testBucket))
+	}
+	if got, _ := s3.get(testBucket, copies[0]); string(got) != "ours" {
+		t.Errorf("expected the local changes in the conflict copy, got %q", got)
+	}
+	if got, _ := s3.get(testBucket, "file"); string(got) != "theirs" {
+		t.Errorf("expected the remote changes to be kept, got %q", got)
+	}
+	if n := m.Stats().Conflicts; n != 2 {
+		t.Errorf("expected the conflict to be detected by both flushes, got %d", n)
+	}
+}
+
+func TestControlFault(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "file", []byte("file"))
+
+	m := newTestMount(t, s3, t.TempDir(), UnsafeFaults())
+	plain := newTestMount(t, s3, t.TempDir())
+
+	resp := queryTestControl(t, ControlRequest{Command: "fault", Path: m.config.mountpoint, Fault: "s3:get:*:403"}, m, plain)
+	if resp.Error != "" {
+		t.Fatalf("expected the fault to be injected, got %s", resp.Error)
+	}
+	if _, ok := resp.Faults["s3:get:*:403"]; !ok {
+		t.Errorf("expected the injected fault in the response, got %v", resp.Faults)
+	}
+
+	if _, err := m.open("file", fuse.OpenReadOnly); err == nil {
+		t.Fatalf("expected the download to fail")
+	}
+
+	resp = queryTestControl(t, ControlRequest{Command: "fault", Path: m.config.mountpoint}, m, plain)
+	if n := resp.Faults["s3:get:*:403"]; n == 0 {
+		t.Errorf("expected the calls matching the fault to be listed, got %v", resp.Faults)
+	}
+
+	resp = queryTestControl(t, ControlRequest{Command: "clear-faults", Path: m.config.mountpoint}, m, plain)
+	if resp.Error != "" || len(resp.Faults) != 0 {
+		t.Fatalf("expected the faults to be removed, got %+v", resp)
+	}
+	if got := m.readFile("file"); string(got) != "file" {
+		t.Errorf("expected file, got %q", got)
+	}
+
+	resp = queryTestControl(t, ControlRequest{Command: "fault", Path: m.config.mountpoint, Fault: "s3:rename:1:503"}, m, plain)
+	if resp.Error == "" {
+		t.Errorf("expected the invalid fault to be refused")
+	}
+
+	for _, req := range []ControlRequest{
+		{Command: "fault", Path: plain.config.mountpoint, Fault: "s3:get:*:403"},
+		{Command: "fault", Path: plain.config.mountpoint},
+		{Command: "clear-faults", Path: plain.config.mountpoint},
+	} {
+		if resp = queryTestControl(t, req, m, plain); resp.Error != errFaultsDisabled.Error() {
+			t.Errorf("expected %s of a mount without fault injection to fail, got %+v", req.Command, resp)
+		}
+	}
+}
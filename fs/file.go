@@ -19,9 +19,12 @@ package minfs
 import (
 	"context"
 	"crypto/sha256"
+	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path"
+	"sync/atomic"
 	"time"
 
 	"bazil.org/fuse"
@@ -43,7 +46,11 @@ type File struct {
 	Mode os.FileMode
 
 	Size uint64
-	ETag string
+
+	// ETag and LastModified are of the remote object as last seen by a
+	// listing, stat, download or upload.
+	ETag         string
+	LastModified time.Time
 
 	Atime time.Time
 	Mtime time.Time
@@ -58,6 +65,45 @@ type File struct {
 	Flags    uint32 // see chflags(2)
 
 	Hash []byte
+
+	// CachePath is the cache file kept for reuse, holding the content
+	// of the object with CacheETag.
+	CachePath string
+	CacheETag string
+
+	// ModeSet is set once the mode is set by create or chmod, otherwise
+	// the mode is the default of the mount.
+	ModeSet bool
+
+	// LocalOnly is set on scratch mounts once the file is written, and on
+	// Finder files kept local, the cache file is its content and the
+	// remote object is left alone.
+	LocalOnly bool
+
+	// cached object lock status, see refreshRetention
+	RetentionMode    string
+	RetainUntil      time.Time
+	LegalHold        bool
+	RetentionChecked time.Time
+
+	// attributes of the object with StatETag, see statAttrs
+	StatETag   string
+	ExpiryDate time.Time
+	ExpiryRule string
+	SSE        string
+	SSEKMSKey  string
+
+	// last access of the entry, updated at most once per touch interval,
+	// see evict
+	Accessed time.Time
+
+	// bytes transferred of the object, counted at the end of downloads
+	// and uploads
+	BytesDownloaded uint64
+	BytesUploaded   uint64
+
+	// unlinked is set once the file is removed while open, see unlink.go
+	unlinked bool
 }
 
 func (f *File) store(tx *meta.Tx) error {
@@ -67,35 +113,81 @@ func (f *File) store(tx *meta.Tx) error {
 
 // Attr - attr file context.
 func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
+	defer f.mfs.config.reportedAttr(a)
+
 	*a = fuse.Attr{
 		Inode:  f.Inode,
 		Size:   f.Size,
-		Atime:  f.Atime,
+		Atime:  f.atime(),
 		Mtime:  f.Mtime,
 		Ctime:  f.Chgtime,
 		Crtime: f.Crtime,
-		Mode:   f.Mode,
+		Mode:   f.mode(),
 		Uid:    f.UID,
 		Gid:    f.GID,
-		Flags:  f.Flags,
+		Flags:  f.flags(),
+		Nlink:  f.nlink(),
 	}
 
 	return nil
 }
 
 // Setattr - set attribute.
-func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	defer mapErrno(&err)
+
+	f.mfs.opPath(ctx, f.FullPath())
+	if err = f.mfs.denyWrite(f.BucketName()); err != nil {
+		return err
+	}
+
+	// an unlinked file has no entry to store the attributes in
+	if f.unlinked {
+		return f.setattrUnlinked(req)
+	}
+
+	ignoreUID, ignoreGID := f.mfs.config.overriddenAttrs(req)
+	if f.mfs.config.strictAttrs && (ignoreUID || ignoreGID) {
+		return fuse.EPERM
+	}
+
+	if req.Valid.Mode() || req.Valid.Uid() || req.Valid.Gid() || req.Valid.Size() {
+		defer func() {
+			ev := AuditEvent{Op: "setattr", Path: f.FullPath()}
+			if req.Valid.Mode() {
+				ev.Mode = req.Mode.String()
+			}
+			if req.Valid.Uid() || req.Valid.Gid() {
+				ev.Owner = fmt.Sprintf("%d:%d", f.UID, f.GID)
+			}
+			if req.Valid.Size() {
+				ev.Size = &req.Size
+			}
+			f.mfs.audit(ev, &req.Header, err)
+		}()
+	}
+
+	if req.Valid.Size() {
+		if err := f.checkRetention(); err != nil {
+			return err
+		}
+		if err := f.truncate(ctx, req.Size); err != nil {
+			return err
+		}
+	}
+
 	// update cache with new attributes
-	return f.mfs.db.Update(func(tx *meta.Tx) error {
+	return f.mfs.update(ctx, func(tx *meta.Tx) error {
 		if req.Valid.Mode() {
 			f.Mode = req.Mode
+			f.ModeSet = true
 		}
 
-		if req.Valid.Uid() {
+		if req.Valid.Uid() && !ignoreUID {
 			f.UID = req.Uid
 		}
 
-		if req.Valid.Gid() {
+		if req.Valid.Gid() && !ignoreGID {
 			f.GID = req.Gid
 		}
 
@@ -131,100 +223,471 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 	})
 }
 
+// truncate changes the size of the file content. Open handles are
+// truncated and uploaded when flushed, otherwise the object is replaced
+// right away.
+func (f *File) truncate(ctx context.Context, size uint64) error {
+	if handles := f.mfs.openHandles(f.FullPath()); len(handles) > 0 {
+		for _, fh := range handles {
+			if err := fh.File.Truncate(int64(size)); err != nil {
+				return err
+			}
+			if err := fh.markDirty(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if size == f.Size {
+		return nil
+	}
+
+	if f.mfs.config.scratch || f.LocalOnly {
+		return f.truncateLocal(size)
+	}
+
+	cachePath, err := f.mfs.NewCachePath()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(cachePath)
+
+	file, err := os.Create(cachePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// an empty object doesn't need the current content
+	if size > 0 {
+		if err = f.download(ctx, file, false); err != nil {
+			return err
+		}
+	}
+
+	if err = file.Truncate(int64(size)); err != nil {
+		return err
+	}
+
+	sr := newPutOp(f.BucketName(), cachePath, f.RemotePath(), int64(size))
+	if err = f.mfs.sync(&sr); err != nil {
+		return err
+	}
+	if err = <-sr.Error; err != nil {
+		return err
+	}
+
+	// the reusable cache file has the previous content
+	if f.CachePath != "" {
+		f.mfs.removeCacheFile(f.CachePath, evictReplaced)
+		f.CachePath = ""
+		f.CacheETag = ""
+	}
+
+	f.Size = size
+	return nil
+}
+
 // RemotePath will return the full path on bucket
 func (f *File) RemotePath() string {
 	return path.Join(f.dir.RemotePath(), f.Path)
 }
 
+// BucketName will return the bucket the file is stored in
+func (f *File) BucketName() string {
+	return f.dir.BucketName()
+}
+
 // FullPath will return the full path
 func (f *File) FullPath() string {
 	return path.Join(f.dir.FullPath(), f.Path)
 }
 
+// cacheReusable returns true if the cache file of a previous open can be
+// reused after revalidating it against the remote.
+func (f *File) cacheReusable(req *fuse.OpenRequest) bool {
+	if !f.mfs.config.cacheReuse || f.CachePath == "" || f.CacheETag == "" {
+		return false
+	}
+
+	if req.Flags&fuse.OpenTruncate == fuse.OpenTruncate {
+		return false
+	}
+
+	// a cache file with another size than the object is damaged
+	fi, err := os.Stat(f.CachePath)
+	return err == nil && uint64(fi.Size()) == f.Size
+}
+
 // Saves a new file at cached path and fetches the object based on
-// the incoming fuse request.
-func (f *File) cacheSave(path string, req *fuse.OpenRequest) error {
-	file, err := os.Create(path)
-	if err != nil {
-		return err
+// the incoming fuse request. A reusable cache file is revalidated against
+// the remote, unless current is set. Nothing is created for truncating
+// opens, or when the object can't be fetched.
+func (f *File) cacheSave(ctx context.Context, path string, req *fuse.OpenRequest, current bool) error {
+	if path == f.CachePath && f.cacheReusable(req) {
+		if current {
+			atomic.AddUint64(&f.mfs.stats.Revalidations, 1)
+			return nil
+		}
+		return f.cacheRevalidate(ctx, path)
 	}
-	defer file.Close()
 
+	// the handle creates the empty cache file of a truncating open
 	if req.Flags&fuse.OpenTruncate == fuse.OpenTruncate {
 		f.Size = 0
+		f.CacheETag = ""
 		return nil
 	}
 
-	object, err := f.mfs.api.GetObject(f.mfs.config.bucket, f.RemotePath(), minio.GetObjectOptions{})
+	// the opens waiting for the turn meanwhile copy the download
+	return f.sharedDownload(ctx, path)
+}
+
+// download fetches the object into the cache file, content failing the
+// checksum is downloaded once more before failing unless retry is set.
+// Each attempt reads the whole object sequentially from offset 0, reads
+// are served by the cache file only, so the content is of a single
+// version. The attempt after a failed one is pinned with If-Match to the
+// version of the failed one, an object replaced meanwhile is downloaded
+// again from the start.
+func (f *File) download(ctx context.Context, file *os.File, retry bool) error {
+	var etag string
+	for {
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		opts := f.mfs.getObjectOptions()
+		if etag != "" {
+			if err := opts.SetMatchETag(etag); err != nil {
+				return err
+			}
+		}
+
+		object, err := f.mfs.api.GetObjectWithContext(ctx, f.BucketName(), f.RemotePath(), opts)
+		if err != nil {
+			if isNotFound(err) {
+				return fuse.ENOENT
+			}
+			return err
+		}
+
+		err = f.cacheFill(file, object)
+		if err != nil {
+			if objInfo, serr := object.Stat(); serr == nil {
+				etag = objInfo.ETag
+			}
+		}
+		object.Close()
+
+		if minio.ToErrorResponse(err).StatusCode == http.StatusPreconditionFailed {
+			atomic.AddUint64(&f.mfs.stats.PreconditionFailures, 1)
+			f.logger().Warn("Object replaced during the download, downloading the new version", F("object", f.RemotePath()), F("etag", etag))
+			etag = ""
+			continue
+		}
+
+		if !retryDownload(err) {
+			return err
+		} else if retry {
+			return fuse.EIO
+		}
+		retry = true
+
+		f.logger().Warn("Download failed, retrying", F("object", f.RemotePath()), F("error", err))
+	}
+}
+
+// cacheRevalidate keeps the cache file at path if the remote object
+// still has the cached ETag, otherwise the new version is fetched.
+func (f *File) cacheRevalidate(ctx context.Context, path string) error {
+	opts := f.mfs.getObjectOptions()
+	// ETags are compared as opaque strings, which is also correct for
+	// multipart objects.
+	if err := opts.SetMatchETagExcept(f.CacheETag); err != nil {
+		return err
+	}
+
+	object, err := f.mfs.api.GetObjectWithContext(ctx, f.BucketName(), f.RemotePath(), opts)
 	if err != nil {
-		if meta.IsNoSuchObject(err) {
+		if isNotFound(err) {
 			return fuse.ENOENT
 		}
 		return err
 	}
 	defer object.Close()
 
-	hasher := sha256.New()
-	size, err := io.Copy(file, io.TeeReader(object, hasher))
+	if _, err = object.Stat(); err != nil {
+		if minio.ToErrorResponse(err).StatusCode == http.StatusNotModified {
+			atomic.AddUint64(&f.mfs.stats.Revalidations, 1)
+			return nil
+		}
+		if isNotFound(err) {
+			return fuse.ENOENT
+		}
+		return err
+	}
+
+	// the new version replaces the cache file once it's complete, a
+	// crash leaves the partial file which is removed at mount
+	partPath := path + partialSuffix
+	file, err := os.Create(partPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partPath)
+	defer file.Close()
+
+	if err = f.cacheFill(file, object); retryDownload(err) {
+		f.logger().Warn("Download failed, retrying", F("object", f.RemotePath()), F("error", err))
+		err = f.download(ctx, file, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(partPath, path)
+}
+
+// cacheFill copies the content of object into the cache file.
+func (f *File) cacheFill(file *os.File, object *minio.Object) (err error) {
+	if err := f.mfs.cacheFault("write"); err != nil {
+		return err
+	}
+
+	tt := f.mfs.trackTransfer(Download, f.BucketName(), f.RemotePath(), int64(f.Size))
+	defer func() {
+		tt.finish(err)
+	}()
+
+	algorithm := f.mfs.config.checksum
+
+	hasher := newChecksum(algorithm)
+	if hasher == nil {
+		hasher = sha256.New()
+	}
+
+	size, err := io.Copy(file, io.TeeReader(countingReader{tt.reader(object), &f.mfs.stats.BytesDownloaded}, hasher))
+	f.BytesDownloaded += uint64(size)
+	if err != nil {
+		if isNotFound(err) {
+			return fuse.ENOENT
+		}
+		return err
+	}
+
+	objInfo, err := object.Stat()
 	if err != nil {
 		return err
 	}
 
+	// a connection closed midway may look like the end of the content
+	if objInfo.Size >= 0 && size != objInfo.Size {
+		return errShortDownload
+	}
+
+	atomic.AddUint64(&f.mfs.stats.Downloads, 1)
+
+	// hash will be used when encrypting files
+	sum := hasher.Sum(nil)
+
+	if expected := objectChecksum(objInfo, algorithm); expected != "" && expected != encodeChecksum(sum) {
+		f.logger().Warn("Download has an unexpected checksum", F("object", f.RemotePath()), F("checksum", encodeChecksum(sum)), F("expected", expected))
+		return errChecksumMismatch
+	}
+
 	// update actual file size
 	f.Size = uint64(size)
+	f.ETag = objInfo.ETag
+	f.LastModified = objInfo.LastModified
+	f.CacheETag = objInfo.ETag
+	f.Hash = sum
 
-	// hash will be used when encrypting files
-	_ = hasher.Sum(nil)
+	// the response has the headers of a stat
+	f.setStatAttrs(objInfo)
 
 	// Success.
 	return nil
 }
 
 // Open return a file handle of the opened file
-func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	if err := f.dir.mfs.wait(f.Path); err != nil {
-		return nil, err
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle, err error) {
+	defer mapErrno(&err)
+
+	f.mfs.opPath(ctx, f.FullPath())
+
+	// the path may be taken by a new file already
+	if f.unlinked {
+		return nil, fuse.ENOENT
 	}
 
-	// Start a writable transaction.
-	tx, err := f.mfs.db.Begin(true)
-	if err != nil {
-		return nil, err
+	if !req.Flags.IsReadOnly() || req.Flags&fuse.OpenTruncate == fuse.OpenTruncate {
+		if err := f.mfs.denyWrite(f.BucketName()); err != nil {
+			return nil, err
+		}
+		if f.mfs.stopping() {
+			return nil, errStopping
+		}
 	}
 
-	defer tx.Rollback()
+	// the download of the open holding the turn is copied while waiting
+	// for it, instead of downloading the object once more
+	var (
+		cachePath, sharedPath string
+		shared                *File
+	)
+	if !f.mfs.config.cacheReuse && req.Flags.IsReadOnly() && req.Flags&fuse.OpenTruncate == 0 {
+		if sharedPath, shared, err = f.mfs.copyDownload(ctx, f.downloadKey()); err != nil {
+			return nil, err
+		}
+		if shared != nil {
+			defer func() {
+				if err != nil || cachePath != sharedPath {
+					os.Remove(sharedPath)
+				}
+			}()
+		}
+	}
 
-	cachePath, err := f.dir.mfs.NewCachePath()
+	done, err := f.dir.mfs.wait(ctx, f.FullPath())
 	if err != nil {
 		return nil, err
 	}
+	defer done()
 
-	err = f.cacheSave(cachePath, req)
-	if err != nil {
-		return nil, err
+	if !req.Flags.IsReadOnly() || req.Flags&fuse.OpenTruncate == fuse.OpenTruncate {
+		if err := f.checkRetention(); err != nil {
+			return nil, err
+		}
+	}
+
+	// the download happens outside of the transaction, which would hold
+	// off all other writers
+	if f.LocalOnly {
+		// the content only exists in the cache file
+		cachePath = f.CachePath
+		if req.Flags&fuse.OpenTruncate == fuse.OpenTruncate {
+			f.Size = 0
+		}
+	} else if p, ok := f.mfs.pending(f.FullPath()); ok {
+		// the remote doesn't have the content yet, use the cache file
+		// of the pending upload
+		cachePath = p.Source
+		if req.Flags&fuse.OpenTruncate == fuse.OpenTruncate {
+			f.Size = 0
+		}
+	} else if cached := req.Flags.IsReadOnly() && f.cacheReusable(req); cached && f.mfs.unreachable() {
+		// reads are served from the cache file while the endpoint is
+		// unreachable
+		cachePath = f.CachePath
+	} else {
+		// the cache file is the fallback of the checks, which don't
+		// wait for the endpoint then, even on hard mounts
+		checkCtx := ctx
+		if cached {
+			checkCtx = withRetryMode(ctx, retrySoft)
+		}
+
+		// the cache file is current without checking the remote when the
+		// mount accepts stale content
+		current := !f.mfs.config.openCheck
+		if f.mfs.config.openCheck && req.Flags&fuse.OpenTruncate == 0 {
+			if current, err = f.checkRemote(checkCtx); err != nil {
+				if !cached || !f.mfs.unreachable() {
+					return nil, err
+				}
+				current = true
+			}
+		}
+
+		if shared != nil && shared.ETag == f.ETag {
+			// the copied download is of the current version
+			cachePath = sharedPath
+			f.sharedWith(shared)
+			atomic.AddUint64(&f.mfs.stats.SharedDownloads, 1)
+		} else {
+			if f.cacheReusable(req) {
+				cachePath = f.CachePath
+			} else if cachePath, err = f.dir.mfs.NewCachePath(); err != nil {
+				return nil, err
+			} else {
+				// the new cache file is removed unless the handle is
+				// opened
+				defer func() {
+					if err != nil {
+						os.Remove(cachePath)
+					}
+				}()
+			}
+
+			done := f.mfs.opRemote(ctx, "GetObject "+f.BucketName()+"/"+f.RemotePath())
+			err = f.cacheSave(checkCtx, cachePath, req, current)
+			done()
+			if err != nil && (!cached || !f.mfs.unreachable()) {
+				return nil, err
+			}
+		}
+
+		if f.mfs.config.cacheReuse && cachePath != f.CachePath {
+			// the previous cache file is outdated
+			if f.CachePath != "" {
+				f.mfs.removeCacheFile(f.CachePath, evictReplaced)
+			}
+			f.CachePath = cachePath
+		}
 	}
 
 	fh, err := f.mfs.Acquire(f)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			if fh.File != nil {
+				fh.File.Close()
+			}
+			f.mfs.Release(fh)
+		}
+	}()
 
 	fh.cachePath = cachePath
+	fh.baseETag = f.ETag
+	fh.flags = req.Flags
 
-	fh.File, err = os.OpenFile(fh.cachePath, int(req.Flags), f.mfs.config.mode)
-	if err != nil {
-		return nil, err
+	// the kernel doesn't pass O_CREAT, the cache file of a truncating
+	// open is created here
+	flags := f.mfs.config.cacheFileFlags(req.Flags)
+	if req.Flags&fuse.OpenTruncate == fuse.OpenTruncate {
+		flags |= os.O_CREATE
 	}
-
-	if err = f.store(tx); err != nil {
+	fh.File, err = os.OpenFile(fh.cachePath, flags, f.mfs.config.mode)
+	if err != nil {
 		return nil, err
 	}
 
-	if err = tx.Commit(); err != nil {
+	if err = f.mfs.update(ctx, func(tx *meta.Tx) error {
+		// the truncated content has to be uploaded, even if nothing is
+		// written
+		if req.Flags&fuse.OpenTruncate == fuse.OpenTruncate {
+			fh.setDirty(true)
+			if err := f.mfs.journalTx(tx, fh); err != nil {
+				return err
+			}
+		}
+		return f.store(tx)
+	}); err != nil {
 		return nil, err
 	}
 
 	resp.Handle = fuse.HandleID(fh.handle)
+	resp.Flags |= f.mfs.config.openFlags()
 	return fh, nil
 }
 
@@ -234,18 +697,23 @@ func (f *File) bucket(tx *meta.Tx) *meta.Bucket {
 }
 
 // Getattr returns the file attributes
-func (f *File) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error {
+func (f *File) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) (err error) {
+	defer mapErrno(&err)
+
+	defer f.mfs.config.reportedAttr(&resp.Attr)
+
 	resp.Attr = fuse.Attr{
 		Inode:  f.Inode,
 		Size:   f.Size,
-		Atime:  f.Atime,
+		Atime:  f.atime(),
 		Mtime:  f.Mtime,
 		Ctime:  f.Chgtime,
 		Crtime: f.Crtime,
-		Mode:   f.Mode,
+		Mode:   f.mode(),
 		Uid:    f.UID,
 		Gid:    f.GID,
-		Flags:  f.Flags,
+		Flags:  f.flags(),
+		Nlink:  f.nlink(),
 	}
 
 	return nil
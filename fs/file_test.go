@@ -0,0 +1,580 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+)
+
+// cacheFiles returns the names of the files in the cache dir.
+func cacheFiles(t *testing.T, cache string) []string {
+	t.Helper()
+
+	fis, err := ioutil.ReadDir(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestOpenCacheFiles checks failed opens leave no cache file behind, and
+// truncating opens create the one of their handle only.
+func TestOpenCacheFiles(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	for _, name := range []string{"deleted", "raced", "failed", "truncated", "read"} {
+		s3.put(testBucket, name, []byte(name))
+	}
+
+	cache := t.TempDir()
+	m := newTestMount(t, s3, cache)
+	for _, name := range []string{"deleted", "raced", "failed", "truncated", "read"} {
+		if _, err := m.lookup(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := cacheFiles(t, cache)
+
+	// removed behind the back of the mount, the check of the open fails
+	s3.remove(testBucket, "deleted")
+	if _, err := m.open("deleted", fuse.OpenReadOnly); !isNotFound(err) {
+		t.Errorf("expected ENOENT, got %v", err)
+	}
+
+	// removed between the check and the download
+	s3.setIntercept(func(op string, w http.ResponseWriter, r *http.Request) bool {
+		switch {
+		case op != "GetObject":
+			return false
+		case r.URL.Path == "/"+testBucket+"/raced":
+			fakeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		default:
+			fakeError(w, http.StatusForbidden, "AccessDenied", "Access Denied.")
+		}
+		return true
+	})
+	if _, err := m.open("raced", fuse.OpenReadOnly); !isNotFound(err) {
+		t.Errorf("expected ENOENT, got %v", err)
+	}
+	if _, err := m.open("failed", fuse.OpenReadOnly); err == nil {
+		t.Errorf("expected the failed download to fail the open")
+	}
+	s3.setIntercept(nil)
+
+	if after := cacheFiles(t, cache); !reflect.DeepEqual(after, before) {
+		t.Errorf("expected failed opens to leave no cache file, got %v, had %v", after, before)
+	}
+
+	// read-only handles drop their cache file once closed
+	fh, err := m.open("read", fuse.OpenReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.close(fh); err != nil {
+		t.Fatal(err)
+	}
+	if after := cacheFiles(t, cache); !reflect.DeepEqual(after, before) {
+		t.Errorf("expected the cache file of the read to be removed, got %v, had %v", after, before)
+	}
+
+	// the truncating open creates the cache file of its handle, and
+	// nothing else
+	fh, err = m.open("truncated", fuse.OpenWriteOnly|fuse.OpenTruncate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append([]string{filepath.Base(fh.cachePath)}, before...)
+	sort.Strings(expected)
+	if after := cacheFiles(t, cache); !reflect.DeepEqual(after, expected) {
+		t.Errorf("expected the cache file of the handle only, got %v, expected %v", after, expected)
+	}
+	if err = m.close(fh); err != nil {
+		t.Fatal(err)
+	}
+	m.syncQueue.drain()
+
+	if data, ok := s3.get(testBucket, "truncated"); !ok || len(data) != 0 {
+		t.Errorf("expected the truncated object to be uploaded, got %q", data)
+	}
+	if after := cacheFiles(t, cache); len(after) > len(expected) {
+		t.Errorf("expected no stray cache file after the upload, got %v", after)
+	}
+}
+
+// TestOpenInterrupted interrupts slow downloads, by the kernel and by an
+// unmount, which frees the turn of the path and the request to the server
+// right away.
+func TestOpenInterrupted(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "file", []byte("file"))
+
+	m := newTestMount(t, s3, t.TempDir())
+	node, err := m.lookup("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the downloads last until they're cancelled
+	started, cancelled := make(chan struct{}, 1), make(chan struct{}, 1)
+	hold := func(op string, w http.ResponseWriter, r *http.Request) bool {
+		if op != "GetObject" {
+			return false
+		}
+		started <- struct{}{}
+		<-r.Context().Done()
+		cancelled <- struct{}{}
+		return true
+	}
+	s3.setIntercept(hold)
+
+	// open starts an open of the file, and interrupts it with interrupt
+	// once it downloads
+	open := func(interrupt func(cancel context.CancelFunc)) {
+		t.Helper()
+
+		reqCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req := &fuse.OpenRequest{Header: fuse.Header{ID: 1}, Flags: fuse.OpenReadOnly}
+		ctx := m.trackOp(reqCtx, req)
+
+		opened := make(chan error, 1)
+		go func() {
+			_, err := node.(*File).Open(ctx, req, &fuse.OpenResponse{})
+			opened <- err
+		}()
+		<-started
+
+		interrupt(cancel)
+		start := time.Now()
+		select {
+		case err := <-opened:
+			if err == nil {
+				t.Fatalf("expected the interrupted open to fail")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the interrupted open to return")
+		}
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the request of the interrupted download to be cancelled")
+		}
+
+		// the next operation on the path takes its turn right away
+		done, err := m.wait(context.Background(), node.(*File).FullPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		done()
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("expected the interrupted download to be freed within 2s, took %s", d)
+		}
+		if n := lockEntries(m.MinFS); n != 0 {
+			t.Errorf("expected the lock table to be empty, got %d entries", n)
+		}
+	}
+
+	open(func(cancel context.CancelFunc) { cancel() })
+
+	s3.setIntercept(nil)
+	if got := m.readFile("file"); string(got) != "file" {
+		t.Errorf("expected the file to be opened after the interrupted open, got %q", got)
+	}
+	s3.setIntercept(hold)
+
+	// the unmount interrupts the operations in flight
+	open(func(context.CancelFunc) { m.cancelOps() })
+}
+
+// TestOpenChangedObject changes the object on the remote between two
+// opens, the second one reads the new content.
+func TestOpenChangedObject(t *testing.T) {
+	testCases := []struct {
+		name    string
+		options []func(*Config)
+	}{
+		{"default", nil},
+		{"cache reuse", []func(*Config){CacheReuse()}},
+	}
+
+	for _, testCase := range testCases {
+		s3 := newFakeS3(testBucket)
+		s3.put(testBucket, "file", []byte("version 1"))
+
+		cache := t.TempDir()
+		m := newTestMount(t, s3, cache, testCase.options...)
+		if got := m.readFile("file"); string(got) != "version 1" {
+			t.Fatalf("%s: expected version 1, got %q", testCase.name, got)
+		}
+		before := cacheFiles(t, cache)
+
+		// overwritten by another client
+		etag := s3.put(testBucket, "file", []byte("version 2, longer"))
+		if got := m.readFile("file"); string(got) != "version 2, longer" {
+			t.Errorf("%s: expected the new content, got %q", testCase.name, got)
+		}
+		node, err := m.lookup("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f := node.(*File); f.ETag != etag || f.Size != uint64(len("version 2, longer")) {
+			t.Errorf("%s: expected the attributes of the new version, got ETag %s and size %d", testCase.name, f.ETag, f.Size)
+		}
+		if n := s3.count("GetObject"); n != 2 {
+			t.Errorf("%s: expected the new version to be downloaded, got %d GetObjects", testCase.name, n)
+		}
+
+		// the stale cache file is replaced, not kept next to the new one
+		if after := cacheFiles(t, cache); len(after) != len(before) {
+			t.Errorf("%s: expected the stale cache file to be dropped, got %v, had %v", testCase.name, after, before)
+		}
+
+		// unchanged objects are downloaded again only without reuse
+		m.readFile("file")
+		expected := 3
+		if m.config.cacheReuse {
+			expected = 2
+		}
+		if n := s3.count("GetObject"); n != expected {
+			t.Errorf("%s: expected %d GetObjects after reading the unchanged object, got %d", testCase.name, expected, n)
+		}
+		s3.Close()
+	}
+}
+
+// TestOpenNoCheck checks mounts accepting stale content reuse the cache
+// file without checking the remote.
+func TestOpenNoCheck(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "file", []byte("version 1"))
+
+	m := newTestMount(t, s3, t.TempDir(), CacheReuse(), NoOpenCheck())
+	m.readFile("file")
+
+	s3.put(testBucket, "file", []byte("version 2"))
+	heads := s3.count("HeadObject")
+	if got := m.readFile("file"); string(got) != "version 1" {
+		t.Errorf("expected the stale cached content, got %q", got)
+	}
+	if n := s3.count("HeadObject"); n != heads {
+		t.Errorf("expected no HeadObject on open, got %d", n-heads)
+	}
+	if n := s3.count("GetObject"); n != 1 {
+		t.Errorf("expected a single GetObject, got %d", n)
+	}
+}
+
+// TestPartialCacheFile fails downloads midway, the partial cache file is
+// dropped, and the one a crash would leave behind is removed at mount.
+func TestPartialCacheFile(t *testing.T) {
+	testCases := []struct {
+		name    string
+		options []func(*Config)
+	}{
+		{"download", nil},
+		{"revalidation", []func(*Config){CacheReuse()}},
+	}
+
+	for _, testCase := range testCases {
+		s3 := newFakeS3(testBucket)
+		s3.put(testBucket, "file", []byte("cached"))
+
+		cache := t.TempDir()
+		m := newTestMount(t, s3, cache, testCase.options...)
+		m.readFile("file")
+
+		data := bytes.Repeat([]byte("0123456789"), 1<<13)
+		etag := s3.put(testBucket, "file", data)
+		before := cacheFiles(t, cache)
+
+		// the first download fails after half of the content, once the
+		// test looked at the cache dir
+		midway, fail := make(chan struct{}), make(chan struct{})
+		var once sync.Once
+		s3.setIntercept(func(op string, w http.ResponseWriter, r *http.Request) bool {
+			if op != "GetObject" {
+				return false
+			}
+			first := false
+			once.Do(func() { first = true })
+			if !first {
+				return false
+			}
+			w.Header().Set("ETag", `"`+etag+`"`)
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(data[:len(data)/2])
+			w.(http.Flusher).Flush()
+			close(midway)
+			<-fail
+			panic(http.ErrAbortHandler)
+		})
+
+		type result struct {
+			fh  *FileHandle
+			err error
+		}
+		opened := make(chan result, 1)
+		go func() {
+			fh, err := m.open("file", fuse.OpenReadOnly)
+			opened <- result{fh, err}
+		}()
+		select {
+		case <-midway:
+		case r := <-opened:
+			t.Fatalf("%s: expected the open to download, got %v", testCase.name, r.err)
+		}
+
+		// what a crash at this point leaves in the cache dir
+		parts, err := filepath.Glob(filepath.Join(cache, "*"+partialSuffix))
+		if err != nil || len(parts) != 1 {
+			t.Fatalf("%s: expected the partial cache file of the download, got %v", testCase.name, parts)
+		}
+		var partial []byte
+		deadline := time.Now().Add(5 * time.Second)
+		for len(partial) == 0 && time.Now().Before(deadline) {
+			partial, _ = ioutil.ReadFile(parts[0])
+		}
+		if len(partial) == 0 || len(partial) >= len(data) {
+			t.Fatalf("%s: expected a partial download, got %d of %d bytes", testCase.name, len(partial), len(data))
+		}
+
+		// the download is retried, the failed attempt leaves nothing
+		close(fail)
+		r := <-opened
+		if r.err != nil {
+			t.Fatalf("%s: expected the download to be retried, got %v", testCase.name, r.err)
+		}
+		if got := m.read(r.fh); !bytes.Equal(got, data) {
+			t.Errorf("%s: expected the whole content, got %d of %d bytes", testCase.name, len(got), len(data))
+		}
+		if err = m.close(r.fh); err != nil {
+			t.Fatal(err)
+		}
+		s3.setIntercept(nil)
+		if after := cacheFiles(t, cache); len(after) != len(before) {
+			t.Errorf("%s: expected the failed download to leave no file, got %v, had %v", testCase.name, after, before)
+		}
+
+		// the crash leaves the partial file behind, the next mount
+		// removes it instead of trusting it
+		if err = ioutil.WriteFile(parts[0], partial, 0600); err != nil {
+			t.Fatal(err)
+		}
+		m = m.remount()
+		if _, err = os.Stat(parts[0]); !os.IsNotExist(err) {
+			t.Errorf("%s: expected the partial cache file to be removed at mount, got %v", testCase.name, err)
+		}
+		if got := m.readFile("file"); !bytes.Equal(got, data) {
+			t.Errorf("%s: expected the whole content after remounting, got %d of %d bytes", testCase.name, len(got), len(data))
+		}
+		s3.Close()
+	}
+}
+
+// checkETag checks the ETag and LastModified stored for the file name are
+// those of the object on the server.
+func (m *testMount) checkETag(t *testing.T, step, name string) {
+	t.Helper()
+
+	etag, modified, ok := m.s3.stat(testBucket, name)
+	if !ok {
+		t.Fatalf("%s: expected the object %s on the server", step, name)
+	}
+
+	dirName, base := splitName(name)
+	dir := m.dir(dirName)
+	var o interface{}
+	if err := m.db.View(func(tx *meta.Tx) error {
+		return dir.readBucket(tx).Get(base, &o)
+	}); err != nil {
+		t.Fatalf("%s: %v", step, err)
+	}
+	f, ok := o.(File)
+	if !ok {
+		t.Fatalf("%s: expected a file %s, got %T", step, name, o)
+	}
+	if f.ETag != etag {
+		t.Errorf("%s: expected the ETag %s of %s to be stored, got %s", step, etag, name, f.ETag)
+	}
+	if !f.LastModified.Equal(modified) {
+		t.Errorf("%s: expected the LastModified %s of %s to be stored, got %s", step, modified, name, f.LastModified)
+	}
+}
+
+// TestETagInvariant checks the ETag and LastModified stored for a file
+// match the server after every kind of remote interaction.
+func TestETagInvariant(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "listed", []byte("listed"))
+	s3.put(testBucket, "dir/nested", []byte("nested"))
+
+	m := newTestMount(t, s3, t.TempDir(), PartSize(minPartSize), CacheReuse())
+
+	if _, err := m.root().ReadDirAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	m.checkETag(t, "listing", "listed")
+
+	if _, err := m.lookup("dir/nested"); err != nil {
+		t.Fatal(err)
+	}
+	m.checkETag(t, "lookup", "dir/nested")
+
+	m.readFile("listed")
+	m.checkETag(t, "download", "listed")
+
+	s3.put(testBucket, "listed", []byte("overwritten by another client"))
+	if got := m.readFile("listed"); string(got) != "overwritten by another client" {
+		t.Fatalf("expected the new content, got %q", got)
+	}
+	m.checkETag(t, "download of a changed object", "listed")
+
+	m.writeFile("written", []byte("written"))
+	m.checkETag(t, "upload", "written")
+
+	m.writeFile("multipart", bytes.Repeat([]byte("m"), minPartSize+1))
+	m.checkETag(t, "multipart upload", "multipart")
+
+	fh, err := m.open("listed", fuse.OpenReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.write(fh, 0, []byte("changed"))
+	if err = m.close(fh); err != nil {
+		t.Fatal(err)
+	}
+	m.checkETag(t, "upload of changes", "listed")
+
+	if err = m.rename("written", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	m.checkETag(t, "rename", "renamed")
+
+	if err = m.rename("dir/nested", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	m.checkETag(t, "rename across directories", "moved")
+
+	// the listing of the next mount stores the objects changed meanwhile
+	s3.put(testBucket, "renamed", []byte("overwritten again"))
+	m = m.remount()
+	if _, err = m.root().ReadDirAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"listed", "multipart", "renamed", "moved"} {
+		m.checkETag(t, "listing after remount", name)
+	}
+}
+
+// TestOpenReplacedMidDownload replaces the object on the remote while its
+// download is in flight, the cache file never mixes the two versions.
+func TestOpenReplacedMidDownload(t *testing.T) {
+	version1 := bytes.Repeat([]byte("1"), 1<<16)
+	version2 := bytes.Repeat([]byte("2"), 1<<16+100)
+
+	testCases := []struct {
+		name string
+		// the connection of the download is closed after the object is
+		// replaced, otherwise the first version is sent to the end
+		cut           bool
+		expected      []byte
+		preconditions uint64
+	}{
+		{"response completed", false, version1, 0},
+		{"connection closed", true, version2, 1},
+	}
+
+	for _, testCase := range testCases {
+		s3 := newFakeS3(testBucket)
+		etag := s3.put(testBucket, "file", version1)
+		m := newTestMount(t, s3, t.TempDir())
+
+		var once sync.Once
+		s3.setIntercept(func(op string, w http.ResponseWriter, r *http.Request) bool {
+			if op != "GetObject" {
+				return false
+			}
+			replace := false
+			once.Do(func() { replace = true })
+			if !replace {
+				return false
+			}
+
+			w.Header().Set("ETag", `"`+etag+`"`)
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Header().Set("Content-Length", strconv.Itoa(len(version1)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(version1[:len(version1)/2])
+			w.(http.Flusher).Flush()
+
+			s3.put(testBucket, "file", version2)
+			if testCase.cut {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err == nil {
+					conn.Close()
+				}
+				return true
+			}
+			w.Write(version1[len(version1)/2:])
+			return true
+		})
+
+		if got := m.readFile("file"); !bytes.Equal(got, testCase.expected) {
+			t.Errorf("%s: expected %d bytes of a single version, got %d bytes", testCase.name, len(testCase.expected), len(got))
+		}
+		if n := m.Stats().PreconditionFailures; n != testCase.preconditions {
+			t.Errorf("%s: expected %d precondition failures, got %d", testCase.name, testCase.preconditions, n)
+		}
+		if replaced := strings.Contains(m.logs.String(), "Object replaced during the download"); replaced != testCase.cut {
+			t.Errorf("%s: expected the restart to be logged %t, got %t", testCase.name, testCase.cut, replaced)
+		}
+
+		// the next open has the new version either way
+		if got := m.readFile("file"); !bytes.Equal(got, version2) {
+			t.Errorf("%s: expected the new version to be read next, got %d bytes", testCase.name, len(got))
+		}
+		m.checkETag(t, testCase.name, "file")
+
+		m.stop()
+		s3.Close()
+	}
+}
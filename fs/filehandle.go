@@ -24,6 +24,7 @@ import (
 	"bazil.org/fuse"
 
 	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v6"
 )
 
 // FileHandle - Contains an opened file which can be read from and written to
@@ -34,27 +35,60 @@ type FileHandle struct {
 	// the fuse file
 	f *File
 
-	// cache file has been written to
+	// cache file has been written to, set with setDirty as other
+	// goroutines read it with the handles locked
 	dirty bool
 
+	// ETag of the object the content is based on, to detect changes
+	// by other clients
+	baseETag string
+
 	cachePath string
 
+	// flags the handle was opened with
+	flags fuse.OpenFlags
+
+	// set once the file is removed while the handle is open, see
+	// unlink.go
+	unlinked *unlinkedFile
+
 	handle uint64
 }
 
 // Read from the file handle
-func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	defer mapErrno(&err)
+
+	if err := fh.f.mfs.cacheFault("read"); err != nil {
+		return err
+	}
+
 	buff := make([]byte, req.Size)
 	n, err := fh.File.ReadAt(buff, req.Offset)
 	if err != nil && err != io.EOF {
 		return err
 	}
 	resp.Data = buff[:n]
+	fh.f.accessed()
 	return nil
 }
 
 // Write to the file handle
-func (fh *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+func (fh *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer mapErrno(&err)
+
+	if err := fh.f.mfs.denyWrite(fh.f.BucketName()); err != nil {
+		return err
+	}
+
+	if fh.f.mfs.stopping() {
+		return errStopping
+	}
+
+	if err := fh.f.mfs.cacheFault("write"); err != nil {
+		return err
+	}
+
 	if _, err := fh.File.Seek(req.Offset, 0); err != nil {
 		return err
 	}
@@ -69,8 +103,27 @@ func (fh *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *f
 		fh.f.Size = uint64(req.Offset) + uint64(n)
 	}
 	resp.Size = n
-	fh.dirty = true
-	return nil
+	return fh.markDirty()
+}
+
+// setDirty sets the dirty flag of the handle.
+func (fh *FileHandle) setDirty(dirty bool) {
+	fh.f.mfs.m.Lock()
+	fh.dirty = dirty
+	fh.f.mfs.m.Unlock()
+}
+
+// markDirty journals the upload of the handle when it's first written to.
+func (fh *FileHandle) markDirty() error {
+	if fh.dirty {
+		return nil
+	}
+	fh.setDirty(true)
+	// the content of an unlinked file is never uploaded
+	if fh.unlinked != nil {
+		return nil
+	}
+	return fh.f.mfs.journal(fh)
 }
 
 // Fsync because of bug in fuse lib, this is on file. -- FIXME - needs more context (y4m4).
@@ -80,42 +133,192 @@ func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
 }
 
 // Release the file handle
-func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) (err error) {
+	defer mapErrno(&err)
+
 	if err := fh.Close(); err != nil {
 		return err
 	}
 
+	if fh.unlinked != nil {
+		fh.f.mfs.releaseUnlinked(fh)
+		return nil
+	}
+
 	defer fh.f.mfs.Release(fh)
 
-	os.Remove(fh.cachePath)
+	// the cache file of a pending upload is kept until it's uploaded
+	if p, ok := fh.f.mfs.pending(fh.f.FullPath()); ok && p.Source == fh.cachePath {
+		return nil
+	}
+
+	// the cache file of a local-only file is its content
+	if fh.f.LocalOnly && fh.cachePath == fh.f.CachePath {
+		return nil
+	}
+
+	// clean cache files can be reused by the next open
+	if fh.f.mfs.config.cacheReuse && !fh.dirty && fh.cachePath == fh.f.CachePath {
+		return nil
+	}
+
+	fh.f.mfs.removeCacheFile(fh.cachePath, evictCloseDrop)
+	return nil
+}
+
+// queueUpload hands the journaled upload to the background uploads, the
+// handle is clean once it's queued.
+func (fh *FileHandle) queueUpload() error {
+	if err := fh.f.mfs.queuePending(fh.f.FullPath(), fh.cachePath); err != nil {
+		return err
+	}
+
+	if err := fh.f.mfs.db.Update(func(tx *meta.Tx) error {
+		return fh.f.store(tx)
+	}); err != nil {
+		return err
+	}
+
+	fh.setDirty(false)
+	go fh.f.mfs.retryPending(fh.f.FullPath())
 	return nil
 }
 
 // Flush - experimenting with uploading at flush, this slows operations down till it has been
 // completely flushed
-func (fh *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
-	if !fh.dirty {
+func (fh *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
+	defer mapErrno(&err)
+
+	fh.f.mfs.opPath(ctx, fh.f.FullPath())
+
+	// the content of an unlinked file is dropped at the last close
+	if !fh.dirty || fh.unlinked != nil {
 		return nil
 	}
+	defer func() {
+		size := fh.f.Size
+		fh.f.mfs.audit(AuditEvent{Op: "write", Path: fh.f.FullPath(), Size: &size, ETag: fh.f.ETag}, &req.Header, err)
+	}()
+
+	// renames and removals of the file wait for the upload
+	done, err := fh.f.mfs.turn(ctx, fh.f.FullPath())
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	// scratch mounts and local Finder files keep the content local
+	// instead of uploading it
+	if fh.f.mfs.config.scratch || fh.f.LocalOnly {
+		if err = fh.f.mfs.update(ctx, func(tx *meta.Tx) error {
+			return fh.f.setLocal(tx, fh.cachePath)
+		}); err != nil {
+			return err
+		}
+		fh.setDirty(false)
+		return nil
+	}
+
+	upload, err := fh.resolveConflict(ctx)
+	if err != nil {
+		return err
+	}
+	if !upload {
+		fh.setDirty(false)
+		if fh.unlinked != nil {
+			// resolveRemoval kept the removal of the object by another
+			// client and unlinked the open handles, this one included;
+			// handles unlinked before returned at the top already
+			return nil
+		}
+		if err = fh.f.mfs.removePending(fh.f.FullPath(), fh.cachePath, fh.cachePath); err != nil {
+			return err
+		}
+		return fh.f.mfs.update(ctx, func(tx *meta.Tx) error {
+			return fh.f.store(tx)
+		})
+	}
+
+	if err = fh.f.mfs.journalUpload(fh); err != nil {
+		return err
+	}
+
+	if fh.f.mfs.config.asyncUploads {
+		return fh.queueUpload()
+	}
 
-	sr := newPutOp(fh.Name(), fh.f.RemotePath(), int64(fh.f.Size))
+	sr := newPutOp(fh.f.BucketName(), fh.Name(), fh.f.RemotePath(), int64(fh.f.Size))
 	if err := fh.f.mfs.sync(&sr); err != nil {
 		return err
 	}
 
 	// we'll wait for the request to be uploaded and synced, before
 	// releasing the file
-	if err := <-sr.Error; err != nil {
+	uploaded := fh.f.mfs.opRemote(ctx, "PutObject "+fh.f.BucketName()+"/"+fh.f.RemotePath())
+	err = <-sr.Error
+	uploaded()
+
+	if err == errUploadCancelled {
+		// removed meanwhile, there is nothing left to upload
+		fh.setDirty(false)
+		return nil
+	} else if err != nil {
+		// keep the cache file, the upload is retried in the background
+		if perr := fh.f.mfs.addPending(fh.f.FullPath(), pendingUpload{
+			Bucket: fh.f.BucketName(),
+			Source: fh.cachePath,
+			Target: fh.f.RemotePath(),
+			Length: int64(fh.f.Size),
+		}); perr != nil {
+			fh.logger().Error("Unable to queue the upload for retrying", F("error", perr))
+		} else {
+			fh.logger().Warn("Upload failed, retrying in the background", s3Fields(err)...)
+		}
+
+		fh.f.mfs.update(ctx, func(tx *meta.Tx) error {
+			return fh.f.store(tx)
+		})
 		return err
 	}
 
+	// the content of a later upload of the file is uploaded next, the
+	// handle stays dirty until then
+	if sr.Superseded {
+		return nil
+	}
+
+	fh.f.BytesUploaded += fh.f.Size
+
+	// an earlier failed upload is superseded
+	if err := fh.f.mfs.removePending(fh.f.FullPath(), "", fh.cachePath); err != nil {
+		return err
+	}
+
+	// the ETag of the upload is the base of further changes, and is
+	// needed to revalidate the cache file
+	uploadETag := ""
+	if objInfo, err := fh.f.mfs.api.StatObjectWithContext(ctx, fh.f.BucketName(), fh.f.RemotePath(), minio.StatObjectOptions{}); err == nil {
+		uploadETag = objInfo.ETag
+		fh.f.ETag = objInfo.ETag
+		fh.f.LastModified = objInfo.LastModified
+		fh.baseETag = objInfo.ETag
+	}
+
+	if fh.f.mfs.config.cacheReuse {
+		if fh.f.CachePath != "" && fh.f.CachePath != fh.cachePath {
+			fh.f.mfs.removeCacheFile(fh.f.CachePath, evictReplaced)
+		}
+		fh.f.CachePath = fh.cachePath
+		fh.f.CacheETag = uploadETag
+	}
+
 	// update cache
-	if err := fh.f.mfs.db.Update(func(tx *meta.Tx) error {
+	if err := fh.f.mfs.update(ctx, func(tx *meta.Tx) error {
 		return fh.f.store(tx)
 	}); err != nil {
 		return err
 	}
 
-	fh.dirty = false
+	fh.setDirty(false)
 	return nil
 }
@@ -0,0 +1,276 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+)
+
+// PathResult is the outcome of flushing or purging a file.
+type PathResult struct {
+	Path   string `json:"path"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// underPath tells if fullPath is prefix or below it, every path is below
+// the root.
+func underPath(fullPath, prefix string) bool {
+	return prefix == "" || fullPath == prefix || strings.HasPrefix(fullPath, prefix+"/")
+}
+
+// sortResults sorts the results by path.
+func sortResults(results []PathResult) {
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Path < results[j].Path
+	})
+}
+
+// FlushPath uploads the dirty files and the pending uploads below
+// fullPath, relative to the mount point, and waits until they're
+// uploaded or failed. Uploads given up on are tried again.
+func (mfs *MinFS) FlushPath(fullPath string) ([]PathResult, error) {
+	if mfs.config.readOnly || mfs.config.scratch {
+		return nil, errors.New("Read-only and scratch mounts don't upload")
+	}
+
+	var (
+		wg      sync.WaitGroup
+		resultM sync.Mutex
+		results = []PathResult{}
+		done    = map[string]bool{}
+	)
+	add := func(path string, err error) {
+		resultM.Lock()
+		defer resultM.Unlock()
+
+		r := PathResult{Path: path, Result: "uploaded"}
+		if err != nil {
+			r.Result, r.Error = "failed", err.Error()
+		}
+		results = append(results, r)
+		done[path] = true
+	}
+
+	var dirty []*FileHandle
+	mfs.m.Lock()
+	for _, fh := range mfs.handles {
+		if fh != nil && fh.dirty && fh.unlinked == nil && underPath(fh.f.FullPath(), fullPath) {
+			dirty = append(dirty, fh)
+		}
+	}
+	mfs.m.Unlock()
+
+	for _, fh := range dirty {
+		wg.Add(1)
+		go func(fh *FileHandle) {
+			defer wg.Done()
+
+			err := fh.Flush(context.Background(), &fuse.FlushRequest{})
+			// async uploads are only queued by the flush
+			if _, pending := mfs.pending(fh.f.FullPath()); err != nil || !pending {
+				add(fh.f.FullPath(), err)
+			}
+		}(fh)
+	}
+	wg.Wait()
+
+	paths, gaveUp, err := mfs.notUploaded()
+	if err != nil {
+		return results, err
+	}
+	for _, path := range append(paths, gaveUp...) {
+		if !underPath(path, fullPath) || done[path] {
+			continue
+		}
+		p, ok := mfs.pending(path)
+		if !ok {
+			// finished meanwhile
+			continue
+		}
+
+		wg.Add(1)
+		go func(path string, p pendingUpload) {
+			defer wg.Done()
+			add(path, mfs.uploadPending(path, p))
+		}(path, p)
+	}
+	wg.Wait()
+
+	sortResults(results)
+	return results, nil
+}
+
+// purge removes the clean files below a path from the meta DB and the
+// cache.
+type purge struct {
+	mfs   *MinFS
+	force bool
+	open  map[string]bool
+
+	results    []PathResult
+	cacheFiles []string
+	entries    [][2]string
+}
+
+// dir purges the files of the meta bucket b of the directory at dir, only
+// the entry name unless it's empty, and the files of its subdirectories.
+// The listing of the directory is marked as having evicted entries, the
+// purged files are looked up on the remote again.
+func (p *purge) dir(tx *meta.Tx, b *meta.Bucket, dir []string, name string) error {
+	if b.InnerBucket == nil {
+		return nil
+	}
+
+	var (
+		subdirs []string
+		files   = map[string]File{}
+	)
+	if err := b.ForEach(func(k string, o interface{}) error {
+		if name != "" && k != name {
+			return nil
+		}
+		switch v := o.(type) {
+		case Dir:
+			subdirs = append(subdirs, k)
+		case File:
+			files[k] = v
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, k := range subdirs {
+		if err := p.dir(tx, b.Bucket(k+"/"), append(dir[:len(dir):len(dir)], k), ""); err != nil {
+			return err
+		}
+	}
+
+	purged := 0
+	for k, f := range files {
+		fullPath := path.Join(append(append([]string{}, dir...), k)...)
+		r := PathResult{Path: fullPath, Result: "purged"}
+
+		pending, isPending := p.mfs.pendingTx(tx, fullPath)
+		switch {
+		case p.open[fullPath]:
+			r.Result, r.Error = "skipped", "open"
+		case (isPending || f.LocalOnly) && !p.force:
+			r.Result, r.Error = "skipped", "changes aren't uploaded, --force-discard discards them"
+		case isPending:
+			if err := p.mfs.cancelUploads(tx, fullPath, pending.Bucket, pending.Target); err != nil {
+				return err
+			}
+			r.Result = "discarded"
+		case f.LocalOnly:
+			r.Result = "discarded"
+		}
+		p.results = append(p.results, r)
+		if r.Error != "" {
+			continue
+		}
+
+		if f.CachePath != "" {
+			p.cacheFiles = append(p.cacheFiles, f.CachePath)
+		}
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+		if err := p.mfs.releaseInode(tx, fullPath); err != nil {
+			return err
+		}
+		p.entries = append(p.entries, [2]string{strings.Join(dir, "/"), k})
+		purged++
+	}
+
+	if purged == 0 {
+		return nil
+	}
+	var state listing
+	if err := b.GetMeta("listing", &state); err != nil {
+		state = listing{}
+	}
+	state.Evicted = true
+	return b.PutMeta("listing", state)
+}
+
+// PurgePath drops the meta data and the cache files of the files below
+// fullPath, relative to the mount point, they're listed or looked up on
+// the remote again. Open files are skipped, and files with changes which
+// aren't uploaded unless force discards the changes.
+func (mfs *MinFS) PurgePath(fullPath string, force bool) ([]PathResult, error) {
+	p := &purge{mfs: mfs, force: force, open: map[string]bool{}}
+
+	mfs.m.Lock()
+	for _, fh := range mfs.handles {
+		if fh != nil && fh.unlinked == nil {
+			p.open[fh.f.FullPath()] = true
+		}
+	}
+	mfs.m.Unlock()
+
+	if err := mfs.db.Update(func(tx *meta.Tx) error {
+		p.results, p.cacheFiles, p.entries = nil, nil, nil
+		if fullPath == "" {
+			return p.dir(tx, tx.Bucket("minio/"), nil, "")
+		}
+
+		parts := strings.Split(fullPath, "/")
+		dir, name := parts[:len(parts)-1], parts[len(parts)-1]
+		b := metaDirBucket(tx, dir)
+		if b.InnerBucket == nil {
+			return fmt.Errorf("%s isn't in the meta DB", fullPath)
+		}
+		var o interface{}
+		if err := b.Get(name, &o); err != nil {
+			return fmt.Errorf("%s isn't in the meta DB", fullPath)
+		}
+		return p.dir(tx, b, dir, name)
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, cachePath := range p.cacheFiles {
+		if err := mfs.removeCacheFile(cachePath, evictPurge); err != nil && !os.IsNotExist(err) {
+			mfs.log.Warn("Unable to remove the cache file", F("path", cachePath), F("error", err))
+		}
+	}
+	for _, e := range p.entries {
+		mfs.invalidateEntry(e[0], e[1])
+	}
+	if len(p.entries) > 0 {
+		// full listings of the dirs list the remote again
+		atomic.AddUint64(&mfs.evictGen, 1)
+		mfs.log.Info("Purged from the cache", F("path", fullPath), F("files", len(p.entries)))
+	}
+
+	results := append([]PathResult{}, p.results...)
+	sortResults(results)
+	return results, nil
+}
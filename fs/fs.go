@@ -22,20 +22,24 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
-	"log"
+	"io"
 	"mime"
 	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/coreos/bbolt"
 	"github.com/minio/minfs/meta"
 	"github.com/minio/minio-go/v6"
 	"github.com/minio/minio-go/v6/pkg/credentials"
+	daemon "github.com/sevlyar/go-daemon"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
@@ -51,92 +55,453 @@ type MinFS struct {
 	config *Config
 	api    *minio.Client
 
+	// live is the current *Config, replaced as a whole on reloads.
+	// Settings which can be reloaded are read from it with cfg.
+	live    atomic.Value
+	reloadM sync.Mutex
+
+	// serializes the retrievals from the credential source
+	credentialsM sync.Mutex
+
+	// stopState is set once SIGTERM starts the shutdown, accessed
+	// atomically, stopErr is its outcome. readyErr is set when the mount
+	// failed the readiness check.
+	stopState int32
+	stopM     sync.Mutex
+	stopErr   error
+	readyErr  error
+
 	db *meta.DB
 
+	// group of the mounts served by the process, nil for a single mount
+	group *Group
+
+	// context of the child serving in the background, it holds the
+	// pid file
+	daemonCtx *daemon.Context
+
 	// Logger instance.
-	log *log.Logger
+	log *logger
 
 	// contains all open handles
 	handles []*FileHandle
 
-	locks map[string]bool
+	// unlinked files still open, whose objects are removed once they're
+	// closed, by path. Guarded by m.
+	unlinked map[string]*unlinkedFile
+
+	// locks of paths held by handles and the operations waiting for these
+	locks *lockManager
+
+	// latencies of operations and requests, nil without metrics listener
+	metrics *metrics
+
+	// exports spans of the operations, nil without trace endpoint
+	tracer *tracer
+
+	// delivers events to the notifier, nil without
+	notify *notifyQueue
+
+	// removed cache files by reason
+	evictions cacheEvictions
+
+	// last error by path, and the last failed S3 request guarded by opsM
+	lastErrors    lastErrors
+	lastS3Failure s3Failure
+
+	// injects faults of S3 requests and cache files, nil unless enabled
+	faults *faultInjector
+
+	// records the mutating operations, nil without audit log
+	auditLog *auditLog
+
+	// requests sent to S3 are dumped to the log while set, toggled on
+	// SIGUSR2
+	wireTrace  int32
+	wireTraceM sync.Mutex
+
+	// serves the profiles on their own address
+	pprofServer *http.Server
+
+	// health checks still running
+	health struct {
+		mount, meta, remote int32
+	}
+
+	// reachability of the endpoint, probed while unreachable
+	outage outage
+
+	// FUSE operations in flight, for diagnostics
+	ops      map[uint64]*opState
+	opsByReq map[fuse.RequestID]*opState
+	opSeq    uint64
+	opsM     sync.Mutex
+
+	// object lock status of the mounted buckets
+	objectLock map[string]bool
 
 	m sync.Mutex
 
-	syncChan chan interface{}
+	// running and recently finished uploads, keyed by bucket and object
+	uploads  map[string]*uploadTracker
+	uploadsM sync.Mutex
+
+	// operations run by the sync workers
+	syncQueue *syncQueue
 
 	listenerDoneCh chan struct{}
+
+	// opsCtx is the root context of the FUSE operations, cancelOps
+	// interrupts the operations in flight at unmount
+	opsCtx    context.Context
+	cancelOps context.CancelFunc
+
+	// server of the mount, set once it serves. Guarded by m.
+	server *fs.Server
+
+	// dir nodes known to the kernel by path, until they're forgotten.
+	// Guarded by m.
+	dirs map[string]*Dir
+
+	// time the filesystem was started.
+	started time.Time
+
+	// set once the mount serves, accessed atomically
+	ready int32
+
+	stats Stats
+
+	// downloads in flight, shared by concurrent opens
+	downloads downloadGroup
+
+	// removals of objects, batched by directory
+	removals removeGroup
+
+	// access times updated by reads, not yet in the meta DB
+	atimes atimeBatch
+
+	// bytes transferred per second, sampled by startRates
+	rates transferRates
+
+	// errors returned to the kernel and S3 errors
+	errors errorCounters
+
+	// unsupported is the set of capabilities rejected by the backend.
+	unsupported uint32
+
+	// readOnlyBuckets is the map[string]bool of the buckets the
+	// credentials can't write to, see bucketaccess.go.
+	readOnlyBuckets atomic.Value
+
+	// evictGen is incremented by eviction passes which removed entries,
+	// directories listed before list again.
+	evictGen uint64
 }
 
-// New will return a new MinFS client
-func New(options ...func(*Config)) (*MinFS, error) {
+// newConfig returns the config of options applied to the defaults and the
+// credentials of config.json.
+func newConfig(options []func(*Config)) (*Config, error) {
 	// Initialize config.
 	ac, err := InitMinFSConfig()
 	if err != nil {
 		return nil, err
 	}
 
-	// Initialize log file.
-	logW, err := os.OpenFile(globalLogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
-	if err != nil {
+	cfg := defaultConfig(ac)
+	for _, optionFn := range options {
+		optionFn(cfg)
+	}
+
+	if err := cfg.validate(); err != nil {
 		return nil, err
 	}
+	return cfg, nil
+}
+
+// defaultConfig returns the config of the defaults with the credentials
+// of ac.
+func defaultConfig(ac *AccessConfig) *Config {
+	return &Config{
+		cache:       globalDBDir,
+		basePath:    "",
+		accountID:   fmt.Sprintf("%d", time.Now().UTC().Unix()),
+		gid:         0,
+		uid:         0,
+		accessKey:   secret(ac.AccessKey),
+		secretKey:   secret(ac.SecretKey),
+		secretToken: secret(ac.SecretToken),
+		mode:        os.FileMode(0660),
+
+		verifyUploads: true,
+		dirMarkers:    true,
+		presignExpiry: time.Hour,
+		addressing:    "auto",
+
+		partSize:          defaultPartSize,
+		uploadConcurrency: defaultUploadConcurrency,
+
+		metaTimeout:     defaultMetaTimeout,
+		dataIdleTimeout: defaultDataIdleTimeout,
+		retryTimeout:    defaultRetryTimeout,
+		readyTimeout:    defaultReadyTimeout,
+		uploadRetries:   defaultUploadRetries,
+		metaStore:       "bolt",
+
+		compactThreshold: defaultCompactThreshold,
+		resyncRate:       defaultResyncRate,
+		openCheck:        true,
+		entryTimeout:     defaultEntryTimeout,
+		conflictPolicy:   conflictLocalWins,
+		atime:            atimeRelatime,
+		bucketAccess:     bucketAccessAuto,
+		uploadWorkers:    defaultUploadWorkers,
+		gcInterval:       defaultGCInterval,
+		smallUpload:      defaultSmallUpload,
+		lockWarn:         defaultLockWarn,
+		lockTimeout:      defaultLockTimeout,
+		slowOp:           defaultSlowOp,
+		shutdownTimeout:  defaultShutdownTimeout,
+		traceSample:      1,
+		logLevel:         "info",
+		logFormat:        "console",
+		logTarget:        "file:" + globalLogFile,
+		logMaxSize:       defaultLogMaxSize,
+	}
+}
 
-	// Set defaults
-	cfg := &Config{
-		cache:     globalDBDir,
-		basePath:  "",
-		accountID: fmt.Sprintf("%d", time.Now().UTC().Unix()),
-		gid:       0,
-		uid:       0,
-		accessKey: ac.AccessKey,
-		secretKey: ac.SecretKey,
-		mode:      os.FileMode(0660),
+// New will return a new MinFS client
+func New(options ...func(*Config)) (*MinFS, error) {
+	cfg, err := newConfig(options)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, optionFn := range options {
-		optionFn(cfg)
+	log, err := openLogger(cfg)
+	if err != nil {
+		return nil, err
 	}
+	return newMinFS(cfg, log)
+}
 
-	if err := cfg.validate(); err != nil {
+// openLogger returns the logger of cfg.
+func openLogger(cfg *Config) (*logger, error) {
+	level, _ := parseLevel(cfg.logLevel)
+
+	// Initialize log sink.
+	logSink, err := openLogSink(cfg.logTarget, cfg.logMaxSize)
+	if err != nil {
 		return nil, err
 	}
+	return newLogger(logSink, level, cfg.logFormat, secretScrubber(cfg.secrets()...)), nil
+}
+
+// newMinFS returns the MinFS of cfg which logs to log.
+func newMinFS(cfg *Config, log *logger) (*MinFS, error) {
+	var err error
 
 	// Initialize MinFS.
 	fs := &MinFS{
 		config:         cfg,
-		syncChan:       make(chan interface{}),
-		locks:          map[string]bool{},
-		log:            log.New(logW, "MinFS ", log.Ldate|log.Ltime|log.Lshortfile),
+		syncQueue:      newSyncQueue(),
+		uploads:        map[string]*uploadTracker{},
+		locks:          newLockManager(),
+		ops:            map[uint64]*opState{},
+		opsByReq:       map[fuse.RequestID]*opState{},
+		objectLock:     map[string]bool{},
+		log:            log,
 		listenerDoneCh: make(chan struct{}),
+		dirs:           map[string]*Dir{},
+		unlinked:       map[string]*unlinkedFile{},
+		started:        time.Now().UTC(),
+	}
+	fs.live.Store(cfg)
+	fs.opsCtx, fs.cancelOps = context.WithCancel(context.Background())
+
+	if cfg.notifier != nil {
+		fs.notify = newNotifyQueue(cfg.notifier)
+	}
+
+	if cfg.faults {
+		fs.faults = &faultInjector{}
+		for _, rule := range cfg.faultRules {
+			r, _ := parseFault(rule)
+			fs.faults.rules = append(fs.faults.rules, r)
+		}
+		fs.log.Warn("Fault injection is enabled, S3 requests and cache files fail on purpose", F("faults", strings.Join(cfg.faultRules, ";")))
+	}
+
+	if cfg.auditLog != "" {
+		if fs.auditLog, err = newAuditLog(cfg.auditLog); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.traceEndpoint != "" {
+		if fs.tracer, err = newTracer(cfg.traceEndpoint, cfg.traceSample, cfg.mountpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.metricsAddr != "" {
+		fs.metrics = newMetrics()
 	}
 
 	// Success..
 	return fs, nil
 }
 
+// errReadOnly is returned by mutating operations of read-only mounts.
+var errReadOnly = fuse.Errno(syscall.EROFS)
+
 func (mfs *MinFS) mount() (*fuse.Conn, error) {
-	return fuse.Mount(
-		mfs.config.mountpoint,
+	volname := mfs.config.volname
+	if volname == "" {
+		volname = mfs.volumeName()
+	}
+	options := []fuse.MountOption{
 		fuse.FSName("MinFS"),
 		fuse.Subtype("MinFS"),
 		fuse.LocalVolume(),
-		fuse.VolumeName(mfs.config.bucket),
-		fuse.AllowOther(),
+		fuse.VolumeName(volname),
+		// the kernel checks the access of other users against the mode,
+		// there is no Access handler
 		fuse.DefaultPermissions(),
-	)
+	}
+	if mfs.config.allowOther || mfs.config.allowRoot {
+		if err := checkUserAllowOther(fuseConf, os.Geteuid()); err != nil {
+			return nil, err
+		}
+	}
+	if mfs.config.allowOther {
+		options = append(options, fuse.AllowOther())
+	}
+	if mfs.config.allowRoot {
+		options = append(options, fuse.AllowRoot())
+	}
+	if mfs.config.readOnly {
+		options = append(options, fuse.ReadOnly())
+	}
+	if mfs.config.writebackCache {
+		options = append(options, fuse.WritebackCache())
+	}
+	// OSXFUSE rejects both in the kernel already
+	if mfs.config.appleDouble == appleFilesReject && mfs.config.dsStore == appleFilesReject {
+		options = append(options, fuse.NoAppleDouble())
+	}
+	return fuse.Mount(mfs.config.mountpoint, options...)
+}
+
+// fuseConf is the config of fusermount, which allows unprivileged users to
+// use allow_other and allow_root.
+const fuseConf = "/etc/fuse.conf"
+
+// checkUserAllowOther returns an error if the user of uid can't mount with
+// allow_other or allow_root, because conf doesn't set user_allow_other.
+// fusermount would fail the mount with a less helpful message.
+func checkUserAllowOther(conf string, uid int) error {
+	if uid == 0 {
+		return nil
+	}
+
+	data, err := os.ReadFile(conf)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "user_allow_other" {
+			return nil
+		}
+	}
+	return fmt.Errorf("Mount options allow-other and allow-root need user_allow_other in %s when mounting as an unprivileged user", conf)
+}
+
+// volumeName returns the name of the mounted volume, which is the
+// bucket or the target host when multiple buckets are mounted.
+func (mfs *MinFS) volumeName() string {
+	if mfs.config.multiBucket() {
+		return mfs.config.target.Host
+	}
+	return mfs.config.bucket
 }
 
 // Serve starts the MinFS client
 func (mfs *MinFS) Serve() (err error) {
+	if mfs.config.background && !daemon.WasReborn() {
+		return mfs.startDaemon(mfs.daemonContext())
+	}
+	if err = mfs.acquirePidFile(); err != nil {
+		return err
+	}
+	defer mfs.releasePidFile()
+	defer func() {
+		mfs.daemonExited(err)
+	}()
+
+	control, err := startControl(func() []*MinFS {
+		if atomic.LoadInt32(&mfs.ready) == 0 {
+			return nil
+		}
+		return []*MinFS{mfs}
+	}, mfs.log)
+	if err != nil {
+		return err
+	}
+	defer control.close()
+
+	return mfs.serve()
+}
+
+// acquirePidFile writes the pid file, the child serving in the background
+// locks it and detaches its output too.
+func (mfs *MinFS) acquirePidFile() error {
+	if mfs.config.background {
+		ctx := mfs.daemonContext()
+		// writes and locks the pid file, and detaches the output
+		if _, err := ctx.Reborn(); err != nil {
+			return err
+		}
+		mfs.daemonCtx = ctx
+		return nil
+	}
+	return mfs.writePidFile()
+}
+
+// releasePidFile removes the pid file written by acquirePidFile.
+func (mfs *MinFS) releasePidFile() {
+	if mfs.daemonCtx != nil {
+		mfs.daemonCtx.Release()
+		return
+	}
+	mfs.removePidFile()
+}
+
+// serve mounts and serves requests until unmounted.
+func (mfs *MinFS) serve() (err error) {
 	if mfs.config.debug {
 		fuse.Debug = func(msg interface{}) {
 			mfs.log.Printf("%#v\n", msg)
 		}
 	}
 
-	defer mfs.shutdown()
+	mfs.startAudit()
+	defer mfs.stopAudit()
+	mfs.startNotifier()
+	defer mfs.stopNotifier()
+
+	defer func() {
+		if serr := mfs.shutdown(); err == nil {
+			err = serr
+		}
+	}()
 
+	if err = mfs.recoverStaleMount(); err != nil {
+		return err
+	}
+
+	mfs.log.Info("Starting minfs", F("version", Build.Version), F("commit", Build.CommitID), F("buildDate", Build.BuildDate))
 	mfs.log.Println("Mounting target....")
 	// mount the drive
 	var c *fuse.Conn
@@ -147,45 +512,181 @@ func (mfs *MinFS) Serve() (err error) {
 
 	defer c.Close()
 
-	// channel to receive errors
-	trapCh := signalTrap(os.Interrupt, syscall.SIGTERM, os.Kill)
-
-	go func() {
-		<-trapCh
-
-		//mfs.stopNotificationListener()
-		mfs.shutdown()
-	}()
+	mfs.startShutdownTrap()
 
 	// Initialize database.
 	mfs.log.Println("Opening cache database...")
-	mfs.db, err = meta.Open(path.Join(mfs.config.cache, "cache.db"), 0600, nil)
+	dbPath, err := mfs.openMeta(false)
 	if err != nil {
 		return err
 	}
 	defer mfs.db.Close()
 
 	mfs.log.Println("Initializing cache database...")
-	if err = mfs.db.Update(func(tx *meta.Tx) error {
-		_, berr := tx.CreateBucketIfNotExists([]byte("minio/"))
-		return berr
-	}); err != nil {
+	if err = mfs.migrateMeta(dbPath); err != nil {
+		return err
+	}
+
+	if err = mfs.checkScratch(); err != nil {
+		return err
+	}
+
+	if err = mfs.compactOnMount(); err != nil {
+		return err
+	}
+
+	if err = mfs.removePartialCacheFiles(); err != nil {
 		return err
 	}
 
 	mfs.log.Println("Initializing minio client...")
+	if err = mfs.connect(); err != nil {
+		return err
+	}
+
+	// Validate if the buckets are valid and accessible.
+	if err = mfs.checkBuckets(); err != nil {
+		return err
+	}
+
+	mfs.probeCapabilities()
+	mfs.startWriteAccess()
+
+	if mfs.config.importMeta != "" {
+		mfs.log.Println("Importing meta DB...")
+		if err = mfs.importMetaFile(mfs.config.importMeta); err != nil {
+			return err
+		}
+	}
+
+	// stops the notification listener and the background loops
+	defer mfs.stopNotificationListener()
+
+	if mfs.config.notifications {
+		mfs.log.Println("Starting notification listener...")
+		if err = mfs.startNotificationListener(); err != nil {
+			return err
+		}
+	}
+
+	if mfs.config.readOnly || mfs.config.scratch {
+		// journaled uploads wait for the next writable mount
+		if paths, gaveUp, perr := mfs.notUploaded(); perr == nil && len(paths)+len(gaveUp) > 0 {
+			mfs.log.Warn("Mounted without uploads, pending uploads wait for a writable mount", F("pending", len(paths)+len(gaveUp)), F("scratch", mfs.config.scratch))
+		}
+	} else {
+		if err = mfs.startSync(); err != nil {
+			return err
+		}
+
+		if err = mfs.replayJournal(); err != nil {
+			return err
+		}
+		mfs.startPendingUploads()
+	}
+	mfs.startResync()
+	mfs.startEviction()
+	mfs.startAtimes()
+	defer func() {
+		if aerr := mfs.flushAtimes(); aerr != nil {
+			mfs.log.Error("Unable to store the access times", F("error", aerr))
+		}
+	}()
+	mfs.startGC()
+	mfs.startWatchdog()
+	mfs.startTracing()
+	mfs.startDump()
+	mfs.startReload()
+	mfs.startWireTraceToggle()
+	mfs.startErrorSummary()
+	mfs.startRates()
+	defer mfs.stopTracing()
+	// the listeners of a group are those of the process
+	if mfs.group == nil {
+		if err = mfs.startMetrics(); err != nil {
+			return err
+		}
+		defer mfs.stopMetrics()
+		if err = mfs.startPprof(); err != nil {
+			return err
+		}
+		defer mfs.stopPprof()
+	}
+
+	mfs.log.Println("Serving... Have fun!")
+	mfs.log.Info("Mounted", F("mountpoint", mfs.config.mountpoint), F("target", mfs.config.target.Host), F("volume", mfs.volumeName()))
+	mfs.startServiceNotify()
+	// Serve the filesystem
+	server := fs.New(c, &fs.Config{
+		WithContext: mfs.trackOp,
+		Debug:       mfs.opResult,
+	})
+	// the notification listener invalidates entries through the server
+	mfs.m.Lock()
+	mfs.server = server
+	mfs.m.Unlock()
+	if err = server.Serve(mfs); err != nil {
+		mfs.log.Println("Error while serving the file system.", err)
+		return err
+	}
+	if err = mfs.readyError(); err != nil {
+		return err
+	}
+
+	<-c.Ready
+	return c.MountError
+}
+
+// metaPath returns the path of the meta DB in the cache dir, badger
+// keeps it in a directory.
+func (mfs *MinFS) metaPath() string {
+	if mfs.config.metaStore == "badger" {
+		return path.Join(mfs.config.cache, "cache.db.badger")
+	}
+	return path.Join(mfs.config.cache, "cache.db")
+}
+
+// openMeta opens the meta DB in the cache dir and returns its path.
+func (mfs *MinFS) openMeta(readOnly bool) (dbPath string, err error) {
+	dbPath = mfs.metaPath()
+	switch mfs.config.metaStore {
+	case "memory":
+		mfs.db = meta.OpenMemory()
+		return dbPath, nil
+	case "badger":
+		mfs.db, err = meta.OpenBadger(dbPath, readOnly)
+		return dbPath, err
+	}
 
+	mfs.db, err = meta.Open(dbPath, 0600, &bbolt.Options{ReadOnly: readOnly, Timeout: time.Second})
+	if err == bbolt.ErrTimeout {
+		return dbPath, fmt.Errorf("Meta DB %s is in use by another minfs", dbPath)
+	}
+	return dbPath, err
+}
+
+// connect sets up the client of the target.
+func (mfs *MinFS) connect() (err error) {
 	var (
 		host     = mfs.config.target.Host
-		access   = mfs.config.accessKey
-		secret   = mfs.config.secretKey
-		token    = mfs.config.secretToken
 		secure   = mfs.config.target.Scheme == "https"
 		cabundle = mfs.config.ca_bundle
 	)
 
-	creds := credentials.NewStaticV4(access, secret, token)
-	mfs.api, err = minio.NewWithCredentials(host, creds, secure, "")
+	region := mfs.config.region
+	if region == "" {
+		region = "auto-detected"
+	}
+	mfs.log.Printf("Endpoint %s://%s, region %s, %s addressing, TLS verification %t\n",
+		mfs.config.target.Scheme, host, region, mfs.config.addressing, secure && !mfs.config.insecure)
+
+	creds := credentials.New(&liveCredentials{mfs: mfs})
+	mfs.api, err = minio.NewWithOptions(host, &minio.Options{
+		Creds:        creds,
+		Secure:       secure,
+		Region:       mfs.config.region,
+		BucketLookup: bucketLookups[mfs.config.addressing],
+	})
 	if err != nil {
 		return err
 	}
@@ -207,7 +708,89 @@ func (mfs *MinFS) Serve() (err error) {
 		}
 	}
 
-	var transport http.RoundTripper = &http.Transport{
+	// the mounts of a group with the same TLS settings share the
+	// connections
+	var transport http.RoundTripper
+	if mfs.group != nil {
+		transport = mfs.group.transport(cabundle, mfs.config.insecure, tlsConfig)
+	} else {
+		transport = newTransport(tlsConfig)
+	}
+
+	if mfs.faults != nil {
+		transport = &faultTransport{
+			RoundTripper: transport,
+			faults:       mfs.faults,
+		}
+	}
+
+	transport = &timeoutTransport{
+		RoundTripper: transport,
+		mfs:          mfs,
+	}
+
+	if mfs.config.requestPayer != "" {
+		transport = &requestPayerTransport{
+			RoundTripper: transport,
+			payer:        mfs.config.requestPayer,
+			mfs:          mfs,
+		}
+	}
+
+	transport = &retryTransport{
+		RoundTripper: transport,
+		mfs:          mfs,
+	}
+
+	if mfs.metrics != nil {
+		transport = &metricsTransport{
+			RoundTripper: transport,
+			metrics:      mfs.metrics,
+		}
+	}
+
+	if mfs.tracer != nil {
+		transport = &spanTransport{
+			RoundTripper: transport,
+			mfs:          mfs,
+		}
+	}
+
+	transport = &errorTransport{
+		RoundTripper: transport,
+		mfs:          mfs,
+	}
+
+	if mfs.config.slowOp > 0 {
+		transport = &opTransport{
+			RoundTripper: transport,
+			mfs:          mfs,
+		}
+	}
+
+	transport = &userAgentTransport{
+		RoundTripper: transport,
+	}
+
+	if mfs.log.Enabled(LevelTrace) {
+		transport = &traceTransport{
+			RoundTripper: transport,
+			log:          mfs.log,
+		}
+	}
+
+	mfs.api.SetCustomTransport(transport)
+
+	// also the requests of --check and --fsck are traced
+	if mfs.cfg().logLevel == LevelTrace.String() {
+		mfs.SetWireTrace(true)
+	}
+	return nil
+}
+
+// newTransport returns the transport of the S3 requests.
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		DialContext: (&net.Dialer{
 			Timeout:   30 * time.Second,
@@ -226,124 +809,272 @@ func (mfs *MinFS) Serve() (err error) {
 		//    https://golang.org/src/net/http/transport.go?h=roundTrip#L1843
 		DisableCompression: true,
 	}
+}
 
-	mfs.api.SetCustomTransport(transport)
-
-	// Validate if the bucket is valid and accessible.
-	exists, err := mfs.api.BucketExists(mfs.config.bucket)
+// checkBuckets validates that all configured buckets are accessible.
+func (mfs *MinFS) checkBuckets() error {
+	missing, err := mfs.missingBuckets()
 	if err != nil {
 		return err
 	}
-	if !exists {
-		mfs.log.Println("Bucket doesn't not exist... attempting to create")
-		if err = mfs.api.MakeBucket(mfs.config.bucket, ""); err != nil {
+
+	for _, bucket := range missing {
+		if !mfs.config.createBucket {
+			return fmt.Errorf("Bucket %s does not exist", bucket)
+		}
+		mfs.log.Printf("Bucket %s does not exist... attempting to create\n", bucket)
+		if err = mfs.makeBucket(bucket); err != nil {
 			return err
 		}
 	}
 
-	// Set notifications
-	// mfs.log.Println("Starting monitoring server...")
-	// if err = mfs.startNotificationListener(); err != nil {
-	//	return err
-	//	}
+	return nil
+}
 
-	if err = mfs.startSync(); err != nil {
-		return err
+// missingBuckets returns the configured buckets which don't exist.
+func (mfs *MinFS) missingBuckets() ([]string, error) {
+	// The root listing will show what is visible to the credentials.
+	buckets, err := mfs.mountedBuckets()
+	if err != nil || mfs.config.allBuckets() {
+		return nil, err
 	}
 
-	mfs.log.Println("Serving... Have fun!")
-	// Serve the filesystem
-	if err = fs.Serve(c, mfs); err != nil {
-		mfs.log.Println("Error while serving the file system.", err)
-		return err
+	var missing []string
+	for _, bucket := range buckets {
+		exists, err := mfs.api.BucketExists(bucket)
+		if err != nil {
+			return nil, mfs.addressingError(bucket, err)
+		}
+		if !exists {
+			missing = append(missing, bucket)
+		}
 	}
+	return missing, nil
+}
 
-	<-c.Ready
-	return c.MountError
+// makeBucket creates the bucket, a bucket created concurrently by
+// ourselves is not an error.
+func (mfs *MinFS) makeBucket(bucket string) error {
+	err := mfs.api.MakeBucket(bucket, mfs.config.createBucketRegion)
+	if err == nil {
+		return nil
+	}
+	if minio.ToErrorResponse(err).Code == "BucketAlreadyOwnedByYou" {
+		return nil
+	}
+	return fmt.Errorf("Unable to create bucket %s: %s", bucket, err)
 }
 
-func (mfs *MinFS) shutdown() {
-	fuse.Unmount(mfs.config.mountpoint)
-	mfs.log.Println("MinFS stopped cleanly.")
+// shutdown unmounts and waits for the queued uploads, unless the graceful
+// shutdown gave up on them already, which is returned.
+func (mfs *MinFS) shutdown() error {
+	mfs.notifyStopping()
+	// unmounted already, unless the mount failed or serving it did
+	if _, err := mfs.unmount(); err == nil {
+		mfs.log.Debug("Unmounted at exit", F("mountpoint", mfs.config.mountpoint))
+	}
+
+	err := mfs.stopError()
+	if err == nil {
+		if n := mfs.syncQueue.stats(); n.Small+n.Large+n.Running > 0 {
+			mfs.log.Printf("Waiting for %d queued uploads.\n", n.Small+n.Large+n.Running)
+		}
+		mfs.syncQueue.drain()
+		mfs.log.Println("MinFS stopped cleanly.")
+	}
+
+	mfs.logErrorSummary(0)
+	mfs.log.Info("Unmounted", F("mountpoint", mfs.config.mountpoint), F("uptime", time.Since(mfs.started).Round(time.Second)))
+	return err
 }
 
 func (mfs *MinFS) sync(req interface{}) error {
-	mfs.syncChan <- req
+	mfs.syncQueue.push(req, mfs.isSmall(req))
 	return nil
 }
 
-func (mfs *MinFS) moveOp(req *MoveOperation) {
-	src := minio.NewSourceInfo(mfs.config.bucket, req.Source, nil)
-	dst, err := minio.NewDestinationInfo(mfs.config.bucket, req.Target, nil, nil)
+// copyHeaders are the object headers preserved when copying objects.
+var copyHeaders = []string{
+	"Content-Type",
+	"Content-Encoding",
+	"Content-Disposition",
+	"Content-Language",
+	"Cache-Control",
+	"X-Amz-Server-Side-Encryption",
+	"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+}
+
+// copyObject copies the object server side, objects larger than the
+// single copy limit are copied with a multipart copy. When the backend
+// doesn't support copying, the object is downloaded and uploaded again.
+func (mfs *MinFS) copyObject(bucket, source, target string) error {
+	objInfo, err := mfs.api.StatObject(bucket, source, minio.StatObjectOptions{})
 	if err != nil {
-		req.Error <- err
-		return
+		return err
 	}
-	if err = mfs.api.CopyObject(dst, src); err != nil {
-		req.Error <- err
-		return
+
+	// With metadata set the destination metadata replaces the source
+	// metadata, so everything we want to keep needs to be passed on.
+	userMeta := map[string]string{}
+	for k, v := range objInfo.Metadata {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") && len(v) > 0 {
+			userMeta[k] = v[0]
+		}
 	}
-	if err = mfs.api.RemoveObject(mfs.config.bucket, req.Source); err != nil {
-		req.Error <- err
-		return
+	for _, k := range copyHeaders {
+		if v := objInfo.Metadata.Get(k); v != "" {
+			userMeta[k] = v
+		}
 	}
-	req.Error <- nil
+
+	src := minio.NewSourceInfo(bucket, source, nil)
+	if err = src.SetMatchETagCond(objInfo.ETag); err != nil {
+		return err
+	}
+
+	dst, err := minio.NewDestinationInfo(bucket, target, nil, userMeta)
+	if err != nil {
+		return err
+	}
+
+	if objInfo.Size > maxPartSize {
+		err = mfs.copyObjectMultipart(bucket, source, target, objInfo, userMeta)
+	} else {
+		err = mfs.api.ComposeObject(dst, []minio.SourceInfo{src})
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "NotImplemented", "MethodNotAllowed", "InvalidRequest":
+		mfs.log.Printf("Server side copy of %s rejected, copying through client: %s\n", source, err)
+		return mfs.streamCopyObject(bucket, source, target, objInfo)
+	}
+	return err
 }
 
-func (mfs *MinFS) copyOp(req *CopyOperation) {
-	src := minio.NewSourceInfo(mfs.config.bucket, req.Source, nil)
-	dst, err := minio.NewDestinationInfo(mfs.config.bucket, req.Target, nil, nil)
+// streamCopyObject copies the object by downloading and uploading it.
+func (mfs *MinFS) streamCopyObject(bucket, source, target string, objInfo minio.ObjectInfo) error {
+	object, err := mfs.api.GetObject(bucket, source, minio.GetObjectOptions{})
 	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	userMeta := map[string]string{}
+	for k, v := range objInfo.UserMetadata {
+		userMeta[k] = v
+	}
+
+	_, err = mfs.api.PutObject(bucket, target, object, objInfo.Size, minio.PutObjectOptions{
+		UserMetadata:       userMeta,
+		ContentType:        objInfo.ContentType,
+		ContentEncoding:    objInfo.Metadata.Get("Content-Encoding"),
+		ContentDisposition: objInfo.Metadata.Get("Content-Disposition"),
+		ContentLanguage:    objInfo.Metadata.Get("Content-Language"),
+		CacheControl:       objInfo.Metadata.Get("Cache-Control"),
+		PartSize:           uint64(mfs.uploadPartSize(objInfo.Size)),
+		NumThreads:         mfs.config.uploadConcurrency,
+	})
+	return err
+}
+
+func (mfs *MinFS) moveOp(req *MoveOperation) {
+	if err := mfs.copyObject(req.Bucket, req.Source, req.Target); err != nil {
 		req.Error <- err
 		return
 	}
-	if err = mfs.api.CopyObject(dst, src); err != nil {
+	if err := mfs.api.RemoveObject(req.Bucket, req.Source); err != nil {
 		req.Error <- err
 		return
 	}
 	req.Error <- nil
 }
 
-func (mfs *MinFS) putOp(req *PutOperation) {
+func (mfs *MinFS) copyOp(req *CopyOperation) {
+	req.Error <- mfs.copyObject(req.Bucket, req.Source, req.Target)
+}
+
+func (mfs *MinFS) putOp(req *PutOperation) error {
+	var err error
+	for i := 0; i < uploadAttempts; i++ {
+		if err = mfs.put(req); err != errUploadMismatch {
+			break
+		}
+		mfs.log.Warn("Upload failed verification, retrying", F("object", req.Target))
+	}
+
+	if err == errUploadMismatch {
+		mfs.log.Error("Upload failed verification", F("object", req.Target), F("attempts", uploadAttempts))
+		err = fuse.EIO
+	}
+	if err != nil {
+		return err
+	}
+
+	mfs.log.Info("Upload finished", F("source", req.Source), F("object", req.Target))
+	return nil
+}
+
+// put uploads the cache file and verifies the integrity of the upload.
+func (mfs *MinFS) put(req *PutOperation) error {
 	r, err := os.Open(req.Source)
 	if err != nil {
-		req.Error <- err
-		return
+		return err
 	}
 	defer r.Close()
 
+	partSize := mfs.uploadPartSize(req.Length)
+
+	var etag string
+	if mfs.config.verifyUploads {
+		if etag, err = uploadETag(r, req.Length, partSize); err != nil {
+			return err
+		}
+		if _, err = r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
 	ops := minio.PutObjectOptions{
 		ContentType: mime.TypeByExtension(filepath.Ext(req.Target)),
+		PartSize:    uint64(partSize),
+		NumThreads:  mfs.config.uploadConcurrency,
+		// Let the remote verify the MD5 of every part.
+		SendContentMd5: mfs.config.verifyUploads,
 	}
-	_, err = mfs.api.PutObject(mfs.config.bucket, req.Target, r, req.Length, ops)
-	if err != nil {
-		req.Error <- err
-		return
-	}
-	mfs.log.Printf("Upload finished: %s -> %s.\n", req.Source, req.Target)
-	req.Error <- nil
-}
 
-func (mfs *MinFS) startSync() error {
-	go func() {
-		for req := range mfs.syncChan {
-			switch req := req.(type) {
-			case *MoveOperation:
-				mfs.moveOp(req)
-			case *CopyOperation:
-				mfs.copyOp(req)
-			case *PutOperation:
-				mfs.putOp(req)
-			default:
-				panic("Unknown type")
-			}
+	// The checksum is stored along the object, to be verified by
+	// downloads.
+	if newChecksum(mfs.config.checksum) != nil {
+		checksum, cerr := readerChecksum(r, mfs.config.checksum)
+		if cerr != nil {
+			return cerr
 		}
-	}()
-	return nil
+		if _, err = r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		ops.UserMetadata = map[string]string{
+			checksumMetaKey + mfs.config.checksum: checksum,
+		}
+	}
+	tracker := mfs.trackUpload(req.Bucket, req.Target, req.Length)
+	ops.Progress = tracker
+
+	n, err := mfs.api.PutObject(req.Bucket, req.Target, r, req.Length, ops)
+	if err == nil && n != req.Length {
+		mfs.log.Printf("Upload of %s sent %d bytes, expected %d bytes.\n", req.Target, n, req.Length)
+		err = errUploadMismatch
+	}
+	if err == nil {
+		err = mfs.verifyUpload(req.Bucket, req.Target, req.Length, etag)
+	}
+
+	tracker.finish(err)
+	return err
 }
 
 // Statfs will return meta information on the minio filesystem
-func (mfs *MinFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+func (mfs *MinFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) (err error) {
+	defer mapErrno(&err)
+
 	resp.Blocks = 0x1000000000
 	resp.Bfree = 0x1000000000
 	resp.Bavail = 0x1000000000
@@ -354,26 +1085,63 @@ func (mfs *MinFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fus
 
 // Acquire will return a new FileHandle
 func (mfs *MinFS) Acquire(f *File) (*FileHandle, error) {
-	if err := mfs.Lock(f.FullPath()); err != nil {
-		return nil, err
-	}
-
 	h := &FileHandle{
 		f: f,
 	}
 
+	mfs.m.Lock()
 	mfs.handles = append(mfs.handles, h)
-
 	h.handle = uint64(len(mfs.handles) - 1)
+	mfs.m.Unlock()
+
+	if err := mfs.Lock(f.FullPath(), fmt.Sprintf("handle %d", h.handle)); err != nil {
+		mfs.m.Lock()
+		mfs.handles[h.handle] = nil
+		mfs.m.Unlock()
+		return nil, err
+	}
 	return h, nil
 }
 
+// openHandles returns the open handles of the file at path.
+func (mfs *MinFS) openHandles(path string) []*FileHandle {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	var handles []*FileHandle
+	for _, h := range mfs.handles {
+		if h != nil && h.File != nil && h.unlinked == nil && h.f.FullPath() == path {
+			handles = append(handles, h)
+		}
+	}
+
+	return handles
+}
+
+// isDirty returns true if an open handle of the file at path has data
+// which hasn't been uploaded.
+func (mfs *MinFS) isDirty(path string) bool {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	for _, h := range mfs.handles {
+		if h != nil && h.dirty && h.f.FullPath() == path {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Release release the filehandle
 func (mfs *MinFS) Release(fh *FileHandle) error {
 	if err := mfs.Unlock(fh.f.FullPath()); err != nil {
 		return err
 	}
 
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
 	mfs.handles[fh.handle] = nil
 	return nil
 }
@@ -386,7 +1154,14 @@ func (mfs *MinFS) NextSequence(tx *meta.Tx) (sequence uint64, err error) {
 
 // Root is the root folder of the MinFS mountpoint
 func (mfs *MinFS) Root() (fs.Node, error) {
-	return &Dir{
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	if root, ok := mfs.dirs[""]; ok {
+		return root, nil
+	}
+
+	root := &Dir{
 		dir:  nil,
 		mfs:  mfs,
 		Path: "",
@@ -394,7 +1169,9 @@ func (mfs *MinFS) Root() (fs.Node, error) {
 		UID:  mfs.config.uid,
 		GID:  mfs.config.gid,
 		Mode: os.ModeDir | 0750,
-	}, nil
+	}
+	mfs.dirs[""] = root
+	return root, nil
 }
 
 // Storer -
@@ -402,6 +1179,29 @@ type Storer interface {
 	store(tx *meta.Tx)
 }
 
+// partialSuffix is appended to cache files while they are downloaded.
+const partialSuffix = ".part"
+
+// removePartialCacheFiles removes the cache files of downloads interrupted
+// by a crash.
+func (mfs *MinFS) removePartialCacheFiles() error {
+	entries, err := os.ReadDir(mfs.config.cache)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), partialSuffix) {
+			continue
+		}
+		mfs.log.Printf("Removing partial cache file %s.\n", entry.Name())
+		if err = os.Remove(path.Join(mfs.config.cache, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // NewCachePath -
 func (mfs *MinFS) NewCachePath() (string, error) {
 	cachePath := path.Join(mfs.config.cache, nextSuffix())
@@ -0,0 +1,366 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v6"
+)
+
+// FsckReport lists the inconsistencies between the meta DB, the cache
+// dir and the remote found by Fsck, by mount path or cache file.
+type FsckReport struct {
+	// MissingRemote are entries of which the object is missing.
+	MissingRemote []string `json:"missingRemote"`
+
+	// MissingMeta are objects missing in the listed directories.
+	MissingMeta []string `json:"missingMeta"`
+
+	// Mismatched are entries with another size or ETag than the object.
+	Mismatched []string `json:"mismatched"`
+
+	// OrphanedCache are cache files not used by any entry.
+	OrphanedCache []string `json:"orphanedCache"`
+
+	// DanglingPending are pending uploads of which the cache file is lost.
+	DanglingPending []string `json:"danglingPending"`
+
+	Repaired bool `json:"repaired"`
+}
+
+// Problems returns the number of inconsistencies found.
+func (r FsckReport) Problems() int {
+	return len(r.MissingRemote) + len(r.MissingMeta) + len(r.Mismatched) + len(r.OrphanedCache) + len(r.DanglingPending)
+}
+
+// Summary returns the counts of the report for humans.
+func (r FsckReport) Summary() string {
+	action := "found"
+	if r.Repaired {
+		action = "repaired"
+	}
+	return fmt.Sprintf("%d problems %s: %d entries without object, %d objects without entry, %d size or ETag mismatches, %d orphaned cache files, %d dangling pending uploads",
+		r.Problems(), action, len(r.MissingRemote), len(r.MissingMeta), len(r.Mismatched), len(r.OrphanedCache), len(r.DanglingPending))
+}
+
+// fsckEntry is a file entry of the meta DB.
+type fsckEntry struct {
+	dir  []string
+	name string
+	file File
+}
+
+// Fsck checks the meta DB against the cache dir and the remote. With
+// repair set, entries without object are removed, mismatched entries take
+// the attributes of the object, directories with missing entries are
+// listed again, and orphaned cache files and dangling pending uploads are
+// removed. Repairs are refused while files are open for writing.
+func (mfs *MinFS) Fsck(repair bool) (FsckReport, error) {
+	var report FsckReport
+
+	if repair && mfs.hasDirtyHandles() {
+		return report, errors.New("Repair refused while files are open for writing")
+	}
+
+	remote, err := mfs.remoteObjects()
+	if err != nil {
+		return report, err
+	}
+
+	var (
+		entries []fsckEntry
+		listed  = map[string]bool{}
+		pending = map[string]pendingUpload{}
+		local   = map[string]bool{}
+	)
+	if err = mfs.db.View(func(tx *meta.Tx) error {
+		if b := tx.Bucket(pendingBucket); b.InnerBucket != nil {
+			if err := b.ForEach(func(k string, _ interface{}) error {
+				var p pendingUpload
+				if err := b.Get(k, &p); err != nil {
+					return err
+				}
+				pending[k] = p
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Bucket(scratchBucket).ForEach(func(k string, _ interface{}) error {
+			local[k] = true
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		root := tx.Bucket("minio/")
+		var state listing
+		if root.InnerBucket != nil && root.GetMeta("listing", &state) == nil && state.Complete {
+			listed[""] = true
+		}
+
+		return fsckWalk(tx.Bucket("minio/"), nil, func(dir []string, name string, o interface{}, b *meta.Bucket) error {
+			if f, ok := o.(File); ok {
+				entries = append(entries, fsckEntry{dir: dir, name: name, file: f})
+				return nil
+			}
+
+			var state listing
+			if b.Bucket(name+"/").GetMeta("listing", &state) == nil && state.Complete {
+				listed[path.Join(append(dir, name)...)] = true
+			}
+			return nil
+		})
+	}); err != nil {
+		return report, err
+	}
+
+	known := map[string]bool{}
+	cacheFiles := map[string]bool{}
+	var missing, mismatched []fsckEntry
+
+	for _, e := range entries {
+		fullPath := path.Join(append(append([]string{}, e.dir...), e.name)...)
+		known[fullPath] = true
+		if e.file.CachePath != "" {
+			cacheFiles[path.Base(e.file.CachePath)] = true
+		}
+
+		// uploads waiting to be retried and local-only files are newer
+		// than the remote
+		if _, ok := pending[fullPath]; ok || e.file.LocalOnly {
+			continue
+		}
+
+		objInfo, ok := remote[fullPath]
+		if !ok {
+			report.MissingRemote = append(report.MissingRemote, fullPath)
+			missing = append(missing, e)
+		} else if objInfo.ETag != e.file.ETag || uint64(objInfo.Size) != e.file.Size {
+			report.Mismatched = append(report.Mismatched, fullPath)
+			mismatched = append(mismatched, e)
+		}
+	}
+
+	relist := map[string]bool{}
+	for key := range remote {
+		if strings.HasSuffix(key, "/") || known[key] || hiddenLocally(local, key) {
+			continue
+		}
+		dir := path.Dir(key)
+		if dir == "." {
+			dir = ""
+		}
+		if listed[dir] {
+			report.MissingMeta = append(report.MissingMeta, key)
+			relist[dir] = true
+		}
+	}
+
+	for fullPath, p := range pending {
+		cacheFiles[path.Base(p.Source)] = true
+		if _, err := os.Stat(p.Source); err != nil {
+			report.DanglingPending = append(report.DanglingPending, fullPath)
+		}
+	}
+
+	cacheEntries, err := os.ReadDir(mfs.config.cache)
+	if err != nil {
+		return report, err
+	}
+	for _, entry := range cacheEntries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, "cache.db") || cacheFiles[name] {
+			continue
+		}
+		report.OrphanedCache = append(report.OrphanedCache, path.Join(mfs.config.cache, name))
+	}
+
+	sort.Strings(report.MissingRemote)
+	sort.Strings(report.MissingMeta)
+	sort.Strings(report.Mismatched)
+	sort.Strings(report.OrphanedCache)
+	sort.Strings(report.DanglingPending)
+
+	if !repair || report.Problems() == 0 {
+		return report, nil
+	}
+
+	if err = mfs.fsckRepair(report, missing, mismatched, relist, remote); err != nil {
+		return report, err
+	}
+	report.Repaired = true
+	return report, nil
+}
+
+// hiddenLocally returns true if the remote key or a parent of it has a
+// local change of a scratch mount.
+func hiddenLocally(local map[string]bool, key string) bool {
+	for ; key != "." && key != ""; key = path.Dir(key) {
+		if local[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// fsckWalk calls fn for the entries of b and its subdirectories.
+func fsckWalk(b *meta.Bucket, dir []string, fn func(dir []string, name string, o interface{}, b *meta.Bucket) error) error {
+	if b.InnerBucket == nil {
+		return nil
+	}
+
+	return b.ForEach(func(k string, o interface{}) error {
+		if err := fn(dir, k, o, b); err != nil {
+			return err
+		}
+		if _, ok := o.(Dir); !ok {
+			return nil
+		}
+		return fsckWalk(b.Bucket(k+"/"), append(dir[:len(dir):len(dir)], k), fn)
+	})
+}
+
+// metaDirBucket returns the meta bucket of the directory at dir.
+func metaDirBucket(tx *meta.Tx, dir []string) *meta.Bucket {
+	b := tx.Bucket("minio/")
+	for _, name := range dir {
+		if b.InnerBucket == nil {
+			break
+		}
+		b = b.Bucket(name + "/")
+	}
+	return b
+}
+
+// fsckRepair fixes the problems of the report conservatively.
+func (mfs *MinFS) fsckRepair(report FsckReport, missing, mismatched []fsckEntry, relist map[string]bool, remote map[string]minio.ObjectInfo) error {
+	var stale []string
+
+	if err := mfs.db.Update(func(tx *meta.Tx) error {
+		for _, e := range missing {
+			if b := metaDirBucket(tx, e.dir); b.InnerBucket != nil {
+				if err := b.Delete(e.name); err != nil {
+					return err
+				}
+			}
+			if err := mfs.releaseInode(tx, path.Join(append(append([]string{}, e.dir...), e.name)...)); err != nil {
+				return err
+			}
+			if e.file.CachePath != "" {
+				stale = append(stale, e.file.CachePath)
+			}
+		}
+
+		for _, e := range mismatched {
+			b := metaDirBucket(tx, e.dir)
+			if b.InnerBucket == nil {
+				continue
+			}
+
+			objInfo := remote[path.Join(append(append([]string{}, e.dir...), e.name)...)]
+			f := e.file
+			f.Size = uint64(objInfo.Size)
+			f.ETag = objInfo.ETag
+			f.LastModified = objInfo.LastModified
+			f.Mtime = objInfo.LastModified
+			f.StatETag = ""
+			if f.CachePath != "" {
+				stale = append(stale, f.CachePath)
+			}
+			f.CachePath = ""
+			f.CacheETag = ""
+			if err := b.Put(e.name, &f); err != nil {
+				return err
+			}
+		}
+
+		for dir := range relist {
+			var parts []string
+			if dir != "" {
+				parts = strings.Split(dir, "/")
+			}
+			if b := metaDirBucket(tx, parts); b.InnerBucket != nil {
+				if err := b.DeleteMeta("listing"); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, fullPath := range report.DanglingPending {
+			if err := tx.Bucket(pendingBucket).Delete(fullPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, cachePath := range append(stale, report.OrphanedCache...) {
+		os.Remove(cachePath)
+	}
+
+	// tracked directories are listed again on the next access
+	mfs.m.Lock()
+	for _, dir := range mfs.dirs {
+		dir.scanned = false
+	}
+	mfs.m.Unlock()
+	return nil
+}
+
+// FsckOffline runs Fsck on the meta DB of an unmounted minfs.
+func (mfs *MinFS) FsckOffline(repair bool) (FsckReport, error) {
+	if mfs.config.metaStore == "memory" {
+		return FsckReport{}, errors.New("Meta store memory is lost at unmount, there is nothing to check")
+	}
+
+	if _, err := mfs.openMeta(!repair); err != nil {
+		return FsckReport{}, err
+	}
+	defer mfs.db.Close()
+
+	var version int
+	if err := mfs.db.View(func(tx *meta.Tx) (err error) {
+		version, err = readSchemaVersion(tx)
+		return err
+	}); err != nil {
+		return FsckReport{}, err
+	}
+	if version != schemaVersion {
+		return FsckReport{}, fmt.Errorf("Meta DB has schema version %d, mount once to migrate it to version %d before checking", version, schemaVersion)
+	}
+
+	if err := mfs.connect(); err != nil {
+		return FsckReport{}, err
+	}
+	if err := mfs.checkBuckets(); err != nil {
+		return FsckReport{}, err
+	}
+	mfs.probeCapabilities()
+
+	return mfs.Fsck(repair)
+}
@@ -0,0 +1,252 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minfs/meta"
+)
+
+const (
+	// defaultGCInterval is the interval of garbage collections.
+	defaultGCInterval = time.Hour
+
+	// gcGrace is the age below which unreferenced cache files are kept,
+	// these might be about to be recorded.
+	gcGrace = 10 * time.Minute
+)
+
+// GCReport lists what a garbage collection removed, or would remove in
+// a dry run.
+type GCReport struct {
+	// CacheReferences are file entries of which the cache file is lost.
+	CacheReferences []string `json:"cacheReferences"`
+
+	// PendingUploads are journaled uploads of which the cache file is lost.
+	PendingUploads []string `json:"pendingUploads"`
+
+	// CacheFiles are cache files nothing refers to.
+	CacheFiles []string `json:"cacheFiles"`
+
+	ReclaimedBytes int64 `json:"reclaimedBytes"`
+	DryRun         bool  `json:"dryRun"`
+}
+
+// Removed returns the number of entries and files removed.
+func (r GCReport) Removed() int {
+	return len(r.CacheReferences) + len(r.PendingUploads) + len(r.CacheFiles)
+}
+
+// Summary returns the counts of the report for humans.
+func (r GCReport) Summary() string {
+	action := "removed"
+	if r.DryRun {
+		action = "to remove"
+	}
+	return fmt.Sprintf("%d %s: %d lost cache references, %d lost pending uploads, %d unreferenced cache files of %d bytes",
+		r.Removed(), action, len(r.CacheReferences), len(r.PendingUploads), len(r.CacheFiles), r.ReclaimedBytes)
+}
+
+// busyPaths returns the mount paths and cache files of open handles and
+// of uploads being queued or run, these are skipped by the collection.
+func (mfs *MinFS) busyPaths() (paths, files map[string]bool) {
+	paths, files = map[string]bool{}, map[string]bool{}
+
+	mfs.m.Lock()
+	for _, fh := range mfs.handles {
+		if fh != nil {
+			paths[fh.f.FullPath()] = true
+			files[fh.cachePath] = true
+		}
+	}
+	mfs.m.Unlock()
+
+	mfs.syncQueue.m.Lock()
+	for _, lane := range [][]queuedOp{mfs.syncQueue.small, mfs.syncQueue.large} {
+		for _, op := range lane {
+			if put, ok := op.req.(*PutOperation); ok {
+				files[put.Source] = true
+			}
+		}
+	}
+	for _, put := range mfs.syncQueue.inflight {
+		files[put.Source] = true
+	}
+	mfs.syncQueue.m.Unlock()
+
+	return paths, files
+}
+
+// GC removes the references of file entries and the journaled uploads of
+// which the cache file is lost, and the cache files nothing refers to.
+// Files with an open handle or transfer are skipped. With dryRun set
+// nothing is removed.
+func (mfs *MinFS) GC(dryRun bool) (GCReport, error) {
+	report := GCReport{DryRun: dryRun}
+	busy, busyFiles := mfs.busyPaths()
+	referenced := map[string]bool{}
+
+	// a dry run doesn't need to write, the DB might be opened read-only
+	run := mfs.db.Update
+	if dryRun {
+		run = mfs.db.View
+	}
+
+	err := run(func(tx *meta.Tx) error {
+		if err := fsckWalk(tx.Bucket("minio/"), nil, func(dir []string, name string, o interface{}, b *meta.Bucket) error {
+			f, ok := o.(File)
+			if !ok || f.CachePath == "" {
+				return nil
+			}
+
+			fullPath := path.Join(append(append([]string{}, dir...), name)...)
+			if _, err := os.Stat(f.CachePath); err == nil || busy[fullPath] {
+				referenced[f.CachePath] = true
+				return nil
+			}
+
+			report.CacheReferences = append(report.CacheReferences, fullPath)
+			if dryRun {
+				return nil
+			}
+			f.CachePath = ""
+			f.CacheETag = ""
+			return b.Put(name, &f)
+		}); err != nil {
+			return err
+		}
+
+		b := tx.Bucket(pendingBucket)
+		if b.InnerBucket == nil {
+			return nil
+		}
+
+		journal := map[string]pendingUpload{}
+		if err := b.ForEach(func(k string, _ interface{}) error {
+			var p pendingUpload
+			if err := b.Get(k, &p); err != nil {
+				return err
+			}
+			journal[k] = p
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for fullPath, p := range journal {
+			if _, err := os.Stat(p.Source); err == nil || busy[fullPath] || busyFiles[p.Source] {
+				referenced[p.Source] = true
+				continue
+			}
+
+			report.PendingUploads = append(report.PendingUploads, fullPath)
+			if dryRun {
+				continue
+			}
+			if err := b.Delete(fullPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	entries, err := os.ReadDir(mfs.config.cache)
+	if err != nil {
+		return report, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		cachePath := path.Join(mfs.config.cache, name)
+		if entry.IsDir() || strings.HasPrefix(name, "cache.db") || strings.HasSuffix(name, partialSuffix) {
+			continue
+		}
+		if referenced[cachePath] {
+			continue
+		}
+		if busyFiles[cachePath] {
+			if !dryRun {
+				mfs.evictions.skipBusy()
+			}
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < gcGrace {
+			continue
+		}
+
+		report.CacheFiles = append(report.CacheFiles, cachePath)
+		report.ReclaimedBytes += info.Size()
+		if dryRun {
+			continue
+		}
+		if err = mfs.removeCacheFile(cachePath, evictGC); err != nil && !os.IsNotExist(err) {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// GCOffline runs the garbage collection of an unmounted target.
+func (mfs *MinFS) GCOffline(dryRun bool) (GCReport, error) {
+	if mfs.config.metaStore == "memory" {
+		return GCReport{}, errors.New("Meta store memory is lost at unmount, there is nothing to collect")
+	}
+
+	if _, err := mfs.openMeta(dryRun); err != nil {
+		return GCReport{}, err
+	}
+	defer mfs.db.Close()
+
+	return mfs.GC(dryRun)
+}
+
+// startGC collects garbage in the background at the gc interval.
+func (mfs *MinFS) startGC() {
+	if mfs.config.gcInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(mfs.config.gcInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-mfs.listenerDoneCh:
+				return
+			case <-ticker.C:
+			}
+
+			report, err := mfs.GC(false)
+			if err != nil {
+				mfs.log.Println("Error:", err)
+			} else if report.Removed() > 0 {
+				mfs.log.Printf("Garbage collection: %s.\n", report.Summary())
+			}
+		}
+	}()
+}
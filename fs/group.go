@@ -0,0 +1,417 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	daemon "github.com/sevlyar/go-daemon"
+)
+
+// processWide are the fields of Config which are settings of the process,
+// the same for all mounts of a group.
+var processWide = map[string]bool{
+	"debug":         true,
+	"background":    true,
+	"pidFile":       true,
+	"metricsAddr":   true,
+	"pprof":         true,
+	"pprofAddr":     true,
+	"logLevel":      true,
+	"logFormat":     true,
+	"logTarget":     true,
+	"logMaxSize":    true,
+	"uploadWorkers": true,
+}
+
+// GroupMount is a mount of a group, Name labels its log entries.
+type GroupMount struct {
+	Name    string
+	Options []func(*Config)
+}
+
+// Group serves several mounts from one process. The mounts share the log,
+// the transports of the S3 requests, the upload workers and the metrics
+// listener, its samples are labeled by mount.
+type Group struct {
+	mounts       []*MinFS
+	names        map[*MinFS]string
+	allOrNothing bool
+
+	// settings of the process, those of the first mount
+	config *Config
+	log    *logger
+
+	// transports by TLS settings
+	transports  map[string]*http.Transport
+	transportsM sync.Mutex
+
+	// slots of the general upload workers of all mounts
+	workers *workerSlots
+
+	metricsServer *http.Server
+
+	// outcome of the mounts which are serving or failed, ready is closed
+	// once all are
+	settled  map[*MinFS]error
+	settledM sync.Mutex
+	ready    chan struct{}
+}
+
+// NewGroup returns the group of mounts. The settings of the process must
+// be the same for all. With allOrNothing a mount failing to mount
+// unmounts the others, otherwise the others are served.
+func NewGroup(allOrNothing bool, mounts ...GroupMount) (*Group, error) {
+	if len(mounts) == 0 {
+		return nil, errors.New("No mounts configured")
+	}
+
+	var (
+		cfgs        []*Config
+		mountpoints = map[string]string{}
+		caches      = map[string]string{}
+	)
+	for _, m := range mounts {
+		cfg, err := newConfig(m.Options)
+		if err != nil {
+			return nil, fmt.Errorf("Mount %s: %s", m.Name, err)
+		}
+
+		// the meta DB of each mount is in its own cache dir
+		if cfg.cache == globalDBDir {
+			cfg.cache = filepath.Join(globalDBDir, m.Name)
+			if err = os.MkdirAll(cfg.cache, 0777); err != nil {
+				return nil, err
+			}
+		}
+		if other, ok := mountpoints[cfg.mountpoint]; ok {
+			return nil, fmt.Errorf("Mounts %s and %s have the same mount point %s", other, m.Name, cfg.mountpoint)
+		}
+		if other, ok := caches[cfg.cache]; ok {
+			return nil, fmt.Errorf("Mounts %s and %s have the same cache dir %s", other, m.Name, cfg.cache)
+		}
+		mountpoints[cfg.mountpoint], caches[cfg.cache] = m.Name, m.Name
+
+		if len(cfgs) > 0 {
+			for _, field := range diffConfig(cfgs[0], cfg) {
+				if processWide[field] {
+					return nil, fmt.Errorf("Mount %s sets %s, which can only be set for all mounts", m.Name, optionName(field))
+				}
+			}
+		}
+		cfgs = append(cfgs, cfg)
+	}
+
+	g := &Group{
+		names:        map[*MinFS]string{},
+		allOrNothing: allOrNothing,
+		config:       cfgs[0],
+		transports:   map[string]*http.Transport{},
+		workers:      newWorkerSlots(cfgs[0].uploadWorkers - reservedCount(cfgs[0].uploadWorkers)),
+		settled:      map[*MinFS]error{},
+		ready:        make(chan struct{}),
+	}
+
+	var err error
+	if g.log, err = openLogger(g.config); err != nil {
+		return nil, err
+	}
+	g.log.setFormat(g.config.logFormat, configScrubber(cfgs))
+
+	for i, cfg := range cfgs {
+		log := &logger{out: g.log.out, fields: []Field{F("mount", mounts[i].Name)}}
+		mfs, err := newMinFS(cfg, log)
+		if err != nil {
+			return nil, fmt.Errorf("Mount %s: %s", mounts[i].Name, err)
+		}
+		mfs.group = g
+		g.mounts = append(g.mounts, mfs)
+		g.names[mfs] = mounts[i].Name
+	}
+	return g, nil
+}
+
+// configScrubber returns the scrubber of the credentials of cfgs.
+func configScrubber(cfgs []*Config) *strings.Replacer {
+	var secrets []secret
+	for _, cfg := range cfgs {
+		secrets = append(secrets, cfg.secrets()...)
+	}
+	return secretScrubber(secrets...)
+}
+
+// scrubber returns the scrubber of the current credentials of all mounts.
+func (g *Group) scrubber() *strings.Replacer {
+	var cfgs []*Config
+	for _, mfs := range g.mounts {
+		cfgs = append(cfgs, mfs.cfg())
+	}
+	return configScrubber(cfgs)
+}
+
+// Serve serves the mounts until all are unmounted. SIGTERM and SIGHUP
+// apply to all of them. Mounts which fail to mount are logged, and the
+// others served unless the group is all or nothing. The errors of all
+// mounts are returned.
+func (g *Group) Serve() (err error) {
+	first := g.mounts[0]
+	if g.config.background && !daemon.WasReborn() {
+		return first.startDaemon(first.daemonContext())
+	}
+	if err = first.acquirePidFile(); err != nil {
+		return err
+	}
+	defer first.releasePidFile()
+	defer func() {
+		first.daemonExited(err)
+	}()
+
+	control, err := startControl(g.serving, g.log)
+	if err != nil {
+		return err
+	}
+	defer control.close()
+
+	if err = g.startMetrics(); err != nil {
+		return err
+	}
+	defer g.stopMetrics()
+	if err = first.startPprof(); err != nil {
+		return err
+	}
+	defer first.stopPprof()
+
+	var (
+		wg      sync.WaitGroup
+		results = make([]error, len(g.mounts))
+	)
+	for i, mfs := range g.mounts {
+		wg.Add(1)
+		go func(i int, mfs *MinFS) {
+			defer wg.Done()
+			results[i] = mfs.serve()
+			g.mounted(mfs, results[i])
+		}(i, mfs)
+	}
+
+	<-g.ready
+	if g.allOrNothing && len(g.serving()) < len(g.mounts) {
+		g.log.Error("A mount failed, unmounting the others")
+		for _, mfs := range g.serving() {
+			go mfs.stop(make(chan struct{}))
+		}
+	}
+	wg.Wait()
+
+	var errs []string
+	for i, rerr := range results {
+		if rerr != nil {
+			errs = append(errs, g.names[g.mounts[i]]+": "+rerr.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d mounts failed, %s", len(errs), len(g.mounts), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// mounted records that mfs is serving, or failed with err. The parent of
+// a background group is told once all mounts are.
+func (g *Group) mounted(mfs *MinFS, err error) {
+	g.settledM.Lock()
+	defer g.settledM.Unlock()
+
+	if _, ok := g.settled[mfs]; ok {
+		return
+	}
+	g.settled[mfs] = err
+	if err != nil {
+		mfs.log.Error("Unable to mount", F("mountpoint", mfs.config.mountpoint), F("error", err))
+	}
+	if len(g.settled) < len(g.mounts) {
+		return
+	}
+
+	failed := 0
+	for _, err := range g.settled {
+		if err != nil {
+			failed++
+		}
+	}
+	// otherwise the parent is told the error once the mounts are gone
+	if failed == 0 || failed < len(g.mounts) && !g.allOrNothing {
+		daemonReport(daemonReadyMsg)
+		reportReadyFD(g.config.readyFD, true)
+	}
+	close(g.ready)
+}
+
+// serving returns the mounts which mounted.
+func (g *Group) serving() []*MinFS {
+	g.settledM.Lock()
+	defer g.settledM.Unlock()
+
+	var mounts []*MinFS
+	for _, mfs := range g.mounts {
+		if err, ok := g.settled[mfs]; ok && err == nil {
+			mounts = append(mounts, mfs)
+		}
+	}
+	return mounts
+}
+
+// transport returns the transport of the mounts with the CA bundle and
+// insecure setting, which share its connections.
+func (g *Group) transport(cabundle string, insecure bool, tlsConfig *tls.Config) *http.Transport {
+	g.transportsM.Lock()
+	defer g.transportsM.Unlock()
+
+	key := fmt.Sprintf("%s:%t", cabundle, insecure)
+	t, ok := g.transports[key]
+	if !ok {
+		t = newTransport(tlsConfig)
+		g.transports[key] = t
+	}
+	return t
+}
+
+// startMetrics serves the metrics of all mounts at /metrics and their
+// health at /healthz of the metrics address.
+func (g *Group) startMetrics() error {
+	if g.config.metricsAddr == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", g.config.metricsAddr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for metrics on %s: %s", g.config.metricsAddr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fam := newMetricFamilies()
+		for _, mfs := range g.serving() {
+			mfs.writeMetrics(fam)
+		}
+		fam.writeTo(w)
+	})
+	mux.HandleFunc("/healthz", g.serveHealth)
+	if g.config.pprof && g.config.pprofAddr == "" {
+		registerPprof(mux)
+	}
+
+	g.metricsServer = &http.Server{Handler: mux}
+	go g.metricsServer.Serve(l)
+
+	g.log.Printf("Serving metrics on %s.\n", l.Addr())
+	return nil
+}
+
+// stopMetrics closes the metrics listener.
+func (g *Group) stopMetrics() {
+	if g.metricsServer != nil {
+		g.metricsServer.Close()
+	}
+}
+
+// GroupHealth is the health of the mounts of a group, by mount.
+type GroupHealth struct {
+	Healthy bool              `json:"healthy"`
+	Mounts  map[string]Health `json:"mounts"`
+}
+
+// serveHealth answers with the health of the mounts, 503 if a check of a
+// mount failed or a mount isn't serving.
+func (g *Group) serveHealth(w http.ResponseWriter, r *http.Request) {
+	h := GroupHealth{Healthy: true, Mounts: map[string]Health{}}
+	serving := map[*MinFS]bool{}
+	for _, mfs := range g.serving() {
+		serving[mfs] = true
+	}
+	for _, mfs := range g.mounts {
+		mh := Health{Checks: map[string]HealthCheck{"mount": {Error: "Not serving"}}}
+		if serving[mfs] {
+			mh = mfs.Health()
+		}
+		h.Mounts[g.names[mfs]] = mh
+		h.Healthy = h.Healthy && mh.Healthy
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !h.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
+
+// workerSlots limits the operations run by the general upload workers of
+// all mounts of a group.
+type workerSlots struct {
+	m    sync.Mutex
+	cond *sync.Cond
+	n    int
+	used int
+}
+
+func newWorkerSlots(n int) *workerSlots {
+	s := &workerSlots{}
+	s.cond = sync.NewCond(&s.m)
+	s.resize(n)
+	return s
+}
+
+// acquire blocks until a slot is free and takes it.
+func (s *workerSlots) acquire() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for s.used >= s.n {
+		s.cond.Wait()
+	}
+	s.used++
+}
+
+// release frees a slot taken by acquire.
+func (s *workerSlots) release() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.used--
+	s.cond.Broadcast()
+}
+
+// resize sets the number of slots, at least one.
+func (s *workerSlots) resize(n int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if n < 1 {
+		n = 1
+	}
+	s.n = n
+	s.cond.Broadcast()
+}
@@ -0,0 +1,136 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minfs/meta"
+)
+
+// healthTimeout is the time a health check may take before it fails.
+const healthTimeout = 2 * time.Second
+
+// HealthCheck is the result of a self-check.
+type HealthCheck struct {
+	Healthy  bool   `json:"healthy"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Health is the result of the self-checks of the mount.
+type Health struct {
+	Healthy bool                   `json:"healthy"`
+	Checks  map[string]HealthCheck `json:"checks"`
+}
+
+// runCheck runs fn with the health timeout. Checks which are still
+// running from an earlier probe fail right away, so a wedged mount
+// doesn't pile up stuck checks.
+func runCheck(running *int32, fn func() error) HealthCheck {
+	start := time.Now()
+	result := func(err error) HealthCheck {
+		c := HealthCheck{Healthy: err == nil, Duration: time.Since(start).Round(time.Microsecond).String()}
+		if err != nil {
+			c.Error = err.Error()
+		}
+		return c
+	}
+
+	if !atomic.CompareAndSwapInt32(running, 0, 1) {
+		return result(errors.New("Check of an earlier probe is still running"))
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		defer atomic.StoreInt32(running, 0)
+		errCh <- fn()
+	}()
+
+	select {
+	case err := <-errCh:
+		return result(err)
+	case <-time.After(healthTimeout):
+		return result(errors.New("Check timed out"))
+	}
+}
+
+// Health checks that the mount root can be stat'ed through the kernel,
+// that the meta DB serves transactions and, with remote health checks,
+// that the bucket is reachable.
+func (mfs *MinFS) Health() Health {
+	h := Health{Healthy: true, Checks: map[string]HealthCheck{}}
+
+	h.Checks["mount"] = runCheck(&mfs.health.mount, func() error {
+		_, err := os.Stat(mfs.config.mountpoint)
+		return err
+	})
+	h.Checks["meta"] = runCheck(&mfs.health.meta, func() error {
+		return mfs.db.View(func(tx *meta.Tx) error {
+			return nil
+		})
+	})
+	if mfs.config.healthRemote {
+		h.Checks["remote"] = runCheck(&mfs.health.remote, mfs.checkRemote)
+	}
+
+	for _, c := range h.Checks {
+		h.Healthy = h.Healthy && c.Healthy
+	}
+	return h
+}
+
+// checkRemote sends a HEAD request for the bucket, or lists the buckets
+// when all are mounted.
+func (mfs *MinFS) checkRemote() error {
+	// a single attempt, which ends an outage if answered
+	ctx := withRetryMode(context.Background(), retryNone)
+
+	if mfs.config.allBuckets() {
+		_, err := mfs.api.ListBucketsWithContext(ctx)
+		return err
+	}
+
+	bucket := mfs.config.bucket
+	if mfs.config.multiBucket() {
+		bucket = mfs.config.buckets[0]
+	}
+
+	exists, err := mfs.api.BucketExistsWithContext(ctx, bucket)
+	if err == nil && !exists {
+		err = errors.New("Bucket " + bucket + " does not exist")
+	}
+	return err
+}
+
+// serveHealth answers with the health of the mount, 503 if a check
+// failed.
+func (mfs *MinFS) serveHealth(w http.ResponseWriter, r *http.Request) {
+	h := mfs.Health()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !h.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
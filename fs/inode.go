@@ -0,0 +1,174 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"path"
+	"strings"
+
+	"github.com/minio/minfs/meta"
+)
+
+// inodeBucket is the meta bucket mapping the paths of the mount to their
+// inodes. An inode is assigned once per path until the path is removed,
+// and inode numbers are never reused.
+const inodeBucket = "inodes/"
+
+// inode returns the inode of the entry at fullPath, a new one is allocated
+// if the path has none.
+func (mfs *MinFS) inode(tx *meta.Tx, fullPath string) (uint64, error) {
+	b := tx.Bucket(inodeBucket)
+
+	var ino uint64
+	if err := b.Get(fullPath, &ino); err == nil {
+		return ino, nil
+	} else if !isNotFound(err) {
+		return 0, err
+	}
+
+	ino, err := mfs.NextSequence(tx)
+	if err != nil {
+		return 0, err
+	}
+	return ino, b.Put(fullPath, ino)
+}
+
+// releaseInode drops the inodes of the removed entry at fullPath and the
+// entries below it, within the transaction committing the removal.
+func (mfs *MinFS) releaseInode(tx *meta.Tx, fullPath string) error {
+	b := tx.Bucket(inodeBucket)
+
+	if err := b.Delete(fullPath); err != nil {
+		return err
+	}
+
+	for _, k := range inodesBelow(b, fullPath) {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveInodes moves the inodes of the entry at oldPath and the entries
+// below it to newPath, replacing the inodes of an entry at newPath.
+func (mfs *MinFS) moveInodes(tx *meta.Tx, oldPath, newPath string) error {
+	if err := mfs.releaseInode(tx, newPath); err != nil {
+		return err
+	}
+
+	b := tx.Bucket(inodeBucket)
+	for _, k := range append([]string{oldPath}, inodesBelow(b, oldPath)...) {
+		var ino uint64
+		if err := b.Get(k, &ino); isNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+		if err := b.Put(newPath+strings.TrimPrefix(k, oldPath), ino); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inodesBelow returns the paths below dirPath with an inode.
+func inodesBelow(b *meta.Bucket, dirPath string) []string {
+	prefix := dirPath + "/"
+
+	var paths []string
+	b.ForEach(func(k string, _ interface{}) error {
+		if strings.HasPrefix(k, prefix) {
+			paths = append(paths, k)
+		}
+		return nil
+	})
+	return paths
+}
+
+// migrateV1 records the inodes of the entries, entries sharing an inode
+// or without one get a new inode.
+func migrateV1(tx *meta.Tx) error {
+	inodes, err := tx.CreateBucketIfNotExists(inodeBucket)
+	if err != nil {
+		return err
+	}
+
+	root := tx.Bucket("minio/")
+
+	type fix struct {
+		dir  []string
+		name string
+		o    interface{}
+	}
+
+	seen := map[uint64]bool{}
+	var fixes []fix
+
+	if err = fsckWalk(root, nil, func(dir []string, name string, o interface{}, b *meta.Bucket) error {
+		var ino uint64
+		switch v := o.(type) {
+		case File:
+			ino = v.Inode
+		case Dir:
+			ino = v.Inode
+		default:
+			return nil
+		}
+
+		if ino == 0 || seen[ino] {
+			fixes = append(fixes, fix{dir, name, o})
+			return nil
+		}
+		seen[ino] = true
+		return inodes.Put(path.Join(append(dir, name)...), ino)
+	}); err != nil {
+		return err
+	}
+
+	for _, fx := range fixes {
+		ino, err := root.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		switch v := fx.o.(type) {
+		case File:
+			v.Inode = ino
+			fx.o = v
+		case Dir:
+			v.Inode = ino
+			fx.o = v
+		}
+
+		b := root
+		for _, name := range fx.dir {
+			b = b.Bucket(name + "/")
+		}
+		if err = b.Put(fx.name, fx.o); err != nil {
+			return err
+		}
+		if err = inodes.Put(path.Join(append(fx.dir, fx.name)...), ino); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"fmt"
+	"testing"
+)
+
+// inodeOf returns the inode of the entry name.
+func (m *testMount) inodeOf(name string) uint64 {
+	m.t.Helper()
+
+	node, err := m.lookup(name)
+	if err != nil {
+		m.t.Fatalf("lookup %s: %v", name, err)
+	}
+	switch n := node.(type) {
+	case *File:
+		return n.Inode
+	case *Dir:
+		return n.Inode
+	}
+	m.t.Fatalf("lookup %s: unexpected node %T", name, node)
+	return 0
+}
+
+// TestInodesAcrossRemounts creates, removes and creates again the same and
+// other names across remounts, every path keeps its inode until it's
+// removed and no inode is handed out twice.
+func TestInodesAcrossRemounts(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "remote", []byte("remote"))
+
+	m := newTestMount(t, s3, t.TempDir())
+
+	// owners maps every inode handed out to the path it was first seen at,
+	// current the paths to their inodes
+	owners := map[uint64]string{}
+	current := map[string]uint64{}
+	check := func(round int, names ...string) {
+		t.Helper()
+		for _, name := range names {
+			ino := m.inodeOf(name)
+			if ino == 0 {
+				t.Fatalf("round %d: expected an inode of %s", round, name)
+			}
+			if prev, ok := current[name]; ok {
+				if prev != ino {
+					t.Errorf("round %d: expected %s to keep inode %d, got %d", round, name, prev, ino)
+				}
+				continue
+			}
+			if owner, ok := owners[ino]; ok {
+				t.Errorf("round %d: expected a new inode of %s, got %d of %s", round, name, ino, owner)
+			}
+			owners[ino] = name
+			current[name] = ino
+		}
+	}
+	removed := func(name string, isDir bool) {
+		t.Helper()
+		if err := m.remove(name, isDir); err != nil {
+			t.Fatalf("remove %s: %v", name, err)
+		}
+		delete(current, name)
+	}
+
+	for round := 0; round < 3; round++ {
+		if err := m.mkdir("d"); err != nil {
+			t.Fatal(err)
+		}
+		m.writeFile("same", []byte("same"))
+		m.writeFile("d/same", []byte("same"))
+		m.writeFile(fmt.Sprintf("other-%d", round), []byte("other"))
+		m.syncQueue.drain()
+		check(round, "remote", "d", "same", "d/same", fmt.Sprintf("other-%d", round))
+
+		// the inodes are kept across remounts
+		m = m.remount()
+		check(round, "remote", "d", "same", "d/same", fmt.Sprintf("other-%d", round))
+
+		// renames keep the inode, the renamed path gets a new one
+		if err := m.rename("same", "renamed"); err != nil {
+			t.Fatal(err)
+		}
+		current["renamed"] = current["same"]
+		delete(current, "same")
+		m.writeFile("same", []byte("again"))
+		m.syncQueue.drain()
+		check(round, "renamed", "same")
+
+		// removed paths get new inodes once created again, also after
+		// a remount
+		removed("same", false)
+		removed("renamed", false)
+		removed("d/same", false)
+		removed("d", true)
+		m.syncQueue.drain()
+		m = m.remount()
+
+		s3.put(testBucket, fmt.Sprintf("remote-%d", round), []byte("remote"))
+		check(round, "remote", fmt.Sprintf("remote-%d", round))
+	}
+}
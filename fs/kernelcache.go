@@ -0,0 +1,49 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// defaultEntryTimeout is the time the kernel caches the names looked up,
+// the default of bazil.org/fuse. Attributes aren't cached by default.
+const defaultEntryTimeout = time.Minute
+
+// cacheFileFlags returns the flags the cache file of a handle opened with
+// flags is opened with. The kernel reads the pages it merges partial
+// writes into through writable handles and writes them back at their
+// offsets in writeback cache mode, also for appends.
+func (cfg *Config) cacheFileFlags(flags fuse.OpenFlags) int {
+	f := int(flags)
+	if cfg.writebackCache && f&syscall.O_ACCMODE != os.O_RDONLY {
+		f = f&^(syscall.O_ACCMODE|os.O_APPEND) | os.O_RDWR
+	}
+	return f
+}
+
+// openFlags returns the flags of the response to an open or create.
+func (cfg *Config) openFlags() fuse.OpenResponseFlags {
+	if cfg.directIO {
+		return fuse.OpenDirectIO
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"path"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// maxKeyLen is the maximum length of object keys in bytes. The depth of
+// the hierarchy isn't limited otherwise: cache files are named
+// independently of the keys, and the meta DB nests a bucket per
+// directory.
+const maxKeyLen = 1024
+
+// errKeyTooLong fails creates and renames of entries whose object keys
+// exceed maxKeyLen.
+var errKeyTooLong = fuse.Errno(syscall.ENAMETOOLONG)
+
+// checkKey fails with ENAMETOOLONG if the key of the entry name of dir is
+// longer than S3 allows, directories are checked with the slash of their
+// markers.
+func (dir *Dir) checkKey(name string, isDir bool) error {
+	key := path.Join(dir.RemotePath(), name)
+	if isDir {
+		key += "/"
+	}
+	if len(key) > maxKeyLen {
+		return errKeyTooLong
+	}
+	return nil
+}
+
+// checkMovedKeys fails with ENAMETOOLONG if a key below the directory
+// oldPath, moved below newPath, would be longer than S3 allows. Only
+// renames making the keys longer list the directory.
+func (dir *Dir) checkMovedKeys(oldPath, newPath string) error {
+	grow := len(newPath) - len(oldPath)
+	if grow <= 0 {
+		return nil
+	}
+
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	for message := range dir.mfs.listObjects(dir.BucketName(), oldPath+"/", doneCh) {
+		if message.Err != nil {
+			return message.Err
+		}
+		if len(message.Key)+grow > maxKeyLen {
+			return errKeyTooLong
+		}
+	}
+	return nil
+}
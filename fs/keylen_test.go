@@ -0,0 +1,138 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+)
+
+// TestDeepHierarchy creates files 50 directories deep, whose keys and
+// meta DB buckets nest as deep.
+func TestDeepHierarchy(t *testing.T) {
+	const depth = 50
+
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "remote/"+deepPath(depth, "existing"), []byte("existing"))
+
+	cache := t.TempDir()
+	m := newTestMount(t, s3, cache)
+
+	for i := 1; i <= depth; i++ {
+		if err := m.mkdir(deepPath(i, "")); err != nil {
+			t.Fatalf("mkdir level %d: %v", i, err)
+		}
+	}
+	name := deepPath(depth, "file")
+	m.writeFile(name, []byte("deep"))
+	m.syncQueue.drain()
+
+	if data, ok := s3.get(testBucket, name); !ok || string(data) != "deep" {
+		t.Fatalf("expected the object %s, got %q", name, data)
+	}
+	if got := m.readFile("remote/" + deepPath(depth, "existing")); string(got) != "existing" {
+		t.Errorf("expected existing, got %q", got)
+	}
+
+	// cache files are named independently of the keys
+	for _, name := range cacheFiles(t, cache) {
+		if len(name) > 64 {
+			t.Errorf("expected short cache file names, got %s", name)
+		}
+	}
+
+	m = m.remount()
+	if got := m.readFile(name); string(got) != "deep" {
+		t.Errorf("expected deep after remounting, got %q", got)
+	}
+	if err := m.rename(name, deepPath(depth-1, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	m.syncQueue.drain()
+	if _, ok := s3.get(testBucket, deepPath(depth-1, "moved")); !ok {
+		t.Errorf("expected the renamed object")
+	}
+}
+
+// deepPath returns the path of name below depth nested directories, the
+// directory at depth itself for "".
+func deepPath(depth int, name string) string {
+	var elems []string
+	for i := 1; i <= depth; i++ {
+		elems = append(elems, fmt.Sprintf("level-%02d", i))
+	}
+	return path.Join(append(elems, name)...)
+}
+
+func TestLongKeys(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+
+	m := newTestMount(t, s3, t.TempDir())
+
+	// keys of 900 bytes, below 4 directories of 200 bytes
+	var dir string
+	for i := 0; i < 4; i++ {
+		dir = path.Join(dir, strings.Repeat(string(rune('a'+i)), 200))
+		if err := m.mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := path.Join(dir, strings.Repeat("f", 900-len(dir)-1))
+	if len(name) != 900 {
+		t.Fatalf("expected a 900 byte key, got %d", len(name))
+	}
+	m.writeFile(name, []byte("long"))
+	m.syncQueue.drain()
+
+	if data, ok := s3.get(testBucket, name); !ok || string(data) != "long" {
+		t.Fatalf("expected the 900 byte key to be uploaded, got %q", data)
+	}
+	m = m.remount()
+	if got := m.readFile(name); string(got) != "long" {
+		t.Errorf("expected long after remounting, got %q", got)
+	}
+
+	// the full key is limited to 1024 bytes, not the path elements
+	fits := path.Join(dir, strings.Repeat("g", maxKeyLen-len(dir)-1))
+	m.writeFile(fits, []byte("fits"))
+	if _, _, err := m.create(fits + "x"); err != errKeyTooLong {
+		t.Errorf("expected ENAMETOOLONG creating a 1025 byte key, got %v", err)
+	}
+	if err := m.mkdir(fits[:len(fits)-1] + "d"); err != errKeyTooLong {
+		t.Errorf("expected ENAMETOOLONG for a directory marker of 1025 bytes, got %v", err)
+	}
+	if err := m.rename(name, name+strings.Repeat("x", 125)); err != errKeyTooLong {
+		t.Errorf("expected ENAMETOOLONG renaming to a 1025 byte key, got %v", err)
+	}
+
+	// renaming a directory checks the keys below it before moving any
+	top := strings.Repeat("a", 200)
+	if err := m.rename(top, top+strings.Repeat("x", 30)); err != errKeyTooLong {
+		t.Errorf("expected ENAMETOOLONG for a rename making keys below too long, got %v", err)
+	}
+	m.syncQueue.drain()
+	if _, ok := s3.get(testBucket, name); !ok {
+		t.Errorf("expected no object to be moved by the failed rename")
+	}
+	if err := m.rename(top, "short"); err != nil {
+		t.Errorf("expected the rename shortening the keys to succeed, got %v", err)
+	}
+}
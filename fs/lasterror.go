@@ -0,0 +1,164 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// maxLastErrors is the number of paths of which the last error is kept.
+const maxLastErrors = 1024
+
+// LastError is the last failed FUSE operation of a path, with the S3
+// request causing it.
+type LastError struct {
+	Time  time.Time
+	Op    string
+	OpID  uint64
+	Errno string
+	Error string `json:",omitempty"`
+	Cause string `json:",omitempty"`
+
+	// S3RequestID and S3HostID identify the failed S3 request for the
+	// operator of the backend.
+	S3RequestID string `json:",omitempty"`
+	S3HostID    string `json:",omitempty"`
+}
+
+// lastErrors keeps the last error by path, the oldest entry is dropped
+// once the limit is reached.
+type lastErrors struct {
+	m      sync.Mutex
+	byPath map[string]LastError
+}
+
+func (le *lastErrors) record(path string, e LastError) {
+	le.m.Lock()
+	defer le.m.Unlock()
+
+	if le.byPath == nil {
+		le.byPath = map[string]LastError{}
+	}
+	if _, ok := le.byPath[path]; !ok && len(le.byPath) >= maxLastErrors {
+		oldest := ""
+		for p, e := range le.byPath {
+			if oldest == "" || e.Time.Before(le.byPath[oldest].Time) {
+				oldest = p
+			}
+		}
+		delete(le.byPath, oldest)
+	}
+	le.byPath[path] = e
+}
+
+func (le *lastErrors) get(path string) (LastError, bool) {
+	le.m.Lock()
+	defer le.m.Unlock()
+
+	e, ok := le.byPath[path]
+	return e, ok
+}
+
+// s3Failure is the last failed S3 request, attributed to a failing
+// operation which sent requests without its context.
+type s3Failure struct {
+	at        time.Time
+	requestID string
+	hostID    string
+}
+
+// failureErrno tells if errno is a failure worth keeping, missing entries
+// and attributes are answers rather than failures.
+func failureErrno(errno string) bool {
+	switch errno {
+	case fuse.ENOENT.ErrnoName(), fuse.ErrNoXattr.ErrnoName():
+		return false
+	}
+	return true
+}
+
+// opFailed logs the failure of the operation with the S3 request causing
+// it and keeps it as the last error of the path. The request is taken
+// from the last failed S3 request while the operation ran if it didn't
+// send requests with its context.
+func (mfs *MinFS) opFailed(s *opState, errno, text, cause string) {
+	mfs.opsM.Lock()
+	path, requestID, hostID := s.path, s.s3RequestID, s.s3HostID
+	if requestID == "" && cause != "" && mfs.lastS3Failure.at.After(s.since) {
+		requestID, hostID = mfs.lastS3Failure.requestID, mfs.lastS3Failure.hostID
+	}
+	mfs.opsM.Unlock()
+
+	if requestID != "" {
+		mfs.log.Error("FUSE operation failed",
+			F("op", s.op), F("op_id", s.id), F("path", path), F("errno", errno), F("error", text),
+			F("cause", cause), F("s3_request_id", requestID), F("s3_host_id", hostID))
+	}
+
+	if path == "" || !failureErrno(errno) {
+		return
+	}
+	e := LastError{
+		Time:        time.Now().UTC(),
+		Op:          s.op,
+		OpID:        s.id,
+		Errno:       errno,
+		Error:       text,
+		Cause:       cause,
+		S3RequestID: requestID,
+		S3HostID:    hostID,
+	}
+	mfs.lastErrors.record(path, e)
+	mfs.notifyError(ErrorEvent{Path: path, LastError: e})
+}
+
+// lastErrorXattr returns the last error of the file as JSON.
+func (f *File) lastErrorXattr(ctx context.Context) ([]byte, error) {
+	e, ok := f.mfs.lastErrors.get(f.FullPath())
+	if !ok {
+		return nil, fuse.ErrNoXattr
+	}
+	return json.Marshal(e)
+}
+
+// lastErrorsJSON returns the last error of every path.
+func (mfs *MinFS) lastErrorsJSON() ([]byte, error) {
+	type pathError struct {
+		Path string
+		LastError
+	}
+
+	mfs.lastErrors.m.Lock()
+	errs := make([]pathError, 0, len(mfs.lastErrors.byPath))
+	for p, e := range mfs.lastErrors.byPath {
+		errs = append(errs, pathError{p, e})
+	}
+	mfs.lastErrors.m.Unlock()
+
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Path < errs[j].Path
+	})
+
+	data, err := json.MarshalIndent(errs, "", "  ")
+	return append(data, '\n'), err
+}
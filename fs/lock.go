@@ -17,54 +17,347 @@
 package minfs
 
 import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
 	"time"
 
 	"bazil.org/fuse"
 )
 
+const (
+	// defaultLockWarn is the time waiting for a lock after which the
+	// wait is logged.
+	defaultLockWarn = time.Second
+
+	// defaultLockTimeout is the time waiting for a lock after which the
+	// operation fails.
+	defaultLockTimeout = 5 * time.Second
+)
+
+// lockStripes is the number of independently locked parts of the lock
+// table, paths are assigned to these by hash.
+const lockStripes = 64
+
+// lockHolder describes the holder of the lock of a path.
+type lockHolder struct {
+	Holder string
+	Since  time.Time
+}
+
+// pathLock is the lock of a path: the handle holding it, the waiter whose
+// turn it is and the operations waiting in arrival order. refs counts
+// these, the entry is dropped when it reaches zero.
+type pathLock struct {
+	holder  *lockHolder
+	owner   *lockWaiter
+	waiters []*lockWaiter
+	refs    int
+}
+
+// lockWaiter is closed once the waiter is let through, waiters with
+// handle set don't wait for the lock held by a handle.
+type lockWaiter struct {
+	ready  chan struct{}
+	handle bool
+}
+
+type lockStripe struct {
+	m     sync.Mutex
+	paths map[string]*pathLock
+}
+
+// lockManager is the table of path locks. It's striped, so operations
+// on unrelated paths don't contend.
+type lockManager struct {
+	stripes [lockStripes]lockStripe
+}
+
+func newLockManager() *lockManager {
+	lm := &lockManager{}
+	for i := range lm.stripes {
+		lm.stripes[i].paths = map[string]*pathLock{}
+	}
+	return lm
+}
+
+// stripe returns the stripe of path.
+func (lm *lockManager) stripe(path string) *lockStripe {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return &lm.stripes[h.Sum32()%lockStripes]
+}
+
+// ref returns the entry of path with a reference taken, st.m must be held.
+func (st *lockStripe) ref(path string) *pathLock {
+	l, ok := st.paths[path]
+	if !ok {
+		l = &pathLock{}
+		st.paths[path] = l
+	}
+	l.refs++
+	return l
+}
+
+// unref drops a reference of the entry of path, st.m must be held.
+func (st *lockStripe) unref(path string, l *pathLock) {
+	if l.refs--; l.refs == 0 {
+		delete(st.paths, path)
+	}
+}
+
+// grant lets the first waiter through once it's nobody's turn. While a
+// handle holds the lock, the first waiter ignoring handle locks is let
+// through, so the flushes of the handle don't queue behind operations
+// waiting for the handle to be closed. st.m must be held.
+func (l *pathLock) grant() {
+	if l.owner != nil {
+		return
+	}
+
+	for i, w := range l.waiters {
+		if l.holder != nil && !w.handle {
+			continue
+		}
+
+		l.owner = w
+		l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+		close(w.ready)
+		return
+	}
+}
+
 // Unlock - unlock the lock at path.
 func (mfs *MinFS) Unlock(path string) error {
-	mfs.m.Lock()
-	defer mfs.m.Unlock()
+	st := mfs.locks.stripe(path)
+	st.m.Lock()
+	defer st.m.Unlock()
 
-	delete(mfs.locks, path)
+	l, ok := st.paths[path]
+	if !ok || l.holder == nil {
+		return nil
+	}
 
+	l.holder = nil
+	l.grant()
+	st.unref(path, l)
 	return nil
 }
 
-// Lock - acquires a lock at path.
-func (mfs *MinFS) Lock(path string) error {
-	mfs.m.Lock()
-	defer mfs.m.Unlock()
+// Lock - acquires a lock at path for holder.
+func (mfs *MinFS) Lock(path, holder string) error {
+	st := mfs.locks.stripe(path)
+	st.m.Lock()
+	defer st.m.Unlock()
 
-	mfs.locks[path] = true
+	l, ok := st.paths[path]
+	if !ok || l.holder == nil {
+		l = st.ref(path)
+	}
+	l.holder = &lockHolder{
+		Holder: holder,
+		Since:  time.Now().UTC(),
+	}
 	return nil
 }
 
 // IsLocked returns if the path is currently locked
 func (mfs *MinFS) IsLocked(path string) bool {
-	mfs.m.Lock()
-	defer mfs.m.Unlock()
-
-	_, ok := mfs.locks[path]
+	_, ok := mfs.lockHolder(path)
 	return ok
 }
 
-// wait for the file lock to be unlocked
-func (mfs *MinFS) wait(path string) error {
-	// check if the file is locked, and wait for max 5 seconds for the file to be
-	// acquired
-	for i := 0; ; /* retries */ i++ {
-		if !mfs.IsLocked(path) {
-			break
+// lockHolder returns the holder of the lock at path.
+func (mfs *MinFS) lockHolder(path string) (lockHolder, bool) {
+	st := mfs.locks.stripe(path)
+	st.m.Lock()
+	defer st.m.Unlock()
+
+	if l, ok := st.paths[path]; ok && l.holder != nil {
+		return *l.holder, true
+	}
+	return lockHolder{}, false
+}
+
+// wait for the file lock to be unlocked, waiters are let through one at
+// a time in arrival order. The returned func ends the turn of the caller,
+// which should hold the lock by then if it needs one. Waits longer than
+// the lock-warn threshold are logged, waits fail with EIO after the lock
+// timeout and with EINTR when the request is interrupted.
+func (mfs *MinFS) wait(ctx context.Context, path string) (func(), error) {
+	return mfs.waitTurn(ctx, path, false)
+}
+
+// turn waits for the turns of the paths, but not for the locks held by
+// handles. Turns are taken in the order of the paths, so operations on
+// two paths can't deadlock each other.
+func (mfs *MinFS) turn(ctx context.Context, paths ...string) (func(), error) {
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+
+	var dones []func()
+	done := func() {
+		for i := len(dones) - 1; i >= 0; i-- {
+			dones[i]()
 		}
+	}
 
-		if i > 25 /* max number of retries */ {
-			return fuse.EPERM
+	for i, path := range sorted {
+		if i > 0 && path == sorted[i-1] {
+			continue
 		}
 
-		time.Sleep(time.Millisecond * 200)
+		d, err := mfs.waitTurn(ctx, path, true)
+		if err != nil {
+			done()
+			return nil, err
+		}
+		dones = append(dones, d)
 	}
+	return done, nil
+}
 
-	return nil
+// waitTurn waits for the turn of path, with handle set waiters don't wait
+// for a lock held by a handle.
+func (mfs *MinFS) waitTurn(ctx context.Context, path string, handle bool) (func(), error) {
+	w := &lockWaiter{ready: make(chan struct{}), handle: handle}
+
+	st := mfs.locks.stripe(path)
+	st.m.Lock()
+	l := st.ref(path)
+	l.waiters = append(l.waiters, w)
+	l.grant()
+	st.m.Unlock()
+
+	done := func() {
+		st.m.Lock()
+		defer st.m.Unlock()
+
+		if l.owner == w {
+			l.owner = nil
+		}
+		for i, v := range l.waiters {
+			if v == w {
+				l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+				break
+			}
+		}
+		l.grant()
+		st.unref(path, l)
+	}
+
+	var (
+		cfg             = mfs.cfg()
+		warnC, timeoutC <-chan time.Time
+	)
+	if cfg.lockWarn > 0 {
+		t := time.NewTimer(cfg.lockWarn)
+		defer t.Stop()
+		warnC = t.C
+	}
+	if cfg.lockTimeout > 0 {
+		t := time.NewTimer(cfg.lockTimeout)
+		defer t.Stop()
+		timeoutC = t.C
+	}
+
+	_, sp := mfs.startSpan(ctx, "lock.wait")
+	sp.set("path", path)
+
+	start := time.Now()
+	for {
+		select {
+		case <-w.ready:
+			sp.finish(nil)
+			return done, nil
+		case <-ctx.Done():
+			done()
+			sp.finish(fuse.EINTR)
+			return nil, fuse.EINTR
+		case <-warnC:
+			mfs.log.Warn("Waiting for the lock", F("path", path), F("duration", time.Since(start).Round(time.Millisecond)), F("holder", mfs.describeHolder(path)))
+		case <-timeoutC:
+			mfs.log.Error("Timed out waiting for the lock", F("path", path), F("duration", time.Since(start).Round(time.Millisecond)), F("holder", mfs.describeHolder(path)))
+			done()
+			sp.finish(fuse.EIO)
+			return nil, fuse.EIO
+		}
+	}
+}
+
+// describeHolder describes what holds up the waiters for path.
+func (mfs *MinFS) describeHolder(path string) string {
+	if h, ok := mfs.lockHolder(path); ok {
+		return fmt.Sprintf("held by %s for %s", h.Holder, time.Since(h.Since).Round(time.Millisecond))
+	}
+	return "held by an operation let through earlier"
+}
+
+// snapshot returns the held locks.
+func (lm *lockManager) snapshot() []LockInfo {
+	var locks []LockInfo
+	for i := range lm.stripes {
+		st := &lm.stripes[i]
+
+		st.m.Lock()
+		for path, l := range st.paths {
+			if l.holder != nil {
+				locks = append(locks, LockInfo{
+					Path:   path,
+					Holder: l.holder.Holder,
+					Since:  l.holder.Since,
+				})
+			}
+		}
+		st.m.Unlock()
+	}
+	return locks
+}
+
+// LockInfo describes a held lock.
+type LockInfo struct {
+	Path   string    `json:"path"`
+	Holder string    `json:"holder"`
+	Since  time.Time `json:"since"`
+}
+
+// OpInfo describes a FUSE operation in flight.
+type OpInfo struct {
+	ID      uint64    `json:"id"`
+	Op      string    `json:"op"`
+	Request string    `json:"request"`
+	Path    string    `json:"path,omitempty"`
+	Remote  string    `json:"remote,omitempty"`
+	Since   time.Time `json:"since"`
+}
+
+// Diagnostics is a snapshot of the held locks and the operations in
+// flight, to find out what hanging operations wait for.
+type Diagnostics struct {
+	Locks      []LockInfo `json:"locks"`
+	Operations []OpInfo   `json:"operations"`
+}
+
+// Diagnostics returns the current lock table and operations in flight,
+// the oldest first.
+func (mfs *MinFS) Diagnostics() Diagnostics {
+	var d Diagnostics
+
+	d.Locks = mfs.locks.snapshot()
+
+	mfs.opsM.Lock()
+	for _, op := range mfs.ops {
+		d.Operations = append(d.Operations, op.info())
+	}
+	mfs.opsM.Unlock()
+
+	sort.Slice(d.Locks, func(i, j int) bool {
+		return d.Locks[i].Since.Before(d.Locks[j].Since)
+	})
+	sort.Slice(d.Operations, func(i, j int) bool {
+		return d.Operations[i].Since.Before(d.Operations[j].Since)
+	})
+	return d
 }
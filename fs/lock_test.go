@@ -0,0 +1,366 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// newLockTestFS returns a minfs which isn't started, for the lock table.
+func newLockTestFS(t *testing.T, options ...func(*Config)) *MinFS {
+	t.Helper()
+
+	cfg := defaultConfig(&AccessConfig{})
+	for _, optionFn := range options {
+		optionFn(cfg)
+	}
+	mfs, err := newMinFS(cfg, newLogger(writerSink{ioutil.Discard}, LevelError, cfg.logFormat, secretScrubber()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mfs
+}
+
+// queued returns the number of operations waiting for the turn of path.
+func queued(mfs *MinFS, path string) int {
+	st := mfs.locks.stripe(path)
+	st.m.Lock()
+	defer st.m.Unlock()
+
+	if l, ok := st.paths[path]; ok {
+		return len(l.waiters)
+	}
+	return 0
+}
+
+// lockEntries returns the number of paths in the lock table.
+func lockEntries(mfs *MinFS) int {
+	var n int
+	for i := range mfs.locks.stripes {
+		st := &mfs.locks.stripes[i]
+		st.m.Lock()
+		n += len(st.paths)
+		st.m.Unlock()
+	}
+	return n
+}
+
+// waitQueued waits until n operations wait for the turn of path.
+func waitQueued(t *testing.T, mfs *MinFS, path string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for queued(mfs, path) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d waiters of %s, got %d", n, path, queued(mfs, path))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWaitFIFO(t *testing.T) {
+	const (
+		path    = "hot/file"
+		waiters = 20
+	)
+
+	mfs := newLockTestFS(t)
+
+	first, err := mfs.wait(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		m       sync.Mutex
+		order   []int
+		wg      sync.WaitGroup
+		errs    = make([]error, waiters)
+		cancels = make([]context.CancelFunc, waiters)
+	)
+	for i := 0; i < waiters; i++ {
+		var ctx context.Context
+		ctx, cancels[i] = context.WithCancel(context.Background())
+
+		wg.Add(1)
+		go func(i int, ctx context.Context) {
+			defer wg.Done()
+			done, err := mfs.wait(ctx, path)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			m.Lock()
+			order = append(order, i)
+			m.Unlock()
+			done()
+		}(i, ctx)
+
+		// the waiters arrive one after another
+		waitQueued(t, mfs, path, i+1)
+	}
+
+	// every third waiter gives up, and leaves the queue right away
+	var expected []int
+	for i := 0; i < waiters; i++ {
+		if i%3 != 1 {
+			expected = append(expected, i)
+			continue
+		}
+		cancels[i]()
+	}
+	waitQueued(t, mfs, path, len(expected))
+
+	first()
+	wg.Wait()
+
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected the turns %v, got %v", expected, order)
+	}
+	for i, err := range errs {
+		if i%3 == 1 && err != fuse.EINTR {
+			t.Errorf("expected the cancelled waiter %d to fail with EINTR, got %v", i, err)
+		} else if i%3 != 1 && err != nil {
+			t.Errorf("expected waiter %d to get its turn, got %v", i, err)
+		}
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+
+	if n := lockEntries(mfs); n != 0 {
+		t.Errorf("expected the lock table to be empty, got %d entries", n)
+	}
+}
+
+// TestWaitHandleLock checks that flushes of a handle holding the lock are
+// let through ahead of the operations waiting for the handle.
+func TestWaitHandleLock(t *testing.T) {
+	const path = "file"
+
+	mfs := newLockTestFS(t)
+	mfs.Lock(path, "handle 1")
+
+	waited := make(chan error, 1)
+	go func() {
+		done, err := mfs.wait(context.Background(), path)
+		if err == nil {
+			done()
+		}
+		waited <- err
+	}()
+	waitQueued(t, mfs, path, 1)
+
+	// the operation waiting for the handle doesn't hold up its flush
+	done, err := mfs.turn(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+
+	select {
+	case err = <-waited:
+		t.Fatalf("expected the wait to last until the handle is closed, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	mfs.Unlock(path)
+	select {
+	case err = <-waited:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the wait to end once the handle is closed")
+	}
+
+	if n := lockEntries(mfs); n != 0 {
+		t.Errorf("expected the lock table to be empty, got %d entries", n)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	const path = "file"
+
+	mfs := newLockTestFS(t, LockTimeout(50*time.Millisecond))
+	mfs.Lock(path, "handle 1")
+
+	start := time.Now()
+	if _, err := mfs.wait(context.Background(), path); err != fuse.EIO {
+		t.Fatalf("expected EIO, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("expected the wait to time out after 50ms, took %s", d)
+	}
+	if n := queued(mfs, path); n != 0 {
+		t.Errorf("expected the timed out waiter to leave the queue, got %d waiters", n)
+	}
+
+	mfs.Unlock(path)
+	if n := lockEntries(mfs); n != 0 {
+		t.Errorf("expected the lock table to be empty, got %d entries", n)
+	}
+}
+
+func TestLockDisjointPaths(t *testing.T) {
+	mfs := newLockTestFS(t, LockTimeout(5*time.Second))
+
+	// a long flush of x/y
+	held, err := mfs.turn(context.Background(), "x/y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfs.Lock("x/z", "handle 1")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	start := time.Now()
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := "a/" + string(rune('a'+i))
+			for j := 0; j < 200; j++ {
+				done, err := mfs.wait(context.Background(), path)
+				if err != nil {
+					errs <- err
+					return
+				}
+				done()
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("expected operations on other paths to go through, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("expected operations on other paths not to wait, took %s", d)
+	}
+
+	held()
+	mfs.Unlock("x/z")
+	if n := lockEntries(mfs); n != 0 {
+		t.Errorf("expected the lock table to be empty, got %d entries", n)
+	}
+}
+
+// TestTurnOrder takes the turns of two paths in both orders at once, like
+// renames a -> b and b -> a, which deadlock unless the turns are ordered.
+func TestTurnOrder(t *testing.T) {
+	mfs := newLockTestFS(t, LockTimeout(5*time.Second))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			paths := []string{"dir/a", "dir/b"}
+			if i%2 == 1 {
+				paths = []string{"dir/b", "dir/a"}
+			}
+			for j := 0; j < 200; j++ {
+				done, err := mfs.turn(context.Background(), paths...)
+				if err != nil {
+					errs <- err
+					return
+				}
+				done()
+			}
+		}(i)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected turns of two paths taken in both orders not to deadlock")
+	}
+	close(errs)
+	for err := range errs {
+		t.Errorf("expected the turns to be taken, got %v", err)
+	}
+
+	// the turn of the same path twice is taken once
+	done, err := mfs.turn(context.Background(), "dir/a", "dir/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+
+	if n := lockEntries(mfs); n != 0 {
+		t.Errorf("expected the lock table to be empty, got %d entries", n)
+	}
+}
+
+// TestLockEntries checks the entries of the lock table are dropped once
+// the locks are released and nobody waits.
+func TestLockEntries(t *testing.T) {
+	mfs := newLockTestFS(t)
+
+	mfs.Lock("a", "handle 1")
+	mfs.Lock("a", "handle 2")
+	if n := lockEntries(mfs); n != 1 {
+		t.Fatalf("expected an entry of the held lock, got %d", n)
+	}
+	if h, ok := mfs.lockHolder("a"); !ok || h.Holder != "handle 2" {
+		t.Errorf("expected handle 2 to hold the lock, got %+v", h)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waited := make(chan error, 1)
+	go func() {
+		_, err := mfs.wait(ctx, "a")
+		waited <- err
+	}()
+	waitQueued(t, mfs, "a", 1)
+	cancel()
+	if err := <-waited; err != fuse.EINTR {
+		t.Fatalf("expected EINTR, got %v", err)
+	}
+
+	done, err := mfs.turn(context.Background(), "a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := lockEntries(mfs); n != 2 {
+		t.Errorf("expected the entries of a and b, got %d", n)
+	}
+	done()
+
+	mfs.Unlock("a")
+	mfs.Unlock("a")
+	if n := lockEntries(mfs); n != 0 {
+		t.Errorf("expected the lock table to be empty, got %d entries", n)
+	}
+	if mfs.IsLocked("a") {
+		t.Errorf("expected a to be unlocked")
+	}
+}
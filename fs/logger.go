@@ -0,0 +1,316 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v6"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+// Log levels, each includes the ones before.
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+	LevelTrace
+)
+
+var levelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+func (l Level) String() string {
+	if l < LevelError || l > LevelTrace {
+		return fmt.Sprintf("level%d", int(l))
+	}
+	return levelNames[l]
+}
+
+// parseLevel returns the level of name.
+func parseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unsupported log level %s", name)
+}
+
+// Field is a key value pair added to log entries.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns the field key with value v.
+func F(key string, v interface{}) Field {
+	return Field{Key: key, Value: v}
+}
+
+// Logger is the leveled, structured logger of a mount. Loggers returned by
+// With add their fields to all entries.
+type Logger interface {
+	Error(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Debug(msg string, fields ...Field)
+	Trace(msg string, fields ...Field)
+
+	With(fields ...Field) Logger
+	Enabled(level Level) bool
+}
+
+// logOutput is the sink shared by a logger and the loggers derived from
+// it.
+type logOutput struct {
+	// level is accessed atomically, the other fields under m.
+	level int32
+
+	m      sync.Mutex
+	sink   logSink
+	format string
+
+	// removes the values of credentials from entries
+	scrubber *strings.Replacer
+}
+
+// logger writes entries as console lines or JSON objects.
+type logger struct {
+	out    *logOutput
+	fields []Field
+}
+
+// newLogger returns the logger writing entries up to level to sink, format
+// is console or json. Entries are passed through scrubber.
+func newLogger(sink logSink, level Level, format string, scrubber *strings.Replacer) *logger {
+	return &logger{out: &logOutput{sink: sink, level: int32(level), format: format, scrubber: scrubber}}
+}
+
+// setLevel changes the level of the logger and the loggers derived from it.
+func (l *logger) setLevel(level Level) {
+	atomic.StoreInt32(&l.out.level, int32(level))
+}
+
+// setFormat changes the format of the logger and the loggers derived from
+// it, and the scrubber entries are passed through.
+func (l *logger) setFormat(format string, scrubber *strings.Replacer) {
+	l.out.m.Lock()
+	defer l.out.m.Unlock()
+
+	l.out.format = format
+	l.out.scrubber = scrubber
+}
+
+// scrub passes text through the scrubber of the logger.
+func (l *logger) scrub(text string) string {
+	l.out.m.Lock()
+	defer l.out.m.Unlock()
+
+	return l.out.scrubber.Replace(text)
+}
+
+// setSink switches the logger and the loggers derived from it to sink, and
+// returns the previous one.
+func (l *logger) setSink(sink logSink) logSink {
+	l.out.m.Lock()
+	defer l.out.m.Unlock()
+
+	old := l.out.sink
+	l.out.sink = sink
+	return old
+}
+
+func (l *logger) Error(msg string, fields ...Field) { l.log(2, LevelError, msg, fields) }
+func (l *logger) Warn(msg string, fields ...Field)  { l.log(2, LevelWarn, msg, fields) }
+func (l *logger) Info(msg string, fields ...Field)  { l.log(2, LevelInfo, msg, fields) }
+func (l *logger) Debug(msg string, fields ...Field) { l.log(2, LevelDebug, msg, fields) }
+func (l *logger) Trace(msg string, fields ...Field) { l.log(2, LevelTrace, msg, fields) }
+
+// With returns a logger adding fields to the entries.
+func (l *logger) With(fields ...Field) Logger {
+	return &logger{
+		out:    l.out,
+		fields: append(l.fields[:len(l.fields):len(l.fields)], fields...),
+	}
+}
+
+// Enabled returns true if entries of level are written.
+func (l *logger) Enabled(level Level) bool {
+	return level <= Level(atomic.LoadInt32(&l.out.level))
+}
+
+// Printf writes an info entry, or an error entry for messages starting
+// with Error.
+func (l *logger) Printf(format string, v ...interface{}) {
+	l.printLegacy(fmt.Sprintf(format, v...))
+}
+
+// Println writes an entry like Printf.
+func (l *logger) Println(v ...interface{}) {
+	l.printLegacy(fmt.Sprintln(v...))
+}
+
+func (l *logger) printLegacy(msg string) {
+	msg = strings.TrimSuffix(msg, "\n")
+
+	level := LevelInfo
+	if strings.HasPrefix(msg, "Error") {
+		level = LevelError
+	}
+	l.log(3, level, msg, nil)
+}
+
+// log writes the entry, skip is the number of frames up to the code
+// calling the exported methods.
+func (l *logger) log(skip int, level Level, msg string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	caller := ""
+	if _, file, line, ok := runtime.Caller(skip); ok {
+		caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+
+	all := append(l.fields[:len(l.fields):len(l.fields)], fields...)
+	now := time.Now()
+
+	l.out.m.Lock()
+	format := l.out.format
+	l.out.m.Unlock()
+
+	var entry string
+	if format == "json" {
+		obj := map[string]interface{}{
+			"time":   now.UTC().Format(time.RFC3339Nano),
+			"level":  level.String(),
+			"msg":    msg,
+			"caller": caller,
+		}
+		for _, f := range all {
+			obj[f.Key] = fieldValue(f.Value)
+		}
+		data, err := json.Marshal(obj)
+		if err != nil {
+			data, _ = json.Marshal(map[string]string{"level": level.String(), "msg": msg, "error": err.Error()})
+		}
+		entry = string(data)
+	} else {
+		var b strings.Builder
+		fmt.Fprintf(&b, "MinFS %s %s %-5s %s", now.Format("2006/01/02 15:04:05"), caller, strings.ToUpper(level.String()), msg)
+
+		for _, f := range all {
+			fmt.Fprintf(&b, " %s=%v", f.Key, fieldValue(f.Value))
+		}
+		entry = b.String()
+	}
+
+	l.out.m.Lock()
+	defer l.out.m.Unlock()
+
+	l.out.sink.write(level, l.out.scrubber.Replace(entry))
+}
+
+// fieldValue returns v as written to the log, errors by their message and
+// durations in their readable form.
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// logger returns the logger of the file, with its path and inode.
+func (f *File) logger() Logger {
+	return f.mfs.log.With(F("path", f.FullPath()), F("inode", f.Inode))
+}
+
+// logger returns the logger of the directory, with its path and inode.
+func (dir *Dir) logger() Logger {
+	return dir.mfs.log.With(F("path", dir.FullPath()), F("inode", dir.Inode))
+}
+
+// logger returns the logger of the handle, with the path and inode of its
+// file and the handle id.
+func (fh *FileHandle) logger() Logger {
+	return fh.f.logger().With(F("handle", fh.handle))
+}
+
+// traceTransport logs a summary of the S3 requests and responses. Headers
+// and query strings are left out as they carry signatures, credentials and
+// SSE keys.
+type traceTransport struct {
+	http.RoundTripper
+
+	log Logger
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+
+	fields := []Field{
+		F("method", req.Method),
+		F("host", req.URL.Host),
+		F("path", req.URL.Path),
+		F("duration", time.Since(start)),
+	}
+	if req.ContentLength > 0 {
+		fields = append(fields, F("sent", req.ContentLength))
+	}
+	if err != nil {
+		t.log.Trace("S3 request failed", append(fields, F("error", err))...)
+		return resp, err
+	}
+
+	fields = append(fields, F("status", resp.StatusCode))
+	if id := resp.Header.Get("X-Amz-Request-Id"); id != "" {
+		fields = append(fields, F("s3_request_id", id))
+	}
+	t.log.Trace("S3 request", fields...)
+	return resp, err
+}
+
+// s3Fields returns the fields describing err, with the request and host
+// id of S3 error responses.
+func s3Fields(err error) []Field {
+	fields := []Field{F("error", err)}
+	resp := minio.ToErrorResponse(err)
+	if resp.RequestID != "" {
+		fields = append(fields, F("s3_request_id", resp.RequestID))
+	}
+	if resp.HostID != "" {
+		fields = append(fields, F("s3_host_id", resp.HostID))
+	}
+	return fields
+}
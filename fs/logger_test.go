@@ -0,0 +1,123 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"strings"
+	"testing"
+)
+
+// wireTraceMarker starts the trace of an S3 request in the log.
+const wireTraceMarker = "---------START-HTTP---------"
+
+// logEntries logs an entry of each level, and returns the levels of the
+// entries found in the log.
+func (m *testMount) logEntries(name string) []string {
+	m.log.Error(name + " error entry")
+	m.log.Warn(name + " warn entry")
+	m.log.Info(name + " info entry")
+	m.log.Debug(name + " debug entry")
+	m.log.Trace(name + " trace entry")
+
+	var found []string
+	logs := m.logs.String()
+	for _, level := range levelNames {
+		if strings.Contains(logs, name+" "+level+" entry") {
+			found = append(found, level)
+		}
+	}
+	return found
+}
+
+func TestLogLevels(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "file", []byte("file"))
+
+	for i, level := range levelNames {
+		t.Run(level, func(t *testing.T) {
+			m := newTestMount(t, s3, t.TempDir(), LogLevel(level))
+
+			if found := m.logEntries("configured"); strings.Join(found, ",") != strings.Join(levelNames[:i+1], ",") {
+				t.Errorf("expected the entries %v, got %v", levelNames[:i+1], found)
+			}
+
+			m.readFile("file")
+			logs := m.logs.String()
+			if traced := strings.Contains(logs, wireTraceMarker); traced != (level == "trace") {
+				t.Errorf("expected the wire trace to be logged %t, got %t", level == "trace", traced)
+			}
+			if strings.Contains(logs, testSecretKey) {
+				t.Errorf("expected the secret key to be redacted")
+			}
+		})
+	}
+}
+
+// TestLogLevelRuntime changes the level of a mount while mounted, by
+// SetLogLevel and by the control socket.
+func TestLogLevelRuntime(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "a", []byte("a"))
+	s3.put(testBucket, "b", []byte("b"))
+
+	m := newTestMount(t, s3, t.TempDir(), LogLevel("info"))
+	if found := m.logEntries("mounted"); len(found) != 3 {
+		t.Fatalf("expected the entries up to info, got %v", found)
+	}
+
+	if err := m.SetLogLevel("debug"); err != nil {
+		t.Fatal(err)
+	}
+	if found := m.logEntries("debug"); len(found) != 4 {
+		t.Errorf("expected the entries up to debug, got %v", found)
+	}
+
+	resp := queryTestControl(t, ControlRequest{Command: "log-level", Level: "trace"}, m)
+	if resp.Error != "" || len(resp.Mounts) != 1 || resp.Mounts[0].LogLevel != "trace" {
+		t.Fatalf("expected the level to change to trace, got %+v", resp)
+	}
+	if found := m.logEntries("trace"); len(found) != 5 {
+		t.Errorf("expected the entries of all levels, got %v", found)
+	}
+	m.readFile("a")
+	traces := strings.Count(m.logs.String(), wireTraceMarker)
+	if traces == 0 {
+		t.Errorf("expected the wire trace to start at the trace level")
+	}
+
+	resp = queryTestControl(t, ControlRequest{Command: "log-level", Level: "error"}, m)
+	if resp.Error != "" || resp.Mounts[0].LogLevel != "error" {
+		t.Fatalf("expected the level to change to error, got %+v", resp)
+	}
+	if found := m.logEntries("quiet"); len(found) != 1 {
+		t.Errorf("expected the error entries only, got %v", found)
+	}
+	m.readFile("b")
+	if n := strings.Count(m.logs.String(), wireTraceMarker); n != traces {
+		t.Errorf("expected the wire trace to stop below the trace level, got %d more traces", n-traces)
+	}
+
+	resp = queryTestControl(t, ControlRequest{Command: "log-level", Level: "loud"}, m)
+	if resp.Error == "" {
+		t.Errorf("expected the unknown level to be refused")
+	}
+	if level := m.cfg().logLevel; level != "error" {
+		t.Errorf("expected the level to stay error, got %s", level)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// defaultLogMaxSize is the size at which log files are rotated.
+const defaultLogMaxSize = 64 << 20
+
+// logBackups is the number of rotated log files kept, as path.1 to path.N.
+const logBackups = 3
+
+// logSink receives the formatted entries of a logger.
+type logSink interface {
+	write(level Level, entry string) error
+	Close() error
+}
+
+// parseLogTarget validates target, which is stderr, syslog, journal or
+// file:<path>.
+func parseLogTarget(target string) error {
+	switch {
+	case target == "stderr", target == "syslog", target == "journal":
+		return nil
+	case strings.HasPrefix(target, "file:"):
+		if strings.TrimPrefix(target, "file:") == "" {
+			return errors.New("Log target file has no path")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported log target %s", target)
+}
+
+// openLogSink opens the sink of target, files are rotated at maxSize.
+func openLogSink(target string, maxSize int64) (logSink, error) {
+	if err := parseLogTarget(target); err != nil {
+		return nil, err
+	}
+
+	switch target {
+	case "stderr":
+		return writerSink{os.Stderr}, nil
+	case "syslog", "journal":
+		// journald reads the entries of the syslog socket.
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "minfs")
+		if err != nil {
+			return nil, fmt.Errorf("Unable to connect to syslog: %s", err)
+		}
+		return syslogSink{w}, nil
+	}
+	return openRotatingFile(strings.TrimPrefix(target, "file:"), maxSize)
+}
+
+// writerSink writes entries to a writer which isn't closed.
+type writerSink struct {
+	w io.Writer
+}
+
+func (s writerSink) write(level Level, entry string) error {
+	_, err := fmt.Fprintln(s.w, entry)
+	return err
+}
+
+func (s writerSink) Close() error {
+	return nil
+}
+
+// syslogSink writes entries with the syslog priority of their level.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func (s syslogSink) write(level Level, entry string) error {
+	switch level {
+	case LevelError:
+		return s.w.Err(entry)
+	case LevelWarn:
+		return s.w.Warning(entry)
+	case LevelInfo:
+		return s.w.Info(entry)
+	}
+	return s.w.Debug(entry)
+}
+
+func (s syslogSink) Close() error {
+	return s.w.Close()
+}
+
+// rotatingFile appends entries to a file, which is moved to path.1 once
+// it reaches maxSize.
+type rotatingFile struct {
+	m       sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+// rotate shifts the backups, dropping the oldest, and starts a new file.
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+
+	for i := logBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) write(level Level, entry string) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.f == nil {
+		return os.ErrClosed
+	}
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(entry))+1 > r.maxSize {
+		if err := r.rotate(); err != nil {
+			r.f = nil
+			return err
+		}
+	}
+
+	n, err := fmt.Fprintln(r.f, entry)
+	r.size += int64(n)
+	return err
+}
+
+func (r *rotatingFile) Close() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// SetLogTarget switches the log entries to target, the previous sink is
+// closed.
+func (mfs *MinFS) SetLogTarget(target string) error {
+	sink, err := openLogSink(target, mfs.cfg().logMaxSize)
+	if err != nil {
+		return err
+	}
+
+	old := mfs.log.setSink(sink)
+	mfs.log.Info("Log target switched", F("target", target))
+	return old.Close()
+}
@@ -0,0 +1,63 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package minfs
+
+import (
+	"bytes"
+	"context"
+	"path"
+	"strings"
+
+	minio "github.com/minio/minio-go/v6"
+)
+
+// hadoopMarkerSuffix is appended to the directory name by the Hadoop S3
+// connectors to mark a directory.
+const hadoopMarkerSuffix = "_$folder$"
+
+// dirMarker returns the directory name if the key is a directory marker,
+// like the prefix/ objects created by the MinIO console or s3fs and the
+// prefix_$folder$ objects created by Hadoop.
+func dirMarker(key string) (string, bool) {
+	if strings.HasSuffix(key, "/") {
+		return strings.TrimSuffix(key, "/"), true
+	}
+	if strings.HasSuffix(key, hadoopMarkerSuffix) {
+		return strings.TrimSuffix(key, hadoopMarkerSuffix), true
+	}
+	return "", false
+}
+
+// putDirMarker creates the marker of the directory name, so it survives
+// without any objects below it.
+func (dir *Dir) putDirMarker(ctx context.Context, name string) error {
+	key := path.Join(dir.RemotePath(), name) + "/"
+	_, err := dir.mfs.api.PutObjectWithContext(ctx, dir.BucketName(), key, bytes.NewReader(nil), 0, minio.PutObjectOptions{
+		ContentType: "application/x-directory",
+	})
+	return err
+}
+
+// removeHadoopMarker removes the Hadoop marker of the directory name, which
+// isn't below the prefix of the directory.
+func (dir *Dir) removeHadoopMarker(name string) error {
+	key := path.Join(dir.RemotePath(), name) + hadoopMarkerSuffix
+	err := dir.mfs.api.RemoveObject(dir.BucketName(), key)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// dirents returns the names of the entries of the directory name, with a
+// trailing / for directories.
+func (m *testMount) dirents(name string) []string {
+	m.t.Helper()
+
+	entries, err := m.dir(name).ReadDirAll(context.Background())
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type == fuse.DT_Dir {
+			names = append(names, e.Name+"/")
+		} else {
+			names = append(names, e.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestDirMarkers mounts a bucket populated by the MinIO console, s3fs and
+// Hadoop, the markers are directories, and directories made and removed
+// on the mount keep their markers in step.
+func TestDirMarkers(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	for _, key := range []string{
+		"console/", "console/file", "console/sub/",
+		"empty/",
+		"hadoop_$folder$", "hadoop/part-00000",
+		"hadoopempty_$folder$",
+	} {
+		data := []byte{}
+		if key == "console/file" || key == "hadoop/part-00000" {
+			data = []byte("data")
+		}
+		s3.put(testBucket, key, data)
+	}
+
+	m := newTestMount(t, s3, t.TempDir())
+
+	testCases := []struct {
+		dir      string
+		expected []string
+	}{
+		{"", []string{"console/", "empty/", "hadoop/", "hadoopempty/"}},
+		{"console", []string{"file", "sub/"}},
+		{"console/sub", nil},
+		{"empty", nil},
+		{"hadoop", []string{"part-00000"}},
+		{"hadoopempty", nil},
+	}
+	for _, testCase := range testCases {
+		if got := m.dirents(testCase.dir); !reflect.DeepEqual(got, testCase.expected) {
+			t.Errorf("expected the entries %v of %q, got %v", testCase.expected, testCase.dir, got)
+		}
+	}
+	for _, name := range []string{"console/sub", "empty", "hadoopempty"} {
+		if node, err := m.lookup(name); err != nil {
+			t.Errorf("expected %s to be found, got %v", name, err)
+		} else if _, ok := node.(*Dir); !ok {
+			t.Errorf("expected %s to be a directory, got %T", name, node)
+		}
+	}
+	if got := m.readFile("console/file"); string(got) != "data" {
+		t.Errorf("expected data, got %q", got)
+	}
+
+	// new directories get a marker, and survive the remount while empty
+	if err := m.mkdir("made"); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := s3.get(testBucket, "made/"); !ok || len(data) != 0 {
+		t.Fatalf("expected an empty marker of the new directory, got %q (%t)", data, ok)
+	}
+
+	// removing the directories removes their markers
+	if err := m.remove("hadoop/part-00000", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"empty", "hadoop", "hadoopempty", "console/sub"} {
+		if err := m.remove(name, true); err != nil {
+			t.Fatalf("rmdir %s: %v", name, err)
+		}
+	}
+	if keys := s3.keys(testBucket); !reflect.DeepEqual(keys, []string{"console/", "console/file", "made/"}) {
+		t.Errorf("expected the markers of the removed directories to be gone, got %v", keys)
+	}
+
+	m = m.remount()
+	if got := m.dirents(""); !reflect.DeepEqual(got, []string{"console/", "made/"}) {
+		t.Errorf("expected console/ and made/ after remounting, got %v", got)
+	}
+	if got := m.dirents("made"); got != nil {
+		t.Errorf("expected made to stay empty, got %v", got)
+	}
+
+	// without markers empty directories only last until the remount
+	m.stop()
+	m = newTestMount(t, s3, t.TempDir(), NoDirMarkers())
+	if err := m.mkdir("unmarked"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s3.get(testBucket, "unmarked/"); ok {
+		t.Errorf("expected no marker without dir markers")
+	}
+	m = m.remount()
+	if _, err := m.lookup("unmarked"); err != fuse.ENOENT {
+		t.Errorf("expected the unmarked directory to be gone after remounting, got %v", err)
+	}
+}
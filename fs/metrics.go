@@ -0,0 +1,355 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minfs/meta"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency
+// histograms.
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram counts observations by latency bucket.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// metrics collects the latencies of FUSE operations and S3 requests,
+// the collection is only set up when the metrics listener is enabled.
+type metrics struct {
+	m sync.Mutex
+
+	// by FUSE operation
+	ops map[string]*histogram
+
+	// by HTTP method, and by method and status code
+	requests map[string]*histogram
+	codes    map[[2]string]uint64
+
+	server *http.Server
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		ops:      map[string]*histogram{},
+		requests: map[string]*histogram{},
+		codes:    map[[2]string]uint64{},
+	}
+}
+
+// observeOp records a FUSE operation.
+func (m *metrics) observeOp(op string, d time.Duration) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	h, ok := m.ops[op]
+	if !ok {
+		h = &histogram{}
+		m.ops[op] = h
+	}
+	h.observe(d)
+}
+
+// observeRequest records an S3 request, code is the status code or error
+// for requests without response.
+func (m *metrics) observeRequest(method, code string, d time.Duration) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	h, ok := m.requests[method]
+	if !ok {
+		h = &histogram{}
+		m.requests[method] = h
+	}
+	h.observe(d)
+	m.codes[[2]string{method, code}]++
+}
+
+// metricsTransport records the S3 requests.
+type metricsTransport struct {
+	http.RoundTripper
+
+	metrics *metrics
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	t.metrics.observeRequest(req.Method, code, time.Since(start))
+	return resp, err
+}
+
+// startMetrics serves the metrics at /metrics and the health at /healthz
+// of the metrics address.
+func (mfs *MinFS) startMetrics() error {
+	if mfs.config.metricsAddr == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", mfs.config.metricsAddr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for metrics on %s: %s", mfs.config.metricsAddr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fam := newMetricFamilies()
+		mfs.writeMetrics(fam)
+		fam.writeTo(w)
+	})
+	mux.HandleFunc("/healthz", mfs.serveHealth)
+	if mfs.config.pprof && mfs.config.pprofAddr == "" {
+		registerPprof(mux)
+	}
+
+	mfs.metrics.server = &http.Server{Handler: mux}
+	go mfs.metrics.server.Serve(l)
+
+	mfs.log.Printf("Serving metrics on %s.\n", l.Addr())
+	return nil
+}
+
+// stopMetrics closes the metrics listener.
+func (mfs *MinFS) stopMetrics() {
+	if mfs.metrics != nil && mfs.metrics.server != nil {
+		mfs.metrics.server.Close()
+	}
+}
+
+// metricFamilies collects the samples of metrics by metric, so the
+// samples of several mounts are written below a single header.
+type metricFamilies struct {
+	names   []string
+	headers map[string]string
+	samples map[string][]string
+
+	// cur is the metric of the last header, its samples follow it
+	cur string
+}
+
+func newMetricFamilies() *metricFamilies {
+	return &metricFamilies{headers: map[string]string{}, samples: map[string][]string{}}
+}
+
+// writeTo writes the metrics in the Prometheus text format.
+func (fam *metricFamilies) writeTo(w io.Writer) {
+	for _, name := range fam.names {
+		io.WriteString(w, fam.headers[name])
+		for _, s := range fam.samples[name] {
+			io.WriteString(w, s)
+		}
+	}
+}
+
+// metricsWriter adds metrics to the families, with the labels of the
+// mount added to each sample.
+type metricsWriter struct {
+	fam    *metricFamilies
+	labels string
+}
+
+func (mw metricsWriter) header(name, kind, help string) {
+	if _, ok := mw.fam.headers[name]; !ok {
+		mw.fam.names = append(mw.fam.names, name)
+		mw.fam.headers[name] = fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	mw.fam.cur = name
+}
+
+func (mw metricsWriter) sample(name string, value float64, labels ...string) {
+	l := mw.labels
+	for i := 0; i+1 < len(labels); i += 2 {
+		l += fmt.Sprintf(",%s=%s", labels[i], strconv.Quote(labels[i+1]))
+	}
+	mw.fam.samples[mw.fam.cur] = append(mw.fam.samples[mw.fam.cur], fmt.Sprintf("%s{%s} %s\n", name, l, strconv.FormatFloat(value, 'g', -1, 64)))
+}
+
+func (mw metricsWriter) histogram(name string, h *histogram, labels ...string) {
+	for i, bound := range latencyBuckets {
+		mw.sample(name+"_bucket", float64(h.counts[i]), append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64))...)
+	}
+	mw.sample(name+"_bucket", float64(h.count), append(labels, "le", "+Inf")...)
+	mw.sample(name+"_sum", h.sum, labels...)
+	mw.sample(name+"_count", float64(h.count), labels...)
+}
+
+// writeMetrics adds all metrics of the mount to fam.
+func (mfs *MinFS) writeMetrics(fam *metricFamilies) {
+	mw := metricsWriter{
+		fam:    fam,
+		labels: fmt.Sprintf("bucket=%s,mountpoint=%s", strconv.Quote(mfs.volumeName()), strconv.Quote(mfs.config.mountpoint)),
+	}
+
+	m := mfs.metrics
+	m.m.Lock()
+	mw.header("minfs_fuse_operation_duration_seconds", "histogram", "Latency of FUSE operations by operation.")
+	for _, op := range sortedKeys(m.ops) {
+		mw.histogram("minfs_fuse_operation_duration_seconds", m.ops[op], "op", op)
+	}
+	mw.header("minfs_s3_request_duration_seconds", "histogram", "Latency of S3 requests by method.")
+	for _, method := range sortedKeys(m.requests) {
+		mw.histogram("minfs_s3_request_duration_seconds", m.requests[method], "method", method)
+	}
+	mw.header("minfs_s3_requests_total", "counter", "S3 requests by method and status code.")
+	var codes [][2]string
+	for k := range m.codes {
+		codes = append(codes, k)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		return codes[i][0]+codes[i][1] < codes[j][0]+codes[j][1]
+	})
+	for _, k := range codes {
+		mw.sample("minfs_s3_requests_total", float64(m.codes[k]), "method", k[0], "code", k[1])
+	}
+	m.m.Unlock()
+
+	stats := mfs.Stats()
+	mw.header("minfs_cache_downloads_total", "counter", "Opens which downloaded the object.")
+	mw.sample("minfs_cache_downloads_total", float64(stats.Downloads))
+	mw.header("minfs_cache_shared_downloads_total", "counter", "Opens which copied the download of a concurrent open.")
+	mw.sample("minfs_cache_shared_downloads_total", float64(stats.SharedDownloads))
+	mw.header("minfs_download_precondition_failures_total", "counter", "Downloads restarted as the object was replaced between two attempts.")
+	mw.sample("minfs_download_precondition_failures_total", float64(stats.PreconditionFailures))
+	mw.header("minfs_cache_hits_total", "counter", "Opens served by a cache file confirmed to be current.")
+	mw.sample("minfs_cache_hits_total", float64(stats.Revalidations))
+	if total := stats.Downloads + stats.Revalidations; total > 0 {
+		mw.header("minfs_cache_hit_ratio", "gauge", "Share of opens served by the cache.")
+		mw.sample("minfs_cache_hit_ratio", float64(stats.Revalidations)/float64(total))
+	}
+
+	mw.header("minfs_cache_bytes", "gauge", "Size of the files in the cache dir.")
+	mw.sample("minfs_cache_bytes", float64(stats.Cache.Bytes))
+	mw.header("minfs_dirty_bytes", "gauge", "Size of the files open with writes not uploaded yet.")
+	mw.sample("minfs_dirty_bytes", float64(mfs.dirtyBytes()))
+	writeCacheMetrics(mw, stats.Cache)
+
+	pending, gaveUp := mfs.pendingCounts()
+	mw.header("minfs_pending_uploads", "gauge", "Uploads waiting to be retried.")
+	mw.sample("minfs_pending_uploads", float64(pending))
+	mw.header("minfs_failed_uploads", "gauge", "Uploads given up after all retries.")
+	mw.sample("minfs_failed_uploads", float64(gaveUp))
+	mw.header("minfs_upload_retries_total", "counter", "Retries of failed uploads.")
+	mw.sample("minfs_upload_retries_total", float64(stats.UploadRetries))
+
+	mw.header("minfs_upload_queue", "gauge", "Queued uploads, copies and moves by lane.")
+	mw.sample("minfs_upload_queue", float64(stats.SyncQueue.Small), "lane", "small")
+	mw.sample("minfs_upload_queue", float64(stats.SyncQueue.Large), "lane", "large")
+	mw.header("minfs_conflicts_total", "counter", "Changes of both the local file and the remote object.")
+	mw.sample("minfs_conflicts_total", float64(stats.Conflicts))
+	mw.header("minfs_evicted_total", "counter", "File entries evicted from the meta DB.")
+	mw.sample("minfs_evicted_total", float64(stats.Evicted))
+	mw.header("minfs_audit_dropped_total", "counter", "Audit events dropped as the audit log couldn't keep up.")
+	mw.sample("minfs_audit_dropped_total", float64(stats.AuditDropped))
+
+	mfs.writeErrorMetrics(mw)
+}
+
+func sortedKeys(m map[string]*histogram) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// cacheBytes returns the size of the cache files.
+func (mfs *MinFS) cacheBytes() int64 {
+	entries, err := os.ReadDir(mfs.config.cache)
+	if err != nil {
+		return 0
+	}
+
+	var size int64
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), "cache.db") {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// dirtyBytes returns the size of the files with dirty handles.
+func (mfs *MinFS) dirtyBytes() uint64 {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	var size uint64
+	for _, fh := range mfs.handles {
+		if fh != nil && fh.dirty {
+			size += fh.f.Size
+		}
+	}
+	return size
+}
+
+// pendingCounts returns the number of pending uploads and of those given
+// up.
+func (mfs *MinFS) pendingCounts() (pending, gaveUp int) {
+	mfs.db.View(func(tx *meta.Tx) error {
+		b := tx.Bucket(pendingBucket).ReadOnly()
+		return b.ForEach(func(k string, _ interface{}) error {
+			var p pendingUpload
+			if b.Get(k, &p) == nil {
+				pending++
+				if p.GaveUp {
+					gaveUp++
+				}
+			}
+			return nil
+		})
+	})
+	return pending, gaveUp
+}
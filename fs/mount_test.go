@@ -0,0 +1,502 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+const (
+	testBucket    = "bucket"
+	testAccessKey = "minfsaccesskey"
+	testSecretKey = "minfssecretkey/0123456789abcdef"
+)
+
+// syncBuffer is a log buffer safe for the concurrent writes of the
+// background loops.
+type syncBuffer struct {
+	m sync.Mutex
+	b bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.b.String()
+}
+
+// testMount is a minfs of the fake server without a FUSE mount, the
+// tests call the node methods the kernel would call.
+type testMount struct {
+	*MinFS
+
+	t     testing.TB
+	s3    *fakeS3
+	cache string
+	logs  *syncBuffer
+
+	options []func(*Config)
+	stopped bool
+}
+
+// newTestMount starts a minfs of the bucket of s3, caching in cache.
+func newTestMount(t testing.TB, s3 *fakeS3, cache string, options ...func(*Config)) *testMount {
+	t.Helper()
+
+	m, err := startTestMount(t, s3, cache, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// startTestMount starts a minfs like newTestMount, and returns the error
+// of the mount.
+func startTestMount(t testing.TB, s3 *fakeS3, cache string, options ...func(*Config)) (*testMount, error) {
+	t.Helper()
+
+	cfg := defaultConfig(&AccessConfig{AccessKey: testAccessKey, SecretKey: testSecretKey})
+	for _, optionFn := range append([]func(*Config){
+		Mountpoint(t.TempDir()),
+		Target(s3.URL + "/" + testBucket),
+		CacheDir(cache),
+		Region("us-east-1"),
+		Addressing("path"),
+	}, options...) {
+		optionFn(cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := &syncBuffer{}
+	level, err := parseLevel(cfg.logLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := newMinFS(cfg, newLogger(writerSink{logs}, level, cfg.logFormat, secretScrubber(cfg.secrets()...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &testMount{MinFS: mfs, t: t, s3: s3, cache: cache, logs: logs, options: options}
+	if err := m.start(); err != nil {
+		return nil, err
+	}
+	t.Cleanup(m.stop)
+	return m, nil
+}
+
+// start runs the steps of serve up to the FUSE server.
+func (m *testMount) start() error {
+	dbPath, err := m.openMeta(false)
+	if err != nil {
+		return err
+	}
+	for _, step := range []func() error{
+		func() error { return m.migrateMeta(dbPath) },
+		m.checkScratch,
+		m.compactOnMount,
+		m.removePartialCacheFiles,
+		m.connect,
+		m.checkBuckets,
+	} {
+		if err := step(); err != nil {
+			m.db.Close()
+			return err
+		}
+	}
+	m.probeCapabilities()
+	m.startWriteAccess()
+	if !m.config.readOnly && !m.config.scratch {
+		if err := m.startSync(); err != nil {
+			return err
+		}
+		if err := m.replayJournal(); err != nil {
+			return err
+		}
+		m.startPendingUploads()
+	}
+	return nil
+}
+
+// stop waits for the queued uploads and closes the meta DB, like an
+// unmount.
+func (m *testMount) stop() {
+	if m.stopped {
+		return
+	}
+	m.stopped = true
+	m.stopNotificationListener()
+	m.syncQueue.drain()
+	m.db.Close()
+}
+
+// remount stops the mount and starts a new one of the same cache.
+func (m *testMount) remount() *testMount {
+	m.t.Helper()
+	m.stop()
+	return newTestMount(m.t, m.s3, m.cache, m.options...)
+}
+
+func (m *testMount) root() *Dir {
+	root, err := m.Root()
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return root.(*Dir)
+}
+
+// lookup walks the slash separated name from the root.
+func (m *testMount) lookup(name string) (fs.Node, error) {
+	var node fs.Node = m.root()
+	for _, elem := range strings.Split(name, "/") {
+		dir, ok := node.(*Dir)
+		if !ok {
+			return nil, fuse.Errno(syscall.ENOTDIR)
+		}
+		var err error
+		if node, err = dir.Lookup(context.Background(), &fuse.LookupRequest{Name: elem}, &fuse.LookupResponse{}); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// dir returns the directory name, the root for "".
+func (m *testMount) dir(name string) *Dir {
+	m.t.Helper()
+	if name == "" || name == "." {
+		return m.root()
+	}
+	node, err := m.lookup(name)
+	if err != nil {
+		m.t.Fatalf("lookup %s: %v", name, err)
+	}
+	return node.(*Dir)
+}
+
+func splitName(name string) (string, string) {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// create creates the file name and returns its open handle.
+func (m *testMount) create(name string) (*File, *FileHandle, error) {
+	parent, base := splitName(name)
+	dir := m.dir(parent)
+	node, handle, err := dir.Create(context.Background(), &fuse.CreateRequest{
+		Name:  base,
+		Flags: fuse.OpenReadWrite | fuse.OpenCreate,
+		Mode:  0644,
+	}, &fuse.CreateResponse{})
+	if err != nil {
+		return nil, nil, err
+	}
+	return node.(*File), handle.(*FileHandle), nil
+}
+
+// open opens the file name with the flags.
+func (m *testMount) open(name string, flags fuse.OpenFlags) (*FileHandle, error) {
+	node, err := m.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := node.(*File)
+	if !ok {
+		return nil, fuse.Errno(syscall.EISDIR)
+	}
+	handle, err := f.Open(context.Background(), &fuse.OpenRequest{Flags: flags}, &fuse.OpenResponse{})
+	if err != nil {
+		return nil, err
+	}
+	return handle.(*FileHandle), nil
+}
+
+func (m *testMount) write(fh *FileHandle, offset int64, data []byte) {
+	m.t.Helper()
+	if err := fh.Write(context.Background(), &fuse.WriteRequest{Offset: offset, Data: data}, &fuse.WriteResponse{}); err != nil {
+		m.t.Fatalf("write %s: %v", fh.f.FullPath(), err)
+	}
+}
+
+func (m *testMount) read(fh *FileHandle) []byte {
+	m.t.Helper()
+	resp := &fuse.ReadResponse{}
+	if err := fh.Read(context.Background(), &fuse.ReadRequest{Size: int(fh.f.Size) + 1}, resp); err != nil {
+		m.t.Fatalf("read %s: %v", fh.f.FullPath(), err)
+	}
+	return resp.Data
+}
+
+// close flushes and releases the handle, like close(2).
+func (m *testMount) close(fh *FileHandle) error {
+	err := fh.Flush(context.Background(), &fuse.FlushRequest{})
+	if rerr := fh.Release(context.Background(), &fuse.ReleaseRequest{}); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// writeFile creates or truncates the file name with data.
+func (m *testMount) writeFile(name string, data []byte) {
+	m.t.Helper()
+	var fh *FileHandle
+	var err error
+	if _, lerr := m.lookup(name); lerr == nil {
+		fh, err = m.open(name, fuse.OpenReadWrite|fuse.OpenTruncate)
+	} else {
+		_, fh, err = m.create(name)
+	}
+	if err != nil {
+		m.t.Fatalf("open %s: %v", name, err)
+	}
+	m.write(fh, 0, data)
+	if err := m.close(fh); err != nil {
+		m.t.Fatalf("close %s: %v", name, err)
+	}
+}
+
+// readFile returns the content of the file name.
+func (m *testMount) readFile(name string) []byte {
+	m.t.Helper()
+	fh, err := m.open(name, fuse.OpenReadOnly)
+	if err != nil {
+		m.t.Fatalf("open %s: %v", name, err)
+	}
+	data := m.read(fh)
+	if err := m.close(fh); err != nil {
+		m.t.Fatalf("close %s: %v", name, err)
+	}
+	return data
+}
+
+func (m *testMount) mkdir(name string) error {
+	parent, base := splitName(name)
+	_, err := m.dir(parent).Mkdir(context.Background(), &fuse.MkdirRequest{Name: base, Mode: os.ModeDir | 0755})
+	return err
+}
+
+func (m *testMount) remove(name string, isDir bool) error {
+	parent, base := splitName(name)
+	return m.dir(parent).Remove(context.Background(), &fuse.RemoveRequest{Name: base, Dir: isDir})
+}
+
+func (m *testMount) rename(oldName, newName string) error {
+	oldParent, oldBase := splitName(oldName)
+	newParent, newBase := splitName(newName)
+	return m.dir(oldParent).Rename(context.Background(), &fuse.RenameRequest{OldName: oldBase, NewName: newBase}, m.dir(newParent))
+}
+
+func TestMountReadWrite(t *testing.T) {
+	for _, store := range []string{"bolt", "badger"} {
+		s3 := newFakeS3(testBucket)
+		s3.put(testBucket, "dir/existing", []byte("existing"))
+
+		m := newTestMount(t, s3, t.TempDir(), MetaStore(store))
+		if got := m.readFile("dir/existing"); string(got) != "existing" {
+			t.Fatalf("%s: expected existing, got %q", store, got)
+		}
+
+		m.writeFile("new", []byte("hello"))
+		if data, ok := s3.get(testBucket, "new"); !ok || string(data) != "hello" {
+			t.Fatalf("%s: expected hello uploaded, got %q (%t)", store, data, ok)
+		}
+
+		m = m.remount()
+		if got := m.readFile("new"); string(got) != "hello" {
+			t.Fatalf("%s: expected hello after remount, got %q", store, got)
+		}
+		m.stop()
+		s3.Close()
+	}
+}
+
+// TestMountEmptyFile creates an empty file and truncates a file to zero
+// bytes, both are uploaded as empty objects and read as empty files,
+// before and after a remount.
+func TestMountEmptyFile(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "full", []byte("full"))
+
+	m := newTestMount(t, s3, t.TempDir())
+	_, fh, err := m.create("empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.close(fh); err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := m.lookup("full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node.(*File).Setattr(context.Background(), &fuse.SetattrRequest{
+		Valid: fuse.SetattrSize,
+		Size:  0,
+	}, &fuse.SetattrResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(m *testMount, step string) {
+		for _, name := range []string{"empty", "full"} {
+			if data, ok := s3.get(testBucket, name); !ok || len(data) != 0 {
+				t.Errorf("%s: expected %s uploaded empty, got %q (%t)", step, name, data, ok)
+			}
+
+			node, err := m.lookup(name)
+			if err != nil {
+				t.Fatalf("%s: lookup %s: %v", step, name, err)
+			}
+			var a fuse.Attr
+			if err := node.Attr(context.Background(), &a); err != nil {
+				t.Fatal(err)
+			}
+			if a.Size != 0 {
+				t.Errorf("%s: expected %s to be 0 bytes, got %d", step, name, a.Size)
+			}
+
+			fh, err := m.open(name, fuse.OpenReadOnly)
+			if err != nil {
+				t.Fatalf("%s: open %s: %v", step, name, err)
+			}
+			resp := &fuse.ReadResponse{}
+			if err := fh.Read(context.Background(), &fuse.ReadRequest{Size: 4096}, resp); err != nil {
+				t.Errorf("%s: expected the read of %s to reach EOF, got %v", step, name, err)
+			} else if len(resp.Data) != 0 {
+				t.Errorf("%s: expected the read of %s to reach EOF, got %q", step, name, resp.Data)
+			}
+			if err := m.close(fh); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	check(m, "mounted")
+	m = m.remount()
+	check(m, "remounted")
+}
+
+func TestCheckUserAllowOther(t *testing.T) {
+	testCases := []struct {
+		name    string
+		conf    string
+		uid     int
+		allowed bool
+	}{
+		{"set", "user_allow_other\n", 1000, true},
+		{"set among others", "mount_max = 1000\n  user_allow_other  # for the containers\n", 1000, true},
+		{"commented out", "#user_allow_other\n", 1000, false},
+		{"other options", "mount_max = 1000\n", 1000, false},
+		{"empty", "", 1000, false},
+		{"missing", "", 1000, false},
+		{"root", "", 0, true},
+	}
+
+	for _, testCase := range testCases {
+		conf := filepath.Join(t.TempDir(), "fuse.conf")
+		if testCase.name != "missing" {
+			if err := os.WriteFile(conf, []byte(testCase.conf), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := checkUserAllowOther(conf, testCase.uid)
+		if testCase.allowed && err != nil {
+			t.Errorf("%s: expected allow-other to be permitted, got %v", testCase.name, err)
+		} else if !testCase.allowed && (err == nil || !strings.Contains(err.Error(), "user_allow_other in "+conf)) {
+			t.Errorf("%s: expected an error naming user_allow_other in %s, got %v", testCase.name, conf, err)
+		}
+	}
+
+	// an unreadable config fails the mount too
+	if err := checkUserAllowOther(t.TempDir(), 1000); err == nil {
+		t.Errorf("expected an unreadable config to fail")
+	}
+
+	cfg := defaultConfig(&AccessConfig{AccessKey: testAccessKey, SecretKey: testSecretKey})
+	for _, optionFn := range []func(*Config){
+		Mountpoint(t.TempDir()),
+		Target("http://localhost:9000/" + testBucket),
+		CacheDir(t.TempDir()),
+		AllowOther(),
+		AllowRoot(),
+	} {
+		optionFn(cfg)
+	}
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "can't be combined") {
+		t.Errorf("expected allow-other and allow-root not to be combined, got %v", err)
+	}
+}
+
+// TestBucketOpsConfig allows bucket operations only on mounts of all
+// buckets, a bucket created on a mount of listed buckets isn't mounted.
+func TestBucketOpsConfig(t *testing.T) {
+	testCases := []struct {
+		name    string
+		buckets []string
+		valid   bool
+	}{
+		{"all buckets", []string{"*"}, true},
+		{"listed buckets", []string{"a", "b"}, false},
+		{"single bucket", nil, false},
+	}
+
+	for _, testCase := range testCases {
+		cfg := defaultConfig(&AccessConfig{AccessKey: testAccessKey, SecretKey: testSecretKey})
+		options := []func(*Config){
+			Mountpoint(t.TempDir()),
+			CacheDir(t.TempDir()),
+			BucketOps(),
+		}
+		if testCase.buckets != nil {
+			options = append(options, Target("http://localhost:9000"), Buckets(testCase.buckets...))
+		} else {
+			options = append(options, Target("http://localhost:9000/"+testBucket))
+		}
+		for _, optionFn := range options {
+			optionFn(cfg)
+		}
+
+		err := cfg.validate()
+		if testCase.valid && err != nil {
+			t.Errorf("%s: expected bucket operations to be allowed, got %v", testCase.name, err)
+		} else if !testCase.valid && (err == nil || !strings.Contains(err.Error(), "require mounting all buckets")) {
+			t.Errorf("%s: expected bucket operations to be refused, got %v", testCase.name, err)
+		}
+	}
+}
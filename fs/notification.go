@@ -13,94 +13,288 @@
  * See the License for the specific language governing permissions and
  * limitations under the License.
  */
-
 package minfs
 
 import (
 	"net/url"
-	"os"
 	"path"
 	"strings"
+	"time"
 
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/minio/minfs/meta"
 	minio "github.com/minio/minio-go/v6"
 )
 
+const (
+	// listenerMinBackoff and listenerMaxBackoff bound the delay before
+	// listening again after the notification stream ended.
+	listenerMinBackoff = time.Second
+	listenerMaxBackoff = time.Minute
+)
+
+// startNotificationListener listens for changes to the mounted buckets
+// made by other clients.
 func (mfs *MinFS) startNotificationListener() error {
+	buckets, err := mfs.mountedBuckets()
+	if err != nil {
+		return err
+	}
+
+	for _, bucket := range buckets {
+		go mfs.listenBucket(bucket)
+	}
+	return nil
+}
+
+// mountedBuckets returns the remote buckets visible in the mount.
+func (mfs *MinFS) mountedBuckets() ([]string, error) {
+	if mfs.config.allBuckets() {
+		infos, err := mfs.api.ListBuckets()
+		if err != nil {
+			return nil, err
+		}
+		buckets := []string{}
+		for _, info := range infos {
+			buckets = append(buckets, info.Name)
+		}
+		return buckets, nil
+	} else if mfs.config.multiBucket() {
+		return mfs.config.buckets, nil
+	}
+	return []string{mfs.config.bucket}, nil
+}
+
+// listenBucket applies the events of the bucket until the listener is
+// stopped, listening again with backoff when the stream ends.
+func (mfs *MinFS) listenBucket(bucket string) {
 	events := []string{string(minio.ObjectCreatedAll), string(minio.ObjectRemovedAll)}
 
-	// Start listening on all bucket events.
-	eventsCh := mfs.api.ListenBucketNotification(mfs.config.bucket, "", "", events, mfs.listenerDoneCh)
-	go func() {
-		for {
-			select {
-			case notificationInfo := <-eventsCh:
-				if notificationInfo.Err != nil {
-					continue
-				}
+	prefix := ""
+	if !mfs.config.multiBucket() && mfs.config.basePath != "" {
+		prefix = mfs.config.basePath + "/"
+	}
 
-				// Start a writable transaction.
-				tx, err := mfs.db.Begin(true)
-				if err != nil {
-					panic(err)
-				}
-				for _, record := range notificationInfo.Records {
-					key, e := url.QueryUnescape(record.S3.Object.Key)
-					if e != nil {
-						mfs.log.Println("Error:", err)
-						tx.Rollback()
-						continue
-					}
-
-					dir, file := path.Split(key)
-
-					var d *Dir
-					if dir == "" {
-						d = &Dir{
-							dir: nil,
-
-							mfs:  mfs,
-							Mode: os.ModeDir | 0555,
-							Path: "",
-						}
-					} else {
-						rootDir, _ := mfs.Root()
-						d = &Dir{
-							dir:  rootDir.(*Dir),
-							mfs:  mfs,
-							Mode: 0770 | os.ModeDir,
-							Path: dir,
-							GID:  mfs.config.gid,
-							UID:  mfs.config.uid,
-						}
-					}
-
-					if strings.HasPrefix(record.EventName, "s3:ObjectCreated:") {
-						if err = d.storeFile(d.bucket(tx), tx, file, minio.ObjectInfo{
-							Key:  record.S3.Object.Key,
-							Size: record.S3.Object.Size,
-							ETag: record.S3.Object.ETag,
-						}); err != nil {
-							tx.Rollback()
-							mfs.log.Println("Error:", err)
-							continue
-						}
-					}
+	backoff := listenerMinBackoff
+	for {
+		eventsCh := mfs.api.ListenBucketNotification(bucket, prefix, "", events, mfs.listenerDoneCh)
+		for notificationInfo := range eventsCh {
+			if notificationInfo.Err != nil {
+				mfs.log.Printf("Notifications of bucket %s failed: %s\n", bucket, notificationInfo.Err)
+				continue
+			}
 
+			backoff = listenerMinBackoff
+			for _, record := range notificationInfo.Records {
+				if err := mfs.applyEvent(bucket, prefix, record); err != nil {
+					mfs.log.Println("Error:", err)
 				}
+			}
+		}
 
-				// Commit the transaction and check for error.
-				if err := tx.Commit(); err != nil {
-					tx.Rollback()
-					panic(err)
+		select {
+		case <-mfs.listenerDoneCh:
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > listenerMaxBackoff {
+			backoff = listenerMaxBackoff
+		}
+	}
+}
+
+// applyEvent updates the meta entry of the object in the event, and
+// invalidates the kernel entry. Events of changes minfs made itself are
+// recognized by the ETag and ignored.
+func (mfs *MinFS) applyEvent(bucket, prefix string, record minio.NotificationEvent) error {
+	key, err := url.QueryUnescape(record.S3.Object.Key)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(key, prefix) {
+		return nil
+	}
+	if _, ok := dirMarker(key); ok {
+		return nil
+	}
+	key = strings.TrimPrefix(key, prefix)
+
+	parts := strings.Split(key, "/")
+	if mfs.config.multiBucket() {
+		parts = append([]string{bucket}, parts...)
+	}
+
+	created := strings.HasPrefix(record.EventName, "s3:ObjectCreated:")
+
+	// the entry to invalidate, if any
+	var (
+		invalidateDir  string
+		invalidateName string
+		cachePath      string
+	)
+
+	if err = mfs.db.Update(func(tx *meta.Tx) error {
+		root, _ := mfs.Root()
+		dir := root.(*Dir)
+		b := tx.Bucket("minio/")
+
+		for _, part := range parts[:len(parts)-1] {
+			sub := b.Bucket(part + "/")
+			if sub.InnerBucket == nil {
+				// a new directory in a listed dir, list it again
+				if created && b.DeleteMeta("listing") == nil {
+					invalidateDir, invalidateName = dir.FullPath(), part
 				}
-			case <-mfs.listenerDoneCh:
-				return
+				return nil
+			}
+
+			var o interface{}
+			if err := b.Get(part, &o); err != nil {
+				return err
+			}
+			d, ok := o.(Dir)
+			if !ok || d.LocalOnly {
+				return nil
+			}
+			d.dir, d.mfs = dir, mfs
+			dir, b = &d, sub
+		}
+
+		name := parts[len(parts)-1]
+		if mfs.shadowed(tx, path.Join(dir.FullPath(), name)) {
+			return nil
+		}
+
+		var o interface{}
+		err := b.Get(name, &o)
+		if isNotFound(err) {
+			if !created {
+				return nil
+			}
+			invalidateDir, invalidateName = dir.FullPath(), name
+			return dir.storeFile(b, tx, name, minio.ObjectInfo{
+				Key:          key,
+				Size:         record.S3.Object.Size,
+				ETag:         record.S3.Object.ETag,
+				LastModified: eventTime(record),
+			})
+		} else if err != nil {
+			return err
+		}
+
+		f, ok := o.(File)
+		if !ok {
+			return nil
+		}
+
+		if !created {
+			// local changes are kept, the conflict policy resolves the
+			// removal when they're uploaded
+			fullPath := path.Join(dir.FullPath(), name)
+			if _, pending := mfs.pendingTx(tx, fullPath); pending || mfs.dirtyPaths()[fullPath] {
+				mfs.log.Info("Object removed remotely, keeping the local changes", F("path", fullPath))
+				return nil
 			}
+
+			cachePath = f.CachePath
+			invalidateDir, invalidateName = dir.FullPath(), name
+			if err := mfs.releaseInode(tx, path.Join(dir.FullPath(), name)); err != nil {
+				return err
+			}
+			return b.Delete(name)
+		}
+
+		if strings.EqualFold(f.ETag, record.S3.Object.ETag) {
+			// our own upload
+			return nil
 		}
-	}()
+
+		cachePath = f.CachePath
+		invalidateDir, invalidateName = dir.FullPath(), name
+
+		f.Size = uint64(record.S3.Object.Size)
+		f.ETag = record.S3.Object.ETag
+		f.LastModified = eventTime(record)
+		f.Mtime = eventTime(record)
+		f.Chgtime = f.Mtime
+		f.CachePath = ""
+		f.CacheETag = ""
+		return b.Put(name, &f)
+	}); err != nil {
+		return err
+	}
+
+	if cachePath != "" {
+		mfs.removeCacheFile(cachePath, evictRemoteChanged)
+	}
+
+	if invalidateName != "" {
+		mfs.invalidateEntry(invalidateDir, invalidateName)
+	}
 	return nil
 }
 
+// eventTime returns the time of the event, or now if it can't be parsed.
+func eventTime(record minio.NotificationEvent) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, record.EventTime)
+	if err != nil {
+		return time.Now().UTC()
+	}
+	return t
+}
+
+// trackDir remembers the dir node handed to the kernel, so entries of the
+// dir can be invalidated.
+func (mfs *MinFS) trackDir(dir *Dir) {
+	if !mfs.config.notifications && mfs.config.resyncInterval == 0 {
+		return
+	}
+
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	mfs.dirs[dir.FullPath()] = dir
+}
+
+// forgetDir drops the dir node the kernel forgot, unless a later lookup
+// of its path replaced it.
+func (mfs *MinFS) forgetDir(dir *Dir) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	if fullPath := dir.FullPath(); mfs.dirs[fullPath] == dir {
+		delete(mfs.dirs, fullPath)
+	}
+}
+
+// fuseServer returns the server of the mount, nil until it serves.
+func (mfs *MinFS) fuseServer() *fs.Server {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	return mfs.server
+}
+
+// invalidateEntry makes the kernel look up the entry name of the dir at
+// dirPath again.
+func (mfs *MinFS) invalidateEntry(dirPath, name string) {
+	mfs.m.Lock()
+	dir, ok := mfs.dirs[dirPath]
+	server := mfs.server
+	mfs.m.Unlock()
+
+	if !ok || server == nil {
+		return
+	}
+
+	if err := server.InvalidateEntry(dir, name); err != nil && err != fuse.ErrNotCached {
+		mfs.log.Printf("Unable to invalidate %s: %s\n", path.Join(dirPath, name), err)
+	}
+}
+
 func (mfs *MinFS) stopNotificationListener() error {
 	close(mfs.listenerDoneCh)
 	return nil
@@ -0,0 +1,79 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func (m *testMount) trackedDir(fullPath string) (*Dir, bool) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	dir, ok := m.dirs[fullPath]
+	return dir, ok
+}
+
+func TestForgetDir(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "a/b/file", []byte("file"))
+
+	m := newTestMount(t, s3, t.TempDir(), ResyncInterval(time.Hour))
+
+	old := m.dir("a")
+	if dir, ok := m.trackedDir(old.FullPath()); !ok || dir != old {
+		t.Fatalf("expected the dir node of a to be tracked")
+	}
+
+	// a later lookup replaces the node, forgetting the old one keeps it
+	current := m.dir("a")
+	old.Forget()
+	if dir, ok := m.trackedDir(current.FullPath()); !ok || dir != current {
+		t.Fatalf("expected the dir node of the later lookup to stay tracked")
+	}
+
+	current.Forget()
+	if _, ok := m.trackedDir(current.FullPath()); ok {
+		t.Fatalf("expected the forgotten dir node to be dropped")
+	}
+
+	// lookups and forgets racing with invalidations, see go test -race
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				m.dir("a/b").Forget()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				m.invalidateEntry("a/b", "file")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, ok := m.trackedDir("a/b"); ok {
+		t.Errorf("expected the forgotten dir nodes of a/b to be dropped")
+	}
+}
@@ -0,0 +1,347 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// notifyQueueSize is the number of events waiting for the notifier,
+// further events are dropped.
+const notifyQueueSize = 1024
+
+// Notifier receives the transfers, cache evictions and errors of a mount,
+// for embedding applications showing progress.
+//
+// Delivery is best effort. Callbacks are invoked one at a time from a
+// single goroutine, in the order of the events, never from the goroutine
+// of the filesystem operation. Events are dropped while the queue of
+// undelivered events is full, and progress events of a transfer waiting
+// for delivery are coalesced into the latest one, so a transfer can
+// finish without any progress events.
+type Notifier interface {
+	TransferStarted(t Transfer)
+	TransferProgress(t Transfer)
+	// TransferFinished is called with the error of failed transfers.
+	TransferFinished(t Transfer, err error)
+	CacheEvicted(e Eviction)
+	Error(e ErrorEvent)
+}
+
+// Transfer directions
+const (
+	Download = "download"
+	Upload   = "upload"
+)
+
+// Transfer is a download or upload of an object, Total is the size of the
+// object as known when the transfer started.
+type Transfer struct {
+	Direction string
+	Bucket    string
+	Object    string
+	Bytes     int64
+	Total     int64
+}
+
+// Eviction is the removal of a cache file.
+type Eviction struct {
+	CachePath string
+	Reason    string
+	Bytes     int64
+}
+
+// ErrorEvent is a failed FUSE operation of Path.
+type ErrorEvent struct {
+	Path string
+	LastError
+}
+
+// NopNotifier ignores all events, it can be embedded by notifiers handling
+// only some of them.
+type NopNotifier struct{}
+
+func (NopNotifier) TransferStarted(t Transfer)             {}
+func (NopNotifier) TransferProgress(t Transfer)            {}
+func (NopNotifier) TransferFinished(t Transfer, err error) {}
+func (NopNotifier) CacheEvicted(e Eviction)                {}
+func (NopNotifier) Error(e ErrorEvent)                     {}
+
+// Event kinds of ChanNotifier
+const (
+	EventTransferStarted  = "transfer-started"
+	EventTransferProgress = "transfer-progress"
+	EventTransferFinished = "transfer-finished"
+	EventCacheEvicted     = "cache-evicted"
+	EventError            = "error"
+)
+
+// Event is an event delivered by ChanNotifier, with the field of its
+// kind set.
+type Event struct {
+	Kind string
+
+	Transfer Transfer
+	// Err is the error of failed transfers.
+	Err      error
+	Eviction Eviction
+	Error    ErrorEvent
+}
+
+// ChanNotifier sends the events to C, events are dropped while C is full.
+type ChanNotifier struct {
+	C chan Event
+}
+
+// NewChanNotifier returns a notifier sending to a channel buffering size
+// events.
+func NewChanNotifier(size int) *ChanNotifier {
+	return &ChanNotifier{C: make(chan Event, size)}
+}
+
+func (n *ChanNotifier) send(e Event) {
+	select {
+	case n.C <- e:
+	default:
+	}
+}
+
+func (n *ChanNotifier) TransferStarted(t Transfer) {
+	n.send(Event{Kind: EventTransferStarted, Transfer: t})
+}
+
+func (n *ChanNotifier) TransferProgress(t Transfer) {
+	n.send(Event{Kind: EventTransferProgress, Transfer: t})
+}
+
+func (n *ChanNotifier) TransferFinished(t Transfer, err error) {
+	n.send(Event{Kind: EventTransferFinished, Transfer: t, Err: err})
+}
+
+func (n *ChanNotifier) CacheEvicted(e Eviction) {
+	n.send(Event{Kind: EventCacheEvicted, Eviction: e})
+}
+
+func (n *ChanNotifier) Error(e ErrorEvent) {
+	n.send(Event{Kind: EventError, Error: e})
+}
+
+// notifyQueue delivers events to the notifier from its own goroutine, it's
+// nil without notifier.
+type notifyQueue struct {
+	n      Notifier
+	events chan func(Notifier)
+
+	// latest progress of transfers with a progress event queued
+	m        sync.Mutex
+	progress map[*Transfer]Transfer
+
+	dropped uint64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newNotifyQueue(n Notifier) *notifyQueue {
+	return &notifyQueue{
+		n:        n,
+		events:   make(chan func(Notifier), notifyQueueSize),
+		progress: map[*Transfer]Transfer{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// send queues the event, it's dropped if the queue is full.
+func (q *notifyQueue) send(fn func(Notifier)) bool {
+	if q == nil {
+		return false
+	}
+
+	select {
+	case q.events <- fn:
+		return true
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+		return false
+	}
+}
+
+// sendProgress queues the progress of the transfer identified by key,
+// unless a progress event of it is queued already, which then delivers
+// t instead.
+func (q *notifyQueue) sendProgress(key *Transfer, t Transfer) {
+	if q == nil {
+		return
+	}
+
+	q.m.Lock()
+	_, queued := q.progress[key]
+	q.progress[key] = t
+	q.m.Unlock()
+	if queued {
+		return
+	}
+
+	if !q.send(func(n Notifier) {
+		q.m.Lock()
+		t := q.progress[key]
+		delete(q.progress, key)
+		q.m.Unlock()
+
+		n.TransferProgress(t)
+	}) {
+		q.m.Lock()
+		delete(q.progress, key)
+		q.m.Unlock()
+	}
+}
+
+func (q *notifyQueue) run() {
+	defer close(q.done)
+
+	for {
+		select {
+		case fn := <-q.events:
+			fn(q.n)
+		case <-q.stop:
+			// deliver what's queued already
+			for {
+				select {
+				case fn := <-q.events:
+					fn(q.n)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// startNotifier starts delivering events to the notifier.
+func (mfs *MinFS) startNotifier() {
+	if mfs.notify != nil {
+		go mfs.notify.run()
+	}
+}
+
+// notificationsDropped returns the number of events dropped as the queue
+// was full.
+func (mfs *MinFS) notificationsDropped() uint64 {
+	if mfs.notify == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&mfs.notify.dropped)
+}
+
+// stopNotifier delivers the queued events and stops.
+func (mfs *MinFS) stopNotifier() {
+	if mfs.notify != nil {
+		close(mfs.notify.stop)
+		<-mfs.notify.done
+	}
+}
+
+// transferTracker reports the progress of a transfer to the notifier, it's
+// nil without notifier.
+type transferTracker struct {
+	q *notifyQueue
+
+	m sync.Mutex
+	t Transfer
+}
+
+// trackTransfer reports the start of the transfer of total bytes of
+// object.
+func (mfs *MinFS) trackTransfer(direction, bucket, object string, total int64) *transferTracker {
+	if mfs.notify == nil {
+		return nil
+	}
+
+	tt := &transferTracker{q: mfs.notify, t: Transfer{
+		Direction: direction,
+		Bucket:    bucket,
+		Object:    object,
+		Total:     total,
+	}}
+	t := tt.t
+	mfs.notify.send(func(n Notifier) { n.TransferStarted(t) })
+	return tt
+}
+
+// add reports n more bytes transferred.
+func (tt *transferTracker) add(n int64) {
+	if tt == nil {
+		return
+	}
+
+	tt.m.Lock()
+	tt.t.Bytes += n
+	t := tt.t
+	tt.m.Unlock()
+
+	tt.q.sendProgress(&tt.t, t)
+}
+
+// finish reports the end of the transfer.
+func (tt *transferTracker) finish(err error) {
+	if tt == nil {
+		return
+	}
+
+	tt.m.Lock()
+	t := tt.t
+	tt.m.Unlock()
+
+	tt.q.send(func(n Notifier) { n.TransferFinished(t, err) })
+}
+
+// reader returns r counting the bytes read as transferred.
+func (tt *transferTracker) reader(r io.Reader) io.Reader {
+	if tt == nil {
+		return r
+	}
+	return &trackedReader{r, tt}
+}
+
+type trackedReader struct {
+	r  io.Reader
+	tt *transferTracker
+}
+
+func (r *trackedReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.tt.add(int64(n))
+	return n, err
+}
+
+// notifyEviction reports the removal of a cache file.
+func (mfs *MinFS) notifyEviction(e Eviction) {
+	if mfs.notify == nil {
+		return
+	}
+	mfs.notify.send(func(n Notifier) { n.CacheEvicted(e) })
+}
+
+// notifyError reports a failed operation.
+func (mfs *MinFS) notifyError(e ErrorEvent) {
+	if mfs.notify == nil {
+		return
+	}
+	mfs.notify.send(func(n Notifier) { n.Error(e) })
+}
@@ -0,0 +1,169 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package minfs
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v6"
+)
+
+var (
+	expiryDateRegexp = regexp.MustCompile(`expiry-date="([^"]*)"`)
+	expiryRuleRegexp = regexp.MustCompile(`rule-id="([^"]*)"`)
+)
+
+// statAttrs fetches the attributes of the object only returned by
+// StatObject. These are cached in the meta DB until the ETag of the
+// object changes.
+func (f *File) statAttrs(ctx context.Context) error {
+	if f.StatETag != "" && f.StatETag == f.ETag {
+		return nil
+	}
+
+	objInfo, err := f.mfs.api.StatObjectWithContext(ctx, f.BucketName(), f.RemotePath(), minio.StatObjectOptions{})
+	if isNotFound(err) {
+		// not uploaded yet
+		return fuse.ErrNoXattr
+	} else if err != nil {
+		return err
+	}
+
+	f.ETag = objInfo.ETag
+	f.LastModified = objInfo.LastModified
+	f.setStatAttrs(objInfo)
+
+	return f.mfs.update(ctx, func(tx *meta.Tx) error {
+		return f.store(tx)
+	})
+}
+
+// checkRemote compares the ETag of the object with the cached attributes.
+// An object overwritten by another client gets the new attributes and its
+// stale cache file is dropped. It returns true if the cache file has the
+// content of the object.
+func (f *File) checkRemote(ctx context.Context) (bool, error) {
+	objInfo, err := f.mfs.api.StatObjectWithContext(ctx, f.BucketName(), f.RemotePath(), minio.StatObjectOptions{})
+	if isNotFound(err) {
+		// not uploaded yet, or removed, which the download reports
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if objInfo.ETag != f.ETag {
+		f.mfs.log.Printf("Object %s was overwritten, ETag %s, cached %s.\n", f.RemotePath(), objInfo.ETag, f.ETag)
+
+		f.Size = uint64(objInfo.Size)
+		f.ETag = objInfo.ETag
+		f.LastModified = objInfo.LastModified
+		f.Mtime = objInfo.LastModified
+		f.Chgtime = objInfo.LastModified
+	}
+	f.setStatAttrs(objInfo)
+
+	if f.CachePath != "" && f.CacheETag != objInfo.ETag {
+		f.mfs.removeCacheFile(f.CachePath, evictRemoteChanged)
+		f.CachePath = ""
+		f.CacheETag = ""
+	}
+
+	return f.CacheETag != "", nil
+}
+
+// setStatAttrs takes the attributes from the headers of a StatObject or
+// GetObject response.
+func (f *File) setStatAttrs(objInfo minio.ObjectInfo) {
+	f.ExpiryDate, f.ExpiryRule = parseExpiration(objInfo.Metadata.Get("X-Amz-Expiration"))
+
+	f.SSE = objInfo.Metadata.Get("X-Amz-Server-Side-Encryption")
+	f.SSEKMSKey = objInfo.Metadata.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id")
+	if f.SSE == "" && objInfo.Metadata.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		f.SSE = "SSE-C"
+	}
+
+	f.StatETag = objInfo.ETag
+}
+
+// parseExpiration parses the x-amz-expiration header, which looks like:
+//
+//	expiry-date="Fri, 23 Dec 2012 00:00:00 GMT", rule-id="rule"
+func parseExpiration(expiration string) (date time.Time, rule string) {
+	if m := expiryDateRegexp.FindStringSubmatch(expiration); m != nil {
+		date, _ = http.ParseTime(m[1])
+	}
+	if m := expiryRuleRegexp.FindStringSubmatch(expiration); m != nil {
+		rule = m[1]
+	}
+	return date, rule
+}
+
+// expiryDateXattr returns the date the object expires by lifecycle rules.
+func (f *File) expiryDateXattr(ctx context.Context) ([]byte, error) {
+	if err := f.statAttrs(ctx); err != nil {
+		return nil, err
+	}
+
+	if f.ExpiryDate.IsZero() {
+		return nil, fuse.ErrNoXattr
+	}
+
+	return []byte(f.ExpiryDate.UTC().Format(time.RFC3339)), nil
+}
+
+// expiryRuleXattr returns the lifecycle rule expiring the object.
+func (f *File) expiryRuleXattr(ctx context.Context) ([]byte, error) {
+	if err := f.statAttrs(ctx); err != nil {
+		return nil, err
+	}
+
+	if f.ExpiryRule == "" {
+		return nil, fuse.ErrNoXattr
+	}
+
+	return []byte(f.ExpiryRule), nil
+}
+
+// sseXattr returns the server side encryption algorithm of the object.
+func (f *File) sseXattr(ctx context.Context) ([]byte, error) {
+	if err := f.statAttrs(ctx); err != nil {
+		return nil, err
+	}
+
+	if f.SSE == "" {
+		return nil, fuse.ErrNoXattr
+	}
+
+	return []byte(f.SSE), nil
+}
+
+// sseKMSKeyXattr returns the KMS key id encrypting the object.
+func (f *File) sseKMSKeyXattr(ctx context.Context) ([]byte, error) {
+	if err := f.statAttrs(ctx); err != nil {
+		return nil, err
+	}
+
+	if f.SSEKMSKey == "" {
+		return nil, fuse.ErrNoXattr
+	}
+
+	return []byte(f.SSEKMSKey), nil
+}
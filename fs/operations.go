@@ -25,12 +25,15 @@ type Operation struct {
 type MoveOperation struct {
 	*Operation
 
+	Bucket string
+
 	Source string
 	Target string
 }
 
-func newMoveOp(sourcePath, targetPath string) MoveOperation {
+func newMoveOp(bucket, sourcePath, targetPath string) MoveOperation {
 	return MoveOperation{
+		Bucket: bucket,
 		Source: sourcePath,
 		Target: targetPath,
 		Operation: &Operation{
@@ -43,6 +46,8 @@ func newMoveOp(sourcePath, targetPath string) MoveOperation {
 type CopyOperation struct {
 	*Operation
 
+	Bucket string
+
 	Source string
 	Target string
 }
@@ -53,12 +58,26 @@ type PutOperation struct {
 
 	Length int64
 
+	Bucket string
+
 	Source string
 	Target string
+
+	// Superseded is set when another upload of the target was queued
+	// while this one ran, the content uploaded isn't the latest.
+	Superseded bool
+
+	// requests collapsed into this one while queued
+	merged []*PutOperation
+
+	// removed is set when the file was removed while this upload ran,
+	// the object is removed again afterwards.
+	removed bool
 }
 
-func newPutOp(sourcePath string, targetPath string, length int64) PutOperation {
+func newPutOp(bucket, sourcePath string, targetPath string, length int64) PutOperation {
 	return PutOperation{
+		Bucket: bucket,
 		Source: sourcePath,
 		Target: targetPath,
 		Length: int64(length),
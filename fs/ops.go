@@ -0,0 +1,337 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// defaultSlowOp is the duration of FUSE operations after which they are
+// logged as slow.
+const defaultSlowOp = 5 * time.Second
+
+// opState is a FUSE operation in flight. The fields after since are
+// guarded by opsM.
+type opState struct {
+	id    uint64
+	op    string
+	req   fuse.Request
+	since time.Time
+
+	path   string
+	remote string
+	errno  string
+	warned bool
+
+	// class and ids of the last S3 error of the operation
+	cause       string
+	s3RequestID string
+	s3HostID    string
+
+	// root span of the operation, nil unless it's traced
+	span *span
+
+	// closed once the request is answered, for the operations of hard
+	// mounts without intr which outlast interrupts, nil otherwise and
+	// once closed
+	responded chan struct{}
+}
+
+// info returns the description of the operation, opsM is held.
+func (s *opState) info() OpInfo {
+	return OpInfo{
+		ID:      s.id,
+		Op:      s.op,
+		Request: s.req.String(),
+		Path:    s.path,
+		Remote:  s.remote,
+		Since:   s.since.UTC(),
+	}
+}
+
+type opKey struct{}
+
+// opFromContext returns the operation of ctx, nil outside of FUSE
+// operations.
+func opFromContext(ctx context.Context) *opState {
+	s, _ := ctx.Value(opKey{}).(*opState)
+	return s
+}
+
+// opName returns the name of the request type, without allocating.
+func opName(req fuse.Request) string {
+	t := reflect.TypeOf(req)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return strings.TrimSuffix(t.Name(), "Request")
+}
+
+// trackOp registers the request as in flight until ctx is done, which
+// happens once the request is answered. The returned context is done at
+// unmount as well.
+func (mfs *MinFS) trackOp(ctx context.Context, req fuse.Request) context.Context {
+	s := &opState{
+		id:    atomic.AddUint64(&mfs.opSeq, 1),
+		op:    opName(req),
+		req:   req,
+		since: time.Now(),
+	}
+	hdr := req.Hdr()
+
+	// interrupts only abort the operations of hard mounts with intr, the
+	// context of the request is done on interrupts too
+	var responded chan struct{}
+	if cfg := mfs.cfg(); cfg.hard && !cfg.intr {
+		responded = make(chan struct{})
+		s.responded = responded
+	}
+
+	mfs.opsM.Lock()
+	mfs.ops[s.id] = s
+	mfs.opsByReq[hdr.ID] = s
+	mfs.opsM.Unlock()
+
+	if mfs.log.Enabled(LevelDebug) {
+		mfs.log.Debug("FUSE operation started", F("op", s.op), F("inode", uint64(hdr.Node)), F("request", req.String()))
+	}
+
+	// the request is answered once its context is done, an unmount
+	// interrupts it before
+	answered := ctx.Done()
+	if responded != nil {
+		ctx = detachedContext{ctx}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+
+	ctx, s.span = mfs.startTrace(ctx, s.op)
+
+	go func() {
+		select {
+		case <-answered:
+		case <-mfs.opsCtx.Done():
+			cancel()
+			<-answered
+		}
+		if responded != nil {
+			select {
+			case <-responded:
+			case <-mfs.opsCtx.Done():
+			}
+		}
+		cancel()
+
+		mfs.opsM.Lock()
+		delete(mfs.ops, s.id)
+		if mfs.opsByReq[hdr.ID] == s {
+			delete(mfs.opsByReq, hdr.ID)
+		}
+		mfs.opsM.Unlock()
+
+		if s.span != nil {
+			s.span.set("fuse.path", s.path)
+			if s.errno != "" {
+				s.span.setError(errors.New(s.errno))
+			}
+			s.span.finish(nil)
+		}
+
+		duration := time.Since(s.since)
+		if mfs.metrics != nil {
+			mfs.metrics.observeOp(s.op, duration)
+		}
+
+		if s.warned {
+			fields := []Field{F("op", s.op), F("path", s.path), F("duration", duration)}
+			if s.errno != "" {
+				mfs.log.Warn("Slow FUSE operation failed", append(fields, F("errno", s.errno))...)
+			} else {
+				mfs.log.Warn("Slow FUSE operation finished", fields...)
+			}
+		} else if mfs.log.Enabled(LevelDebug) {
+			mfs.log.Debug("FUSE operation finished", F("op", s.op), F("inode", uint64(hdr.Node)), F("duration", duration), F("errno", s.errno))
+		}
+	}()
+	return context.WithValue(ctx, opKey{}, s)
+}
+
+// opResult records and counts the errno of failed requests from the debug
+// messages of the FUSE server, which are sent before the request is done.
+func (mfs *MinFS) opResult(msg interface{}) {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Struct || v.Type().Name() != "response" {
+		return
+	}
+
+	id := v.FieldByName("Request").FieldByName("ID")
+	if !id.IsValid() {
+		return
+	}
+	mfs.opResponded(fuse.RequestID(id.Uint()))
+
+	errno, text := v.FieldByName("Errno"), v.FieldByName("Error")
+	if !errno.IsValid() || !text.IsValid() || errno.String() == "" && text.String() == "" {
+		return
+	}
+
+	name := errno.String()
+	if name == "" {
+		name = text.String()
+	}
+
+	mfs.opsM.Lock()
+	s := mfs.opsByReq[fuse.RequestID(id.Uint())]
+	var op, cause string
+	if s != nil {
+		s.errno = name
+		op, cause = s.op, s.cause
+	}
+	mfs.opsM.Unlock()
+
+	if s == nil {
+		return
+	}
+	// errors of calls without the context of the operation are
+	// classified by their message
+	if cause == "" {
+		cause = classifyMessage(text.String())
+	}
+	mfs.countError(op, name, cause)
+	mfs.opFailed(s, name, text.String(), cause)
+}
+
+// opResponded ends the operation of the request id waiting for its
+// answer, see opState.responded.
+func (mfs *MinFS) opResponded(id fuse.RequestID) {
+	mfs.opsM.Lock()
+	defer mfs.opsM.Unlock()
+
+	if s := mfs.opsByReq[id]; s != nil && s.responded != nil {
+		close(s.responded)
+		s.responded = nil
+	}
+}
+
+// opPath records the path the operation of ctx works on.
+func (mfs *MinFS) opPath(ctx context.Context, path string) {
+	if s := opFromContext(ctx); s != nil {
+		mfs.opsM.Lock()
+		s.path = path
+		mfs.opsM.Unlock()
+	}
+}
+
+// opRemote records the remote call the operation of ctx is blocked on
+// until the returned func is called, traced operations get a child span
+// of the call.
+func (mfs *MinFS) opRemote(ctx context.Context, call string) func() {
+	s := opFromContext(ctx)
+	if s == nil {
+		return func() {}
+	}
+
+	_, sp := mfs.startSpan(ctx, call)
+	if sp != nil {
+		sp.kind = spanClient
+	}
+
+	mfs.opsM.Lock()
+	prev := s.remote
+	s.remote = call
+	mfs.opsM.Unlock()
+
+	return func() {
+		mfs.opsM.Lock()
+		s.remote = prev
+		mfs.opsM.Unlock()
+
+		sp.finish(nil)
+	}
+}
+
+// startWatchdog logs operations running longer than the slow operation
+// threshold, until the listener is done.
+func (mfs *MinFS) startWatchdog() {
+	threshold := mfs.config.slowOp
+	if threshold <= 0 {
+		return
+	}
+
+	interval := threshold / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var slow []OpInfo
+		for {
+			select {
+			case <-mfs.listenerDoneCh:
+				return
+			case now := <-ticker.C:
+				slow = slow[:0]
+
+				mfs.opsM.Lock()
+				for _, s := range mfs.ops {
+					if !s.warned && now.Sub(s.since) >= threshold {
+						s.warned = true
+						slow = append(slow, s.info())
+					}
+				}
+				mfs.opsM.Unlock()
+
+				for _, op := range slow {
+					fields := []Field{F("op", op.Op), F("path", op.Path), F("duration", now.Sub(op.Since).Round(time.Millisecond)), F("request", op.Request)}
+					if op.Remote != "" {
+						fields = append(fields, F("remote", op.Remote))
+					}
+					mfs.log.Warn("Slow FUSE operation", fields...)
+				}
+			}
+		}
+	}()
+}
+
+// opTransport records the S3 requests sent by FUSE operations as the
+// remote call they are blocked on.
+type opTransport struct {
+	http.RoundTripper
+
+	mfs *MinFS
+}
+
+func (t *opTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if opFromContext(req.Context()) == nil {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	done := t.mfs.opRemote(req.Context(), req.Method+" "+req.URL.Path)
+	defer done()
+
+	return t.RoundTripper.RoundTrip(req)
+}
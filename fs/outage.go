@@ -0,0 +1,315 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v6"
+)
+
+const (
+	// defaultRetryTimeout is the time soft mounts retry requests after
+	// the endpoint became unreachable.
+	defaultRetryTimeout = 30 * time.Second
+
+	// retryInterval and retryMaxInterval bound the delay between
+	// retries, and between the probes of an unreachable endpoint.
+	retryInterval    = time.Second
+	retryMaxInterval = 30 * time.Second
+
+	// statusRetries is the number of retries of responses with a
+	// retryable status, like 503 for slow down.
+	statusRetries = 10
+)
+
+// errUnreachable fails the requests of soft mounts once the endpoint is
+// unreachable for longer than the retry timeout.
+var errUnreachable = errors.New("Endpoint is unreachable")
+
+// retryableStatus are the statuses of responses worth sending the request
+// again for, the ones minio-go retries.
+var retryableStatus = map[int]bool{
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+func init() {
+	// The retries are made by retryTransport, which knows if the mount
+	// is soft or hard. The retries of minio-go would add minutes of
+	// backoff to the retry timeout of soft mounts.
+	minio.MaxRetry = 1
+}
+
+// retryMode is how long a request is retried while the endpoint is
+// unreachable.
+type retryMode int
+
+const (
+	// a single attempt, for probes of the endpoint
+	retryNone retryMode = iota
+	// until the retry timeout, for soft mounts and for requests with a
+	// cached fallback
+	retrySoft
+	// until the endpoint answers again, for hard mounts
+	retryHard
+)
+
+type retryModeKey struct{}
+
+// withRetryMode limits the retries of the requests sent with ctx to mode.
+func withRetryMode(ctx context.Context, mode retryMode) context.Context {
+	return context.WithValue(ctx, retryModeKey{}, mode)
+}
+
+// outage is the reachability of the endpoint of a mount.
+type outage struct {
+	m sync.Mutex
+
+	// time of the first failed request, zero while reachable
+	since time.Time
+
+	// closed once the endpoint answers again
+	back chan struct{}
+}
+
+// unreachable returns true while the endpoint doesn't answer requests.
+func (mfs *MinFS) unreachable() bool {
+	mfs.outage.m.Lock()
+	defer mfs.outage.m.Unlock()
+
+	return !mfs.outage.since.IsZero()
+}
+
+// endpointFailed records a request which didn't get an answer, and starts
+// probing the endpoint on the first one. It returns the start of the
+// outage and the channel closed once it ends.
+func (mfs *MinFS) endpointFailed(err error) (time.Time, <-chan struct{}) {
+	mfs.outage.m.Lock()
+	defer mfs.outage.m.Unlock()
+
+	if mfs.outage.since.IsZero() {
+		mfs.outage.since = time.Now()
+		mfs.outage.back = make(chan struct{})
+		mfs.log.Warn("Endpoint unreachable", F("endpoint", mfs.config.target.Host), F("error", err), F("hard", mfs.cfg().hard))
+		go mfs.probeEndpoint(mfs.outage.back)
+	}
+	return mfs.outage.since, mfs.outage.back
+}
+
+// endpointAnswered ends the outage, if any, on a response of the endpoint.
+func (mfs *MinFS) endpointAnswered() {
+	mfs.outage.m.Lock()
+	defer mfs.outage.m.Unlock()
+
+	if mfs.outage.since.IsZero() {
+		return
+	}
+	mfs.log.Info("Endpoint reachable again", F("endpoint", mfs.config.target.Host), F("duration", time.Since(mfs.outage.since).Round(time.Millisecond)))
+	close(mfs.outage.back)
+	mfs.outage.since, mfs.outage.back = time.Time{}, nil
+}
+
+// probeEndpoint checks the remote with backoff until it answers, which
+// wakes the requests of hard mounts waiting for it.
+func (mfs *MinFS) probeEndpoint(back <-chan struct{}) {
+	for interval := retryInterval; ; {
+		select {
+		case <-back:
+			return
+		case <-time.After(interval):
+		}
+		if mfs.stopping() {
+			return
+		}
+
+		mfs.checkRemote()
+
+		if interval *= 2; interval > retryMaxInterval {
+			interval = retryMaxInterval
+		}
+	}
+}
+
+// unreachableError returns true for errors of requests which got no
+// answer. Other errors, like TLS verification failures, aren't outages.
+func unreachableError(err error) bool {
+	if err == context.DeadlineExceeded || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// retryTransport retries requests failing while the endpoint is
+// unreachable and responses with retryable statuses. Soft mounts give up
+// once the endpoint is unreachable for longer than the retry timeout,
+// hard mounts wait for it to answer again.
+type retryTransport struct {
+	http.RoundTripper
+
+	// the mode and the retry timeout are those of the current config
+	mfs *MinFS
+}
+
+// RoundTrip - executes the request, retrying it per the mount mode.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the notification stream reconnects with its own backoff
+	if _, ok := req.URL.Query()["events"]; ok {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	cfg := t.mfs.cfg()
+	mode := retrySoft
+	if cfg.hard {
+		mode = retryHard
+	}
+	if m, ok := req.Context().Value(retryModeKey{}).(retryMode); ok && m < mode {
+		mode = m
+	}
+
+	// requests with a body can't be sent again, failed uploads are
+	// retried by the upload queue
+	replayable := req.Body == nil || req.Body == http.NoBody
+
+	if mode == retrySoft && t.mfs.unreachableFor(cfg.retryTimeout) {
+		return nil, errUnreachable
+	}
+
+	// interrupts only abort the requests of hard mounts with intr
+	ctx, r := req.Context(), req
+	if mode == retryHard && !cfg.intr {
+		ctx = detachedContext{ctx}
+		r = req.WithContext(ctx)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			// the signature expires while waiting for the endpoint
+			r = t.mfs.signV4(cloneRequest(r))
+		}
+
+		resp, err := t.RoundTripper.RoundTrip(r)
+		if err == nil {
+			t.mfs.endpointAnswered()
+			if !replayable || mode == retryNone || attempt == statusRetries || !retryableStatus[resp.StatusCode] {
+				return resp, nil
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+
+			if err = sleepContext(ctx, retryBackoff(attempt)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if ctx.Err() != nil || !unreachableError(err) {
+			return nil, err
+		}
+		since, back := t.mfs.endpointFailed(err)
+		if !replayable || mode == retryNone {
+			return nil, err
+		}
+
+		if mode == retrySoft {
+			left := cfg.retryTimeout - time.Since(since)
+			if left <= 0 {
+				return nil, err
+			}
+			wait := retryBackoff(attempt)
+			if wait > left {
+				wait = left
+			}
+			if err = sleepContext(ctx, wait); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if err = t.mfs.waitReachable(ctx, back); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// unreachableFor returns true if the endpoint is unreachable for longer
+// than d.
+func (mfs *MinFS) unreachableFor(d time.Duration) bool {
+	mfs.outage.m.Lock()
+	defer mfs.outage.m.Unlock()
+
+	return !mfs.outage.since.IsZero() && time.Since(mfs.outage.since) >= d
+}
+
+// waitReachable blocks until back is closed, ctx is done or the mount
+// shuts down.
+func (mfs *MinFS) waitReachable(ctx context.Context, back <-chan struct{}) error {
+	ticker := time.NewTicker(shutdownPoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-back:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if mfs.stopping() {
+				return errUnreachable
+			}
+		}
+	}
+}
+
+// retryBackoff returns the delay before the retry following attempt.
+func retryBackoff(attempt int) time.Duration {
+	d := retryInterval << uint(attempt)
+	if d > retryMaxInterval || d <= 0 {
+		d = retryMaxInterval
+	}
+	return d
+}
+
+// sleepContext sleeps for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// detachedContext has the values of its parent without its cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
@@ -0,0 +1,240 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// openFile opens the file node read-only with ctx.
+func openFile(ctx context.Context, node *File) (*FileHandle, error) {
+	handle, err := node.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		return nil, err
+	}
+	return handle.(*FileHandle), nil
+}
+
+// interruptibleOpen opens the file node read-only like the FUSE server,
+// the open is interrupted by calling interrupt.
+func (m *testMount) interruptibleOpen(node *File) (opened <-chan error, interrupt context.CancelFunc) {
+	reqCtx, cancel := context.WithCancel(context.Background())
+	req := &fuse.OpenRequest{Header: fuse.Header{ID: 1}, Flags: fuse.OpenReadOnly}
+	ctx := m.trackOp(reqCtx, req)
+
+	errs := make(chan error, 1)
+	go func() {
+		fh, err := openFile(ctx, node)
+		if err == nil {
+			if got := m.read(fh); string(got) != "file" {
+				err = fmt.Errorf("expected file, got %q", got)
+			}
+			m.close(fh)
+		}
+		m.opResponded(req.ID)
+		cancel()
+		errs <- err
+	}()
+	return errs, cancel
+}
+
+// lookupFile returns the file node of name.
+func (m *testMount) lookupFile(name string) *File {
+	m.t.Helper()
+	node, err := m.lookup(name)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return node.(*File)
+}
+
+// TestSoftMountOutage fails the operations of a soft mount once the
+// endpoint is unreachable for longer than the retry timeout, and
+// recovers once it's back.
+func TestSoftMountOutage(t *testing.T) {
+	// longer than the backoff of minio-go after a failed attempt
+	const retryTimeout = 1500 * time.Millisecond
+
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "file", []byte("file"))
+
+	m := newTestMount(t, s3, t.TempDir(), Soft(), RetryTimeout(retryTimeout))
+	node := m.lookupFile("file")
+
+	s3.takeDown()
+
+	start := time.Now()
+	_, err := openFile(context.Background(), node)
+	if en, ok := err.(fuse.ErrorNumber); !ok || (en.Errno() != fuse.EIO && en.Errno() != fuse.Errno(syscall.ETIMEDOUT)) {
+		t.Fatalf("expected the open to fail with EIO or ETIMEDOUT, got %v", err)
+	}
+	if d := time.Since(start); d < retryTimeout || d > 5*time.Second {
+		t.Errorf("expected the open to fail after the retry timeout of %s, took %s", retryTimeout, d)
+	}
+	if !m.unreachable() {
+		t.Errorf("expected the endpoint to be unreachable")
+	}
+
+	// later operations fail without retrying
+	start = time.Now()
+	if _, err = openFile(context.Background(), node); err == nil {
+		t.Fatalf("expected the open to fail during the outage")
+	}
+	if d := time.Since(start); d > retryTimeout {
+		t.Errorf("expected the open to fail without retrying, took %s", d)
+	}
+
+	if err = s3.bringBack(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		fh, err := openFile(context.Background(), node)
+		if err == nil {
+			if got := m.read(fh); string(got) != "file" {
+				t.Errorf("expected file, got %q", got)
+			}
+			m.close(fh)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the mount to recover once the endpoint is back, got %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if m.unreachable() {
+		t.Errorf("expected the outage to end")
+	}
+}
+
+// TestHardMountOutage blocks the operations of a hard mount until the
+// endpoint is back, interrupts don't abort them without intr.
+func TestHardMountOutage(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "file", []byte("file"))
+
+	m := newTestMount(t, s3, t.TempDir(), Hard(), RetryTimeout(100*time.Millisecond))
+	node := m.lookupFile("file")
+
+	s3.takeDown()
+
+	opened, interrupt := m.interruptibleOpen(node)
+
+	time.Sleep(500 * time.Millisecond)
+	interrupt()
+	select {
+	case err := <-opened:
+		t.Fatalf("expected the open to wait for the endpoint, got %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if err := s3.bringBack(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Fatalf("expected the open to succeed once the endpoint is back, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the open to finish once the endpoint is back")
+	}
+}
+
+// TestHardMountIntr aborts the operations of a hard mount with intr
+// waiting for the endpoint by interrupts.
+func TestHardMountIntr(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "file", []byte("file"))
+
+	m := newTestMount(t, s3, t.TempDir(), Hard(), Intr())
+	node := m.lookupFile("file")
+
+	s3.takeDown()
+	defer s3.bringBack()
+
+	opened, interrupt := m.interruptibleOpen(node)
+
+	time.Sleep(300 * time.Millisecond)
+	interrupt()
+	select {
+	case err := <-opened:
+		if en, ok := err.(fuse.ErrorNumber); !ok || en.Errno() != fuse.EINTR {
+			t.Errorf("expected the interrupted open to fail with EINTR, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the interrupt to abort the open")
+	}
+}
+
+// TestOutageCachedReads reads cached files during an outage, of soft and
+// hard mounts.
+func TestOutageCachedReads(t *testing.T) {
+	testCases := []struct {
+		name string
+		mode func(*Config)
+	}{
+		{"soft", Soft()},
+		{"hard", Hard()},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			s3 := newFakeS3(testBucket)
+			defer s3.Close()
+			s3.put(testBucket, "cached", []byte("cached"))
+			s3.put(testBucket, "uncached", []byte("uncached"))
+
+			m := newTestMount(t, s3, t.TempDir(), testCase.mode, CacheReuse(), RetryTimeout(300*time.Millisecond))
+			m.readFile("cached")
+			uncached := m.lookupFile("uncached")
+
+			s3.takeDown()
+			defer s3.bringBack()
+
+			// the first read finds the endpoint unreachable, the later
+			// ones don't wait for it
+			for i := 0; i < 3; i++ {
+				start := time.Now()
+				if got := m.readFile("cached"); string(got) != "cached" {
+					t.Fatalf("expected the cached content, got %q", got)
+				}
+				if d := time.Since(start); d > 5*time.Second {
+					t.Errorf("expected the cached read %d not to wait for the endpoint, took %s", i, d)
+				}
+			}
+			if !m.unreachable() {
+				t.Errorf("expected the endpoint to be unreachable")
+			}
+
+			if testCase.name == "soft" {
+				if _, err := openFile(context.Background(), uncached); err == nil {
+					t.Errorf("expected the read of an uncached file to fail")
+				}
+			}
+		})
+	}
+}
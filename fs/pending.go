@@ -0,0 +1,427 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package minfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v6"
+)
+
+const (
+	// pendingBucket is the meta bucket of uploads to retry.
+	pendingBucket = "pending/"
+
+	// pendingInterval is the interval pending uploads are checked at.
+	pendingInterval = 5 * time.Second
+
+	// pendingMaxBackoff is the maximum delay between retries.
+	pendingMaxBackoff = 10 * time.Minute
+
+	// defaultUploadRetries is the number of retries before giving up on
+	// an upload.
+	defaultUploadRetries = 20
+)
+
+// pendingUpload is a journaled upload of a cache file, recorded when a
+// handle becomes dirty. The cache file is kept until the upload succeeds,
+// so writes survive a crash of minfs.
+type pendingUpload struct {
+	Bucket string
+	Source string
+	Target string
+	Length int64
+
+	// Hash is the hex SHA-256 of the cache file when the upload started.
+	Hash string
+
+	// Dirty is set while a handle writes the cache file, before it's
+	// flushed.
+	Dirty bool
+
+	Attempts    int
+	NextAttempt time.Time
+	GaveUp      bool
+}
+
+// journal records the dirty handle, the record is dropped once the content
+// is uploaded.
+func (mfs *MinFS) journal(fh *FileHandle) error {
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		return mfs.journalTx(tx, fh)
+	})
+}
+
+// journalTx records the dirty handle within tx.
+func (mfs *MinFS) journalTx(tx *meta.Tx, fh *FileHandle) error {
+	// scratch mounts and local-only files don't upload, there is nothing
+	// to journal
+	if mfs.config.scratch || fh.f.LocalOnly {
+		return nil
+	}
+
+	b := tx.Bucket(pendingBucket)
+
+	var p pendingUpload
+	if err := b.Get(fh.f.FullPath(), &p); err == nil && p.Source == fh.cachePath {
+		p.Dirty = true
+		return b.Put(fh.f.FullPath(), &p)
+	}
+
+	return b.Put(fh.f.FullPath(), &pendingUpload{
+		Bucket:      fh.f.BucketName(),
+		Source:      fh.cachePath,
+		Target:      fh.f.RemotePath(),
+		Length:      int64(fh.f.Size),
+		Dirty:       true,
+		NextAttempt: time.Now().Add(pendingInterval),
+	})
+}
+
+// journalUpload updates the record of the handle with the size and hash of
+// the content about to be uploaded.
+func (mfs *MinFS) journalUpload(fh *FileHandle) error {
+	// the handle may be write-only
+	r, err := os.Open(fh.cachePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, io.NewSectionReader(r, 0, int64(fh.f.Size))); err != nil {
+		return err
+	}
+
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		b := tx.Bucket(pendingBucket)
+
+		var p pendingUpload
+		if err := b.Get(fh.f.FullPath(), &p); err != nil || p.Source != fh.cachePath {
+			return mfs.journalTx(tx, fh)
+		}
+
+		p.Length = int64(fh.f.Size)
+		p.Hash = hex.EncodeToString(hasher.Sum(nil))
+		return b.Put(fh.f.FullPath(), &p)
+	})
+}
+
+// replayJournal makes the uploads interrupted by a crash or unmount due,
+// and reports the uploads of which the cache file is lost.
+func (mfs *MinFS) replayJournal() error {
+	var lost, replayed int
+	err := mfs.db.Update(func(tx *meta.Tx) error {
+		b := tx.Bucket(pendingBucket)
+
+		journal := map[string]pendingUpload{}
+		if err := b.ForEach(func(k string, _ interface{}) error {
+			var p pendingUpload
+			if err := b.Get(k, &p); err != nil {
+				return err
+			}
+			journal[k] = p
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for path, p := range journal {
+			fi, err := os.Stat(p.Source)
+			if err != nil {
+				mfs.log.Printf("Upload of %s can't be recovered, its cache file %s is lost: %s\n", path, p.Source, err)
+				if err = b.Delete(path); err != nil {
+					return err
+				}
+				lost++
+				continue
+			}
+
+			if p.Dirty {
+				// not flushed before minfs stopped, the content is as
+				// far as it was written
+				mfs.log.Printf("Upload of %s was not flushed, uploading the %d bytes written.\n", path, fi.Size())
+				p.Hash = ""
+			} else if p.Length != fi.Size() {
+				mfs.log.Printf("Cache file %s of %s has %d bytes, %d were journaled.\n", p.Source, path, fi.Size(), p.Length)
+			}
+
+			p.Length = fi.Size()
+			p.Dirty = false
+			p.NextAttempt = time.Now()
+			if err = b.Put(path, &p); err != nil {
+				return err
+			}
+			replayed++
+		}
+		return nil
+	})
+
+	if lost+replayed > 0 {
+		mfs.log.Printf("Replaying %d journaled uploads, %d lost.\n", replayed, lost)
+	}
+	return err
+}
+
+// addPending records the failed upload of the file at path, replacing an
+// earlier pending upload of the path.
+func (mfs *MinFS) addPending(path string, p pendingUpload) error {
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		b := tx.Bucket(pendingBucket)
+
+		var old pendingUpload
+		if err := b.Get(path, &old); err == nil && old.Source != p.Source {
+			os.Remove(old.Source)
+		}
+
+		p.NextAttempt = time.Now().Add(pendingInterval)
+		return b.Put(path, &p)
+	})
+}
+
+// cancelUploads drops the queued and pending uploads of the removed file
+// at fullPath within tx, a running upload is followed by a removal.
+func (mfs *MinFS) cancelUploads(tx *meta.Tx, fullPath, bucket, object string) error {
+	if waiters := mfs.syncQueue.cancel(bucket, object); len(waiters) > 0 {
+		go func() {
+			for _, w := range waiters {
+				w.Error <- errUploadCancelled
+			}
+		}()
+	}
+
+	b := tx.Bucket(pendingBucket)
+
+	var p pendingUpload
+	if err := b.Get(fullPath, &p); isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	inUse := false
+	for _, fh := range mfs.openHandles(fullPath) {
+		inUse = inUse || fh.cachePath == p.Source
+	}
+	if !inUse {
+		os.Remove(p.Source)
+	}
+	return b.Delete(fullPath)
+}
+
+// queuePending makes the journaled upload of source due now.
+func (mfs *MinFS) queuePending(path, source string) error {
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		b := tx.Bucket(pendingBucket)
+
+		var p pendingUpload
+		if err := b.Get(path, &p); err != nil {
+			return err
+		}
+		if p.Source != source {
+			return nil
+		}
+
+		p.Dirty = false
+		p.NextAttempt = time.Now()
+		return b.Put(path, &p)
+	})
+}
+
+// pending returns the pending upload of the file at path.
+func (mfs *MinFS) pending(path string) (pendingUpload, bool) {
+	var p pendingUpload
+	err := mfs.db.View(func(tx *meta.Tx) error {
+		return tx.Bucket(pendingBucket).ReadOnly().Get(path, &p)
+	})
+	return p, err == nil
+}
+
+// removePending drops the pending upload of the file at path, either
+// finished or superseded by a successful upload. With source set only the
+// pending upload of that cache file is dropped. The cache file is kept if
+// it's still in use.
+func (mfs *MinFS) removePending(path, source, inUse string) error {
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		b := tx.Bucket(pendingBucket)
+
+		var p pendingUpload
+		if err := b.Get(path, &p); isNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if source != "" && p.Source != source {
+			return nil
+		}
+
+		if p.Source != inUse {
+			os.Remove(p.Source)
+		}
+		return b.Delete(path)
+	})
+}
+
+// storeUploaded records the ETag of the finished upload in the entry of
+// the file, so it's the base of further changes.
+func (mfs *MinFS) storeUploaded(fullPath string, p pendingUpload) error {
+	objInfo, err := mfs.api.StatObject(p.Bucket, p.Target, minio.StatObjectOptions{})
+	if err != nil {
+		return err
+	}
+
+	dir, name := path.Split(fullPath)
+	var parts []string
+	if dir = strings.TrimSuffix(dir, "/"); dir != "" {
+		parts = strings.Split(dir, "/")
+	}
+
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		b := metaDirBucket(tx, parts)
+		if b.InnerBucket == nil {
+			return nil
+		}
+
+		var f File
+		if err := b.Get(name, &f); err != nil {
+			return nil
+		}
+
+		f.BytesUploaded += uint64(p.Length)
+
+		// changed since the upload
+		if f.Size == uint64(p.Length) {
+			f.ETag = objInfo.ETag
+			f.LastModified = objInfo.LastModified
+		}
+		return b.Put(name, &f)
+	})
+}
+
+// startPendingUploads retries pending uploads in the background, with
+// exponential backoff until the upload succeeds or it's given up.
+func (mfs *MinFS) startPendingUploads() {
+	go func() {
+		ticker := time.NewTicker(pendingInterval)
+		defer ticker.Stop()
+
+		for {
+			var paths []string
+			if err := mfs.db.View(func(tx *meta.Tx) error {
+				return tx.Bucket(pendingBucket).ForEach(func(k string, _ interface{}) error {
+					paths = append(paths, k)
+					return nil
+				})
+			}); err != nil {
+				mfs.log.Println("Error:", err)
+			}
+
+			for _, path := range paths {
+				mfs.retryPending(path)
+			}
+
+			select {
+			case <-mfs.listenerDoneCh:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// retryPending uploads the pending upload of path if its retry is due.
+func (mfs *MinFS) retryPending(path string) {
+	p, ok := mfs.pending(path)
+	if !ok || p.GaveUp || time.Now().Before(p.NextAttempt) {
+		return
+	}
+	mfs.uploadPending(path, p)
+}
+
+// uploadPending uploads the pending upload p of path now, a failed upload
+// is retried with backoff until it's given up.
+func (mfs *MinFS) uploadPending(path string, p pendingUpload) error {
+	// dirty handles upload the file themselves
+	if mfs.isDirty(path) {
+		return nil
+	}
+
+	sr := newPutOp(p.Bucket, p.Source, p.Target, p.Length)
+	mfs.sync(&sr)
+
+	err := <-sr.Error
+	if err == errUploadCancelled {
+		return nil
+	}
+	if err == nil && sr.Superseded {
+		// the later upload finishes the pending upload
+		return nil
+	}
+	if err == nil {
+		inUse := ""
+		for _, fh := range mfs.openHandles(path) {
+			if fh.cachePath == p.Source {
+				inUse = p.Source
+			}
+		}
+
+		mfs.log.Info("Pending upload finished", F("path", path))
+		if err = mfs.removePending(path, p.Source, inUse); err != nil {
+			mfs.log.Error("Unable to remove the pending upload", F("path", path), F("error", err))
+		}
+		if err = mfs.storeUploaded(path, p); err != nil {
+			mfs.log.Error("Unable to store the uploaded object", F("path", path), F("error", err))
+		}
+		return nil
+	}
+
+	p.Attempts++
+	atomic.AddUint64(&mfs.stats.UploadRetries, 1)
+	if p.Attempts >= mfs.cfg().uploadRetries {
+		p.GaveUp = true
+		mfs.log.Error("Giving up upload, the data is kept in the cache", append(s3Fields(err), F("path", path), F("attempts", p.Attempts), F("source", p.Source))...)
+	} else {
+		backoff := pendingInterval << uint(p.Attempts)
+		if backoff > pendingMaxBackoff || backoff <= 0 {
+			backoff = pendingMaxBackoff
+		}
+		p.NextAttempt = time.Now().Add(backoff)
+		mfs.log.Warn("Pending upload failed, retrying", append(s3Fields(err), F("path", path), F("attempts", p.Attempts), F("backoff", backoff))...)
+	}
+
+	if serr := mfs.db.Update(func(tx *meta.Tx) error {
+		b := tx.Bucket(pendingBucket)
+
+		// superseded while uploading
+		var current pendingUpload
+		if b.Get(path, &current) != nil || current.Source != p.Source {
+			return nil
+		}
+		return b.Put(path, &p)
+	}); serr != nil {
+		mfs.log.Error("Unable to store the pending upload", F("path", path), F("error", serr))
+	}
+	return err
+}
@@ -0,0 +1,180 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// TestWriteOnlyUpload checks the content of write-only handles is
+// journaled and uploaded, which reads their cache file.
+func TestWriteOnlyUpload(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "file", []byte("old content"))
+
+	m := newTestMount(t, s3, t.TempDir())
+	fh, err := m.open("file", fuse.OpenWriteOnly|fuse.OpenTruncate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.write(fh, 0, []byte("new"))
+	if err = m.close(fh); err != nil {
+		t.Fatalf("expected the write-only handle to be closed, got %v", err)
+	}
+	m.syncQueue.drain()
+
+	if data, ok := s3.get(testBucket, "file"); !ok || string(data) != "new" {
+		t.Errorf("expected the new content to be uploaded, got %q", data)
+	}
+	if got := m.readFile("file"); string(got) != "new" {
+		t.Errorf("expected to read the new content, got %q", got)
+	}
+}
+
+// waitUploaded waits until the pending upload of name is done.
+func waitUploaded(t *testing.T, m *testMount, name string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := m.pending(name); !ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the upload of %s to finish", name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestCollapsedUploads saves a file 10 times while the first upload is in
+// flight, the queued uploads collapse into the upload of the last content.
+func TestCollapsedUploads(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+
+	m := newTestMount(t, s3, t.TempDir(), AsyncUploads())
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	s3.setIntercept(func(op string, w http.ResponseWriter, r *http.Request) bool {
+		if op == "PutObject" {
+			once.Do(func() { close(started) })
+			<-release
+		}
+		return false
+	})
+
+	m.writeFile("file", []byte("save 0"))
+	<-started
+	for i := 1; i < 10; i++ {
+		m.writeFile("file", []byte(fmt.Sprintf("save %d", i)))
+	}
+	close(release)
+	waitUploaded(t, m, "file")
+	m.syncQueue.drain()
+
+	if data, ok := s3.get(testBucket, "file"); !ok || string(data) != "save 9" {
+		t.Errorf("expected the last save to be the object, got %q", data)
+	}
+	if n := s3.count("PutObject"); n > 2 {
+		t.Errorf("expected at most 2 PutObjects of 10 saves, got %d", n)
+	}
+	if got := m.readFile("file"); string(got) != "save 9" {
+		t.Errorf("expected to read the last save, got %q", got)
+	}
+}
+
+// holdPuts holds the PutObjects of the fake server until release is
+// closed, started is closed once the first one is held.
+func holdPuts(s3 *fakeS3) (started, release chan struct{}) {
+	started, release = make(chan struct{}), make(chan struct{})
+
+	var once sync.Once
+	s3.setIntercept(func(op string, w http.ResponseWriter, r *http.Request) bool {
+		if op == "PutObject" {
+			once.Do(func() { close(started) })
+			<-release
+		}
+		return false
+	})
+	return started, release
+}
+
+// TestRemoveDuringUpload removes files with uploads in flight and queued,
+// and creates one again right away. The removed objects stay removed, and
+// the created one has the new content.
+func TestRemoveDuringUpload(t *testing.T) {
+	testCases := []struct {
+		name string
+		// saves before the removal, the first one is in flight
+		saves    int
+		recreate bool
+	}{
+		{"in flight", 1, false},
+		{"queued", 3, false},
+		{"recreated", 1, true},
+		{"queued recreated", 3, true},
+	}
+
+	for _, testCase := range testCases {
+		s3 := newFakeS3(testBucket)
+		m := newTestMount(t, s3, t.TempDir(), AsyncUploads())
+		started, release := holdPuts(s3)
+
+		m.writeFile("file", []byte("save 0"))
+		<-started
+		for i := 1; i < testCase.saves; i++ {
+			m.writeFile("file", []byte(fmt.Sprintf("save %d", i)))
+		}
+
+		if err := m.remove("file", false); err != nil {
+			t.Fatalf("%s: %v", testCase.name, err)
+		}
+		if testCase.recreate {
+			m.writeFile("file", []byte("recreated"))
+		}
+		close(release)
+		waitUploaded(t, m, "file")
+		m.syncQueue.drain()
+
+		data, ok := s3.get(testBucket, "file")
+		switch {
+		case testCase.recreate && (!ok || string(data) != "recreated"):
+			t.Errorf("%s: expected the recreated content, got %q", testCase.name, data)
+		case !testCase.recreate && ok:
+			t.Errorf("%s: expected the removed object to stay removed, got %q", testCase.name, data)
+		}
+
+		// the mount agrees after resyncing with the remote
+		m = m.remount()
+		if testCase.recreate {
+			if got := m.readFile("file"); string(got) != "recreated" {
+				t.Errorf("%s: expected to read the recreated content, got %q", testCase.name, got)
+			}
+		} else if _, err := m.lookup("file"); !isNotFound(err) {
+			t.Errorf("%s: expected the removed file to be gone, got %v", testCase.name, err)
+		}
+		s3.Close()
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	rpprof "runtime/pprof"
+	"time"
+)
+
+// profiles are the profiles written by WriteProfiles.
+var profiles = []string{"heap", "goroutine"}
+
+// registerPprof adds the profiling handlers at /debug/pprof/ of mux.
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// startPprof serves the profiling handlers on the profiling address,
+// without one they're served on the metrics listener.
+func (mfs *MinFS) startPprof() error {
+	if !mfs.config.pprof || mfs.config.pprofAddr == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", mfs.config.pprofAddr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for profiling on %s: %s", mfs.config.pprofAddr, err)
+	}
+
+	mux := http.NewServeMux()
+	registerPprof(mux)
+
+	mfs.pprofServer = &http.Server{Handler: mux}
+	go mfs.pprofServer.Serve(l)
+
+	mfs.log.Printf("Serving profiles on %s.\n", l.Addr())
+	return nil
+}
+
+// stopPprof closes the profiling listener.
+func (mfs *MinFS) stopPprof() {
+	if mfs.pprofServer != nil {
+		mfs.pprofServer.Close()
+	}
+}
+
+// WriteProfiles writes the heap and goroutine profiles to files in dir,
+// and returns their paths.
+func (mfs *MinFS) WriteProfiles(dir string) ([]string, error) {
+	stamp := time.Now().UTC().Format("20060102T150405")
+
+	var paths []string
+	for _, name := range profiles {
+		path := filepath.Join(dir, fmt.Sprintf("minfs-%s-%s.pprof", name, stamp))
+
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return paths, err
+		}
+		err = rpprof.Lookup(name).WriteTo(f, 0)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
@@ -0,0 +1,77 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package minfs
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+const (
+	// presignXattr is the extended attribute returning a presigned URL,
+	// variants with a duration suffix set the expiry of the URL.
+	presignXattr = "minfs.presigned-url"
+
+	// maxPresignExpiry is the maximum validity of presigned URLs.
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// presignedURLXattr returns a presigned GET URL of the object with the
+// default expiry.
+func (f *File) presignedURLXattr(ctx context.Context) ([]byte, error) {
+	return f.presignedURL(f.mfs.cfg().presignExpiry)
+}
+
+// presignedURLXattrFor returns the getter of the presigned URL extended
+// attribute with a duration suffix, like minfs.presigned-url.1h.
+func presignedURLXattrFor(name string) (func(*File, context.Context) ([]byte, error), bool) {
+	if !strings.HasPrefix(name, presignXattr+".") {
+		return nil, false
+	}
+
+	expiry, err := time.ParseDuration(strings.TrimPrefix(name, presignXattr+"."))
+	if err != nil {
+		return nil, false
+	}
+
+	return func(f *File, ctx context.Context) ([]byte, error) {
+		return f.presignedURL(expiry)
+	}, true
+}
+
+// presignedURL generates a presigned GET URL valid for expiry. The URL is
+// generated on every request and never cached.
+func (f *File) presignedURL(expiry time.Duration) ([]byte, error) {
+	if expiry <= 0 || expiry > maxPresignExpiry {
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+
+	// the URL wouldn't serve the current content
+	if f.mfs.isDirty(f.FullPath()) {
+		return nil, fuse.Errno(syscall.EAGAIN)
+	}
+
+	u, err := f.mfs.api.PresignedGetObject(f.BucketName(), f.RemotePath(), expiry, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(u.String()), nil
+}
@@ -0,0 +1,185 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// progressRetention is the time finished uploads are kept in the stats.
+const progressRetention = 5 * time.Minute
+
+// UploadProgress is the state of an upload, running or finished in the
+// retention window.
+type UploadProgress struct {
+	Bucket string
+	Object string
+
+	Sent  int64
+	Total int64
+
+	Started  time.Time
+	Finished time.Time
+
+	// Error is set for failed uploads.
+	Error string
+}
+
+// Percent returns the share of the upload sent so far.
+func (p UploadProgress) Percent() float64 {
+	if p.Total <= 0 {
+		return 100
+	}
+	return float64(p.Sent) * 100 / float64(p.Total)
+}
+
+// Elapsed returns the duration of the upload.
+func (p UploadProgress) Elapsed() time.Duration {
+	if !p.Finished.IsZero() {
+		return p.Finished.Sub(p.Started)
+	}
+	return time.Since(p.Started)
+}
+
+// Rate returns the average bytes sent per second.
+func (p UploadProgress) Rate() float64 {
+	if elapsed := p.Elapsed().Seconds(); elapsed > 0 {
+		return float64(p.Sent) / elapsed
+	}
+	return 0
+}
+
+// uploadTracker is passed to PutObject as progress reader, it's handed
+// the bytes of the request body as they are sent.
+type uploadTracker struct {
+	m sync.Mutex
+	p UploadProgress
+
+	// reports the progress to the notifier
+	tt *transferTracker
+
+	// counter of the bytes uploaded by the mount
+	uploaded *uint64
+}
+
+// Read counts the bytes sent.
+func (t *uploadTracker) Read(b []byte) (int, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	// parts sent again don't count twice
+	sent := t.p.Sent
+	if t.p.Sent += int64(len(b)); t.p.Sent > t.p.Total {
+		t.p.Sent = t.p.Total
+	}
+	if t.p.Sent > sent {
+		t.tt.add(t.p.Sent - sent)
+		atomic.AddUint64(t.uploaded, uint64(t.p.Sent-sent))
+	}
+	return len(b), nil
+}
+
+func (t *uploadTracker) progress() UploadProgress {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	return t.p
+}
+
+// finish records the end of the upload.
+func (t *uploadTracker) finish(err error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.p.Finished = time.Now().UTC()
+	if err != nil {
+		t.p.Error = err.Error()
+	}
+	t.tt.finish(err)
+}
+
+// countingReader adds the bytes read from r to n.
+type countingReader struct {
+	r io.Reader
+	n *uint64
+}
+
+func (c countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
+
+// trackUpload registers the upload of length bytes to object, replacing
+// an earlier upload of the object.
+func (mfs *MinFS) trackUpload(bucket, object string, length int64) *uploadTracker {
+	t := &uploadTracker{p: UploadProgress{
+		Bucket:  bucket,
+		Object:  object,
+		Total:   length,
+		Started: time.Now().UTC(),
+	}, tt: mfs.trackTransfer(Upload, bucket, object, length), uploaded: &mfs.stats.BytesUploaded}
+
+	mfs.uploadsM.Lock()
+	defer mfs.uploadsM.Unlock()
+
+	mfs.uploads[bucket+"/"+object] = t
+	return t
+}
+
+// uploadProgress returns the running and recently finished uploads, the
+// oldest first.
+func (mfs *MinFS) uploadProgress() []UploadProgress {
+	mfs.uploadsM.Lock()
+	defer mfs.uploadsM.Unlock()
+
+	var uploads []UploadProgress
+	for k, t := range mfs.uploads {
+		p := t.progress()
+		if !p.Finished.IsZero() && time.Since(p.Finished) > progressRetention {
+			delete(mfs.uploads, k)
+			continue
+		}
+		uploads = append(uploads, p)
+	}
+
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].Started.Before(uploads[j].Started)
+	})
+	return uploads
+}
+
+// uploadProgressXattr returns the percentage sent of the running or last
+// upload of the file.
+func (f *File) uploadProgressXattr(ctx context.Context) ([]byte, error) {
+	f.mfs.uploadsM.Lock()
+	t, ok := f.mfs.uploads[f.BucketName()+"/"+f.RemotePath()]
+	f.mfs.uploadsM.Unlock()
+	if !ok {
+		return nil, fuse.ErrNoXattr
+	}
+
+	return []byte(fmt.Sprintf("%.1f", t.progress().Percent())), nil
+}
@@ -0,0 +1,294 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"unicode"
+
+	"github.com/minio/minio-go/v6/pkg/credentials"
+)
+
+// reloadable are the settings applied by reloads, by the name of their
+// field in Config. Changes of the other settings need a remount.
+var reloadable = map[string]func(dst, src *Config){
+	"logLevel":        func(dst, src *Config) { dst.logLevel = src.logLevel },
+	"logFormat":       func(dst, src *Config) { dst.logFormat = src.logFormat },
+	"logTarget":       func(dst, src *Config) { dst.logTarget = src.logTarget },
+	"logMaxSize":      func(dst, src *Config) { dst.logMaxSize = src.logMaxSize },
+	"metaTimeout":     func(dst, src *Config) { dst.metaTimeout = src.metaTimeout },
+	"dataIdleTimeout": func(dst, src *Config) { dst.dataIdleTimeout = src.dataIdleTimeout },
+	"hard":            func(dst, src *Config) { dst.hard = src.hard },
+	"intr":            func(dst, src *Config) { dst.intr = src.intr },
+	"retryTimeout":    func(dst, src *Config) { dst.retryTimeout = src.retryTimeout },
+	"lockWarn":        func(dst, src *Config) { dst.lockWarn = src.lockWarn },
+	"lockTimeout":     func(dst, src *Config) { dst.lockTimeout = src.lockTimeout },
+	"shutdownTimeout": func(dst, src *Config) { dst.shutdownTimeout = src.shutdownTimeout },
+	"dirTTL":          func(dst, src *Config) { dst.dirTTL = src.dirTTL },
+	"presignExpiry":   func(dst, src *Config) { dst.presignExpiry = src.presignExpiry },
+	"uploadRetries":   func(dst, src *Config) { dst.uploadRetries = src.uploadRetries },
+	"uploadWorkers":   func(dst, src *Config) { dst.uploadWorkers = src.uploadWorkers },
+	"smallUpload":     func(dst, src *Config) { dst.smallUpload = src.smallUpload },
+	"resyncRate":      func(dst, src *Config) { dst.resyncRate = src.resyncRate },
+	"accessKey":       func(dst, src *Config) { dst.accessKey = src.accessKey },
+	"secretKey":       func(dst, src *Config) { dst.secretKey = src.secretKey },
+	"secretToken":     func(dst, src *Config) { dst.secretToken = src.secretToken },
+	"credentialSource": func(dst, src *Config) {
+		dst.credentialSource, dst.sourced = src.credentialSource, nil
+	},
+}
+
+// notReloaded are the fields of Config which aren't settings of the config
+// file, or differ on every load.
+var notReloaded = map[string]bool{
+	"accountID": true,
+	"targetErr": true,
+	"notifier":  true,
+	"reload":    true,
+	"sourced":   true,
+	"readyFD":   true,
+}
+
+// optionNames are the mount options of fields not named like them.
+var optionNames = map[string]string{
+	"ca_bundle":        "cabundle",
+	"verifyUploads":    "no-verify-upload",
+	"openCheck":        "no-open-check",
+	"dirMarkers":       "no-dir-markers",
+	"credentialSource": "credentials",
+}
+
+// optionName returns the mount option of the Config field name, e.g.
+// dir-ttl for dirTTL.
+func optionName(field string) string {
+	if name, ok := optionNames[field]; ok {
+		return name
+	}
+
+	var b strings.Builder
+	runes := []rune(field)
+	for i, r := range runes {
+		// an upper case letter starts a word, unless it continues an
+		// acronym
+		if unicode.IsUpper(r) && i > 0 && (!unicode.IsUpper(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			b.WriteByte('-')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// cfg returns the current config. It's replaced as a whole on reloads, an
+// operation reading several settings should read them from one cfg.
+func (mfs *MinFS) cfg() *Config {
+	return mfs.live.Load().(*Config)
+}
+
+// diffConfig returns the fields of Config which differ in a and b.
+func diffConfig(a, b *Config) []string {
+	var (
+		changed []string
+		va      = reflect.ValueOf(a).Elem()
+		vb      = reflect.ValueOf(b).Elem()
+	)
+	for i := 0; i < va.NumField(); i++ {
+		name := va.Type().Field(i).Name
+		if notReloaded[name] {
+			continue
+		}
+		// the fields are unexported, fmt prints their values without
+		// calling their methods
+		if fmt.Sprint(va.Field(i)) != fmt.Sprint(vb.Field(i)) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// ReloadConfig loads the config again and applies the changes of the
+// settings which can change while mounted. The other changes are logged
+// and ignored until the next mount.
+func (mfs *MinFS) ReloadConfig() error {
+	if mfs.config.reload == nil {
+		return errors.New("Reloading isn't configured for this mount")
+	}
+
+	mfs.reloadM.Lock()
+	defer mfs.reloadM.Unlock()
+
+	options, err := mfs.config.reload()
+	if err != nil {
+		return err
+	}
+	loaded, err := newConfig(options)
+	if err != nil {
+		return err
+	}
+
+	var (
+		cur              = mfs.cfg()
+		next             = *cur
+		applied, ignored []string
+	)
+	for _, field := range diffConfig(cur, loaded) {
+		apply, ok := reloadable[field]
+		if !ok {
+			ignored = append(ignored, optionName(field))
+			continue
+		}
+		apply(&next, loaded)
+		applied = append(applied, optionName(field))
+	}
+
+	if len(ignored) > 0 {
+		mfs.log.Warn("Changed options need a remount, ignored", F("options", strings.Join(ignored, ",")))
+	}
+	if len(applied) == 0 {
+		mfs.log.Info("Config reloaded, no changes")
+		return nil
+	}
+
+	// open the new log sink before anything changes, a failure leaves
+	// the config as it is
+	var sink logSink
+	if next.logTarget != cur.logTarget || next.logMaxSize != cur.logMaxSize {
+		if sink, err = openLogSink(next.logTarget, next.logMaxSize); err != nil {
+			return err
+		}
+	}
+
+	// operations see either the old or the new settings, never a mix
+	mfs.live.Store(&next)
+
+	mfs.applyLogLevel(cur.logLevel, next.logLevel)
+	mfs.log.setFormat(next.logFormat, mfs.scrubber())
+	if sink != nil {
+		if err = mfs.log.setSink(sink).Close(); err != nil {
+			mfs.log.Warn("Unable to close the previous log sink", F("error", err))
+		}
+	}
+
+	if next.uploadWorkers != cur.uploadWorkers {
+		if err = mfs.SetUploadWorkers(next.uploadWorkers); err != nil {
+			mfs.log.Error("Unable to change the upload workers", F("error", err))
+		}
+	}
+
+	if next.accessKey != cur.accessKey || next.secretKey != cur.secretKey || next.secretToken != cur.secretToken || next.credentialSource != cur.credentialSource {
+		mfs.log.Info("Credentials rotated, requests are signed with the new ones")
+	}
+
+	mfs.log.Info("Config reloaded", F("options", strings.Join(applied, ",")))
+	return nil
+}
+
+// SetLogLevel changes the level of the log entries written until the
+// config is reloaded, see LogLevel.
+func (mfs *MinFS) SetLogLevel(name string) error {
+	if _, err := parseLevel(name); err != nil {
+		return err
+	}
+
+	mfs.reloadM.Lock()
+	defer mfs.reloadM.Unlock()
+
+	cur := mfs.cfg()
+	next := *cur
+	next.logLevel = name
+	mfs.live.Store(&next)
+
+	mfs.applyLogLevel(cur.logLevel, name)
+	mfs.log.Info("Log level changed", F("level", name))
+	return nil
+}
+
+// applyLogLevel changes the level of the logger from prev to name. The S3
+// wire trace is on at the trace level.
+func (mfs *MinFS) applyLogLevel(prev, name string) {
+	level, _ := parseLevel(name)
+	mfs.log.setLevel(level)
+
+	if (prev == LevelTrace.String()) != (level == LevelTrace) && mfs.api != nil {
+		mfs.SetWireTrace(level == LevelTrace)
+	}
+}
+
+// startReload reloads the config on SIGHUP until the listener is done.
+func (mfs *MinFS) startReload() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(sigCh)
+
+		for {
+			select {
+			case <-mfs.listenerDoneCh:
+				return
+			case <-sigCh:
+				if err := mfs.ReloadConfig(); err != nil {
+					mfs.log.Error("Unable to reload the config, keeping the current one", F("error", err))
+				}
+			}
+		}
+	}()
+}
+
+// liveCredentials provides the current credentials of the mount to the
+// client, rotated credentials are used from the next request on.
+type liveCredentials struct {
+	mfs  *MinFS
+	used *Config
+}
+
+// Retrieve returns the credentials of the current config, or of its
+// credential source.
+func (c *liveCredentials) Retrieve() (credentials.Value, error) {
+	cfg := c.mfs.cfg()
+	accessKey, secretKey, secretToken := cfg.accessKey, cfg.secretKey, cfg.secretToken
+	if cfg.credentialSource != "" {
+		var err error
+		if cfg, err = c.mfs.sourcedCredentials(cfg); err != nil {
+			return credentials.Value{}, err
+		}
+		accessKey, secretKey, secretToken = cfg.sourced.accessKey, cfg.sourced.secretKey, cfg.sourced.secretToken
+	}
+
+	c.used = cfg
+	if accessKey == "" || secretKey == "" {
+		// anonymous requests, like the static credentials
+		return credentials.Value{SignerType: credentials.SignatureAnonymous}, nil
+	}
+	return credentials.Value{
+		AccessKeyID:     accessKey.reveal(),
+		SecretAccessKey: secretKey.reveal(),
+		SessionToken:    secretToken.reveal(),
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+// IsExpired returns true once the config was reloaded, or the credentials
+// of the credential source are about to expire.
+func (c *liveCredentials) IsExpired() bool {
+	return c.used != c.mfs.cfg() || c.used.sourced != nil && c.used.sourced.stale()
+}
@@ -0,0 +1,113 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"path"
+	"sync"
+)
+
+// removeBatchSize is the number of keys per multi-object delete request.
+const removeBatchSize = 1000
+
+// removeGroup batches the removals of the objects of a directory, like the
+// unlinks of rm -r. The first removal of a directory is sent right away,
+// the removals arriving while it's in flight join the next batch, which is
+// sent as multi-object deletes once it's done.
+type removeGroup struct {
+	m      sync.Mutex
+	queues map[string]*removeQueue
+}
+
+// removeQueue is the batch of a directory in flight and the next one.
+type removeQueue struct {
+	next *removeBatch
+}
+
+// removeBatch is a batch of keys of a bucket, done is closed once they
+// were removed, failed has the errors of the keys which weren't.
+type removeBatch struct {
+	bucket string
+	keys   []string
+	done   chan struct{}
+	failed map[string]error
+}
+
+// removeObject removes the object key of bucket, batched with concurrent
+// removals of the same directory.
+func (mfs *MinFS) removeObject(bucket, key string) error {
+	g := &mfs.removals
+	id := bucket + "/" + path.Dir(key)
+
+	g.m.Lock()
+	if g.queues == nil {
+		g.queues = map[string]*removeQueue{}
+	}
+	q, busy := g.queues[id]
+	if !busy {
+		q = &removeQueue{}
+		g.queues[id] = q
+	}
+	if q.next == nil {
+		q.next = &removeBatch{bucket: bucket, done: make(chan struct{})}
+	}
+	b := q.next
+	b.keys = append(b.keys, key)
+	if !busy {
+		q.next = nil
+		go mfs.runRemovals(id, q, b)
+	}
+	g.m.Unlock()
+
+	<-b.done
+	return b.failed[key]
+}
+
+// runRemovals removes the keys of b, and then those of the batches queued
+// for the directory meanwhile.
+func (mfs *MinFS) runRemovals(id string, q *removeQueue, b *removeBatch) {
+	g := &mfs.removals
+	for {
+		b.failed = map[string]error{}
+		for i := 0; i < len(b.keys); i += removeBatchSize {
+			end := i + removeBatchSize
+			if end > len(b.keys) {
+				end = len(b.keys)
+			}
+			chunk := b.keys[i:end]
+			if len(chunk) == 1 {
+				if err := mfs.api.RemoveObject(b.bucket, chunk[0]); err != nil {
+					b.failed[chunk[0]] = err
+				}
+				continue
+			}
+			for key, err := range mfs.removeObjects(mfs.opsCtx, b.bucket, chunk) {
+				b.failed[key] = err
+			}
+		}
+		close(b.done)
+
+		g.m.Lock()
+		if b = q.next; b == nil {
+			delete(g.queues, id)
+			g.m.Unlock()
+			return
+		}
+		q.next = nil
+		g.m.Unlock()
+	}
+}
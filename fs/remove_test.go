@@ -0,0 +1,120 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// TestRmdirNotEmpty removes directories with children, listed or not, and
+// children only known to the meta DB, none of them is removed.
+func TestRmdirNotEmpty(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	for _, key := range []string{"listed/", "listed/file", "nested/sub/file", "unlisted/", "unlisted/child"} {
+		s3.put(testBucket, key, []byte{})
+	}
+
+	m := newTestMount(t, s3, t.TempDir())
+	m.dirents("listed")
+	if err := m.mkdir("local"); err != nil {
+		t.Fatal(err)
+	}
+	m.writeFile("local/file", []byte("file"))
+
+	// the file is gone from the remote, the meta DB still has it
+	s3.remove(testBucket, "local/file")
+	before := s3.keys(testBucket)
+
+	for _, name := range []string{"listed", "nested", "unlisted", "local"} {
+		if err := m.remove(name, true); err != fuse.Errno(syscall.ENOTEMPTY) {
+			t.Errorf("expected rmdir %s to fail with ENOTEMPTY, got %v", name, err)
+		}
+		if _, err := m.lookup(name); err != nil {
+			t.Errorf("expected %s to stay, got %v", name, err)
+		}
+	}
+	if after := s3.keys(testBucket); !reflect.DeepEqual(after, before) {
+		t.Errorf("expected the objects %v to stay, got %v", before, after)
+	}
+
+	// once the children are removed the marker goes too
+	if err := m.remove("listed/file", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.remove("listed", true); err != nil {
+		t.Fatalf("expected the empty directory to be removed, got %v", err)
+	}
+	if _, ok := s3.get(testBucket, "listed/"); ok {
+		t.Errorf("expected the marker of the removed directory to be gone")
+	}
+}
+
+// TestRemoveBatched removes the files of a directory concurrently, the
+// removals arriving while others are in flight are sent together.
+func TestRemoveBatched(t *testing.T) {
+	const (
+		files   = 200
+		workers = 16
+	)
+
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	for i := 0; i < files; i++ {
+		s3.put(testBucket, fmt.Sprintf("dir/file-%03d", i), []byte("file"))
+	}
+	s3.put(testBucket, "other", []byte("other"))
+
+	m := newTestMount(t, s3, t.TempDir())
+	m.dirents("dir")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, files)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < files; i += workers {
+				if err := m.remove(fmt.Sprintf("dir/file-%03d", i), false); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("expected the removal to succeed, got %v", err)
+	}
+
+	if keys := s3.keys(testBucket); !reflect.DeepEqual(keys, []string{"other"}) {
+		t.Errorf("expected the files to be removed, got %v", keys)
+	}
+	if got := m.dirents("dir"); got != nil {
+		t.Errorf("expected the directory to be empty, got %v", got)
+	}
+	deletes, batches := s3.count("DeleteObject"), s3.count("RemoveObjects")
+	if batches == 0 || deletes+batches >= files {
+		t.Errorf("expected the removals to be batched, got %d deletes and %d multi-object deletes", deletes, batches)
+	}
+}
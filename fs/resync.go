@@ -0,0 +1,401 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v6"
+)
+
+// defaultResyncRate is the default number of listing requests per second
+// of a resync pass.
+const defaultResyncRate = 5
+
+// errResyncStopped is returned by a resync pass interrupted by unmount.
+var errResyncStopped = errors.New("Resync stopped")
+
+// resyncStats summarizes the changes of a resync pass.
+type resyncStats struct {
+	Dirs    int
+	Added   int
+	Updated int
+	Removed int
+}
+
+// startResync reconciles the meta DB with the remote listing every
+// resync interval, until unmount.
+func (mfs *MinFS) startResync() {
+	if mfs.config.resyncInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(mfs.config.resyncInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-mfs.listenerDoneCh:
+				return
+			case <-ticker.C:
+			}
+
+			stats, err := mfs.resync()
+			if err == errResyncStopped {
+				return
+			} else if err != nil {
+				mfs.log.Println("Resync failed:", err)
+				continue
+			}
+			mfs.log.Printf("Resynced %d directories: %d added, %d updated, %d removed.\n", stats.Dirs, stats.Added, stats.Updated, stats.Removed)
+		}
+	}()
+}
+
+// resync walks the directories listed before and reconciles their entries
+// with the remote listing. Directories never listed are left alone, they
+// are listed on first access.
+func (mfs *MinFS) resync() (resyncStats, error) {
+	var stats resyncStats
+
+	limiter := time.NewTicker(time.Second / time.Duration(mfs.cfg().resyncRate))
+	defer limiter.Stop()
+
+	root, _ := mfs.Root()
+
+	var queue []*Dir
+	if dir := root.(*Dir); dir.isBucketRoot() {
+		// the buckets themselves are listed on access of the root
+		subdirs, err := mfs.listedSubdirs(dir)
+		if err != nil {
+			return stats, err
+		}
+		queue = subdirs
+	} else {
+		queue = []*Dir{dir}
+	}
+
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+
+		if err := mfs.resyncDir(dir, limiter.C, &stats); err != nil {
+			return stats, err
+		}
+		stats.Dirs++
+
+		subdirs, err := mfs.listedSubdirs(dir)
+		if err != nil {
+			return stats, err
+		}
+		queue = append(queue, subdirs...)
+	}
+
+	return stats, nil
+}
+
+// listedSubdirs returns the subdirectories of dir with a remote listing.
+func (mfs *MinFS) listedSubdirs(dir *Dir) ([]*Dir, error) {
+	var subdirs []*Dir
+	err := mfs.db.View(func(tx *meta.Tx) error {
+		b := dir.readBucket(tx)
+		return b.ForEach(func(k string, o interface{}) error {
+			d, ok := o.(Dir)
+			if !ok {
+				return nil
+			}
+
+			var state listing
+			if err := b.Bucket(k+"/").GetMeta("listing", &state); err != nil {
+				return nil
+			}
+
+			d.dir, d.mfs = dir, mfs
+			subdirs = append(subdirs, &d)
+			return nil
+		})
+	})
+	return subdirs, err
+}
+
+// dirtyPaths returns the paths of the files with unflushed writes.
+func (mfs *MinFS) dirtyPaths() map[string]bool {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	dirty := map[string]bool{}
+	for _, h := range mfs.handles {
+		if h != nil && h.dirty && h.unlinked == nil {
+			dirty[h.f.FullPath()] = true
+		}
+	}
+	return dirty
+}
+
+// resyncDir reconciles the entries of dir with all pages of its remote
+// listing, waiting for limiter before each request. Entries missing on the
+// remote are removed, unless they are newer locally.
+func (mfs *MinFS) resyncDir(dir *Dir, limiter <-chan time.Time, stats *resyncStats) error {
+	prefix := dir.RemotePath()
+	if prefix != "" {
+		prefix = prefix + "/"
+	}
+
+	started := time.Now().UTC()
+	seen := map[string]bool{}
+
+	// entries to invalidate and stale cache files, after commit
+	var (
+		invalidate []string
+		stale      []string
+	)
+
+	token := ""
+	for {
+		select {
+		case <-mfs.listenerDoneCh:
+			return errResyncStopped
+		case <-limiter:
+		}
+
+		page, err := mfs.listObjectsPage(dir.BucketName(), prefix, token, listPageSize)
+		if err != nil {
+			return err
+		}
+
+		dirty := mfs.dirtyPaths()
+		if err = mfs.db.Update(func(tx *meta.Tx) error {
+			b := dir.bucket(tx)
+
+			for _, objInfo := range page.Contents {
+				baseKey := objInfo.Key[len(prefix):]
+				if baseKey == "" {
+					continue
+				}
+
+				if name, ok := dirMarker(baseKey); ok {
+					seen[name] = true
+					added, err := mfs.resyncDirEntry(dir, b, tx, name, objInfo)
+					if err != nil {
+						return err
+					}
+					if added {
+						stats.Added++
+						invalidate = append(invalidate, name)
+					}
+					continue
+				}
+
+				seen[baseKey] = true
+				changed, cachePath, err := mfs.resyncFileEntry(dir, b, tx, baseKey, objInfo, dirty, stats)
+				if err != nil {
+					return err
+				}
+				if changed {
+					invalidate = append(invalidate, baseKey)
+				}
+				if cachePath != "" {
+					stale = append(stale, cachePath)
+				}
+			}
+
+			for _, commonPrefix := range page.CommonPrefixes {
+				name := strings.TrimSuffix(commonPrefix.Prefix[len(prefix):], "/")
+				seen[name] = true
+				added, err := mfs.resyncDirEntry(dir, b, tx, name, minio.ObjectInfo{Key: commonPrefix.Prefix})
+				if err != nil {
+					return err
+				}
+				if added {
+					stats.Added++
+					invalidate = append(invalidate, name)
+				}
+			}
+
+			if page.IsTruncated {
+				return nil
+			}
+
+			removed, cachePaths, err := mfs.resyncRemoved(dir, b, tx, seen, dirty, started)
+			if err != nil {
+				return err
+			}
+			stats.Removed += len(removed)
+			invalidate = append(invalidate, removed...)
+			stale = append(stale, cachePaths...)
+
+			return b.PutMeta("listing", listing{
+				Complete: true,
+				Time:     time.Now().UTC(),
+			})
+		}); err != nil {
+			return err
+		}
+
+		if !page.IsTruncated {
+			break
+		}
+		token = page.Next
+	}
+
+	for _, cachePath := range stale {
+		mfs.removeCacheFile(cachePath, evictRemoteChanged)
+	}
+	for _, name := range invalidate {
+		mfs.invalidateEntry(dir.FullPath(), name)
+	}
+	return nil
+}
+
+// resyncDirEntry adds the directory name if it's new.
+func (mfs *MinFS) resyncDirEntry(dir *Dir, b *meta.Bucket, tx *meta.Tx, name string, objInfo minio.ObjectInfo) (bool, error) {
+	if mfs.shadowed(tx, path.Join(dir.FullPath(), name)) {
+		return false, nil
+	}
+
+	var o interface{}
+	if err := b.Get(name, &o); err == nil {
+		return false, nil
+	} else if !isNotFound(err) {
+		return false, err
+	}
+	return true, dir.storeDir(b, tx, name, objInfo)
+}
+
+// resyncFileEntry adds the file name if it's new, or updates its attributes
+// when the ETag changed and the file isn't dirty locally. The stale cache
+// file of an updated file is returned.
+func (mfs *MinFS) resyncFileEntry(dir *Dir, b *meta.Bucket, tx *meta.Tx, name string, objInfo minio.ObjectInfo, dirty map[string]bool, stats *resyncStats) (bool, string, error) {
+	if mfs.shadowed(tx, path.Join(dir.FullPath(), name)) {
+		return false, "", nil
+	}
+
+	var o interface{}
+	err := b.Get(name, &o)
+	if isNotFound(err) {
+		stats.Added++
+		return true, "", dir.storeFile(b, tx, name, objInfo)
+	} else if err != nil {
+		return false, "", err
+	}
+
+	f, ok := o.(File)
+	if !ok || strings.EqualFold(f.ETag, objInfo.ETag) {
+		return false, "", nil
+	}
+
+	f.dir, f.mfs = dir, mfs
+	fullPath := f.FullPath()
+	if _, pending := mfs.pendingTx(tx, fullPath); pending || dirty[fullPath] {
+		return false, "", nil
+	}
+
+	cachePath := f.CachePath
+	f.Size = uint64(objInfo.Size)
+	f.ETag = objInfo.ETag
+	f.LastModified = objInfo.LastModified
+	f.Mtime = objInfo.LastModified
+	f.Chgtime = objInfo.LastModified
+	f.StatETag = ""
+	f.CachePath = ""
+	f.CacheETag = ""
+
+	stats.Updated++
+	return true, cachePath, b.Put(name, &f)
+}
+
+// resyncRemoved removes the entries of dir not seen in the listing. Files
+// dirty locally, waiting for an upload or changed after the listing
+// started are kept.
+func (mfs *MinFS) resyncRemoved(dir *Dir, b *meta.Bucket, tx *meta.Tx, seen, dirty map[string]bool, started time.Time) ([]string, []string, error) {
+	var (
+		removed    []string
+		cachePaths []string
+	)
+
+	if err := b.ForEach(func(k string, o interface{}) error {
+		if seen[k] {
+			return nil
+		}
+
+		if f, ok := o.(File); ok {
+			f.dir, f.mfs = dir, mfs
+			fullPath := f.FullPath()
+			if _, pending := mfs.pendingTx(tx, fullPath); pending || dirty[fullPath] || f.Mtime.After(started) || mfs.shadowed(tx, fullPath) {
+				return nil
+			}
+			if f.CachePath != "" {
+				cachePaths = append(cachePaths, f.CachePath)
+			}
+		} else if d, ok := o.(Dir); ok {
+			d.dir, d.mfs = dir, mfs
+			if d.Mtime.After(started) || mfs.hasLocalChanges(tx, d.FullPath(), dirty) {
+				// created locally, the files may not be uploaded yet
+				return nil
+			}
+		}
+
+		removed = append(removed, k)
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	for _, k := range removed {
+		if err := b.Delete(k); err != nil {
+			return nil, nil, err
+		}
+		b.DeleteBucket(k + "/")
+		if err := mfs.releaseInode(tx, path.Join(dir.FullPath(), k)); err != nil {
+			return nil, nil, err
+		}
+	}
+	return removed, cachePaths, nil
+}
+
+// hasLocalChanges returns true if a file below dirPath is dirty, waiting
+// for an upload or changed locally on a scratch mount.
+func (mfs *MinFS) hasLocalChanges(tx *meta.Tx, dirPath string, dirty map[string]bool) bool {
+	prefix := dirPath + "/"
+	for p := range dirty {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+
+	found := false
+	tx.Bucket(pendingBucket).ForEach(func(k string, o interface{}) error {
+		if strings.HasPrefix(k, prefix) {
+			found = true
+		}
+		return nil
+	})
+	if mfs.config.scratch {
+		tx.Bucket(scratchBucket).ForEach(func(k string, o interface{}) error {
+			if strings.HasPrefix(k, prefix) {
+				found = true
+			}
+			return nil
+		})
+	}
+	return found
+}
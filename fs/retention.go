@@ -0,0 +1,155 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package minfs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"bazil.org/fuse"
+	minio "github.com/minio/minio-go/v6"
+)
+
+const (
+	// retentionTTL is how long the retention status of an object is cached.
+	retentionTTL = time.Minute
+
+	// ufImmutable is the chflags(2) flag of immutable files.
+	ufImmutable = 0x00000002
+)
+
+// bucketObjectLock returns true if object lock is enabled on the bucket.
+func (mfs *MinFS) bucketObjectLock(bucket string) bool {
+	mfs.m.Lock()
+	enabled, ok := mfs.objectLock[bucket]
+	mfs.m.Unlock()
+
+	if ok {
+		return enabled
+	}
+
+	status, _, _, _, err := mfs.api.GetObjectLockConfig(bucket)
+	enabled = err == nil && status == "Enabled"
+
+	mfs.m.Lock()
+	mfs.objectLock[bucket] = enabled
+	mfs.m.Unlock()
+
+	return enabled
+}
+
+// retained returns true while a legal hold or retention period prevents
+// modifying the object, based on the cached retention status.
+func (f *File) retained() bool {
+	if f.LegalHold {
+		return true
+	}
+
+	if !minio.RetentionMode(f.RetentionMode).IsValid() {
+		return false
+	}
+
+	return f.RetainUntil.After(time.Now())
+}
+
+// flags returns the chflags(2) flags of the file.
+func (f *File) flags() uint32 {
+	if f.retained() {
+		return f.Flags | ufImmutable
+	}
+	return f.Flags
+}
+
+// refreshRetention updates the cached retention status of the object if
+// it is older than retentionTTL. Callers persist the status with store.
+func (f *File) refreshRetention() error {
+	if time.Since(f.RetentionChecked) < retentionTTL {
+		return nil
+	}
+
+	if !f.mfs.bucketObjectLock(f.BucketName()) {
+		return nil
+	}
+
+	mode, until, err := f.mfs.api.GetObjectRetention(f.BucketName(), f.RemotePath(), "")
+	if err != nil && !noObjectLock(err) {
+		return err
+	}
+
+	f.RetentionMode = ""
+	f.RetainUntil = time.Time{}
+	if mode != nil {
+		f.RetentionMode = string(*mode)
+	}
+	if until != nil {
+		f.RetainUntil = *until
+	}
+
+	status, err := f.mfs.api.GetObjectLegalHold(f.BucketName(), f.RemotePath(), minio.GetObjectLegalHoldOptions{})
+	if err != nil && !noObjectLock(err) {
+		return err
+	}
+
+	f.LegalHold = status != nil && *status == minio.LegalHoldEnabled
+	f.RetentionChecked = time.Now()
+	return nil
+}
+
+// checkRetention returns EPERM if the object can't be modified.
+func (f *File) checkRetention() error {
+	// the content of local-only files isn't the object
+	if f.LocalOnly {
+		return nil
+	}
+
+	if err := f.refreshRetention(); err != nil {
+		return err
+	}
+
+	if f.retained() {
+		return fuse.EPERM
+	}
+
+	return nil
+}
+
+// noObjectLock returns true if the error indicates the object has no
+// retention or legal hold, or doesn't exist on the remote yet.
+func noObjectLock(err error) bool {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchObjectLockConfiguration", "NoSuchKey":
+		return true
+	}
+	return false
+}
+
+// retentionXattr describes the active legal hold or retention.
+func (f *File) retentionXattr(ctx context.Context) ([]byte, error) {
+	if err := f.refreshRetention(); err != nil {
+		return nil, err
+	}
+
+	if f.LegalHold {
+		return []byte("legal-hold"), nil
+	}
+
+	if f.retained() {
+		return []byte(fmt.Sprintf("%s until %s", f.RetentionMode, f.RetainUntil.UTC().Format(time.RFC3339))), nil
+	}
+
+	return nil, fuse.ErrNoXattr
+}
@@ -0,0 +1,386 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultUploadWorkers is the number of operations run concurrently.
+	defaultUploadWorkers = 4
+
+	// reservedWorkers is the number of workers only running small
+	// operations, so these aren't stuck behind huge uploads. A pool of a
+	// single worker has none.
+	reservedWorkers = 1
+
+	// defaultSmallUpload is the size up to which uploads are small.
+	defaultSmallUpload = 16 * 1024 * 1024
+)
+
+// queuedOp is an operation waiting for a worker, key is set for
+// uploads, only one upload of an object runs at a time.
+type queuedOp struct {
+	req    interface{}
+	queued time.Time
+	key    string
+}
+
+// putKey returns the key of uploads of the object.
+func putKey(req *PutOperation) string {
+	return req.Bucket + "/" + req.Target
+}
+
+// syncQueue schedules the operations on two lanes: small operations are
+// run by all workers, the reserved ones included, large uploads only by
+// the others. The other workers pick the operation queued first of both
+// lanes, so neither lane starves.
+type syncQueue struct {
+	m    sync.Mutex
+	cond *sync.Cond
+
+	small, large []queuedOp
+	running      int
+
+	// general is the number of workers running operations of both lanes,
+	// retire the number of these still to stop after shrinking the pool.
+	general int
+	retire  int
+
+	// reservedN is the number of reserved workers.
+	reservedN int
+
+	// uploads being run, by object
+	inflight map[string]*PutOperation
+}
+
+func newSyncQueue() *syncQueue {
+	q := &syncQueue{inflight: map[string]*PutOperation{}}
+	q.cond = sync.NewCond(&q.m)
+	return q
+}
+
+// push queues req on the small or large lane. An upload of an object
+// which is still queued takes over the payload of req, which gets the
+// result of that upload. An upload being run is marked superseded.
+func (q *syncQueue) push(req interface{}, small bool) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	op := queuedOp{req: req, queued: time.Now()}
+	if put, ok := req.(*PutOperation); ok {
+		op.key = putKey(put)
+		if queued := q.queuedPut(op.key); queued != nil {
+			queued.Source = put.Source
+			queued.Length = put.Length
+			queued.merged = append(queued.merged, put)
+			return
+		}
+		if running, ok := q.inflight[op.key]; ok {
+			running.Superseded = true
+		}
+	}
+
+	if small {
+		q.small = append(q.small, op)
+	} else {
+		q.large = append(q.large, op)
+	}
+	q.cond.Broadcast()
+}
+
+// queuedPut returns the queued upload with key, q.m must be held.
+func (q *syncQueue) queuedPut(key string) *PutOperation {
+	for _, lane := range [][]queuedOp{q.small, q.large} {
+		for _, op := range lane {
+			if op.key == key {
+				return op.req.(*PutOperation)
+			}
+		}
+	}
+	return nil
+}
+
+// next returns the index of the first operation of lane which may run,
+// -1 if there is none.
+func (q *syncQueue) next(lane []queuedOp) int {
+	for i, op := range lane {
+		if _, ok := q.inflight[op.key]; op.key == "" || !ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// pop blocks until an operation is queued the worker may run, it returns
+// nil when the worker is to stop.
+func (q *syncQueue) pop(reserved bool) interface{} {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	for {
+		small, large := q.next(q.small), -1
+		if !reserved {
+			large = q.next(q.large)
+		}
+
+		var op queuedOp
+		switch {
+		case small >= 0 && (large < 0 || !q.large[large].queued.Before(q.small[small].queued)):
+			op = q.small[small]
+			q.small = append(q.small[:small], q.small[small+1:]...)
+		case large >= 0:
+			op = q.large[large]
+			q.large = append(q.large[:large], q.large[large+1:]...)
+		default:
+			if !reserved && q.retire > 0 {
+				q.retire--
+				return nil
+			}
+			q.cond.Wait()
+			continue
+		}
+
+		if op.key != "" {
+			q.inflight[op.key] = op.req.(*PutOperation)
+		}
+		q.running++
+		return op.req
+	}
+}
+
+// done records the end of an operation returned by pop.
+func (q *syncQueue) done(req interface{}) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if put, ok := req.(*PutOperation); ok && q.inflight[putKey(put)] == put {
+		delete(q.inflight, putKey(put))
+	}
+	q.running--
+	q.cond.Broadcast()
+}
+
+// finishPut returns the requests waiting for the result of the upload,
+// marked superseded if another upload of the object was queued meanwhile,
+// and whether the file was removed while uploading.
+func (q *syncQueue) finishPut(req *PutOperation) ([]*PutOperation, bool) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	waiters := append([]*PutOperation{req}, req.merged...)
+	for _, w := range waiters {
+		w.Superseded = req.Superseded
+	}
+	return waiters, req.removed
+}
+
+// cancel drops the queued upload of the object and marks the running one
+// to be followed by a removal. The waiters of the dropped upload are
+// returned.
+func (q *syncQueue) cancel(bucket, object string) []*PutOperation {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	key := bucket + "/" + object
+	if running, ok := q.inflight[key]; ok {
+		running.removed = true
+	}
+
+	for _, lane := range []*[]queuedOp{&q.small, &q.large} {
+		for i, op := range *lane {
+			if op.key != key {
+				continue
+			}
+			*lane = append((*lane)[:i], (*lane)[i+1:]...)
+
+			put := op.req.(*PutOperation)
+			return append([]*PutOperation{put}, put.merged...)
+		}
+	}
+	return nil
+}
+
+// drain blocks until all queued operations have finished.
+func (q *syncQueue) drain() {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	for len(q.small)+len(q.large)+q.running > 0 {
+		q.cond.Wait()
+	}
+}
+
+// resize sets the number of general workers, calling start for each
+// worker to add.
+func (q *syncQueue) resize(general int, start func()) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	current := q.general - q.retire
+	for ; current < general; current++ {
+		if q.retire > 0 {
+			q.retire--
+		} else {
+			q.general++
+			start()
+		}
+	}
+	if current > general {
+		q.retire += current - general
+		q.cond.Broadcast()
+	}
+}
+
+// retired records the stop of a general worker.
+func (q *syncQueue) retired() {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	q.general--
+}
+
+// SyncQueueStats is the composition of the operation queue.
+type SyncQueueStats struct {
+	Small   int
+	Large   int
+	Running int
+	Workers int
+}
+
+// stats returns the composition of the queue.
+func (q *syncQueue) stats() SyncQueueStats {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	return SyncQueueStats{
+		Small:   len(q.small),
+		Large:   len(q.large),
+		Running: q.running,
+		Workers: q.general - q.retire + q.reservedN,
+	}
+}
+
+// reservedCount returns the number of reserved workers of a pool of
+// workers.
+func reservedCount(workers int) int {
+	if workers <= reservedWorkers {
+		return 0
+	}
+	return reservedWorkers
+}
+
+// startSync starts the workers of the operation queue.
+func (mfs *MinFS) startSync() error {
+	workers := mfs.config.uploadWorkers
+
+	mfs.syncQueue.m.Lock()
+	mfs.syncQueue.reservedN = reservedCount(workers)
+	mfs.syncQueue.m.Unlock()
+
+	for i := 0; i < reservedCount(workers); i++ {
+		go mfs.syncWorker(true)
+	}
+	mfs.syncQueue.resize(workers-reservedCount(workers), func() {
+		go mfs.syncWorker(false)
+	})
+	return nil
+}
+
+// SetUploadWorkers changes the number of workers of uploads, copies and
+// moves while mounted. The number of reserved workers for small
+// operations is kept, the pool keeps at least one other worker.
+func (mfs *MinFS) SetUploadWorkers(workers int) error {
+	if workers < 1 {
+		return errors.New("Upload workers must be at least 1")
+	}
+
+	mfs.syncQueue.m.Lock()
+	reserved := mfs.syncQueue.reservedN
+	mfs.syncQueue.m.Unlock()
+
+	general := workers - reserved
+	if general < 1 {
+		general = 1
+	}
+
+	mfs.syncQueue.resize(general, func() {
+		go mfs.syncWorker(false)
+	})
+	if mfs.group != nil {
+		mfs.group.workers.resize(general)
+	}
+	mfs.log.Printf("Running %d upload workers.\n", general+reserved)
+	return nil
+}
+
+// syncWorker runs queued operations, reserved workers only the small ones.
+func (mfs *MinFS) syncWorker(reserved bool) {
+	for {
+		req := mfs.syncQueue.pop(reserved)
+		if req == nil {
+			mfs.syncQueue.retired()
+			return
+		}
+
+		// the general workers of the mounts of a group share its slots
+		shared := !reserved && mfs.group != nil
+		if shared {
+			mfs.group.workers.acquire()
+		}
+
+		switch req := req.(type) {
+		case *MoveOperation:
+			mfs.moveOp(req)
+		case *CopyOperation:
+			mfs.copyOp(req)
+		case *PutOperation:
+			err := mfs.putOp(req)
+			waiters, removed := mfs.syncQueue.finishPut(req)
+			if removed {
+				// uploads queued after the removal run only after
+				// the object is removed again
+				if err == nil {
+					if rerr := mfs.api.RemoveObject(req.Bucket, req.Target); rerr != nil {
+						mfs.log.Printf("Unable to remove %s uploaded after its removal: %s\n", req.Target, rerr)
+					}
+				}
+				err = errUploadCancelled
+			}
+			for _, w := range waiters {
+				w.Error <- err
+			}
+		default:
+			panic("Unknown type")
+		}
+
+		if shared {
+			mfs.group.workers.release()
+		}
+		mfs.syncQueue.done(req)
+	}
+}
+
+// isSmall returns true if req runs on the small lane, only uploads of
+// files larger than the small-upload threshold are large.
+func (mfs *MinFS) isSmall(req interface{}) bool {
+	put, ok := req.(*PutOperation)
+	return !ok || put.Length <= mfs.cfg().smallUpload
+}
@@ -0,0 +1,113 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package minfs
+
+import (
+	"fmt"
+
+	"github.com/minio/minfs/meta"
+)
+
+// schemaVersion is the version of the meta DB layout written by this
+// version of minfs. Meta DBs from before versioning have version 0.
+const schemaVersion = 3
+
+// migrations upgrade the meta DB layout from the version of the key to
+// the next version.
+var migrations = map[int]func(tx *meta.Tx) error{
+	0: migrateV0,
+	1: migrateV1,
+	2: migrateV2,
+}
+
+// migrateV0 adds the buckets of retried uploads, files and directories
+// are binary compatible.
+func migrateV0(tx *meta.Tx) error {
+	_, err := tx.CreateBucketIfNotExists(pendingBucket)
+	return err
+}
+
+// readSchemaVersion returns the schema version of the meta DB, fresh meta
+// DBs return -1.
+func readSchemaVersion(tx *meta.Tx) (int, error) {
+	b := tx.Bucket("minio/")
+	if b.InnerBucket == nil {
+		return -1, nil
+	}
+
+	var version int
+	if err := b.GetMeta("schema", &version); isNotFound(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("Meta DB has a corrupt schema version (%s), remove the cache DB to start with a fresh one", err)
+	}
+	return version, nil
+}
+
+// checkSchemaVersion returns an error if the meta DB at dbPath with the
+// schema version can't be migrated.
+func checkSchemaVersion(version int, dbPath string) error {
+	if version > schemaVersion {
+		return fmt.Errorf("Meta DB has schema version %d, this minfs supports up to %d. Upgrade minfs, or remove %s to start with a fresh DB", version, schemaVersion, dbPath)
+	} else if version < -1 {
+		return fmt.Errorf("Meta DB has an unknown schema version %d, remove %s to start with a fresh DB", version, dbPath)
+	}
+	return nil
+}
+
+// migrateMeta initializes a fresh meta DB, or upgrades an older meta DB to
+// the current schema after backing it up next to dbPath.
+func (mfs *MinFS) migrateMeta(dbPath string) error {
+	var version int
+	if err := mfs.db.View(func(tx *meta.Tx) (err error) {
+		version, err = readSchemaVersion(tx)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if err := checkSchemaVersion(version, dbPath); err != nil {
+		return err
+	}
+
+	if version >= 0 && version < schemaVersion {
+		backupPath := fmt.Sprintf("%s.v%d.bak", dbPath, version)
+		if err := mfs.db.Backup(backupPath); err != nil && err != meta.ErrBackupUnsupported {
+			return fmt.Errorf("Unable to back up the meta DB before migrating: %s", err)
+		}
+		mfs.log.Printf("Migrating meta DB from schema version %d to %d, the original is kept in %s.\n", version, schemaVersion, backupPath)
+	}
+
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		b, err := tx.CreateBucketIfNotExists("minio/")
+		if err != nil {
+			return err
+		}
+
+		// a fresh meta DB is built up by all migrations
+		if version == -1 {
+			version = 0
+		}
+
+		for ; version < schemaVersion; version++ {
+			if err = migrations[version](tx); err != nil {
+				return fmt.Errorf("Unable to migrate the meta DB from schema version %d: %s", version, err)
+			}
+		}
+
+		return b.PutMeta("schema", schemaVersion)
+	})
+}
@@ -0,0 +1,217 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/minio/minfs/meta"
+)
+
+// writeFixture writes a meta DB of the layout of the schema version to
+// the cache dir, with a file a, a directory d and a file d/b. Before
+// version 2 the inodes weren't recorded, d shares the inode of a and d/b
+// has none.
+func writeFixture(t *testing.T, cache string, version int) {
+	t.Helper()
+
+	inodes := map[string]uint64{"a": 5, "d": 5}
+	if version >= 2 {
+		inodes = map[string]uint64{"a": 5, "d": 6, "d/b": 7}
+	}
+
+	db, err := meta.Open(filepath.Join(cache, "cache.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = db.Update(func(tx *meta.Tx) error {
+		root, err := tx.CreateBucketIfNotExists("minio/")
+		if err != nil {
+			return err
+		}
+		if err = root.SetSequence(7); err != nil {
+			return err
+		}
+		if err = root.Put("a", File{Path: "a", Inode: inodes["a"], Size: 1, ETag: "a"}); err != nil {
+			return err
+		}
+		if err = root.Put("d", Dir{Path: "d", Inode: inodes["d"]}); err != nil {
+			return err
+		}
+		d, err := root.CreateBucketIfNotExists("d/")
+		if err != nil {
+			return err
+		}
+		if err = d.Put("b", File{Path: "b", Inode: inodes["d/b"], Size: 1, ETag: "b"}); err != nil {
+			return err
+		}
+
+		// the buckets added by the later versions
+		buckets := []string{pendingBucket, inodeBucket, scratchBucket}
+		for _, name := range buckets[:version] {
+			if _, err = tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if version >= 2 {
+			b := tx.Bucket(inodeBucket)
+			for name, ino := range inodes {
+				if err = b.Put(name, ino); err != nil {
+					return err
+				}
+			}
+		}
+		if version == 0 {
+			return nil
+		}
+		return root.PutMeta("schema", version)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storedSchemaVersion returns the schema version of the meta DB at path.
+func storedSchemaVersion(t *testing.T, path string) int {
+	t.Helper()
+
+	db, err := meta.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var version int
+	if err = db.View(func(tx *meta.Tx) (err error) {
+		version, err = readSchemaVersion(tx)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestMigrateMeta(t *testing.T) {
+	for version := 0; version < schemaVersion; version++ {
+		s3 := newFakeS3(testBucket)
+		s3.put(testBucket, "a", []byte("a"))
+		s3.put(testBucket, "d/b", []byte("b"))
+
+		cache := t.TempDir()
+		writeFixture(t, cache, version)
+
+		m := newTestMount(t, s3, cache)
+
+		// every layout ends up with the buckets and unique inodes
+		if err := m.db.View(func(tx *meta.Tx) error {
+			for _, name := range []string{pendingBucket, inodeBucket, scratchBucket} {
+				if tx.Bucket(name).InnerBucket == nil {
+					t.Errorf("v%d: expected the bucket %s after migrating", version, name)
+				}
+			}
+			v, err := readSchemaVersion(tx)
+			if v != schemaVersion {
+				t.Errorf("v%d: expected schema version %d after migrating, got %d", version, schemaVersion, v)
+			}
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		inodes := map[uint64]string{}
+		for _, name := range []string{"a", "d", "d/b"} {
+			node, err := m.lookup(name)
+			if err != nil {
+				t.Fatalf("v%d: lookup %s: %v", version, name, err)
+			}
+			var ino uint64
+			switch n := node.(type) {
+			case *File:
+				ino = n.Inode
+			case *Dir:
+				ino = n.Inode
+			}
+			if ino == 0 || inodes[ino] != "" {
+				t.Errorf("v%d: expected a unique inode of %s, got %d shared with %q", version, name, ino, inodes[ino])
+			}
+			inodes[ino] = name
+		}
+		if got := m.readFile("d/b"); string(got) != "b" {
+			t.Errorf("v%d: expected to read d/b after migrating, got %q", version, got)
+		}
+		m.stop()
+
+		// the original is backed up, and isn't migrated twice
+		backup := filepath.Join(cache, fmt.Sprintf("cache.db.v%d.bak", version))
+		if v := storedSchemaVersion(t, backup); v != version {
+			t.Errorf("v%d: expected the backup to keep schema version %d, got %d", version, version, v)
+		}
+		m = m.remount()
+		if matches, _ := filepath.Glob(filepath.Join(cache, "*.bak")); len(matches) != 1 {
+			t.Errorf("v%d: expected a single backup, got %v", version, matches)
+		}
+		s3.Close()
+	}
+}
+
+func TestMigrateMetaRefused(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+
+	testCases := []struct {
+		name    string
+		version interface{}
+		err     string
+	}{
+		{"future", schemaVersion + 1, "Upgrade minfs"},
+		{"unknown", -5, "unknown schema version"},
+		{"corrupt", "three", "corrupt schema version"},
+	}
+	for _, testCase := range testCases {
+		cache := t.TempDir()
+		writeFixture(t, cache, 0)
+
+		db, err := meta.Open(filepath.Join(cache, "cache.db"), 0600, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Update(func(tx *meta.Tx) error {
+			return tx.Bucket("minio/").PutMeta("schema", testCase.version)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		_, err = startTestMount(t, s3, cache)
+		if err == nil || !strings.Contains(err.Error(), testCase.err) || !strings.Contains(err.Error(), "fresh") {
+			t.Errorf("%s: expected the mount to fail with %q and suggest a fresh DB, got %v", testCase.name, testCase.err, err)
+		}
+
+		// the meta DB is left alone
+		if matches, _ := filepath.Glob(filepath.Join(cache, "*.bak")); len(matches) != 0 {
+			t.Errorf("%s: expected no backup of a refused meta DB, got %v", testCase.name, matches)
+		}
+		if _, err = os.Stat(filepath.Join(cache, "cache.db")); err != nil {
+			t.Errorf("%s: expected the meta DB to be kept, got %v", testCase.name, err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+)
+
+// scratchBucket is the meta bucket of the local changes of scratch mounts,
+// keyed by the path of the entry in the mount.
+const scratchBucket = "scratch/"
+
+// localOnlyXattr is set on the files of scratch mounts which are written
+// locally, and on the Finder files kept local.
+const localOnlyXattr = "minfs.local-only"
+
+// scratchEntry is a local change of a scratch mount. Files written and
+// directories created locally are local-only, removed entries are
+// whiteouts hiding the remote entry. Listings, notifications and resyncs
+// leave the paths with a local change alone.
+type scratchEntry struct {
+	Whiteout bool
+	Time     time.Time
+}
+
+// migrateV2 adds the bucket of the local changes of scratch mounts.
+func migrateV2(tx *meta.Tx) error {
+	_, err := tx.CreateBucketIfNotExists(scratchBucket)
+	return err
+}
+
+// shadowed returns true if the remote entry at fullPath is replaced or
+// hidden by a local change, by the filter of Finder files, or belongs to
+// an unlinked file which is still open.
+func (mfs *MinFS) shadowed(tx *meta.Tx, fullPath string) bool {
+	if mfs.filtered(fullPath) || mfs.unlinkedPath(fullPath) {
+		return true
+	}
+	if !mfs.config.scratch {
+		return false
+	}
+
+	var e scratchEntry
+	return tx.Bucket(scratchBucket).Get(fullPath, &e) == nil
+}
+
+// markLocal records the entry at fullPath as local-only, replacing a
+// whiteout of the path.
+func (mfs *MinFS) markLocal(tx *meta.Tx, fullPath string) error {
+	return tx.Bucket(scratchBucket).Put(fullPath, &scratchEntry{Time: time.Now().UTC()})
+}
+
+// scratchRemove records the removal of the entry at fullPath, the local
+// changes below it are dropped. With remote set the remote entry is hidden
+// by a whiteout.
+func (mfs *MinFS) scratchRemove(tx *meta.Tx, fullPath string, remote bool) error {
+	b := tx.Bucket(scratchBucket)
+
+	prefix := fullPath + "/"
+	var below []string
+	if err := b.ForEach(func(k string, _ interface{}) error {
+		if strings.HasPrefix(k, prefix) {
+			below = append(below, k)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, k := range below {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	if !remote {
+		return b.Delete(fullPath)
+	}
+	return b.Put(fullPath, &scratchEntry{Whiteout: true, Time: time.Now().UTC()})
+}
+
+// localChanges returns the number of local changes of scratch mounts.
+func (mfs *MinFS) localChanges() (int, error) {
+	n := 0
+	err := mfs.db.View(func(tx *meta.Tx) error {
+		return tx.Bucket(scratchBucket).ForEach(func(string, interface{}) error {
+			n++
+			return nil
+		})
+	})
+	return n, err
+}
+
+// checkScratch returns an error if the meta DB has local changes of a
+// scratch mount and the mount isn't one, which would upload them.
+func (mfs *MinFS) checkScratch() error {
+	if mfs.config.scratch {
+		return nil
+	}
+
+	n, err := mfs.localChanges()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("Cache %s has %d local changes of a scratch mount, mount with scratch to keep them or remove the cache", mfs.config.cache, n)
+	}
+	return nil
+}
+
+// makeLocal makes the file local-only, with content a cache file of the
+// remote object is kept for it. Storing the file is up to the caller.
+func (f *File) makeLocal(content bool) error {
+	if f.LocalOnly {
+		return nil
+	}
+
+	cachePath, err := f.mfs.NewCachePath()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(cachePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if content {
+		if err = f.download(context.Background(), file, false); err != nil {
+			os.Remove(cachePath)
+			return err
+		}
+	}
+
+	if f.CachePath != "" {
+		f.mfs.removeCacheFile(f.CachePath, evictReplaced)
+	}
+	f.CachePath, f.CacheETag, f.LocalOnly = cachePath, "", true
+	return nil
+}
+
+// setLocal makes the cache file at cachePath the content of the file,
+// which is local-only from then on.
+func (f *File) setLocal(tx *meta.Tx, cachePath string) error {
+	if f.CachePath != "" && f.CachePath != cachePath {
+		f.mfs.removeCacheFile(f.CachePath, evictReplaced)
+	}
+	f.CachePath, f.CacheETag, f.LocalOnly = cachePath, "", true
+
+	// local Finder files of other mounts don't hide a remote entry
+	if f.mfs.config.scratch {
+		if err := f.mfs.markLocal(tx, f.FullPath()); err != nil {
+			return err
+		}
+	}
+	return f.store(tx)
+}
+
+// truncateLocal truncates the local content of the file, the remote
+// content is copied first unless the file becomes empty.
+func (f *File) truncateLocal(size uint64) error {
+	if err := f.makeLocal(size > 0); err != nil {
+		return err
+	}
+
+	if err := os.Truncate(f.CachePath, int64(size)); err != nil {
+		return err
+	}
+	f.Size = size
+
+	if !f.mfs.config.scratch {
+		return nil
+	}
+	return f.mfs.db.Update(func(tx *meta.Tx) error {
+		return f.mfs.markLocal(tx, f.FullPath())
+	})
+}
+
+// localOnlyXattr returns 1 for files written locally on scratch mounts,
+// and for local Finder files.
+func (f *File) localOnlyXattr(ctx context.Context) ([]byte, error) {
+	if !f.LocalOnly {
+		return nil, fuse.ErrNoXattr
+	}
+	return []byte("1"), nil
+}
@@ -0,0 +1,181 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultReadyTimeout is the time the mount has to answer the first stat
+// of its root, it's unmounted and fails otherwise.
+const defaultReadyTimeout = time.Minute
+
+// sdNotify sends state to the service manager, it does nothing when
+// NOTIFY_SOCKET isn't set.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// abstract sockets are given with a leading @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval of watchdog pings requested by
+// the service manager, half of the watchdog timeout, or 0 without one.
+func watchdogInterval() time.Duration {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// serviceStatus returns the STATUS= line of the service manager.
+func (mfs *MinFS) serviceStatus() string {
+	pending, gaveUp := mfs.pendingCounts()
+	q := mfs.syncQueue.stats()
+	return fmt.Sprintf("STATUS=Serving %s, %d uploads queued, %d running, %d pending, %d given up",
+		mfs.config.mountpoint, q.Small+q.Large, q.Running, pending, gaveUp)
+}
+
+// responsive tells if the mount root can be stat'ed and the meta DB serves
+// transactions, the remote isn't checked as an outage isn't fixed by a
+// restart.
+func (mfs *MinFS) responsive() bool {
+	h := mfs.Health()
+	return h.Checks["mount"].Healthy && h.Checks["meta"].Healthy
+}
+
+// startServiceNotify sends READY=1 once the mount answers a stat of its
+// root, and pings the watchdog while the mount is responsive. Nothing is
+// sent when minfs isn't started by a service manager. The parent of a
+// background mount is told to exit at the same time, and the ready fd is
+// written. A mount not answering within the ready timeout is unmounted.
+func (mfs *MinFS) startServiceNotify() {
+	go func() {
+		// the stat is answered once the server serves requests
+		ready := make(chan error, 1)
+		go func() {
+			_, err := os.Stat(mfs.config.mountpoint)
+			ready <- err
+		}()
+
+		timeout := mfs.config.readyTimeout
+		select {
+		case err := <-ready:
+			if err != nil {
+				mfs.notReady(fmt.Errorf("Mount root stat failed %s", err))
+				return
+			}
+		case <-time.After(timeout):
+			mfs.notReady(fmt.Errorf("Mount root stat timed out after %s", timeout))
+			return
+		case <-mfs.listenerDoneCh:
+			return
+		}
+
+		// the parent of a background mount exits now
+		atomic.StoreInt32(&mfs.ready, 1)
+		mfs.daemonReady()
+		if os.Getenv("NOTIFY_SOCKET") == "" {
+			return
+		}
+
+		if err := sdNotify("READY=1\n" + mfs.serviceStatus()); err != nil {
+			mfs.log.Warn("Unable to notify the service manager", F("error", err))
+			return
+		}
+
+		interval := watchdogInterval()
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-mfs.listenerDoneCh:
+				return
+			case <-ticker.C:
+			}
+
+			state := mfs.serviceStatus()
+			if watchdogInterval() > 0 {
+				if !mfs.responsive() {
+					// the service manager restarts the mount once the
+					// pings stop
+					mfs.log.Warn("Mount isn't responsive, stopped the watchdog pings")
+					continue
+				}
+				state = "WATCHDOG=1\n" + state
+			}
+			sdNotify(state)
+		}
+	}()
+}
+
+// notReady unmounts the mount which failed the readiness check, serve
+// returns err then.
+func (mfs *MinFS) notReady(err error) {
+	mfs.stopM.Lock()
+	mfs.readyErr = err
+	mfs.stopM.Unlock()
+
+	mfs.log.Error("Mount isn't ready, unmounting", F("mountpoint", mfs.config.mountpoint), F("error", err))
+	if _, uerr := mfs.unmount(); uerr != nil {
+		mfs.log.Error("Unable to unmount", F("mountpoint", mfs.config.mountpoint), F("error", uerr))
+	}
+}
+
+// readyError returns why the mount failed the readiness check, nil if it
+// didn't.
+func (mfs *MinFS) readyError() error {
+	mfs.stopM.Lock()
+	defer mfs.stopM.Unlock()
+
+	return mfs.readyErr
+}
+
+// notifyStopping tells the service manager that the mount shuts down.
+func (mfs *MinFS) notifyStopping() {
+	sdNotify("STOPPING=1\nSTATUS=Unmounting " + mfs.config.mountpoint)
+}
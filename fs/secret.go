@@ -0,0 +1,116 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// redactedSecret replaces credentials in logs, dumps and status output.
+const redactedSecret = "***redacted***"
+
+// minScrubLength is the length from which secret values are also removed
+// from log entries and dumps, shorter values would mangle unrelated text.
+const minScrubLength = 8
+
+// secret is a credential, formatted by fmt and encoding/json as
+// ***redacted***. The value is only available by reveal.
+type secret string
+
+func (s secret) String() string {
+	return redactedSecret
+}
+
+// GoString keeps the value out of %#v.
+func (s secret) GoString() string {
+	return redactedSecret
+}
+
+// Format redacts the value for all verbs.
+func (s secret) Format(f fmt.State, verb rune) {
+	fmt.Fprint(f, redactedSecret)
+}
+
+func (s secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + redactedSecret + `"`), nil
+}
+
+func (s secret) MarshalText() ([]byte, error) {
+	return []byte(redactedSecret), nil
+}
+
+// reveal returns the value, to be passed to the client only.
+func (s secret) reveal() string {
+	return string(s)
+}
+
+// secretScrubber returns the replacer removing the values of secrets from
+// text, a safety net for credentials echoed by errors of the remote.
+func secretScrubber(secrets ...secret) *strings.Replacer {
+	var pairs []string
+	for _, s := range secrets {
+		if len(s) >= minScrubLength {
+			pairs = append(pairs, s.reveal(), redactedSecret)
+		}
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// scrubber returns the scrubber of the current credentials of the mount,
+// those of all mounts of a group as these share the log.
+func (mfs *MinFS) scrubber() *strings.Replacer {
+	if mfs.group != nil {
+		return mfs.group.scrubber()
+	}
+	return secretScrubber(mfs.cfg().secrets()...)
+}
+
+// secrets returns the credentials of cfg, also those retrieved from its
+// credential source.
+func (cfg *Config) secrets() []secret {
+	secrets := []secret{cfg.accessKey, cfg.secretKey, cfg.secretToken}
+	if cfg.sourced != nil {
+		secrets = append(secrets, cfg.sourced.accessKey, cfg.sourced.secretKey, cfg.sourced.secretToken)
+	}
+	return secrets
+}
+
+// scrub removes the values of the credentials of the mount from text.
+func (mfs *MinFS) scrub(text string) string {
+	return mfs.log.scrub(text)
+}
+
+// Format prints the config with its credentials redacted, fmt doesn't call
+// the methods of unexported fields.
+func (cfg Config) Format(f fmt.State, verb rune) {
+	type plain Config
+	c := plain(cfg)
+	for _, s := range []*secret{&c.accessKey, &c.secretKey, &c.secretToken} {
+		if *s != "" {
+			*s = redactedSecret
+		}
+	}
+
+	format := "%"
+	for _, flag := range "+-# 0" {
+		if f.Flag(int(flag)) {
+			format += string(flag)
+		}
+	}
+	fmt.Fprintf(f, format+string(verb), c)
+}
@@ -0,0 +1,170 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestSecretFormat(t *testing.T) {
+	s := secret(testSecretKey)
+
+	formats := []string{"%v", "%+v", "%#v", "%s", "%q", "%x", "%X", "%10s", "%d"}
+	for _, format := range formats {
+		if out := fmt.Sprintf(format, s); strings.Contains(out, testSecretKey) || strings.Contains(out, fmt.Sprintf("%x", testSecretKey)) {
+			t.Errorf("expected %s to redact the secret, got %s", format, out)
+		}
+	}
+
+	data, err := json.Marshal(struct {
+		Key secret            `json:"key"`
+		Map map[secret]secret `json:"map"`
+	}{s, map[secret]secret{s: s}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), testSecretKey) {
+		t.Errorf("expected json to redact the secret, got %s", data)
+	}
+
+	if s.reveal() != testSecretKey {
+		t.Errorf("expected the value to be revealed, got %s", s.reveal())
+	}
+}
+
+func TestSecretScrubber(t *testing.T) {
+	testCases := []struct {
+		secrets  []secret
+		text     string
+		expected string
+	}{
+		{[]secret{testAccessKey}, "denied for " + testAccessKey + ".", "denied for " + redactedSecret + "."},
+		{[]secret{testAccessKey, testSecretKey}, testSecretKey + testAccessKey, redactedSecret + redactedSecret},
+		// short values would mangle unrelated text
+		{[]secret{"abc"}, "abcdef", "abcdef"},
+		{[]secret{""}, "text", "text"},
+		{nil, testSecretKey, testSecretKey},
+	}
+
+	for _, testCase := range testCases {
+		if out := secretScrubber(testCase.secrets...).Replace(testCase.text); out != testCase.expected {
+			t.Errorf("expected %q, got %q", testCase.expected, out)
+		}
+	}
+}
+
+// TestSecretScan runs operations with tracing on, also against a server
+// echoing the credentials in its errors, and scans every diagnostic output
+// of the mount for the credentials.
+func TestSecretScan(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "remote", []byte("remote"))
+	s3.put(testBucket, "denied", []byte("denied"))
+
+	cache := t.TempDir()
+	dumpFile := filepath.Join(t.TempDir(), "dump")
+	m := newTestMount(t, s3, cache, LogLevel("trace"), DumpFile(dumpFile))
+	m.SetWireTrace(true)
+
+	s3.setIntercept(func(op string, w http.ResponseWriter, r *http.Request) bool {
+		if op != "GetObject" || !strings.HasSuffix(r.URL.Path, "/denied") {
+			return false
+		}
+		fakeError(w, http.StatusForbidden, "AccessDenied", "Access denied for "+testAccessKey+" signed with "+testSecretKey)
+		return true
+	})
+
+	m.writeFile("file", []byte("file"))
+	if got := m.readFile("remote"); string(got) != "remote" {
+		t.Fatalf("expected remote, got %q", got)
+	}
+	if err := m.mkdir("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.rename("file", "dir/file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.remove("dir/file", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.open("denied", fuse.OpenReadOnly); err == nil {
+		t.Fatalf("expected the open of denied to fail")
+	}
+
+	outputs := map[string]string{}
+
+	m.writeDump()
+	dump, err := ioutil.ReadFile(dumpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs["dump file"] = string(dump)
+
+	for i, sf := range statusFiles {
+		fh, err := (&statusFile{mfs: m.MinFS, index: i}).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs["status file "+sf.name] = string(fh.(*statusHandle).data)
+	}
+
+	report, err := m.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs["fsck"] = string(data)
+
+	data, err = json.Marshal(m.Stats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs["stats"] = string(data)
+
+	cfg := m.cfg()
+	outputs["config"] = fmt.Sprintf("%v %+v %#v %s", *cfg, *cfg, *cfg, *cfg)
+
+	// the log is read last, after the dump was written to it
+	outputs["log"] = m.logs.String()
+
+	if !strings.Contains(outputs["log"], "GET") {
+		t.Fatalf("expected the wire trace in the log")
+	}
+	if !strings.Contains(outputs["log"], redactedSecret) {
+		t.Errorf("expected the credentials echoed by the server to be redacted in the log")
+	}
+	for name, output := range outputs {
+		for _, key := range []string{testAccessKey, testSecretKey} {
+			if strings.Contains(output, key) {
+				t.Errorf("expected no credentials in the %s, found %s in:\n%s", name, key, output)
+			}
+		}
+	}
+}
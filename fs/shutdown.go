@@ -0,0 +1,241 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+)
+
+const (
+	// defaultShutdownTimeout is the time SIGTERM waits for uploads, below
+	// the default stop timeout of systemd.
+	defaultShutdownTimeout = 60 * time.Second
+
+	// shutdownPoll is the interval the uploads are checked at while
+	// shutting down.
+	shutdownPoll = 500 * time.Millisecond
+)
+
+// stopping returns true once the mount is shutting down, new writes fail
+// with EBUSY then.
+func (mfs *MinFS) stopping() bool {
+	return atomic.LoadInt32(&mfs.stopState) == 1
+}
+
+// errStopping is returned to writes while shutting down.
+var errStopping = fuse.Errno(syscall.EBUSY)
+
+// startShutdownTrap shuts down gracefully on the first SIGINT or SIGTERM,
+// a second one stops waiting for the uploads.
+func (mfs *MinFS) startShutdownTrap() {
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		defer signal.Stop(sigCh)
+
+		skip := make(chan struct{})
+		<-sigCh
+		go mfs.stop(skip)
+
+		<-sigCh
+		mfs.log.Warn("Signalled again, unmounting without waiting for the uploads")
+		close(skip)
+	}()
+}
+
+// stop flushes the dirty handles and waits for the uploads until the
+// shutdown timeout passes or skip is closed, and unmounts. Files which
+// aren't uploaded by then stay journaled, and are uploaded on the next
+// mount.
+func (mfs *MinFS) stop(skip <-chan struct{}) {
+	if !atomic.CompareAndSwapInt32(&mfs.stopState, 0, 1) {
+		return
+	}
+	mfs.notifyStopping()
+
+	timeout := mfs.cfg().shutdownTimeout
+	mfs.log.Info("Shutting down, flushing dirty files and queued uploads", F("timeout", timeout))
+
+	flushed := mfs.flushAll()
+
+	err := mfs.waitUploads(time.Now().Add(timeout), flushed, skip)
+	if err != nil {
+		mfs.reportNotUploaded()
+	}
+
+	mfs.stopM.Lock()
+	mfs.stopErr = err
+	mfs.stopM.Unlock()
+
+	if lazy, uerr := mfs.unmount(); uerr != nil {
+		mfs.log.Error("Unable to unmount", F("mountpoint", mfs.config.mountpoint), F("error", uerr))
+	} else if lazy {
+		mfs.log.Warn("Files are still in use, unmounted lazily", F("mountpoint", mfs.config.mountpoint))
+	}
+}
+
+// unmount interrupts the FUSE operations in flight, which return EINTR
+// instead of holding off the unmount, and unmounts the mount point.
+func (mfs *MinFS) unmount() (lazy bool, err error) {
+	mfs.cancelOps()
+	return unmount(mfs.config.mountpoint)
+}
+
+// stopError returns the error of the graceful shutdown, nil if the
+// uploads finished or the mount wasn't signalled.
+func (mfs *MinFS) stopError() error {
+	mfs.stopM.Lock()
+	defer mfs.stopM.Unlock()
+
+	return mfs.stopErr
+}
+
+// flushAll flushes the dirty handles like a close does, the returned
+// channel is closed once they're flushed.
+func (mfs *MinFS) flushAll() <-chan struct{} {
+	var dirty []*FileHandle
+
+	mfs.m.Lock()
+	for _, fh := range mfs.handles {
+		if fh != nil && fh.dirty {
+			dirty = append(dirty, fh)
+		}
+	}
+	mfs.m.Unlock()
+
+	var wg sync.WaitGroup
+	for _, fh := range dirty {
+		wg.Add(1)
+		go func(fh *FileHandle) {
+			defer wg.Done()
+
+			if err := fh.Flush(context.Background(), &fuse.FlushRequest{}); err != nil {
+				mfs.log.Error("Unable to flush at shutdown", F("path", fh.f.FullPath()), F("error", err))
+			}
+		}(fh)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// notUploaded returns the paths of the pending uploads which are still
+// retried, uploads given up on aren't waited for.
+func (mfs *MinFS) notUploaded() (paths []string, gaveUp []string, err error) {
+	err = mfs.db.View(func(tx *meta.Tx) error {
+		b := tx.Bucket(pendingBucket)
+		return b.ForEach(func(k string, _ interface{}) error {
+			var p pendingUpload
+			if err := b.Get(k, &p); err != nil {
+				return err
+			}
+			if p.GaveUp {
+				gaveUp = append(gaveUp, k)
+			} else {
+				paths = append(paths, k)
+			}
+			return nil
+		})
+	})
+	return paths, gaveUp, err
+}
+
+// waitUploads waits until the handles are flushed, the upload queue is
+// empty and no pending upload is retried anymore. The stop timeout of
+// systemd is extended up to the deadline.
+func (mfs *MinFS) waitUploads(deadline time.Time, flushed <-chan struct{}, skip <-chan struct{}) error {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	ticker := time.NewTicker(shutdownPoll)
+	defer ticker.Stop()
+
+	for {
+		paths, _, err := mfs.notUploaded()
+		if err != nil {
+			return err
+		}
+		n := mfs.syncQueue.stats()
+		queued := n.Small + n.Large + n.Running
+
+		select {
+		case <-flushed:
+			if len(paths) == 0 && queued == 0 {
+				return nil
+			}
+		default:
+		}
+
+		// systemd kills the service after its stop timeout, unless it's
+		// extended
+		sdNotify(fmt.Sprintf("EXTEND_TIMEOUT_USEC=%d\nSTATUS=Uploading %d files before unmounting", (time.Until(deadline)+2*shutdownPoll)/time.Microsecond, len(paths)))
+
+		select {
+		case <-timer.C:
+			return fmt.Errorf("Shutdown timeout of %s passed with %d files not uploaded", mfs.cfg().shutdownTimeout, len(paths))
+		case <-skip:
+			return fmt.Errorf("Shutdown skipped with %d files not uploaded", len(paths))
+		case <-ticker.C:
+		}
+	}
+}
+
+// reportNotUploaded journals the handles still dirty and logs the files
+// which aren't uploaded, they are uploaded on the next mount.
+func (mfs *MinFS) reportNotUploaded() {
+	mfs.m.Lock()
+	handles := append([]*FileHandle(nil), mfs.handles...)
+	mfs.m.Unlock()
+
+	for _, fh := range handles {
+		if fh == nil || !fh.dirty {
+			continue
+		}
+		if err := mfs.journalUpload(fh); err != nil {
+			mfs.log.Error("Unable to journal the dirty file", F("path", fh.f.FullPath()), F("error", err))
+		}
+	}
+
+	paths, gaveUp, err := mfs.notUploaded()
+	if err != nil {
+		mfs.log.Error("Unable to read the pending uploads", F("error", err))
+		return
+	}
+	for _, path := range paths {
+		p, _ := mfs.pending(path)
+		mfs.log.Error("Not uploaded, retried on the next mount", F("path", path), F("source", p.Source), F("size", p.Length))
+	}
+	for _, path := range gaveUp {
+		p, _ := mfs.pending(path)
+		mfs.log.Error("Not uploaded, given up before", F("path", path), F("source", p.Source), F("size", p.Length))
+	}
+}
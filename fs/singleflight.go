@@ -0,0 +1,189 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"bazil.org/fuse"
+)
+
+// downloadGroup deduplicates the concurrent downloads of an object, the
+// open holding the turn of the path downloads it and the opens waiting
+// for the turn copy its cache file meanwhile.
+type downloadGroup struct {
+	m       sync.Mutex
+	flights map[string]*download
+}
+
+// download is a download in flight, done is closed once it finished.
+type download struct {
+	done chan struct{}
+
+	// the cache file of the leader and its file once downloaded, err is
+	// set if it failed
+	path string
+	file File
+	err  error
+
+	// the waiters copying the cache file, which the leader keeps until
+	// they're done
+	copies sync.WaitGroup
+}
+
+// downloadKey is the key of the downloads of the object of f. The opens
+// of a path download one at a time, holding its turn.
+func (f *File) downloadKey() string {
+	return f.BucketName() + "/" + f.RemotePath()
+}
+
+// start records the download of key to path by the caller.
+func (g *downloadGroup) start(key, path string) *download {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	if g.flights == nil {
+		g.flights = map[string]*download{}
+	}
+	d := &download{done: make(chan struct{}), path: path}
+	g.flights[key] = d
+	return d
+}
+
+// join returns the download in flight for key, nil if there is none.
+// The caller calls copies.Done once it's done with the cache file.
+func (g *downloadGroup) join(key string) *download {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	d, ok := g.flights[key]
+	if ok {
+		d.copies.Add(1)
+	}
+	return d
+}
+
+// finish records the outcome of the leader of d, and waits until the
+// waiters copied the cache file.
+func (g *downloadGroup) finish(key string, d *download, f *File, err error) {
+	g.m.Lock()
+	delete(g.flights, key)
+	g.m.Unlock()
+
+	d.file, d.err = *f, err
+	close(d.done)
+	d.copies.Wait()
+}
+
+// sharedDownload downloads the object into the cache file at path, opens
+// waiting for the turn of the path meanwhile copy it, see copyDownload.
+func (f *File) sharedDownload(ctx context.Context, path string) error {
+	key := f.downloadKey()
+	d := f.mfs.downloads.start(key, path)
+	err := f.downloadFile(ctx, path)
+	f.mfs.downloads.finish(key, d, f, err)
+	return err
+}
+
+// copyDownload copies the download of key in flight to a new cache file,
+// before the open waits for the turn the downloading open holds. It
+// returns the cache file and the file with the attributes of the
+// downloaded version, nil if nothing is downloaded or the download failed.
+// The open downloads the object itself then, taking over from an open
+// which was interrupted.
+func (mfs *MinFS) copyDownload(ctx context.Context, key string) (string, *File, error) {
+	d := mfs.downloads.join(key)
+	if d == nil {
+		return "", nil, nil
+	}
+	defer d.copies.Done()
+
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+		return "", nil, fuse.EINTR
+	}
+	if d.err != nil {
+		return "", nil, nil
+	}
+
+	path, err := mfs.NewCachePath()
+	if err != nil {
+		return "", nil, err
+	}
+	if err = copyFile(d.path, path); err != nil {
+		os.Remove(path)
+		return "", nil, err
+	}
+	return path, &d.file, nil
+}
+
+// downloadFile creates the cache file at path and downloads the object
+// into it, a failed download leaves no cache file behind. The content is
+// downloaded to the partial file first, which is removed at mount after a
+// crash.
+func (f *File) downloadFile(ctx context.Context, path string) error {
+	partPath := path + partialSuffix
+	file, err := os.Create(partPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partPath)
+	defer file.Close()
+
+	if err = f.download(ctx, file, false); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(partPath, path)
+}
+
+// sharedWith takes the attributes of the object downloaded by src.
+func (f *File) sharedWith(src *File) {
+	f.Size = src.Size
+	f.ETag = src.ETag
+	f.LastModified = src.LastModified
+	f.CacheETag = src.CacheETag
+	f.Hash = src.Hash
+	f.ExpiryDate, f.ExpiryRule = src.ExpiryDate, src.ExpiryRule
+	f.SSE, f.SSEKMSKey = src.SSE, src.SSEKMSKey
+	f.StatETag = src.StatETag
+}
+
+// copyFile copies the file at src to a new file at dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
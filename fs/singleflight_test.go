@@ -0,0 +1,190 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// holdDownload holds the first GetObject of the fake server until release
+// is closed or the request is cancelled, started is closed once it's held.
+func holdDownload(s3 *fakeS3) (started, release chan struct{}) {
+	started, release = make(chan struct{}), make(chan struct{})
+
+	var once sync.Once
+	s3.setIntercept(func(op string, w http.ResponseWriter, r *http.Request) bool {
+		if op != "GetObject" {
+			return false
+		}
+		held := false
+		once.Do(func() { held = true })
+		if !held {
+			return false
+		}
+
+		close(started)
+		select {
+		case <-release:
+			return false
+		case <-r.Context().Done():
+			return true
+		}
+	})
+	return started, release
+}
+
+// openShared opens name read-only n times concurrently, and returns the
+// contents read by the opens.
+func openShared(m *testMount, name string, n int) ([][]byte, []error) {
+	var wg sync.WaitGroup
+	contents, errs := make([][]byte, n), make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fh, err := m.open(name, fuse.OpenReadOnly)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			contents[i] = m.read(fh)
+			errs[i] = m.close(fh)
+		}(i)
+	}
+	wg.Wait()
+	return contents, errs
+}
+
+func TestSharedDownload(t *testing.T) {
+	const opens = 8
+
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	data := bytes.Repeat([]byte("shared"), 1<<14)
+	s3.put(testBucket, "file", data)
+
+	m := newTestMount(t, s3, t.TempDir())
+	started, release := holdDownload(s3)
+
+	var (
+		leader    []byte
+		leaderErr error
+		wg        sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fh, err := m.open("file", fuse.OpenReadOnly)
+		if err != nil {
+			leaderErr = err
+			return
+		}
+		leader = m.read(fh)
+		leaderErr = m.close(fh)
+	}()
+	<-started
+
+	// the others arrive while the first open downloads the object
+	var (
+		contents [][]byte
+		errs     []error
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		contents, errs = openShared(m, "file", opens-1)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if leaderErr != nil || !bytes.Equal(leader, data) {
+		t.Fatalf("expected the first open to read the object, got %d bytes, %v", len(leader), leaderErr)
+	}
+	for i := range errs {
+		if errs[i] != nil || !bytes.Equal(contents[i], data) {
+			t.Errorf("expected open %d to read the object, got %d bytes, %v", i, len(contents[i]), errs[i])
+		}
+	}
+	if n := s3.count("GetObject"); n != 1 {
+		t.Errorf("expected %d opens to share a single GetObject, got %d", opens, n)
+	}
+	if n := m.Stats().SharedDownloads; n != opens-1 {
+		t.Errorf("expected %d shared downloads, got %d", opens-1, n)
+	}
+}
+
+// TestSharedDownloadInterrupted interrupts the open downloading the object,
+// the waiting opens download it themselves then.
+func TestSharedDownloadInterrupted(t *testing.T) {
+	const waiters = 3
+
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	data := bytes.Repeat([]byte("taken over"), 1<<12)
+	s3.put(testBucket, "file", data)
+
+	m := newTestMount(t, s3, t.TempDir())
+	started, release := holdDownload(s3)
+	defer close(release)
+
+	node, err := m.lookup("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupted := make(chan error, 1)
+	go func() {
+		_, err := node.(*File).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		interrupted <- err
+	}()
+	<-started
+
+	var (
+		contents [][]byte
+		errs     []error
+		wg       sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		contents, errs = openShared(m, "file", waiters)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+
+	if err = <-interrupted; err == nil {
+		t.Fatalf("expected the interrupted open to fail")
+	}
+	wg.Wait()
+
+	for i := range errs {
+		if errs[i] != nil || !bytes.Equal(contents[i], data) {
+			t.Errorf("expected open %d to take over the download, got %d bytes, %v", i, len(contents[i]), errs[i])
+		}
+	}
+	if n := m.Stats().SharedDownloads; n != 0 {
+		t.Errorf("expected the failed download not to be shared, got %d shared downloads", n)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import "sync/atomic"
+
+// Stats contains counters of the filesystem activity.
+type Stats struct {
+	// Downloads counts objects fetched from the remote.
+	Downloads uint64
+
+	// Revalidations counts cached objects confirmed to be unchanged
+	// on the remote.
+	Revalidations uint64
+
+	// SharedDownloads counts opens which copied the object downloaded
+	// by a concurrent open of the same version instead of fetching it.
+	SharedDownloads uint64
+
+	// Conflicts counts local changes of objects which were changed by
+	// another client at the same time.
+	Conflicts uint64
+
+	// UploadRetries counts the retries of failed uploads.
+	UploadRetries uint64
+
+	// PreconditionFailures counts downloads restarted as the object was
+	// replaced between two attempts.
+	PreconditionFailures uint64
+
+	// BytesDownloaded and BytesUploaded count the bytes of objects
+	// transferred, as they are transferred.
+	BytesDownloaded uint64
+	BytesUploaded   uint64
+
+	// AuditDropped counts audit events dropped as the audit log
+	// couldn't keep up.
+	AuditDropped uint64
+
+	// NotificationsDropped counts events not delivered to the notifier
+	// as it couldn't keep up.
+	NotificationsDropped uint64
+
+	// Evicted counts file entries removed from the meta DB after they
+	// weren't accessed for the eviction period.
+	Evicted uint64
+
+	// Cache is the composition of the cache dir and the removed cache
+	// files.
+	Cache CacheStats
+
+	// SyncQueue is the composition of the queue of uploads, copies and
+	// moves.
+	SyncQueue SyncQueueStats
+
+	// Uploads are the running uploads and the ones finished within the
+	// last minutes.
+	Uploads []UploadProgress
+
+	// WireTrace is set while the requests sent to S3 are dumped to the
+	// log.
+	WireTrace bool
+
+	// Errors are the errors returned to the kernel and the S3 errors.
+	Errors ErrorStats
+
+	// Capabilities lists the optional APIs supported by the backend.
+	Capabilities []string
+}
+
+// Stats returns a snapshot of the filesystem counters.
+func (mfs *MinFS) Stats() Stats {
+	return Stats{
+		Downloads:            atomic.LoadUint64(&mfs.stats.Downloads),
+		Revalidations:        atomic.LoadUint64(&mfs.stats.Revalidations),
+		SharedDownloads:      atomic.LoadUint64(&mfs.stats.SharedDownloads),
+		Conflicts:            atomic.LoadUint64(&mfs.stats.Conflicts),
+		Evicted:              atomic.LoadUint64(&mfs.stats.Evicted),
+		UploadRetries:        atomic.LoadUint64(&mfs.stats.UploadRetries),
+		PreconditionFailures: atomic.LoadUint64(&mfs.stats.PreconditionFailures),
+		BytesDownloaded:      atomic.LoadUint64(&mfs.stats.BytesDownloaded),
+		BytesUploaded:        atomic.LoadUint64(&mfs.stats.BytesUploaded),
+		AuditDropped:         mfs.auditDropped(),
+		NotificationsDropped: mfs.notificationsDropped(),
+		Cache:                mfs.cacheStats(),
+		SyncQueue:            mfs.syncQueue.stats(),
+		Uploads:              mfs.uploadProgress(),
+		WireTrace:            mfs.wireTracing(),
+		Errors:               mfs.errors.stats(),
+		Capabilities:         mfs.Capabilities(),
+	}
+}
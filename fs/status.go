@@ -0,0 +1,300 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	"github.com/minio/minfs/meta"
+)
+
+// statusDirName is the name of the virtual status directory at the mount
+// root.
+const statusDirName = ".minfs"
+
+// inodes of the virtual nodes, counted down from the top so they don't
+// collide with the inodes of the meta DB
+const statusInode = ^uint64(0) - 16
+
+// statusFiles generate the content of the virtual files on open.
+var statusFiles = []struct {
+	name     string
+	generate func(mfs *MinFS) ([]byte, error)
+}{
+	{"status", (*MinFS).statusJSON},
+	{"pending", (*MinFS).pendingList},
+	{"config", (*MinFS).configJSON},
+	{"errors", (*MinFS).lastErrorsJSON},
+}
+
+// isStatusDir returns true if name in dir is the virtual status
+// directory.
+func (dir *Dir) isStatusDir(name string) bool {
+	return dir.dir == nil && dir.mfs.config.statusDir && name == statusDirName
+}
+
+// statusDir is the virtual directory of the status files, it's never
+// stored in the meta DB.
+type statusDir struct {
+	mfs *MinFS
+}
+
+func (d *statusDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	*a = fuse.Attr{
+		Inode: statusInode,
+		Mode:  os.ModeDir | 0555,
+		Uid:   d.mfs.config.uid,
+		Gid:   d.mfs.config.gid,
+		Mtime: d.mfs.started,
+		Ctime: d.mfs.started,
+	}
+	return nil
+}
+
+func (d *statusDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	for i, sf := range statusFiles {
+		if sf.name == name {
+			return &statusFile{mfs: d.mfs, index: i}, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+func (d *statusDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	entries := make([]fuse.Dirent, 0, len(statusFiles))
+	for i, sf := range statusFiles {
+		entries = append(entries, fuse.Dirent{Inode: statusInode + 1 + uint64(i), Name: sf.name, Type: fuse.DT_File})
+	}
+	return entries, nil
+}
+
+func (d *statusDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	return nil, nil, fuse.EPERM
+}
+
+func (d *statusDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	return nil, fuse.EPERM
+}
+
+func (d *statusDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	return fuse.EPERM
+}
+
+func (d *statusDir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node) error {
+	return fuse.EPERM
+}
+
+func (d *statusDir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	return fuse.EPERM
+}
+
+// statusFile is a read-only virtual file, the content is generated when
+// it's opened.
+type statusFile struct {
+	mfs   *MinFS
+	index int
+}
+
+func (f *statusFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	*a = fuse.Attr{
+		Inode: statusInode + 1 + uint64(f.index),
+		Mode:  0444,
+		Uid:   f.mfs.config.uid,
+		Gid:   f.mfs.config.gid,
+		Mtime: time.Now(),
+		Ctime: f.mfs.started,
+	}
+	return nil
+}
+
+func (f *statusFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.EPERM
+	}
+
+	data, err := statusFiles[f.index].generate(f.mfs)
+	if err != nil {
+		return nil, err
+	}
+	data = []byte(f.mfs.scrub(string(data)))
+
+	// the size isn't known before, reads go past the size of the attributes
+	resp.Flags |= fuse.OpenDirectIO
+	return &statusHandle{data: data}, nil
+}
+
+func (f *statusFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	return fuse.EPERM
+}
+
+// statusHandle serves the content generated on open.
+type statusHandle struct {
+	data []byte
+}
+
+func (h *statusHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	if req.Offset >= int64(len(h.data)) {
+		return nil
+	}
+
+	end := req.Offset + int64(req.Size)
+	if end > int64(len(h.data)) {
+		end = int64(len(h.data))
+	}
+	resp.Data = h.data[req.Offset:end]
+	return nil
+}
+
+func (h *statusHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	return fuse.EPERM
+}
+
+// statusJSON returns the stats of the mount and the files with the most
+// bytes transferred.
+func (mfs *MinFS) statusJSON() ([]byte, error) {
+	transfers, err := mfs.TopTransfers(transferTopN)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(struct {
+		MinFS      BuildInfo      `json:"minfs"`
+		Mountpoint string         `json:"mountpoint"`
+		Started    time.Time      `json:"started"`
+		Transfers  []TransferStat `json:"transfers"`
+		Stats
+	}{Build, mfs.config.mountpoint, mfs.started, transfers, mfs.Stats()}, "", "  ")
+	return append(data, '\n'), err
+}
+
+// pendingList returns the files with dirty handles, the queued and
+// running uploads and the pending uploads, a line per file.
+func (mfs *MinFS) pendingList() ([]byte, error) {
+	var lines []string
+
+	mfs.m.Lock()
+	for _, fh := range mfs.handles {
+		if fh != nil && fh.dirty {
+			lines = append(lines, fmt.Sprintf("dirty\t%s\thandle %d", fh.f.FullPath(), fh.handle))
+		}
+	}
+	mfs.m.Unlock()
+
+	mfs.syncQueue.m.Lock()
+	for _, lane := range [][]queuedOp{mfs.syncQueue.small, mfs.syncQueue.large} {
+		for _, op := range lane {
+			if req, ok := op.req.(*PutOperation); ok {
+				lines = append(lines, fmt.Sprintf("queued\t%s/%s\tsince %s", req.Bucket, req.Target, op.queued.UTC().Format(time.RFC3339)))
+			}
+		}
+	}
+	for key := range mfs.syncQueue.inflight {
+		lines = append(lines, fmt.Sprintf("uploading\t%s", key))
+	}
+	mfs.syncQueue.m.Unlock()
+
+	if err := mfs.db.View(func(tx *meta.Tx) error {
+		b := tx.Bucket(pendingBucket).ReadOnly()
+		return b.ForEach(func(k string, _ interface{}) error {
+			var p pendingUpload
+			if b.Get(k, &p) != nil {
+				return nil
+			}
+			state := fmt.Sprintf("%d attempts", p.Attempts)
+			if p.GaveUp {
+				state += ", gave up"
+			}
+			lines = append(lines, fmt.Sprintf("pending\t%s\t%s", k, state))
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(lines)
+
+	var buf bytes.Buffer
+	for _, l := range lines {
+		buf.WriteString(l + "\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// configJSON returns the effective configuration, without credentials.
+func (mfs *MinFS) configJSON() ([]byte, error) {
+	cfg := mfs.config
+
+	target := ""
+	if cfg.target != nil {
+		u := *cfg.target
+		u.User = nil
+		target = u.String()
+	}
+
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"target":            target,
+		"bucket":            cfg.bucket,
+		"buckets":           cfg.buckets,
+		"basePath":          cfg.basePath,
+		"mountpoint":        cfg.mountpoint,
+		"cache":             cfg.cache,
+		"cacheReuse":        cfg.cacheReuse,
+		"scratch":           cfg.scratch,
+		"region":            cfg.region,
+		"insecure":          cfg.insecure,
+		"addressing":        cfg.addressing,
+		"checksum":          cfg.checksum,
+		"verifyUploads":     cfg.verifyUploads,
+		"partSize":          cfg.partSize,
+		"uploadConcurrency": cfg.uploadConcurrency,
+		"uploadWorkers":     cfg.uploadWorkers,
+		"asyncUploads":      cfg.asyncUploads,
+		"uploadRetries":     cfg.uploadRetries,
+		"hard":              cfg.hard,
+		"intr":              cfg.intr,
+		"retryTimeout":      cfg.retryTimeout.String(),
+		"conflictPolicy":    cfg.conflictPolicy,
+		"atime":             cfg.atime,
+		"bucketAccess":      cfg.bucketAccess,
+		"dirMarkers":        cfg.dirMarkers,
+		"dirTTL":            cfg.dirTTL.String(),
+		"attrTimeout":       cfg.attrTimeout.String(),
+		"entryTimeout":      cfg.entryTimeout.String(),
+		"writebackCache":    cfg.writebackCache,
+		"directIO":          cfg.directIO,
+		"evictAfter":        cfg.evictAfter.String(),
+		"resyncInterval":    cfg.resyncInterval.String(),
+		"gcInterval":        cfg.gcInterval.String(),
+		"metaStore":         cfg.metaStore,
+		"notifications":     cfg.notifications,
+		"logLevel":          cfg.logLevel,
+		"logFormat":         cfg.logFormat,
+		"uid":               cfg.uid,
+		"gid":               cfg.gid,
+		"mode":              cfg.mode.String(),
+	}, "", "  ")
+	return append(data, '\n'), err
+}
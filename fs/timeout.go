@@ -0,0 +1,173 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package minfs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMetaTimeout is the deadline of metadata requests, like
+	// stat, list, remove and copy.
+	defaultMetaTimeout = time.Minute
+
+	// defaultDataIdleTimeout aborts object transfers which haven't
+	// transferred any bytes for this long.
+	defaultDataIdleTimeout = 30 * time.Second
+)
+
+// timeoutTransport applies the metadata timeout to metadata requests and
+// the idle timeout to object transfers, which take as long as they take
+// as long as bytes are moving.
+type timeoutTransport struct {
+	http.RoundTripper
+
+	// the timeouts are those of the current config of the mount
+	mfs *MinFS
+}
+
+// RoundTrip - executes the request with the deadline of its class.
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the notification stream stays open while there are no events
+	if _, ok := req.URL.Query()["events"]; ok {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	cfg := t.mfs.cfg()
+	if !isDataRequest(req) {
+		ctx, cancel := context.WithTimeout(req.Context(), cfg.metaTimeout)
+		resp, err := t.RoundTripper.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		resp.Body = &cancelReadCloser{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := &idleTimer{timer: time.AfterFunc(cfg.dataIdleTimeout, cancel), timeout: cfg.dataIdleTimeout}
+
+	r := req.WithContext(ctx)
+	if req.Body != nil && req.Body != http.NoBody {
+		r.Body = &idleReadCloser{ReadCloser: req.Body, timer: timer}
+	}
+
+	resp, err := t.RoundTripper.RoundTrip(r)
+	if err != nil {
+		timer.stop()
+		cancel()
+		return nil, err
+	}
+
+	timer.reset()
+	resp.Body = &cancelReadCloser{
+		ReadCloser: &idleReadCloser{ReadCloser: resp.Body, timer: timer},
+		cancel: func() {
+			timer.stop()
+			cancel()
+		},
+	}
+	return resp, nil
+}
+
+// dataQueryParams are the query parameters of object transfers, other
+// parameters select subresources like tagging or retention.
+var dataQueryParams = map[string]bool{
+	"versionId":  true,
+	"partNumber": true,
+	"uploadId":   true,
+}
+
+// isDataRequest returns true for requests transferring object content,
+// object downloads and uploads of objects or parts.
+func isDataRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if req.Header.Get("X-Amz-Copy-Source") != "" {
+			return false
+		}
+	default:
+		return false
+	}
+
+	for k := range req.URL.Query() {
+		if !dataQueryParams[k] && !strings.HasPrefix(k, "response-") {
+			return false
+		}
+	}
+
+	// listing buckets, bucket requests always have parameters
+	return strings.Trim(req.URL.Path, "/") != ""
+}
+
+// idleTimer cancels a transfer when it isn't reset within the timeout.
+type idleTimer struct {
+	m       sync.Mutex
+	timer   *time.Timer
+	timeout time.Duration
+	stopped bool
+}
+
+func (t *idleTimer) reset() {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if !t.stopped {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *idleTimer) stop() {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.stopped = true
+	t.timer.Stop()
+}
+
+// idleReadCloser resets the idle timer with every read returning bytes.
+type idleReadCloser struct {
+	io.ReadCloser
+	timer *idleTimer
+}
+
+func (r *idleReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.timer.reset()
+	}
+	return n, err
+}
+
+// cancelReadCloser releases the context of the request once the response
+// body is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (r *cancelReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.cancel()
+	return err
+}
@@ -0,0 +1,408 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minio/minfs/meta"
+)
+
+const (
+	// traceBatch is the number of spans exported per request.
+	traceBatch = 512
+
+	// traceInterval is the interval of exporting the collected spans.
+	traceInterval = 5 * time.Second
+
+	// traceQueue is the number of finished spans buffered for export,
+	// spans finishing while the buffer is full are dropped.
+	traceQueue = 4096
+)
+
+// tracer collects spans of FUSE operations, meta transactions and S3
+// requests and exports them to an OTLP/HTTP endpoint.
+type tracer struct {
+	endpoint string
+	ratio    float64
+	client   *http.Client
+
+	spans chan *span
+	stop  chan struct{}
+	done  chan struct{}
+
+	// mountpoint, the resource attribute of the spans
+	mount string
+}
+
+// span is a timed step of a trace. A nil span is a step that isn't
+// sampled, all its methods are no-ops.
+type span struct {
+	t       *tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   []Field
+
+	m   sync.Mutex
+	err string
+}
+
+// span kinds of OTLP
+const (
+	spanInternal = 1
+	spanClient   = 3
+)
+
+// traceEndpoint returns the URL spans are posted to, /v1/traces is added
+// to endpoints without a path.
+func traceEndpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("Trace endpoint is not a valid URL: %s", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return u.String(), nil
+}
+
+// newTracer returns the tracer exporting to endpoint, sampling ratio of
+// the operations.
+func newTracer(endpoint string, ratio float64, mount string) (*tracer, error) {
+	u, err := traceEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &tracer{
+		endpoint: u,
+		ratio:    ratio,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *span, traceQueue),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		mount:    mount,
+	}, nil
+}
+
+type spanKey struct{}
+
+// spanFromContext returns the span of ctx, nil when it isn't traced.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// startTrace starts the root span of the FUSE operation op, if it's
+// sampled.
+func (mfs *MinFS) startTrace(ctx context.Context, op string) (context.Context, *span) {
+	t := mfs.tracer
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &span{t: t, kind: spanInternal, start: time.Now()}
+	if _, err := crand.Read(s.traceID[:]); err != nil {
+		return ctx, nil
+	}
+	// sampled by the trace id like the ratio sampler of OpenTelemetry,
+	// the lower 8 bytes are uniformly distributed
+	if float64(binary.BigEndian.Uint64(s.traceID[8:])>>11)/(1<<53) >= t.ratio {
+		return ctx, nil
+	}
+	crand.Read(s.spanID[:])
+	s.name = "FUSE " + op
+	s.attrs = []Field{F("fuse.op", op)}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startSpan starts a child span of the span of ctx, operations that
+// aren't traced have no child spans.
+func (mfs *MinFS) startSpan(ctx context.Context, name string) (context.Context, *span) {
+	if mfs.tracer == nil {
+		return ctx, nil
+	}
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	s := &span{
+		t:       parent.t,
+		traceID: parent.traceID,
+		parent:  parent.spanID,
+		name:    name,
+		kind:    spanInternal,
+		start:   time.Now(),
+	}
+	crand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// set adds the attribute key with value v.
+func (s *span) set(key string, v interface{}) {
+	if s != nil {
+		s.attrs = append(s.attrs, F(key, v))
+	}
+}
+
+// setError marks the span as failed with err.
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.m.Lock()
+	s.err = err.Error()
+	s.m.Unlock()
+}
+
+// finish ends the span, failed with err unless it's nil, and queues it
+// for export.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.setError(err)
+	s.end = time.Now()
+
+	select {
+	case s.t.spans <- s:
+	default:
+	}
+}
+
+// view runs the read transaction fn of the meta DB in a child span of
+// ctx, unless ctx is done already.
+func (mfs *MinFS) view(ctx context.Context, fn func(*meta.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, s := mfs.startSpan(ctx, "meta.View")
+	err := mfs.db.View(fn)
+	s.finish(err)
+	return err
+}
+
+// update runs the write transaction fn of the meta DB in a child span of
+// ctx. It runs even if ctx is done, the changes record remote changes
+// made already.
+func (mfs *MinFS) update(ctx context.Context, fn func(*meta.Tx) error) error {
+	_, s := mfs.startSpan(ctx, "meta.Update")
+	err := mfs.db.Update(fn)
+	s.finish(err)
+	return err
+}
+
+// run exports the finished spans in batches until stopped.
+func (t *tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(traceInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) >= traceBatch {
+				t.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = nil
+		case <-t.stop:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					t.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// close exports the remaining spans and stops the tracer.
+func (t *tracer) close() {
+	close(t.stop)
+	<-t.done
+}
+
+// OTLP/JSON encoding of spans
+type (
+	otlpValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+		BoolValue   *bool   `json:"boolValue,omitempty"`
+	}
+	otlpAttr struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID      string     `json:"traceId"`
+		SpanID       string     `json:"spanId"`
+		ParentSpanID string     `json:"parentSpanId,omitempty"`
+		Name         string     `json:"name"`
+		Kind         int        `json:"kind"`
+		Start        string     `json:"startTimeUnixNano"`
+		End          string     `json:"endTimeUnixNano"`
+		Attributes   []otlpAttr `json:"attributes,omitempty"`
+		Status       otlpStatus `json:"status"`
+	}
+)
+
+func otlpAttribute(f Field) otlpAttr {
+	var v otlpValue
+	switch val := fieldValue(f.Value).(type) {
+	case bool:
+		v.BoolValue = &val
+	case int, int64, uint32, uint64:
+		s := fmt.Sprint(val)
+		v.IntValue = &s
+	default:
+		s := fmt.Sprint(val)
+		v.StringValue = &s
+	}
+	return otlpAttr{Key: f.Key, Value: v}
+}
+
+// export posts the spans, failures drop them.
+func (t *tracer) export(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		o := otlpSpan{
+			TraceID: hex.EncodeToString(s.traceID[:]),
+			SpanID:  hex.EncodeToString(s.spanID[:]),
+			Name:    s.name,
+			Kind:    s.kind,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for _, f := range s.attrs {
+			o.Attributes = append(o.Attributes, otlpAttribute(f))
+		}
+		s.m.Lock()
+		if s.err != "" {
+			o.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		s.m.Unlock()
+		spans = append(spans, o)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttr{
+					otlpAttribute(F("service.name", "minfs")),
+					otlpAttribute(F("minfs.mountpoint", t.mount)),
+				},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/minio/minfs"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
+
+// startTracing starts exporting spans, without trace endpoint nothing is
+// traced.
+func (mfs *MinFS) startTracing() {
+	if mfs.tracer != nil {
+		go mfs.tracer.run()
+		mfs.log.Printf("Exporting traces to %s.\n", mfs.tracer.endpoint)
+	}
+}
+
+// stopTracing exports the remaining spans.
+func (mfs *MinFS) stopTracing() {
+	if mfs.tracer != nil {
+		mfs.tracer.close()
+	}
+}
+
+// spanTransport records S3 requests as child spans of the operation
+// sending them.
+type spanTransport struct {
+	http.RoundTripper
+
+	mfs *MinFS
+}
+
+func (t *spanTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, s := t.mfs.startSpan(req.Context(), "S3 "+req.Method)
+	if s == nil {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	s.kind = spanClient
+	s.set("http.method", req.Method)
+	s.set("http.path", req.URL.Path)
+
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err == nil {
+		s.set("http.status_code", resp.StatusCode)
+		if id := resp.Header.Get("X-Amz-Request-Id"); id != "" {
+			s.set("s3.request_id", id)
+		}
+		if resp.StatusCode >= 400 {
+			s.setError(errors.New(resp.Status))
+		}
+	}
+	s.finish(err)
+	return resp, err
+}
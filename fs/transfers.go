@@ -0,0 +1,108 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/minio/minfs/meta"
+)
+
+// transferTopN is the number of files listed by transfers in the status.
+const transferTopN = 10
+
+// TransferStat is the number of bytes downloaded and uploaded of a file.
+type TransferStat struct {
+	Path       string
+	Downloaded uint64
+	Uploaded   uint64
+}
+
+// bytesDownloadedXattr returns the bytes downloaded of the file.
+func (f *File) bytesDownloadedXattr(ctx context.Context) ([]byte, error) {
+	return []byte(strconv.FormatUint(f.BytesDownloaded, 10)), nil
+}
+
+// bytesUploadedXattr returns the bytes uploaded of the file.
+func (f *File) bytesUploadedXattr(ctx context.Context) ([]byte, error) {
+	return []byte(strconv.FormatUint(f.BytesUploaded, 10)), nil
+}
+
+// TopTransfers returns the n files with the most bytes transferred, in
+// descending order.
+func (mfs *MinFS) TopTransfers(n int) ([]TransferStat, error) {
+	var top []TransferStat
+	err := mfs.db.View(func(tx *meta.Tx) error {
+		return fsckWalk(tx.Bucket("minio/"), nil, func(dir []string, name string, o interface{}, b *meta.Bucket) error {
+			f, ok := o.(File)
+			if !ok || f.BytesDownloaded+f.BytesUploaded == 0 {
+				return nil
+			}
+			top = append(top, TransferStat{
+				Path:       path.Join(append(append([]string{}, dir...), name)...),
+				Downloaded: f.BytesDownloaded,
+				Uploaded:   f.BytesUploaded,
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		ti, tj := top[i].Downloaded+top[i].Uploaded, top[j].Downloaded+top[j].Uploaded
+		if ti != tj {
+			return ti > tj
+		}
+		return top[i].Path < top[j].Path
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top, nil
+}
+
+// ResetTransfers sets the transfer counters of all files to zero, and
+// returns the number of files reset.
+func (mfs *MinFS) ResetTransfers() (int, error) {
+	// open files store their entry again on flush
+	mfs.m.Lock()
+	for _, fh := range mfs.handles {
+		if fh != nil {
+			fh.f.BytesDownloaded, fh.f.BytesUploaded = 0, 0
+		}
+	}
+	mfs.m.Unlock()
+
+	reset := 0
+	err := mfs.db.Update(func(tx *meta.Tx) error {
+		return fsckWalk(tx.Bucket("minio/"), nil, func(dir []string, name string, o interface{}, b *meta.Bucket) error {
+			f, ok := o.(File)
+			if !ok || f.BytesDownloaded+f.BytesUploaded == 0 {
+				return nil
+			}
+			f.BytesDownloaded, f.BytesUploaded = 0, 0
+			reset++
+			return b.Put(name, &f)
+		})
+	})
+	return reset, err
+}
@@ -0,0 +1,107 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/minio/minio-go/v6/pkg/credentials"
+	"github.com/minio/minio-go/v6/pkg/s3signer"
+)
+
+// requestPayerHeader is the header acknowledging requester pays buckets.
+const requestPayerHeader = "X-Amz-Request-Payer"
+
+// requestPayerTransport adds the request payer header to every request.
+// Requests are signed again so the header is covered by the signature.
+type requestPayerTransport struct {
+	http.RoundTripper
+
+	payer string
+
+	// signs with the current credentials of the mount
+	mfs *MinFS
+}
+
+// RoundTrip - adds the request payer and executes the request.
+func (t *requestPayerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get(requestPayerHeader) != "" {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	// A RoundTripper shouldn't modify the request.
+	r := cloneRequest(req)
+	r.Header.Set(requestPayerHeader, t.payer)
+
+	return t.RoundTripper.RoundTrip(t.mfs.signV4(r))
+}
+
+// cloneRequest returns a copy of req with its own headers.
+func cloneRequest(req *http.Request) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	return r
+}
+
+// signV4 signs r again with the current credentials of the mount, if it
+// has a V4 signature. The headers of r are modified.
+func (mfs *MinFS) signV4(r *http.Request) *http.Request {
+	region, ok := signatureRegion(r.Header.Get("Authorization"))
+	if !ok {
+		return r
+	}
+
+	creds, err := (&liveCredentials{mfs: mfs}).Retrieve()
+	if err != nil || creds.SignerType != credentials.SignatureV4 {
+		return r
+	}
+	return s3signer.SignV4(*r, creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken, region)
+}
+
+// signatureRegion returns the region of the credential scope of a V4
+// signature, which looks like:
+//
+//	AWS4-HMAC-SHA256 Credential=<key>/<date>/<region>/s3/aws4_request, ...
+func signatureRegion(authorization string) (string, bool) {
+	const credential = "Credential="
+
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 ") {
+		return "", false
+	}
+
+	i := strings.Index(authorization, credential)
+	if i == -1 {
+		return "", false
+	}
+
+	scope := authorization[i+len(credential):]
+	if j := strings.Index(scope, ","); j != -1 {
+		scope = scope[:j]
+	}
+
+	parts := strings.Split(scope, "/")
+	if len(parts) != 5 {
+		return "", false
+	}
+
+	return parts[2], true
+}
@@ -0,0 +1,78 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestRequestPayer mounts a requester pays bucket, which denies requests
+// without the request payer header, the header has to be signed.
+func TestRequestPayer(t *testing.T) {
+	s3 := newFakeS3TLS(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "dir/file", []byte("file"))
+
+	var (
+		m   sync.Mutex
+		ops = map[string]bool{}
+	)
+	s3.setIntercept(func(op string, w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get(requestPayerHeader) != "requester" {
+			fakeError(w, http.StatusForbidden, "AccessDenied", "Access Denied")
+			return true
+		}
+		if !strings.Contains(r.Header.Get("Authorization"), "x-amz-request-payer") {
+			fakeError(w, http.StatusForbidden, "SignatureDoesNotMatch", "The request payer header isn't signed")
+			return true
+		}
+		m.Lock()
+		ops[op] = true
+		m.Unlock()
+		return false
+	})
+
+	if _, err := startTestMount(t, s3, t.TempDir(), Insecure()); err == nil {
+		t.Fatalf("expected the mount to be denied without the request payer")
+	}
+
+	mnt := newTestMount(t, s3, t.TempDir(), Insecure(), RequestPayer("requester"), PartSize(minPartSize))
+	if got := mnt.dirents("dir"); len(got) != 1 || got[0] != "file" {
+		t.Errorf("expected the file to be listed, got %v", got)
+	}
+	if got := mnt.readFile("dir/file"); string(got) != "file" {
+		t.Errorf("expected file, got %q", got)
+	}
+	mnt.writeFile("dir/written", []byte("written"))
+	mnt.writeFile("dir/multipart", bytes.Repeat([]byte("m"), minPartSize+1))
+	if err := mnt.rename("dir/written", "dir/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mnt.remove("dir/renamed", false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []string{"ListObjectsV2", "HeadObject", "GetObject", "PutObject", "NewMultipartUpload", "PutObjectPart", "CompleteMultipartUpload", "CopyObject", "DeleteObject"} {
+		if !ops[op] {
+			t.Errorf("expected %s with the request payer", op)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"context"
+
+	"bazil.org/fuse"
+)
+
+// unlinkedFile is a file removed while it's open. Its handles keep
+// working on their cache files, the release of the last one removes the
+// object, which is hidden from listings until then.
+type unlinkedFile struct {
+	fullPath string
+	bucket   string
+	object   string
+
+	// remote is set if the object is removed at the last release,
+	// replaced once a new entry took the path. Guarded by mfs.m.
+	remote   bool
+	replaced bool
+	handles  int
+}
+
+// unlinkOpen turns the open handles of the removed file at fullPath into
+// handles of an unlinked file. They let go of the lock of the path, so a
+// new file can take it.
+func (mfs *MinFS) unlinkOpen(f *File, handles []*FileHandle, remote bool) {
+	u := &unlinkedFile{
+		fullPath: f.FullPath(),
+		bucket:   f.BucketName(),
+		object:   f.RemotePath(),
+		remote:   remote,
+		handles:  len(handles),
+	}
+
+	mfs.m.Lock()
+	for _, fh := range handles {
+		fh.unlinked = u
+		fh.f.unlinked = true
+	}
+	if remote {
+		mfs.unlinked[u.fullPath] = u
+	}
+	mfs.m.Unlock()
+
+	mfs.Unlock(u.fullPath)
+	mfs.log.Debug("Removed open file, removing the object once closed", F("path", u.fullPath), F("handles", len(handles)))
+}
+
+// unlinkedPath tells if fullPath is of an unlinked file whose object
+// isn't removed yet.
+func (mfs *MinFS) unlinkedPath(fullPath string) bool {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	_, ok := mfs.unlinked[fullPath]
+	return ok
+}
+
+// forgetUnlinked keeps the object at fullPath, which belongs to the new
+// entry of the path instead of the unlinked file.
+func (mfs *MinFS) forgetUnlinked(fullPath string) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	if u, ok := mfs.unlinked[fullPath]; ok {
+		u.replaced = true
+		delete(mfs.unlinked, fullPath)
+	}
+}
+
+// releaseUnlinked releases the handle of an unlinked file, its cache file
+// is dropped and the last release removes the object.
+func (mfs *MinFS) releaseUnlinked(fh *FileHandle) {
+	mfs.removeCacheFile(fh.cachePath, evictCloseDrop)
+
+	u := fh.unlinked
+
+	mfs.m.Lock()
+	mfs.handles[fh.handle] = nil
+	u.handles--
+	last := u.handles == 0
+	mfs.m.Unlock()
+
+	if !last {
+		return
+	}
+
+	// new entries of the path wait for the removal
+	done, err := mfs.turn(context.Background(), u.fullPath)
+	if err != nil {
+		mfs.log.Error("Unable to remove the object of the unlinked file", F("path", u.fullPath), F("error", err))
+		return
+	}
+	defer done()
+
+	mfs.m.Lock()
+	remove := u.remote && !u.replaced
+	if mfs.unlinked[u.fullPath] == u {
+		delete(mfs.unlinked, u.fullPath)
+	}
+	mfs.m.Unlock()
+
+	if !remove {
+		return
+	}
+	if err := mfs.api.RemoveObject(u.bucket, u.object); err != nil && !isNotFound(err) {
+		mfs.log.Error("Unable to remove the object of the unlinked file", F("path", u.fullPath), F("object", u.object), F("error", err))
+	}
+}
+
+// unlinkedHandles returns the open handles of the unlinked file f.
+func (mfs *MinFS) unlinkedHandles(f *File) []*FileHandle {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	var handles []*FileHandle
+	for _, fh := range mfs.handles {
+		if fh != nil && fh.unlinked != nil && fh.f == f {
+			handles = append(handles, fh)
+		}
+	}
+	return handles
+}
+
+// setattrUnlinked changes the attributes of the unlinked file f, which
+// only exist in memory, and truncates its handles.
+func (f *File) setattrUnlinked(req *fuse.SetattrRequest) error {
+	if req.Valid.Size() {
+		for _, fh := range f.mfs.unlinkedHandles(f) {
+			if err := fh.File.Truncate(int64(req.Size)); err != nil {
+				return err
+			}
+		}
+		f.Size = req.Size
+	}
+	if req.Valid.Mode() {
+		f.Mode = req.Mode
+		f.ModeSet = true
+	}
+	if req.Valid.Atime() {
+		f.Atime = req.Atime
+	}
+	if req.Valid.Mtime() {
+		f.Mtime = req.Mtime
+	}
+	return nil
+}
+
+// nlink returns the number of links of the file, none once unlinked.
+func (f *File) nlink() uint32 {
+	if f.unlinked {
+		return 0
+	}
+	return 1
+}
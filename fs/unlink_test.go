@@ -0,0 +1,77 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestUnlinkOpen(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+
+	m := newTestMount(t, s3, t.TempDir())
+	m.writeFile("existing", []byte("existing"))
+
+	testCases := []struct {
+		name   string
+		create bool
+	}{
+		{"existing", false},
+		{"new", true},
+	}
+
+	for _, testCase := range testCases {
+		var fh *FileHandle
+		var err error
+		if testCase.create {
+			_, fh, err = m.create(testCase.name)
+		} else {
+			fh, err = m.open(testCase.name, fuse.OpenReadWrite)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", testCase.name, err)
+		}
+
+		m.write(fh, 0, []byte("before"))
+		if err = m.remove(testCase.name, false); err != nil {
+			t.Fatalf("%s: remove: %v", testCase.name, err)
+		}
+		puts := s3.count("PutObject")
+
+		// the handle keeps working after the removal
+		m.write(fh, 6, []byte(" after"))
+		if got := m.read(fh); string(got) != "before after" {
+			t.Errorf("%s: expected the written content, got %q", testCase.name, got)
+		}
+		if err = m.close(fh); err != nil {
+			t.Fatalf("%s: close: %v", testCase.name, err)
+		}
+
+		if _, ok := s3.get(testBucket, testCase.name); ok {
+			t.Errorf("%s: expected the object to be removed", testCase.name)
+		}
+		if n := s3.count("PutObject"); n != puts {
+			t.Errorf("%s: expected no upload after the removal, got %d", testCase.name, n-puts)
+		}
+		if _, err = m.lookup(testCase.name); err != fuse.ENOENT {
+			t.Errorf("%s: expected ENOENT, got %v", testCase.name, err)
+		}
+	}
+}
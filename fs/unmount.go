@@ -0,0 +1,87 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// unmount unmounts the mount point, and falls back to a lazy unmount if
+// it's busy. The lazy unmount detaches the mount point right away, it's
+// gone once the last open file is closed, lazy is true then.
+func unmount(mountpoint string) (lazy bool, err error) {
+	if err = fuse.Unmount(mountpoint); err == nil {
+		return false, nil
+	}
+	if lerr := lazyUnmount(mountpoint); lerr != nil {
+		return false, fmt.Errorf("%s, lazy unmount: %s", err, lerr)
+	}
+	return true, nil
+}
+
+// lazyUnmount detaches the mount point with the tools of the platform,
+// fusermount works for the user who mounted and umount for root.
+func lazyUnmount(mountpoint string) error {
+	var commands [][]string
+	switch runtime.GOOS {
+	case "linux":
+		commands = [][]string{{"fusermount", "-u", "-z", mountpoint}, {"umount", "-l", mountpoint}}
+	default:
+		commands = [][]string{{"umount", "-f", mountpoint}}
+	}
+
+	var errs []string
+	for _, c := range commands {
+		out, err := exec.Command(c[0], c[1:]...).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s %s", c[0], err, strings.TrimSpace(string(out))))
+	}
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// staleMount returns true if the mount point is the mount of a minfs which
+// is gone, which fails every access with ENOTCONN.
+func staleMount(mountpoint string) bool {
+	_, err := os.Stat(mountpoint)
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == syscall.ENOTCONN
+	}
+	return false
+}
+
+// recoverStaleMount unmounts the mount left behind by a crashed minfs on
+// the mount point, so it can be mounted again.
+func (mfs *MinFS) recoverStaleMount() error {
+	if !staleMount(mfs.config.mountpoint) {
+		return nil
+	}
+
+	mfs.log.Warn("Mount point is the stale mount of a previous minfs, unmounting it", F("mountpoint", mfs.config.mountpoint))
+	if _, err := unmount(mfs.config.mountpoint); err != nil {
+		return fmt.Errorf("Unable to unmount the stale mount at %s: %s", mfs.config.mountpoint, err)
+	}
+	return nil
+}
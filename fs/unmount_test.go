@@ -0,0 +1,136 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStaleMount(t *testing.T) {
+	dir := t.TempDir()
+	if staleMount(dir) {
+		t.Errorf("expected a directory not to be a stale mount")
+	}
+	if staleMount(filepath.Join(dir, "missing")) {
+		t.Errorf("expected a missing mount point not to be a stale mount")
+	}
+
+	// nothing is unmounted at a mount point which isn't stale
+	mfs := newLockTestFS(t, Mountpoint(dir))
+	if err := mfs.recoverStaleMount(); err != nil {
+		t.Errorf("expected no stale mount to recover, got %v", err)
+	}
+}
+
+// waitMounted waits until the file at the mount point has data, or the
+// minfs serving it exits.
+func waitMounted(t *testing.T, cmd *exec.Cmd, exited <-chan error, file string, data []byte) {
+	t.Helper()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		got, err := ioutil.ReadFile(file)
+		if err == nil && bytes.Equal(got, data) {
+			return
+		}
+		select {
+		case err := <-exited:
+			t.Fatalf("expected %s to be served, minfs exited with %v", file, err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			t.Fatalf("expected %s to be served, got %q, %v", file, got, err)
+		}
+	}
+}
+
+// TestKilledMountRecovered kills a minfs serving a mount, which leaves the
+// mount point stale, the next minfs mounts it again without a manual
+// unmount. It needs FUSE and fusermount, and builds the minfs command.
+func TestKilledMountRecovered(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and mounts minfs")
+	}
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("FUSE isn't available")
+	}
+	if _, err := exec.LookPath("fusermount"); err != nil {
+		t.Skip("fusermount isn't available")
+	}
+
+	bin := filepath.Join(t.TempDir(), "minfs")
+	if out, err := exec.Command("go", "build", "-o", bin, "github.com/minio/minfs").CombinedOutput(); err != nil {
+		t.Fatalf("building minfs: %v\n%s", err, out)
+	}
+
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+	s3.put(testBucket, "file", []byte("file"))
+
+	mountpoint, cache := t.TempDir(), t.TempDir()
+	t.Cleanup(func() {
+		if staleMount(mountpoint) {
+			lazyUnmount(mountpoint)
+		}
+	})
+
+	start := func() (*exec.Cmd, <-chan error) {
+		cmd := exec.Command(bin, "--foreground", "-o", "region=us-east-1,addressing=path,cache="+cache, s3.URL+"/"+testBucket, mountpoint)
+		cmd.Env = append(os.Environ(), "MINFS_ACCESS_KEY="+testAccessKey, "MINFS_SECRET_KEY="+testSecretKey)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+		return cmd, exited
+	}
+
+	cmd, exited := start()
+	waitMounted(t, cmd, exited, filepath.Join(mountpoint, "file"), []byte("file"))
+
+	cmd.Process.Kill()
+	<-exited
+	if !staleMount(mountpoint) {
+		t.Fatalf("expected the mount of the killed minfs to be stale")
+	}
+
+	cmd, exited = start()
+	waitMounted(t, cmd, exited, filepath.Join(mountpoint, "file"), []byte("file"))
+
+	// a clean exit unmounts
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(30 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("expected minfs to exit on SIGTERM")
+	}
+	if staleMount(mountpoint) {
+		t.Errorf("expected the mount point to be unmounted on exit")
+	}
+	if _, err := os.Stat(filepath.Join(mountpoint, "file")); !os.IsNotExist(err) {
+		t.Errorf("expected the mount point to be empty after the exit, got %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	minio "github.com/minio/minio-go/v6"
+	"github.com/minio/minio-go/v6/pkg/s3utils"
+)
+
+const (
+	// defaultPartSize is the part size of multipart uploads.
+	defaultPartSize = 128 * 1024 * 1024
+
+	// minPartSize and maxPartSize are the limits of the part size of
+	// multipart uploads.
+	minPartSize = 5 * 1024 * 1024
+	maxPartSize = 5 * 1024 * 1024 * 1024
+
+	// maxPartsCount is the maximum number of parts of a multipart upload.
+	maxPartsCount = 10000
+
+	// defaultUploadConcurrency is the number of parts transferred
+	// concurrently.
+	defaultUploadConcurrency = 4
+
+	// uploadAttempts is the number of times an upload failing the
+	// integrity check is tried.
+	uploadAttempts = 3
+)
+
+// errUploadMismatch is returned when the uploaded object doesn't match the
+// cache file.
+var errUploadMismatch = errors.New("Uploaded object doesn't match the local file")
+
+// errUploadCancelled is returned to the waiters of uploads of files which
+// were removed.
+var errUploadCancelled = errors.New("Upload cancelled, the file was removed")
+
+// uploadPartSize returns the part size used for an upload of size bytes,
+// the configured part size is scaled up to keep the upload below the
+// maximum number of parts.
+func (mfs *MinFS) uploadPartSize(size int64) int64 {
+	partSize := mfs.config.partSize
+	if size > partSize*maxPartsCount {
+		partSize = ((size/maxPartsCount)/minPartSize + 1) * minPartSize
+	}
+	return partSize
+}
+
+// uploadETag computes the ETag the remote is expected to report for an
+// upload of r, this is the MD5 of the content for single part uploads and
+// the MD5 of the part MD5s for multipart uploads.
+func uploadETag(r io.Reader, size, partSize int64) (string, error) {
+	if size < partSize {
+		hasher := md5.New()
+		if _, err := io.Copy(hasher, r); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+	}
+
+	var sums []byte
+	parts := 0
+	for {
+		hasher := md5.New()
+		n, err := io.CopyN(hasher, r, partSize)
+		if n > 0 {
+			sums = append(sums, hasher.Sum(nil)...)
+			parts++
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%x-%d", md5.Sum(sums), parts), nil
+}
+
+// verifyUpload compares the uploaded object against the expected size and
+// ETag, an empty ETag or an ETag which isn't an MD5 only verifies the size.
+func (mfs *MinFS) verifyUpload(bucket, object string, size int64, etag string) error {
+	objInfo, err := mfs.api.StatObject(bucket, object, minio.StatObjectOptions{})
+	if err != nil {
+		return err
+	}
+
+	if objInfo.Size != size {
+		mfs.log.Printf("Upload of %s is %d bytes, expected %d bytes.\n", object, objInfo.Size, size)
+		return errUploadMismatch
+	}
+
+	if etag != "" && mfs.etagIsMD5(objInfo) && !strings.EqualFold(objInfo.ETag, etag) {
+		mfs.log.Printf("Upload of %s has ETag %s, expected %s.\n", object, objInfo.ETag, etag)
+		return errUploadMismatch
+	}
+
+	return nil
+}
+
+// etagIsMD5 returns false if the ETag of the object isn't derived from the
+// MD5 of its content, this is the case for objects encrypted with SSE-KMS
+// or SSE-C and for objects on GCS.
+func (mfs *MinFS) etagIsMD5(objInfo minio.ObjectInfo) bool {
+	if s3utils.IsGoogleEndpoint(*mfs.config.target) {
+		return false
+	}
+
+	switch objInfo.Metadata.Get("X-Amz-Server-Side-Encryption") {
+	case "aws:kms", "aws:kms:dsse":
+		return false
+	}
+	return objInfo.Metadata.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") == ""
+}
+
+// copyObjectMultipart copies the object server side in parts of the
+// configured part size, with the configured number of parts in flight.
+func (mfs *MinFS) copyObjectMultipart(bucket, source, target string, objInfo minio.ObjectInfo, userMeta map[string]string) error {
+	core := minio.Core{Client: mfs.api}
+
+	uploadID, err := core.NewMultipartUpload(bucket, target, minio.PutObjectOptions{
+		UserMetadata: userMeta,
+	})
+	if err != nil {
+		return err
+	}
+
+	partSize := mfs.uploadPartSize(objInfo.Size)
+	partsCount := int((objInfo.Size + partSize - 1) / partSize)
+
+	// Fail the copy when the source changes while copying.
+	cond := map[string]string{
+		"x-amz-copy-source-if-match": objInfo.ETag,
+	}
+
+	var (
+		wg    sync.WaitGroup
+		m     sync.Mutex
+		parts []minio.CompletePart
+		cerr  error
+	)
+
+	partCh := make(chan int)
+	for i := uint(0); i < mfs.config.uploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partID := range partCh {
+				offset := int64(partID-1) * partSize
+				length := partSize
+				if offset+length > objInfo.Size {
+					length = objInfo.Size - offset
+				}
+
+				part, perr := core.CopyObjectPart(bucket, source, bucket, target, uploadID, partID, offset, length, cond)
+
+				m.Lock()
+				if perr != nil && cerr == nil {
+					cerr = perr
+				}
+				parts = append(parts, part)
+				m.Unlock()
+			}
+		}()
+	}
+
+	for partID := 1; partID <= partsCount; partID++ {
+		m.Lock()
+		failed := cerr != nil
+		m.Unlock()
+		if failed {
+			break
+		}
+		partCh <- partID
+	}
+	close(partCh)
+	wg.Wait()
+
+	if cerr != nil {
+		core.AbortMultipartUpload(bucket, target, uploadID)
+		return cerr
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+
+	if _, err = core.CompleteMultipartUpload(bucket, target, uploadID, parts); err != nil {
+		core.AbortMultipartUpload(bucket, target, uploadID)
+		return err
+	}
+
+	return nil
+}
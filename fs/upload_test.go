@@ -0,0 +1,99 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"bazil.org/fuse"
+	minio "github.com/minio/minio-go/v6"
+)
+
+// TestEtagIsMD5 only compares the ETags of uploads which aren't encrypted
+// with SSE-KMS or SSE-C and aren't on GCS.
+func TestEtagIsMD5(t *testing.T) {
+	testCases := []struct {
+		name   string
+		target string
+		header http.Header
+		md5    bool
+	}{
+		{"plain", "https://s3.amazonaws.com", http.Header{}, true},
+		{"sse-s3", "https://s3.amazonaws.com", http.Header{"X-Amz-Server-Side-Encryption": {"AES256"}}, true},
+		{"sse-kms", "https://s3.amazonaws.com", http.Header{"X-Amz-Server-Side-Encryption": {"aws:kms"}}, false},
+		{"sse-c", "https://s3.amazonaws.com", http.Header{"X-Amz-Server-Side-Encryption-Customer-Algorithm": {"AES256"}}, false},
+		{"gcs", "https://storage.googleapis.com", http.Header{}, false},
+	}
+
+	for _, testCase := range testCases {
+		target, err := url.Parse(testCase.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mfs := &MinFS{config: &Config{target: target}}
+		if md5 := mfs.etagIsMD5(minio.ObjectInfo{Metadata: testCase.header}); md5 != testCase.md5 {
+			t.Errorf("%s: expected the ETag to be an MD5 %v, got %v", testCase.name, testCase.md5, md5)
+		}
+	}
+}
+
+// TestVerifyUploadEncrypted uploads to a bucket encrypted with SSE-KMS,
+// the ETag reported doesn't match the MD5 of the file and only the size
+// is verified.
+func TestVerifyUploadEncrypted(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+
+	m := newTestMount(t, s3, t.TempDir())
+	var sizeDelta int32
+	s3.setIntercept(func(op string, w http.ResponseWriter, r *http.Request) bool {
+		if op != "HeadObject" {
+			return false
+		}
+		data, ok := s3.get(testBucket, "file")
+		if !ok {
+			return false
+		}
+		w.Header().Set("ETag", `"0123456789abcdef0123456789abcdef"`)
+		w.Header().Set("X-Amz-Server-Side-Encryption", "aws:kms")
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)+int(atomic.LoadInt32(&sizeDelta))))
+		w.WriteHeader(http.StatusOK)
+		return true
+	})
+	defer s3.setIntercept(nil)
+
+	m.writeFile("file", []byte("encrypted"))
+	if data, _ := s3.get(testBucket, "file"); string(data) != "encrypted" {
+		t.Errorf("expected the file to be uploaded, got %q", data)
+	}
+
+	// the size is verified still
+	atomic.StoreInt32(&sizeDelta, 1)
+	fh, err := m.open("file", fuse.OpenReadWrite|fuse.OpenTruncate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.write(fh, 0, []byte("truncated"))
+	if err := m.close(fh); err != fuse.EIO {
+		t.Errorf("expected the upload of the wrong size to fail with EIO, got %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// wireTraceEnd ends each request dumped by the minio client.
+const wireTraceEnd = "---------END-HTTP---------"
+
+// redactedHeaders are the headers carrying credentials or encryption
+// keys, their values are masked in wire traces.
+var redactedHeaders = map[string]bool{
+	"authorization":                                             true,
+	"x-amz-security-token":                                      true,
+	"x-amz-server-side-encryption-customer-key":                 true,
+	"x-amz-server-side-encryption-customer-key-md5":             true,
+	"x-amz-copy-source-server-side-encryption-customer-key":     true,
+	"x-amz-copy-source-server-side-encryption-customer-key-md5": true,
+	"x-amz-server-side-encryption-context":                      true,
+}
+
+// redactedParams are the query parameters of presigned requests carrying
+// credentials.
+var redactedParams = regexp.MustCompile(`(?i)((?:X-Amz-Signature|X-Amz-Credential|X-Amz-Security-Token|Signature|AWSAccessKeyId)=)[^&\s]*`)
+
+const redacted = "**REDACTED**"
+
+// redactTrace masks the credentials and keys of a line of a wire trace.
+func redactTrace(line string) string {
+	if i := strings.IndexByte(line, ':'); i > 0 && !strings.ContainsAny(line[:i], " /") {
+		if redactedHeaders[strings.ToLower(line[:i])] {
+			return line[:i] + ": " + redacted
+		}
+	}
+
+	return redactedParams.ReplaceAllStringFunc(line, func(param string) string {
+		i := strings.IndexByte(param, '=')
+		return param[:i+1] + url.QueryEscape(redacted)
+	})
+}
+
+// wireTraceWriter collects the dumps of the minio client and logs each
+// request with its response as a single entry, redacted.
+type wireTraceWriter struct {
+	m   sync.Mutex
+	buf bytes.Buffer
+	log Logger
+}
+
+func (w *wireTraceWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.buf.Write(p)
+	for {
+		data := w.buf.String()
+		end := strings.Index(data, wireTraceEnd)
+		if end < 0 {
+			return len(p), nil
+		}
+
+		lines := strings.Split(strings.TrimRight(data[:end+len(wireTraceEnd)], "\r\n"), "\n")
+		for i, l := range lines {
+			lines[i] = redactTrace(strings.TrimRight(l, "\r"))
+		}
+		w.log.Info("S3 wire trace\n" + strings.Join(lines, "\n"))
+
+		w.buf.Reset()
+		w.buf.WriteString(strings.TrimLeft(data[end+len(wireTraceEnd):], "\r\n"))
+	}
+}
+
+// SetWireTrace turns the dumps of the requests sent to S3 on or off.
+func (mfs *MinFS) SetWireTrace(on bool) {
+	mfs.wireTraceM.Lock()
+	defer mfs.wireTraceM.Unlock()
+
+	if on == mfs.wireTracing() {
+		return
+	}
+
+	if on {
+		mfs.api.TraceOn(&wireTraceWriter{log: mfs.log})
+		atomic.StoreInt32(&mfs.wireTrace, 1)
+		mfs.log.Println("S3 wire tracing enabled.")
+	} else {
+		mfs.api.TraceOff()
+		atomic.StoreInt32(&mfs.wireTrace, 0)
+		mfs.log.Println("S3 wire tracing disabled.")
+	}
+}
+
+// wireTracing returns true if the requests sent to S3 are dumped.
+func (mfs *MinFS) wireTracing() bool {
+	return atomic.LoadInt32(&mfs.wireTrace) == 1
+}
+
+// startWireTraceToggle toggles the wire trace on SIGUSR2 until the
+// listener is done.
+func (mfs *MinFS) startWireTraceToggle() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR2)
+
+	go func() {
+		defer signal.Stop(sigCh)
+
+		for {
+			select {
+			case <-mfs.listenerDoneCh:
+				return
+			case <-sigCh:
+				mfs.SetWireTrace(!mfs.wireTracing())
+			}
+		}
+	}()
+}
@@ -0,0 +1,141 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package minfs
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRedactTrace(t *testing.T) {
+	testCases := []struct {
+		line     string
+		expected string
+	}{
+		{
+			"Authorization: AWS4-HMAC-SHA256 Credential=AKIAEXAMPLE/20261015/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-date, Signature=0123456789abcdef",
+			"Authorization: " + redacted,
+		},
+		{"authorization: AWS AKIAEXAMPLE:c2lnbmF0dXJl", "authorization: " + redacted},
+		{"X-Amz-Security-Token: FwoGZXIvYXdzEXAMPLE", "X-Amz-Security-Token: " + redacted},
+		{"X-Amz-Server-Side-Encryption-Customer-Key: MzJieXRlc2VjcmV0a2V5Zm9yc3NlY3Rlc3Rpbmcx", "X-Amz-Server-Side-Encryption-Customer-Key: " + redacted},
+		{"X-Amz-Server-Side-Encryption-Customer-Key-Md5: bWQ1b2Z0aGVrZXk=", "X-Amz-Server-Side-Encryption-Customer-Key-Md5: " + redacted},
+		{"X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key: MzJieXRlc2VjcmV0a2V5Zm9yc3NlY3Rlc3Rpbmcx", "X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key: " + redacted},
+		{"X-Amz-Server-Side-Encryption-Context: eyJrZXkiOiJ2YWx1ZSJ9", "X-Amz-Server-Side-Encryption-Context: " + redacted},
+
+		// presigned requests carry the credentials in the query
+		{
+			"GET /bucket/file?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKIAEXAMPLE%2F20261015&X-Amz-Signature=0123456789abcdef HTTP/1.1",
+			"GET /bucket/file?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=%2A%2AREDACTED%2A%2A&X-Amz-Signature=%2A%2AREDACTED%2A%2A HTTP/1.1",
+		},
+		{
+			"GET /bucket/file?AWSAccessKeyId=AKIAEXAMPLE&Signature=c2lnbmF0dXJl&Expires=1 HTTP/1.1",
+			"GET /bucket/file?AWSAccessKeyId=%2A%2AREDACTED%2A%2A&Signature=%2A%2AREDACTED%2A%2A&Expires=1 HTTP/1.1",
+		},
+
+		// everything else is kept
+		{"X-Amz-Content-Sha256: UNSIGNED-PAYLOAD", "X-Amz-Content-Sha256: UNSIGNED-PAYLOAD"},
+		{"X-Amz-Server-Side-Encryption: AES256", "X-Amz-Server-Side-Encryption: AES256"},
+		{"Etag: \"0123456789abcdef\"", "Etag: \"0123456789abcdef\""},
+		{"HTTP/1.1 200 OK", "HTTP/1.1 200 OK"},
+		{"GET /bucket/dir/Authorization: HTTP/1.1", "GET /bucket/dir/Authorization: HTTP/1.1"},
+	}
+
+	for _, testCase := range testCases {
+		if got := redactTrace(testCase.line); got != testCase.expected {
+			t.Errorf("expected %q to be redacted to %q, got %q", testCase.line, testCase.expected, got)
+		}
+	}
+}
+
+// TestWireTraceWriter checks the dumps written in pieces are logged as one
+// entry per request, redacted.
+func TestWireTraceWriter(t *testing.T) {
+	var logs bytes.Buffer
+	cfg := defaultConfig(&AccessConfig{})
+	w := &wireTraceWriter{log: newLogger(writerSink{&logs}, LevelInfo, cfg.logFormat, secretScrubber())}
+
+	dump := "---------START-HTTP---------\r\n" +
+		"PUT /bucket/file HTTP/1.1\r\n" +
+		"Authorization: AWS4-HMAC-SHA256 Credential=AKIAEXAMPLE/20261015/us-east-1/s3/aws4_request, Signature=0123456789abcdef\r\n" +
+		"X-Amz-Server-Side-Encryption-Customer-Key: MzJieXRlc2VjcmV0a2V5Zm9yc3NlY3Rlc3Rpbmcx\r\n" +
+		"\r\n" +
+		"HTTP/1.1 200 OK\r\n" +
+		"---------END-HTTP---------\r\n"
+
+	// the minio client writes the dump line by line, split it further
+	for _, dump := range []string{dump, dump} {
+		for len(dump) > 0 {
+			n := 7
+			if n > len(dump) {
+				n = len(dump)
+			}
+			w.Write([]byte(dump[:n]))
+			dump = dump[n:]
+		}
+	}
+
+	out := logs.String()
+	if n := strings.Count(out, "S3 wire trace"); n != 2 {
+		t.Errorf("expected an entry per request, got %d:\n%s", n, out)
+	}
+	for _, secret := range []string{"AKIAEXAMPLE", "0123456789abcdef", "MzJieXRlc2VjcmV0a2V5Zm9yc3NlY3Rlc3Rpbmcx"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("expected %s to be redacted:\n%s", secret, out)
+		}
+	}
+}
+
+// TestWireTraceMount traces the requests of a mount, which are logged
+// without the credentials until the trace is turned off.
+func TestWireTraceMount(t *testing.T) {
+	s3 := newFakeS3(testBucket)
+	defer s3.Close()
+
+	m := newTestMount(t, s3, t.TempDir())
+	m.SetWireTrace(true)
+	if !m.Stats().WireTrace {
+		t.Errorf("expected the stats to report the wire trace")
+	}
+
+	m.writeFile("file", []byte("traced"))
+	m.readFile("file")
+
+	logs := m.logs.String()
+	if !strings.Contains(logs, "S3 wire trace") || !strings.Contains(logs, "PUT /"+testBucket+"/file") {
+		t.Fatalf("expected the requests to be traced:\n%s", logs)
+	}
+	if !strings.Contains(logs, "Authorization: "+redacted) {
+		t.Errorf("expected the Authorization header to be redacted:\n%s", logs)
+	}
+	for _, secret := range []string{testAccessKey, testSecretKey, "Credential=", "Signature="} {
+		if strings.Contains(logs, secret) {
+			t.Errorf("expected no %s in the trace", secret)
+		}
+	}
+
+	m.SetWireTrace(false)
+	if m.Stats().WireTrace {
+		t.Errorf("expected the stats to report the wire trace off")
+	}
+	traced := strings.Count(m.logs.String(), "S3 wire trace")
+	m.readFile("file")
+	if n := strings.Count(m.logs.String(), "S3 wire trace"); n != traced {
+		t.Errorf("expected no trace once turned off, got %d more entries", n-traced)
+	}
+}
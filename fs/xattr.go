@@ -0,0 +1,108 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package minfs
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+)
+
+// xattrPrefix is the namespace of user extended attributes on Linux,
+// names are matched with and without it.
+const xattrPrefix = "user."
+
+// fileXattrs are the synthetic read-only extended attributes of files,
+// resolved on request. Getters return fuse.ErrNoXattr when the attribute
+// has no value for the file.
+var fileXattrs = map[string]func(*File, context.Context) ([]byte, error){
+	"minfs.retention":        (*File).retentionXattr,
+	"minfs.expiry-date":      (*File).expiryDateXattr,
+	"minfs.expiry-rule":      (*File).expiryRuleXattr,
+	"minfs.sse":              (*File).sseXattr,
+	"minfs.sse-kms-key":      (*File).sseKMSKeyXattr,
+	presignXattr:             (*File).presignedURLXattr,
+	"minfs.upload-progress":  (*File).uploadProgressXattr,
+	"minfs.bytes-downloaded": (*File).bytesDownloadedXattr,
+	"minfs.bytes-uploaded":   (*File).bytesUploadedXattr,
+	"minfs.last-error":       (*File).lastErrorXattr,
+	localOnlyXattr:           (*File).localOnlyXattr,
+}
+
+// Getxattr returns the value of a synthetic extended attribute.
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
+	defer mapErrno(&err)
+
+	name := strings.TrimPrefix(req.Name, xattrPrefix)
+
+	getter, ok := fileXattrs[name]
+	if !ok {
+		getter, ok = presignedURLXattrFor(name)
+	}
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+
+	value, err := getter(f, ctx)
+	if err != nil {
+		return err
+	}
+
+	if req.Size != 0 && uint32(len(value)) > req.Size {
+		return fuse.ERANGE
+	}
+
+	resp.Xattr = value
+	return nil
+}
+
+// refreshXattr is set on a directory to list it again on the next access.
+const refreshXattr = "minfs.refresh"
+
+// Setxattr of minfs.refresh forces the next access of the directory to
+// list the remote, other attributes are not supported.
+func (dir *Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) (err error) {
+	defer mapErrno(&err)
+
+	defer func() {
+		dir.mfs.audit(AuditEvent{Op: "setxattr", Path: dir.FullPath(), Xattr: req.Name}, &req.Header, err)
+	}()
+
+	if strings.TrimPrefix(req.Name, xattrPrefix) != refreshXattr {
+		return fuse.ENOTSUP
+	}
+
+	return dir.mfs.update(ctx, func(tx *meta.Tx) error {
+		return dir.invalidateListing(tx)
+	})
+}
+
+// Listxattr lists the names of the synthetic extended attributes.
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) (err error) {
+	defer mapErrno(&err)
+
+	names := make([]string, 0, len(fileXattrs))
+	for name := range fileXattrs {
+		names = append(names, xattrPrefix+name)
+	}
+	sort.Strings(names)
+
+	resp.Append(names...)
+	return nil
+}
@@ -5,6 +5,7 @@ go 1.12
 require (
 	bazil.org/fuse v0.0.0-20180421153158-65cc252bf669
 	github.com/coreos/bbolt v1.3.3
+	github.com/dgraph-io/badger v1.6.2
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
 	github.com/minio/cli v1.22.0
 	github.com/minio/minio v0.0.0-20200410000145-db4195361876
@@ -0,0 +1,377 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Keys of the badger store. The nested buckets are numbered, the entries
+// of a bucket share the prefix of its number so they are listed in byte
+// order:
+//
+//	e<bucket><name> -> v<value> or b<child bucket>
+//	s<bucket>       -> sequence of the bucket
+//	n               -> last bucket number, the root is 0
+const (
+	badgerEntry    = 'e'
+	badgerSequence = 's'
+	badgerValue    = 'v'
+	badgerBucket   = 'b'
+)
+
+var badgerLastBucket = []byte("n")
+
+// forEachBatch is the number of entries ForEach reads before calling fn,
+// the iterator is closed meanwhile so fn can iterate nested buckets.
+const forEachBatch = 256
+
+// OpenBadger opens the badger meta DB in the directory path. Unlike bolt
+// it doesn't rewrite pages on updates, which suits namespaces of millions
+// of entries. Writable transactions are serialized, and are limited to
+// about 100k changes.
+func OpenBadger(path string, readOnly bool) (*DB, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	db, err := badger.Open(badger.DefaultOptions(path).WithReadOnly(readOnly).WithLogger(nil))
+	if err != nil {
+		return nil, err
+	}
+	return New(&badgerStore{db: db}), nil
+}
+
+type badgerStore struct {
+	db *badger.DB
+
+	// serializes writable transactions, badger would fail conflicting
+	// ones at commit instead
+	writer sync.Mutex
+}
+
+func (s *badgerStore) Begin(writable bool) (StoreTx, error) {
+	if writable {
+		s.writer.Lock()
+	}
+	return &badgerTx{s: s, txn: s.db.NewTransaction(writable), writable: writable}, nil
+}
+
+func (s *badgerStore) Close() error {
+	return s.db.Close()
+}
+
+// Backup writes a badger backup of the store to path, it's restored with
+// badger restore.
+func (s *badgerStore) Backup(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = s.db.Backup(f, 0); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type badgerTx struct {
+	s        *badgerStore
+	txn      *badger.Txn
+	writable bool
+	closed   bool
+}
+
+func (tx *badgerTx) Bucket(name []byte) StoreBucket {
+	return (&badgerBucketTx{tx: tx}).Bucket(name)
+}
+
+func (tx *badgerTx) CreateBucketIfNotExists(name []byte) (StoreBucket, error) {
+	return (&badgerBucketTx{tx: tx}).CreateBucketIfNotExists(name)
+}
+
+func (tx *badgerTx) Commit() error {
+	if tx.closed {
+		return errTxClosed
+	}
+	if !tx.writable {
+		return errTxNotWritable
+	}
+
+	defer tx.close()
+	return tx.txn.Commit()
+}
+
+func (tx *badgerTx) Rollback() error {
+	if tx.closed {
+		return errTxClosed
+	}
+
+	tx.txn.Discard()
+	tx.close()
+	return nil
+}
+
+func (tx *badgerTx) close() {
+	tx.closed = true
+	if tx.writable {
+		tx.s.writer.Unlock()
+	}
+}
+
+// change checks the transaction can modify buckets.
+func (tx *badgerTx) change() error {
+	if tx.closed {
+		return errTxClosed
+	}
+	if !tx.writable {
+		return errTxNotWritable
+	}
+	return nil
+}
+
+// get returns a copy of the value of key, nil if it doesn't exist.
+func (tx *badgerTx) get(key []byte) []byte {
+	if tx.closed {
+		return nil
+	}
+	item, err := tx.txn.Get(key)
+	if err != nil {
+		return nil
+	}
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+func (tx *badgerTx) getUint64(key []byte) uint64 {
+	v := tx.get(key)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func (tx *badgerTx) setUint64(key []byte, n uint64) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, n)
+	return tx.txn.Set(key, v)
+}
+
+type badgerBucketTx struct {
+	tx *badgerTx
+	id uint64
+}
+
+// key returns the key of the record kind of the bucket, followed by name.
+func (b *badgerBucketTx) key(kind byte, name []byte) []byte {
+	k := make([]byte, 9, 9+len(name))
+	k[0] = kind
+	binary.BigEndian.PutUint64(k[1:], b.id)
+	return append(k, name...)
+}
+
+func (b *badgerBucketTx) Get(key []byte) []byte {
+	v := b.tx.get(b.key(badgerEntry, key))
+	if len(v) == 0 || v[0] != badgerValue {
+		return nil
+	}
+	return v[1:]
+}
+
+func (b *badgerBucketTx) Put(key, value []byte) error {
+	if err := b.tx.change(); err != nil {
+		return err
+	}
+
+	k := b.key(badgerEntry, key)
+	if v := b.tx.get(k); len(v) > 0 && v[0] == badgerBucket {
+		return errIncompatibleType
+	}
+	return b.tx.txn.Set(k, append([]byte{badgerValue}, value...))
+}
+
+func (b *badgerBucketTx) Delete(key []byte) error {
+	if err := b.tx.change(); err != nil {
+		return err
+	}
+
+	k := b.key(badgerEntry, key)
+	v := b.tx.get(k)
+	if v == nil {
+		return nil
+	}
+	if v[0] == badgerBucket {
+		return errIncompatibleType
+	}
+	return b.tx.txn.Delete(k)
+}
+
+// scan returns up to forEachBatch entries of the bucket after the key
+// after, all entries from the start for nil.
+func (b *badgerBucketTx) scan(after []byte) (keys, values [][]byte, err error) {
+	prefix := b.key(badgerEntry, nil)
+
+	it := b.tx.txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, PrefetchSize: forEachBatch, Prefix: prefix})
+	defer it.Close()
+
+	seek := prefix
+	if after != nil {
+		seek = b.key(badgerEntry, append(append([]byte(nil), after...), 0))
+	}
+	for it.Seek(seek); it.Valid() && len(keys) < forEachBatch; it.Next() {
+		item := it.Item()
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, item.KeyCopy(nil)[len(prefix):])
+		values = append(values, v)
+	}
+	return keys, values, nil
+}
+
+func (b *badgerBucketTx) ForEach(fn func(k, v []byte) error) error {
+	if b.tx.closed {
+		return errTxClosed
+	}
+
+	var after []byte
+	for {
+		keys, values, err := b.scan(after)
+		if err != nil {
+			return err
+		}
+		for i, k := range keys {
+			v := values[i]
+			if v[0] == badgerBucket {
+				v = nil
+			} else {
+				v = v[1:]
+			}
+			if err = fn(k, v); err != nil {
+				return err
+			}
+		}
+		if len(keys) < forEachBatch {
+			return nil
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+func (b *badgerBucketTx) Bucket(name []byte) StoreBucket {
+	v := b.tx.get(b.key(badgerEntry, name))
+	if len(v) != 9 || v[0] != badgerBucket {
+		return nil
+	}
+	return &badgerBucketTx{tx: b.tx, id: binary.BigEndian.Uint64(v[1:])}
+}
+
+func (b *badgerBucketTx) CreateBucketIfNotExists(name []byte) (StoreBucket, error) {
+	if child := b.Bucket(name); child != nil {
+		return child, nil
+	}
+
+	if err := b.tx.change(); err != nil {
+		return nil, err
+	}
+
+	k := b.key(badgerEntry, name)
+	if b.tx.get(k) != nil {
+		return nil, errIncompatibleType
+	}
+
+	id := b.tx.getUint64(badgerLastBucket) + 1
+	if err := b.tx.setUint64(badgerLastBucket, id); err != nil {
+		return nil, err
+	}
+
+	v := make([]byte, 9)
+	v[0] = badgerBucket
+	binary.BigEndian.PutUint64(v[1:], id)
+	if err := b.tx.txn.Set(k, v); err != nil {
+		return nil, err
+	}
+	return &badgerBucketTx{tx: b.tx, id: id}, nil
+}
+
+func (b *badgerBucketTx) DeleteBucket(name []byte) error {
+	if err := b.tx.change(); err != nil {
+		return err
+	}
+
+	child, ok := b.Bucket(name).(*badgerBucketTx)
+	if !ok {
+		return errNoSuchBucket
+	}
+	if err := child.clear(); err != nil {
+		return err
+	}
+	return b.tx.txn.Delete(b.key(badgerEntry, name))
+}
+
+// clear deletes the entries, the nested buckets and the sequence of the
+// bucket.
+func (b *badgerBucketTx) clear() error {
+	for {
+		keys, values, err := b.scan(nil)
+		if err != nil {
+			return err
+		}
+		for i, k := range keys {
+			if values[i][0] == badgerBucket {
+				child := &badgerBucketTx{tx: b.tx, id: binary.BigEndian.Uint64(values[i][1:])}
+				if err = child.clear(); err != nil {
+					return err
+				}
+			}
+			if err = b.tx.txn.Delete(b.key(badgerEntry, k)); err != nil {
+				return err
+			}
+		}
+		if len(keys) < forEachBatch {
+			break
+		}
+	}
+	return b.tx.txn.Delete(b.key(badgerSequence, nil))
+}
+
+func (b *badgerBucketTx) NextSequence() (uint64, error) {
+	if err := b.tx.change(); err != nil {
+		return 0, err
+	}
+
+	seq := b.Sequence() + 1
+	return seq, b.tx.setUint64(b.key(badgerSequence, nil), seq)
+}
+
+func (b *badgerBucketTx) Sequence() uint64 {
+	return b.tx.getUint64(b.key(badgerSequence, nil))
+}
+
+func (b *badgerBucketTx) SetSequence(v uint64) error {
+	if err := b.tx.change(); err != nil {
+		return err
+	}
+	return b.tx.setUint64(b.key(badgerSequence, nil), v)
+}
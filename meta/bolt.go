@@ -0,0 +1,217 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+// Package meta maintains the caching of all meta data of the files and directories.
+package meta
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/bbolt"
+)
+
+// Open opens the bolt meta DB at path, the default store.
+func Open(path string, mode os.FileMode, options *bbolt.Options) (*DB, error) {
+	dname := filepath.Dir(path)
+	if err := os.MkdirAll(dname, 0700); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(path, mode, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(&boltStore{db: db, path: path}), nil
+}
+
+type boltStore struct {
+	db   *bbolt.DB
+	path string
+}
+
+func (s *boltStore) Begin(writable bool) (StoreTx, error) {
+	tx, err := s.db.Begin(writable)
+	if err != nil {
+		return nil, err
+	}
+	return boltTx{tx}, nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// Fragmentation returns the fraction of free pages in the file.
+func (s *boltStore) Fragmentation() (float64, int64, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// the free page stats are updated by transactions
+	if err = s.db.View(func(*bbolt.Tx) error { return nil }); err != nil {
+		return 0, 0, err
+	}
+
+	stats := s.db.Stats()
+	free := int64(stats.FreePageN+stats.PendingPageN) * int64(s.db.Info().PageSize)
+	if fi.Size() == 0 {
+		return 0, 0, nil
+	}
+	return float64(free) / float64(fi.Size()), fi.Size(), nil
+}
+
+// Compact copies the live buckets into a new file which replaces the
+// current file. The current file stays valid until the new file has been
+// written completely and is renamed over it.
+func (s *boltStore) Compact() error {
+	tmpPath := s.path + ".compact"
+	os.Remove(tmpPath)
+
+	dst, err := bbolt.Open(tmpPath, 0600, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = s.db.View(func(src *bbolt.Tx) error {
+		return dst.Update(func(tx *bbolt.Tx) error {
+			return src.ForEach(func(name []byte, b *bbolt.Bucket) error {
+				child, err := tx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBoltBucket(child, b)
+			})
+		})
+	}); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err = dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err = s.db.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+	}
+
+	// reopen the file in place, either the compacted or the original
+	db, oerr := bbolt.Open(s.path, 0600, nil)
+	if oerr != nil {
+		return oerr
+	}
+	s.db = db
+	return err
+}
+
+// Backup writes a consistent copy of the file to path.
+func (s *boltStore) Backup(path string) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		return tx.CopyFile(path, 0600)
+	})
+}
+
+// copyBoltBucket copies the keys, nested buckets and sequence of src.
+func copyBoltBucket(dst, src *bbolt.Bucket) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+
+		child, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBoltBucket(child, src.Bucket(k))
+	})
+}
+
+type boltTx struct {
+	*bbolt.Tx
+}
+
+func (tx boltTx) Bucket(name []byte) StoreBucket {
+	return wrapBoltBucket(tx.Tx.Bucket(name))
+}
+
+func (tx boltTx) CreateBucketIfNotExists(name []byte) (StoreBucket, error) {
+	b, err := tx.Tx.CreateBucketIfNotExists(name)
+	return wrapBoltBucket(b), err
+}
+
+type boltBucket struct {
+	b *bbolt.Bucket
+}
+
+// wrapBoltBucket keeps missing buckets nil.
+func wrapBoltBucket(b *bbolt.Bucket) StoreBucket {
+	if b == nil {
+		return nil
+	}
+	return boltBucket{b}
+}
+
+func (b boltBucket) Get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+func (b boltBucket) Put(key, value []byte) error {
+	return b.b.Put(key, value)
+}
+
+func (b boltBucket) Delete(key []byte) error {
+	return b.b.Delete(key)
+}
+
+func (b boltBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(fn)
+}
+
+func (b boltBucket) Bucket(name []byte) StoreBucket {
+	return wrapBoltBucket(b.b.Bucket(name))
+}
+
+func (b boltBucket) CreateBucketIfNotExists(name []byte) (StoreBucket, error) {
+	child, err := b.b.CreateBucketIfNotExists(name)
+	return wrapBoltBucket(child), err
+}
+
+func (b boltBucket) DeleteBucket(name []byte) error {
+	return b.b.DeleteBucket(name)
+}
+
+func (b boltBucket) NextSequence() (uint64, error) {
+	return b.b.NextSequence()
+}
+
+func (b boltBucket) Sequence() uint64 {
+	return b.b.Sequence()
+}
+
+func (b boltBucket) SetSequence(v uint64) error {
+	return b.b.SetSequence(v)
+}
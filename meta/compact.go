@@ -0,0 +1,127 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+// Package meta maintains the caching of all meta data of the files and directories.
+package meta
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCompactUnsupported is returned when the store can't be compacted.
+var ErrCompactUnsupported = errors.New("Meta store doesn't support compaction")
+
+// errBusy is returned when transactions didn't finish in time.
+var errBusy = errors.New("Meta DB is busy, transactions didn't finish")
+
+// quiesceTimeout is how long compaction waits for transactions to finish.
+const quiesceTimeout = 10 * time.Second
+
+// Compacter is implemented by stores which can return unused space.
+type Compacter interface {
+	// Fragmentation returns the fraction of the store which is unused,
+	// and the size of the store in bytes.
+	Fragmentation() (float64, int64, error)
+
+	// Compact rewrites the store with only the live data, no
+	// transactions are active while compacting.
+	Compact() error
+}
+
+// Fragmentation returns the unused fraction and the size of the store.
+func (db *DB) Fragmentation() (float64, int64, error) {
+	c, ok := db.store.(Compacter)
+	if !ok {
+		return 0, 0, ErrCompactUnsupported
+	}
+
+	db.gate.enter()
+	defer db.gate.leave()
+
+	return c.Fragmentation()
+}
+
+// Compact rewrites the store, waiting for active transactions to finish
+// and holding off new transactions meanwhile.
+func (db *DB) Compact() error {
+	c, ok := db.store.(Compacter)
+	if !ok {
+		return ErrCompactUnsupported
+	}
+
+	if !db.gate.close(quiesceTimeout) {
+		return errBusy
+	}
+	defer db.gate.open()
+
+	return c.Compact()
+}
+
+// gate counts the active transactions, and blocks new transactions while
+// closed. Transactions started while waiting to close are let through, so
+// nested transactions can't deadlock.
+type gate struct {
+	m      sync.Mutex
+	cond   *sync.Cond
+	active int
+	closed bool
+}
+
+func (g *gate) enter() {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	for g.closed {
+		g.cond.Wait()
+	}
+	g.active++
+}
+
+func (g *gate) leave() {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	g.active--
+}
+
+// close waits until no transactions are active, returns false if that
+// didn't happen within the timeout.
+func (g *gate) close(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		g.m.Lock()
+		if g.active == 0 {
+			g.closed = true
+			g.m.Unlock()
+			return true
+		}
+		g.m.Unlock()
+
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (g *gate) open() {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	g.closed = false
+	g.cond.Broadcast()
+}
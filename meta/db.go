@@ -13,19 +13,17 @@
  * See the License for the specific language governing permissions and
  * limitations under the License.
  */
-
 // Package meta maintains the caching of all meta data of the files and directories.
 package meta
 
 import (
 	"errors"
-	"os"
-	"path/filepath"
+	"fmt"
+	"reflect"
+	"sync"
 
 	"gopkg.in/vmihailenco/msgpack.v2"
-
-	"github.com/coreos/bbolt"
-	minio "github.com/minio/minio-go/v6"
+	"gopkg.in/vmihailenco/msgpack.v2/codes"
 )
 
 // RegisterExt -
@@ -34,72 +32,244 @@ func RegisterExt(id int8, value interface{}) interface{} {
 	return value
 }
 
-// Open -
-func Open(path string, mode os.FileMode, options *bbolt.Options) (*DB, error) {
-	dname := filepath.Dir(path)
-	if err := os.MkdirAll(dname, 0700); err != nil {
-		return nil, err
-	}
-	db, err := bbolt.Open(path, 0600, nil)
-	if err != nil {
-		return nil, err
-	}
+// Store is the key value store backend of the meta DB. Keys are organized
+// in nested buckets, like in bolt.
+type Store interface {
+	Begin(writable bool) (StoreTx, error)
+	Close() error
+}
 
-	return &DB{
-		db,
-	}, nil
+// StoreTx is a transaction of a Store, only one writable transaction is
+// active at a time.
+type StoreTx interface {
+	// Bucket returns nil if the bucket doesn't exist.
+	Bucket(name []byte) StoreBucket
+	CreateBucketIfNotExists(name []byte) (StoreBucket, error)
 
+	Commit() error
+	Rollback() error
+}
+
+// StoreBucket is a bucket of a Store. Values returned by Get are only
+// valid during the transaction.
+type StoreBucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+
+	// ForEach calls fn for the keys in byte order, including the keys of
+	// nested buckets which have a nil value.
+	ForEach(fn func(k, v []byte) error) error
+
+	// Bucket returns nil if the bucket doesn't exist.
+	Bucket(name []byte) StoreBucket
+	CreateBucketIfNotExists(name []byte) (StoreBucket, error)
+	DeleteBucket(name []byte) error
+
+	NextSequence() (uint64, error)
+	Sequence() uint64
+	SetSequence(v uint64) error
+}
+
+// Backuper is implemented by stores which can be copied to a file.
+type Backuper interface {
+	Backup(path string) error
 }
 
 // DB -
 type DB struct {
-	*bbolt.DB
+	store Store
+
+	// transactions are held off while the store is compacted
+	gate gate
+}
+
+// New returns a meta DB on top of the store.
+func New(store Store) *DB {
+	db := &DB{store: store}
+	db.gate.cond = sync.NewCond(&db.gate.m)
+	return db
+}
+
+// Close -
+func (db *DB) Close() error {
+	return db.store.Close()
+}
+
+// Backup writes a copy of the store to path, stores which don't
+// support backups return ErrBackupUnsupported.
+func (db *DB) Backup(path string) error {
+	b, ok := db.store.(Backuper)
+	if !ok {
+		return ErrBackupUnsupported
+	}
+
+	db.gate.enter()
+	defer db.gate.leave()
+
+	return b.Backup(path)
 }
 
+// ErrBackupUnsupported is returned when the store can't be backed up.
+var ErrBackupUnsupported = errors.New("Meta store doesn't support backups")
+
 // Begin -
 func (db *DB) Begin(writable bool) (*Tx, error) {
-	tx, err := db.DB.Begin(writable)
-	return &Tx{tx}, err
+	db.gate.enter()
+
+	tx, err := db.store.Begin(writable)
+	if err != nil {
+		db.gate.leave()
+		return &Tx{StoreTx: tx}, err
+	}
+	return &Tx{StoreTx: tx, done: db.gate.leave}, nil
 }
 
 // Update -
 func (db *DB) Update(fn func(*Tx) error) error {
-	return db.DB.Update(func(tx *bbolt.Tx) error {
-		return fn(&Tx{tx})
-	})
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // View -
 func (db *DB) View(fn func(*Tx) error) error {
-	return db.DB.View(func(tx *bbolt.Tx) error {
-		return fn(&Tx{tx})
-	})
+	tx, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	return fn(tx)
 }
 
 // Bucket -
 type Bucket struct {
-	InnerBucket *bbolt.Bucket
+	InnerBucket StoreBucket
+
+	// shards is the number of shards the entries are spread across,
+	// zero for unsharded buckets.
+	shards int
 }
 
-// Bucket -
-func (b *Bucket) Bucket(name string) *Bucket {
+// newBucket returns the bucket for inner, which may be nil.
+func newBucket(inner StoreBucket) *Bucket {
 	return &Bucket{
-		b.InnerBucket.Bucket([]byte(name)),
+		InnerBucket: inner,
+		shards:      shardCount(inner),
 	}
 }
 
+// Bucket -
+func (b *Bucket) Bucket(name string) *Bucket {
+	return newBucket(b.InnerBucket.Bucket([]byte(name)))
+}
+
 // NextSequence -
 func (b *Bucket) NextSequence() (uint64, error) {
 	return b.InnerBucket.NextSequence()
 }
 
+// Sequence -
+func (b *Bucket) Sequence() uint64 {
+	return b.InnerBucket.Sequence()
+}
+
+// SetSequence -
+func (b *Bucket) SetSequence(v uint64) error {
+	return b.InnerBucket.SetSequence(v)
+}
+
+// ReadBucket is the read-only view of a Bucket, taken by read paths so
+// writes in View transactions are caught by the compiler.
+type ReadBucket struct {
+	b *Bucket
+}
+
+// ReadOnly returns the read-only view of the bucket.
+func (b *Bucket) ReadOnly() ReadBucket {
+	return ReadBucket{b}
+}
+
+// Exists returns false if the bucket doesn't exist.
+func (rb ReadBucket) Exists() bool {
+	return rb.b.InnerBucket != nil
+}
+
+// Bucket returns the view of the nested bucket name.
+func (rb ReadBucket) Bucket(name string) ReadBucket {
+	if !rb.Exists() {
+		return rb
+	}
+	return rb.b.Bucket(name).ReadOnly()
+}
+
+// Get -
+func (rb ReadBucket) Get(key string, v ...interface{}) error {
+	if !rb.Exists() {
+		return ErrNoSuchObject
+	}
+	return rb.b.Get(key, v...)
+}
+
+// GetMeta -
+func (rb ReadBucket) GetMeta(key string, v ...interface{}) error {
+	if !rb.Exists() {
+		return ErrNoSuchObject
+	}
+	return rb.b.GetMeta(key, v...)
+}
+
 // ForEach -
+func (rb ReadBucket) ForEach(fn func(string, interface{}) error) error {
+	if !rb.Exists() {
+		return nil
+	}
+	return rb.b.ForEach(fn)
+}
+
+// metaPrefix is prepended to the keys of bookkeeping records, these are
+// not returned by ForEach.
+const metaPrefix = "\x00"
+
+// ForEach - the entries of sharded buckets are returned in no
+// particular order.
 func (b *Bucket) ForEach(fn func(string, interface{}) error) error {
-	return b.InnerBucket.ForEach(func(k, v []byte) error {
+	if err := forEachEntry(b.InnerBucket, fn); err != nil {
+		return err
+	}
+
+	for i := 0; i < b.shards; i++ {
+		if err := forEachEntry(b.InnerBucket.Bucket(shardName(i)), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachEntry calls fn for the entries of b, skipping nested buckets and
+// bookkeeping records.
+func forEachEntry(b StoreBucket, fn func(string, interface{}) error) error {
+	if b == nil {
+		return nil
+	}
+
+	return b.ForEach(func(k, v []byte) error {
 		if k[len(k)-1] == '/' {
 			return nil
 		}
 
+		if k[0] == metaPrefix[0] {
+			return nil
+		}
+
 		var o interface{}
 		if err := msgpack.Unmarshal(v, &o); err != nil {
 			return err
@@ -112,42 +282,50 @@ func (b *Bucket) ForEach(fn func(string, interface{}) error) error {
 // CreateBucketIfNotExists -
 func (b *Bucket) CreateBucketIfNotExists(key string) (*Bucket, error) {
 	child, err := b.InnerBucket.CreateBucketIfNotExists([]byte(key))
-	return &Bucket{child}, err
+	return newBucket(child), err
 }
 
 // Tx - transaction struct.
 type Tx struct {
-	*bbolt.Tx
+	StoreTx
+
+	done func()
+}
+
+// Commit -
+func (tx *Tx) Commit() error {
+	defer tx.release()
+	return tx.StoreTx.Commit()
+}
+
+// Rollback -
+func (tx *Tx) Rollback() error {
+	defer tx.release()
+	return tx.StoreTx.Rollback()
+}
+
+// release lets compaction continue once all transactions are closed.
+func (tx *Tx) release() {
+	if tx.done != nil {
+		tx.done()
+		tx.done = nil
+	}
 }
 
 // Bucket -
 func (tx *Tx) Bucket(name string) *Bucket {
-	return &Bucket{
-		tx.Tx.Bucket([]byte(name)),
-	}
+	return newBucket(tx.StoreTx.Bucket([]byte(name)))
+}
+
+// CreateBucketIfNotExists -
+func (tx *Tx) CreateBucketIfNotExists(name string) (*Bucket, error) {
+	b, err := tx.StoreTx.CreateBucketIfNotExists([]byte(name))
+	return newBucket(b), err
 }
 
 // ErrNoSuchObject - returned when object is not found.
 var ErrNoSuchObject = errors.New("No such object")
 
-// IsNoSuchObject - is err ErrNoSuchObject ?
-func IsNoSuchObject(err error) bool {
-	if err == nil {
-		return false
-	}
-	// Validate if the type is same as well.
-	if err == ErrNoSuchObject {
-		return true
-	} else if err.Error() == ErrNoSuchObject.Error() {
-		// Reaches here when type did not match but err string matches.
-		// Someone wrapped this error? - still return true since
-		// they are the same.
-		return true
-	}
-	errorResponse := minio.ToErrorResponse(err)
-	return errorResponse.Code == "NoSuchKey"
-}
-
 // DeleteBucket -
 func (b *Bucket) DeleteBucket(key string) error {
 	return b.InnerBucket.DeleteBucket([]byte(key))
@@ -155,16 +333,46 @@ func (b *Bucket) DeleteBucket(key string) error {
 
 // Delete -
 func (b *Bucket) Delete(key string) error {
-	return b.InnerBucket.Delete([]byte(key))
+	return b.entryBucket(key).Delete([]byte(key))
 }
 
 // Get -
 func (b *Bucket) Get(key string, v ...interface{}) error {
-	data := b.InnerBucket.Get([]byte(key))
+	data := b.entryBucket(key).Get([]byte(key))
 	if data == nil {
 		return ErrNoSuchObject
 	}
-	return msgpack.Unmarshal(data, v...)
+	return unmarshal(data, v...)
+}
+
+// unmarshal decodes data into v. Values of the types registered with
+// RegisterExt are decoded into pointers of their type as well, msgpack
+// only decodes them into interfaces.
+func unmarshal(data []byte, v ...interface{}) error {
+	if len(v) != 1 || len(data) == 0 || !isExt(data[0]) {
+		return msgpack.Unmarshal(data, v...)
+	}
+
+	rv := reflect.ValueOf(v[0])
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() == reflect.Interface {
+		return msgpack.Unmarshal(data, v...)
+	}
+
+	var o interface{}
+	if err := msgpack.Unmarshal(data, &o); err != nil {
+		return err
+	}
+	ov := reflect.ValueOf(o)
+	if !ov.IsValid() || ov.Type() != rv.Elem().Type() {
+		return fmt.Errorf("msgpack: cannot decode %T into %s", o, rv.Elem().Type())
+	}
+	rv.Elem().Set(ov)
+	return nil
+}
+
+// isExt returns true if c is the code of an extension type.
+func isExt(c byte) bool {
+	return (c >= codes.FixExt1 && c <= codes.FixExt16) || (c >= codes.Ext8 && c <= codes.Ext32)
 }
 
 // Put -
@@ -173,5 +381,20 @@ func (b *Bucket) Put(key string, v interface{}) error {
 	if err != nil {
 		return err
 	}
-	return b.InnerBucket.Put([]byte(key), data)
+	return b.entryBucket(key).Put([]byte(key), data)
+}
+
+// GetMeta - reads the bookkeeping record key.
+func (b *Bucket) GetMeta(key string, v ...interface{}) error {
+	return b.Get(metaPrefix+key, v...)
+}
+
+// PutMeta - stores the bookkeeping record key.
+func (b *Bucket) PutMeta(key string, v interface{}) error {
+	return b.Put(metaPrefix+key, v)
+}
+
+// DeleteMeta - removes the bookkeeping record key.
+func (b *Bucket) DeleteMeta(key string) error {
+	return b.Delete(metaPrefix + key)
 }
@@ -0,0 +1,330 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+// Package meta maintains the caching of all meta data of the files and directories.
+package meta
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	errTxClosed         = errors.New("Transaction is closed")
+	errTxNotWritable    = errors.New("Transaction is not writable")
+	errIncompatibleType = errors.New("Incompatible value")
+	errNoSuchBucket     = errors.New("No such bucket")
+)
+
+// OpenMemory returns a meta DB kept in memory, the meta data is lost when
+// the DB is closed. Writable transactions are serialized, readers see the
+// changes of an active writable transaction.
+func OpenMemory() *DB {
+	return New(&memStore{root: newMemBucket()})
+}
+
+type memStore struct {
+	// serializes writable transactions
+	writer sync.Mutex
+
+	// guards the buckets
+	m    sync.RWMutex
+	root *memBucket
+}
+
+type memBucket struct {
+	values  map[string][]byte
+	buckets map[string]*memBucket
+	seq     uint64
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{
+		values:  map[string][]byte{},
+		buckets: map[string]*memBucket{},
+	}
+}
+
+func (s *memStore) Begin(writable bool) (StoreTx, error) {
+	if writable {
+		s.writer.Lock()
+	}
+	return &memTx{s: s, writable: writable}, nil
+}
+
+func (s *memStore) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.root = newMemBucket()
+	return nil
+}
+
+type memTx struct {
+	s        *memStore
+	writable bool
+	closed   bool
+
+	// undo reverts the changes of the transaction in reverse order
+	undo []func()
+}
+
+func (tx *memTx) Bucket(name []byte) StoreBucket {
+	return (&memBucketTx{tx: tx, b: tx.s.root}).Bucket(name)
+}
+
+func (tx *memTx) CreateBucketIfNotExists(name []byte) (StoreBucket, error) {
+	return (&memBucketTx{tx: tx, b: tx.s.root}).CreateBucketIfNotExists(name)
+}
+
+func (tx *memTx) Commit() error {
+	if tx.closed {
+		return errTxClosed
+	}
+	if !tx.writable {
+		return errTxNotWritable
+	}
+
+	tx.close()
+	return nil
+}
+
+func (tx *memTx) Rollback() error {
+	if tx.closed {
+		return errTxClosed
+	}
+
+	if tx.writable {
+		tx.s.m.Lock()
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+		tx.s.m.Unlock()
+	}
+
+	tx.close()
+	return nil
+}
+
+func (tx *memTx) close() {
+	tx.closed = true
+	tx.undo = nil
+	if tx.writable {
+		tx.s.writer.Unlock()
+	}
+}
+
+// change checks the transaction can modify buckets, the caller holds the
+// write lock of the store.
+func (tx *memTx) change() error {
+	if tx.closed {
+		return errTxClosed
+	}
+	if !tx.writable {
+		return errTxNotWritable
+	}
+	return nil
+}
+
+type memBucketTx struct {
+	tx *memTx
+	b  *memBucket
+}
+
+func (b *memBucketTx) Get(key []byte) []byte {
+	b.tx.s.m.RLock()
+	defer b.tx.s.m.RUnlock()
+
+	return b.b.values[string(key)]
+}
+
+func (b *memBucketTx) Put(key, value []byte) error {
+	b.tx.s.m.Lock()
+	defer b.tx.s.m.Unlock()
+
+	if err := b.tx.change(); err != nil {
+		return err
+	}
+
+	k := string(key)
+	if _, ok := b.b.buckets[k]; ok {
+		return errIncompatibleType
+	}
+
+	old, existed := b.b.values[k]
+	b.b.values[k] = append([]byte(nil), value...)
+
+	b.tx.undo = append(b.tx.undo, func() {
+		if existed {
+			b.b.values[k] = old
+		} else {
+			delete(b.b.values, k)
+		}
+	})
+	return nil
+}
+
+func (b *memBucketTx) Delete(key []byte) error {
+	b.tx.s.m.Lock()
+	defer b.tx.s.m.Unlock()
+
+	if err := b.tx.change(); err != nil {
+		return err
+	}
+
+	k := string(key)
+	if _, ok := b.b.buckets[k]; ok {
+		return errIncompatibleType
+	}
+
+	old, existed := b.b.values[k]
+	if !existed {
+		return nil
+	}
+	delete(b.b.values, k)
+
+	b.tx.undo = append(b.tx.undo, func() {
+		b.b.values[k] = old
+	})
+	return nil
+}
+
+func (b *memBucketTx) ForEach(fn func(k, v []byte) error) error {
+	b.tx.s.m.RLock()
+	keys := make([]string, 0, len(b.b.values)+len(b.b.buckets))
+	for k := range b.b.values {
+		keys = append(keys, k)
+	}
+	for k := range b.b.buckets {
+		keys = append(keys, k)
+	}
+	b.tx.s.m.RUnlock()
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		b.tx.s.m.RLock()
+		v, ok := b.b.values[k]
+		_, isBucket := b.b.buckets[k]
+		b.tx.s.m.RUnlock()
+
+		if !ok && !isBucket {
+			// removed by fn
+			continue
+		}
+
+		if err := fn([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memBucketTx) Bucket(name []byte) StoreBucket {
+	b.tx.s.m.RLock()
+	defer b.tx.s.m.RUnlock()
+
+	child, ok := b.b.buckets[string(name)]
+	if !ok {
+		return nil
+	}
+	return &memBucketTx{tx: b.tx, b: child}
+}
+
+func (b *memBucketTx) CreateBucketIfNotExists(name []byte) (StoreBucket, error) {
+	b.tx.s.m.Lock()
+	defer b.tx.s.m.Unlock()
+
+	k := string(name)
+	if child, ok := b.b.buckets[k]; ok {
+		return &memBucketTx{tx: b.tx, b: child}, nil
+	}
+
+	if err := b.tx.change(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := b.b.values[k]; ok {
+		return nil, errIncompatibleType
+	}
+
+	child := newMemBucket()
+	b.b.buckets[k] = child
+
+	b.tx.undo = append(b.tx.undo, func() {
+		delete(b.b.buckets, k)
+	})
+	return &memBucketTx{tx: b.tx, b: child}, nil
+}
+
+func (b *memBucketTx) DeleteBucket(name []byte) error {
+	b.tx.s.m.Lock()
+	defer b.tx.s.m.Unlock()
+
+	if err := b.tx.change(); err != nil {
+		return err
+	}
+
+	k := string(name)
+	child, ok := b.b.buckets[k]
+	if !ok {
+		return errNoSuchBucket
+	}
+	delete(b.b.buckets, k)
+
+	b.tx.undo = append(b.tx.undo, func() {
+		b.b.buckets[k] = child
+	})
+	return nil
+}
+
+func (b *memBucketTx) NextSequence() (uint64, error) {
+	b.tx.s.m.Lock()
+	defer b.tx.s.m.Unlock()
+
+	if err := b.tx.change(); err != nil {
+		return 0, err
+	}
+
+	b.b.seq++
+	b.tx.undo = append(b.tx.undo, func() {
+		b.b.seq--
+	})
+	return b.b.seq, nil
+}
+
+func (b *memBucketTx) Sequence() uint64 {
+	b.tx.s.m.RLock()
+	defer b.tx.s.m.RUnlock()
+
+	return b.b.seq
+}
+
+func (b *memBucketTx) SetSequence(v uint64) error {
+	b.tx.s.m.Lock()
+	defer b.tx.s.m.Unlock()
+
+	if err := b.tx.change(); err != nil {
+		return err
+	}
+
+	seq := b.b.seq
+	b.b.seq = v
+	b.tx.undo = append(b.tx.undo, func() {
+		b.b.seq = seq
+	})
+	return nil
+}
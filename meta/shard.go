@@ -0,0 +1,128 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// shardsKey is the bookkeeping record with the number of shards of a
+// sharded bucket.
+const shardsKey = metaPrefix + "shards"
+
+// shardPrefix starts the names of the nested buckets holding the shards,
+// like bookkeeping records these are skipped by ForEach.
+const shardPrefix = metaPrefix + "shard-"
+
+// shardName returns the name of the nested bucket of shard i.
+func shardName(i int) []byte {
+	return []byte(fmt.Sprintf("%s%03d/", shardPrefix, i))
+}
+
+// IsShard returns true if name is the nested bucket of a shard.
+func IsShard(name string) bool {
+	return strings.HasPrefix(name, shardPrefix)
+}
+
+// shardCount returns the number of shards of b, zero if b isn't sharded.
+func shardCount(b StoreBucket) int {
+	if b == nil {
+		return 0
+	}
+
+	var n int
+	if data := b.Get([]byte(shardsKey)); data != nil {
+		msgpack.Unmarshal(data, &n)
+	}
+	return n
+}
+
+// Sharded returns true if the entries of the bucket are sharded.
+func (b *Bucket) Sharded() bool {
+	return b.shards > 0
+}
+
+// entryBucket returns the store bucket holding the entry key.
+func (b *Bucket) entryBucket(key string) StoreBucket {
+	if b.shards == 0 || key == "" || key[0] == metaPrefix[0] {
+		return b.InnerBucket
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	if shard := b.InnerBucket.Bucket(shardName(int(h.Sum32() % uint32(b.shards)))); shard != nil {
+		return shard
+	}
+	return b.InnerBucket
+}
+
+// Shard spreads the entries of the bucket across n nested buckets keyed
+// by a hash of the name, so huge directories don't end up in a single
+// giant tree. The entries of an unsharded bucket are moved to the shards,
+// buckets already sharded are left as they are.
+func (b *Bucket) Shard(n int) error {
+	if b.shards > 0 || n <= 1 {
+		return nil
+	}
+
+	type entry struct {
+		k, v []byte
+	}
+
+	var entries []entry
+	if err := b.InnerBucket.ForEach(func(k, v []byte) error {
+		if v == nil || k[0] == metaPrefix[0] {
+			return nil
+		}
+		entries = append(entries, entry{
+			k: append([]byte{}, k...),
+			v: append([]byte{}, v...),
+		})
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for i := 0; i < n; i++ {
+		if _, err := b.InnerBucket.CreateBucketIfNotExists(shardName(i)); err != nil {
+			return err
+		}
+	}
+
+	data, err := msgpack.Marshal(n)
+	if err != nil {
+		return err
+	}
+	if err = b.InnerBucket.Put([]byte(shardsKey), data); err != nil {
+		return err
+	}
+	b.shards = n
+
+	for _, e := range entries {
+		if err := b.InnerBucket.Delete(e.k); err != nil {
+			return err
+		}
+		if err := b.entryBucket(string(e.k)).Put(e.k, e.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
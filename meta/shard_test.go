@@ -0,0 +1,225 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// entryNames returns the sorted names ForEach passes for the bucket.
+func entryNames(b *Bucket) ([]string, error) {
+	var names []string
+	err := b.ForEach(func(k string, _ interface{}) error {
+		names = append(names, k)
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// TestShardMigration checks the entries of an unsharded bucket, like the
+// buckets of directories created before sharding, are moved to the shards
+// once it's sharded.
+func TestShardMigration(t *testing.T) {
+	const files = 100
+
+	for _, store := range testStores {
+		dir := t.TempDir()
+		db := openTestStore(t, store, dir)
+
+		var expected []string
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists("minio/")
+			if err != nil {
+				return err
+			}
+			for i := 0; i < files; i++ {
+				name := fmt.Sprintf("file-%03d", i)
+				if err = b.Put(name, name); err != nil {
+					return err
+				}
+				expected = append(expected, name)
+			}
+			if err = b.PutMeta("listing", "complete"); err != nil {
+				return err
+			}
+			_, err = b.CreateBucketIfNotExists("sub/")
+			return err
+		}); err != nil {
+			t.Fatalf("%s: %v", store.name, err)
+		}
+
+		if err := db.Update(func(tx *Tx) error {
+			b := tx.Bucket("minio/")
+			if b.Sharded() {
+				return fmt.Errorf("expected the bucket not to be sharded yet")
+			}
+			if err := b.Shard(8); err != nil {
+				return err
+			}
+
+			// the entries left the bucket, the nested bucket and the
+			// bookkeeping records stay
+			keys, err := listKeys(b.InnerBucket)
+			if err != nil {
+				return err
+			}
+			var shards int
+			for _, k := range keys {
+				switch {
+				case IsShard(k):
+					shards++
+				case k == "sub/*" || k[0] == metaPrefix[0]:
+				default:
+					return fmt.Errorf("expected %s to be moved to a shard", k)
+				}
+			}
+			if shards != 8 {
+				return fmt.Errorf("expected 8 shards, got %d", shards)
+			}
+
+			// sharding again keeps the shards
+			return b.Shard(16)
+		}); err != nil {
+			t.Fatalf("%s: %v", store.name, err)
+		}
+
+		check := func(db *DB) error {
+			return db.View(func(tx *Tx) error {
+				b := tx.Bucket("minio/")
+				if !b.Sharded() || b.shards != 8 {
+					return fmt.Errorf("expected 8 shards, got %d", b.shards)
+				}
+				names, err := entryNames(b)
+				if err != nil {
+					return err
+				}
+				if fmt.Sprint(names) != fmt.Sprint(expected) {
+					return fmt.Errorf("expected the entries %v, got %v", expected, names)
+				}
+				for _, name := range expected {
+					var v string
+					if err = b.Get(name, &v); err != nil || v != name {
+						return fmt.Errorf("expected %s, got %q, %v", name, v, err)
+					}
+				}
+				var state string
+				if err = b.GetMeta("listing", &state); err != nil || state != "complete" {
+					return fmt.Errorf("expected the listing to be kept, got %q, %v", state, err)
+				}
+				if b.Bucket("sub/").InnerBucket == nil {
+					return fmt.Errorf("expected the nested bucket to be kept")
+				}
+				return nil
+			})
+		}
+		if err := check(db); err != nil {
+			t.Errorf("%s: %v", store.name, err)
+		}
+
+		// later updates go to the shards
+		if err := db.Update(func(tx *Tx) error {
+			b := tx.Bucket("minio/")
+			if err := b.Delete(expected[0]); err != nil {
+				return err
+			}
+			if err := b.Put("file-new", "file-new"); err != nil {
+				return err
+			}
+			if b.InnerBucket.Get([]byte("file-new")) != nil {
+				return fmt.Errorf("expected the new entry to be put in a shard")
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", store.name, err)
+		}
+		expected = append(expected[1:], "file-new")
+		if err := check(db); err != nil {
+			t.Errorf("%s: %v", store.name, err)
+		}
+
+		db.Close()
+		if !store.persistent {
+			continue
+		}
+		db = openTestStore(t, store, dir)
+		if err := check(db); err != nil {
+			t.Errorf("%s: after reopening: %v", store.name, err)
+		}
+		db.Close()
+	}
+}
+
+// BenchmarkShardedDir fills a directory bucket with a million children,
+// unsharded and sharded, then looks up and updates them. Run with
+// go test -run - -bench ShardedDir -benchtime 1x -timeout 30m ./meta.
+func BenchmarkShardedDir(b *testing.B) {
+	for _, store := range testStores {
+		for _, shards := range []int{0, 256} {
+			b.Run(fmt.Sprintf("%s/shards-%d", store.name, shards), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					db, err := store.open(b.TempDir())
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					for j := 0; j < benchNamespace; j += benchBatch {
+						if err = db.Update(func(tx *Tx) error {
+							dir, err := tx.CreateBucketIfNotExists("minio/")
+							if err != nil {
+								return err
+							}
+							if err = dir.Shard(shards); err != nil {
+								return err
+							}
+							for k := j; k < j+benchBatch; k++ {
+								if err = dir.Put(benchName(k), benchEntry{Path: benchName(k), Size: uint64(k), Inode: uint64(k)}); err != nil {
+									return err
+								}
+							}
+							return nil
+						}); err != nil {
+							b.Fatal(err)
+						}
+					}
+
+					// a page of lookups and updates spread across the directory
+					if err = db.Update(func(tx *Tx) error {
+						dir := tx.Bucket("minio/")
+						for k := 0; k < benchBatch; k++ {
+							n := k * 7919 % benchNamespace
+							var entry benchEntry
+							if err := dir.Get(benchName(n), &entry); err != nil {
+								return err
+							}
+							entry.Size++
+							if err := dir.Put(benchName(n), entry); err != nil {
+								return err
+							}
+						}
+						return nil
+					}); err != nil {
+						b.Fatal(err)
+					}
+					db.Close()
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,540 @@
+/*
+ * MinFS - fuse driver for Object Storage (C) 2016 MinIO, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/bbolt"
+)
+
+// testStore opens a store of a backend in dir.
+type testStore struct {
+	name       string
+	open       func(dir string) (*DB, error)
+	persistent bool
+}
+
+var testStores = []testStore{
+	{"bolt", func(dir string) (*DB, error) {
+		return Open(filepath.Join(dir, "cache.db"), 0600, &bbolt.Options{Timeout: time.Second})
+	}, true},
+	{"badger", func(dir string) (*DB, error) {
+		return OpenBadger(filepath.Join(dir, "cache.db.badger"), false)
+	}, true},
+	{"memory", func(string) (*DB, error) {
+		return OpenMemory(), nil
+	}, false},
+}
+
+func openTestStore(t *testing.T, store testStore, dir string) *DB {
+	t.Helper()
+	db, err := store.open(dir)
+	if err != nil {
+		t.Fatalf("%s: %v", store.name, err)
+	}
+	return db
+}
+
+// listKeys returns the keys of the store bucket b, nested buckets with
+// a trailing *.
+func listKeys(b StoreBucket) ([]string, error) {
+	var keys []string
+	err := b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			keys = append(keys, string(k)+"*")
+		} else {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func TestStoreBuckets(t *testing.T) {
+	for _, store := range testStores {
+		db := openTestStore(t, store, t.TempDir())
+
+		if err := db.Update(func(tx *Tx) error {
+			root, err := tx.StoreTx.CreateBucketIfNotExists([]byte("minio/"))
+			if err != nil {
+				return err
+			}
+			for _, k := range []string{"b", "a", "c"} {
+				if err = root.Put([]byte(k), []byte("value "+k)); err != nil {
+					return err
+				}
+			}
+			child, err := root.CreateBucketIfNotExists([]byte("dir/"))
+			if err != nil {
+				return err
+			}
+			if err = child.Put([]byte("nested"), []byte("nested")); err != nil {
+				return err
+			}
+			if _, err = child.CreateBucketIfNotExists([]byte("sub/")); err != nil {
+				return err
+			}
+
+			if err = root.Put([]byte("dir/"), []byte("value")); err == nil {
+				return fmt.Errorf("expected putting a bucket key to fail")
+			}
+			if _, err = root.CreateBucketIfNotExists([]byte("a")); err == nil {
+				return fmt.Errorf("expected creating a bucket of a value key to fail")
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", store.name, err)
+		}
+
+		if err := db.View(func(tx *Tx) error {
+			root := tx.StoreTx.Bucket([]byte("minio/"))
+			if root == nil {
+				return fmt.Errorf("expected bucket minio/")
+			}
+			if v := root.Get([]byte("a")); string(v) != "value a" {
+				return fmt.Errorf("expected value a, got %q", v)
+			}
+			if v := root.Get([]byte("dir/")); v != nil {
+				return fmt.Errorf("expected no value of a bucket key, got %q", v)
+			}
+			if root.Bucket([]byte("missing/")) != nil {
+				return fmt.Errorf("expected no bucket missing/")
+			}
+			keys, err := listKeys(root)
+			if err != nil {
+				return err
+			}
+			if expected := []string{"a", "b", "c", "dir/*"}; !reflect.DeepEqual(keys, expected) {
+				return fmt.Errorf("expected keys %v, got %v", expected, keys)
+			}
+			if err = root.Put([]byte("d"), []byte("d")); err == nil {
+				return fmt.Errorf("expected a read-only transaction to fail to put")
+			}
+			return nil
+		}); err != nil {
+			t.Errorf("%s: %v", store.name, err)
+		}
+
+		if err := db.Update(func(tx *Tx) error {
+			root := tx.StoreTx.Bucket([]byte("minio/"))
+			if err := root.Delete([]byte("b")); err != nil {
+				return err
+			}
+			if err := root.Delete([]byte("missing")); err != nil {
+				return err
+			}
+			if err := root.Delete([]byte("dir/")); err == nil {
+				return fmt.Errorf("expected deleting a bucket key to fail")
+			}
+			if err := root.DeleteBucket([]byte("dir/")); err != nil {
+				return err
+			}
+			if err := root.DeleteBucket([]byte("dir/")); err == nil {
+				return fmt.Errorf("expected deleting a missing bucket to fail")
+			}
+			// a new bucket of the name starts empty
+			child, err := root.CreateBucketIfNotExists([]byte("dir/"))
+			if err != nil {
+				return err
+			}
+			keys, err := listKeys(child)
+			if err != nil {
+				return err
+			}
+			if len(keys) != 0 {
+				return fmt.Errorf("expected the recreated bucket to be empty, got %v", keys)
+			}
+			return nil
+		}); err != nil {
+			t.Errorf("%s: %v", store.name, err)
+		}
+
+		db.Close()
+	}
+}
+
+func TestStoreTransactions(t *testing.T) {
+	for _, store := range testStores {
+		db := openTestStore(t, store, t.TempDir())
+
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.StoreTx.CreateBucketIfNotExists([]byte("minio/"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("kept"), []byte("kept"))
+		}); err != nil {
+			t.Fatalf("%s: %v", store.name, err)
+		}
+
+		// changes of failed updates are rolled back
+		errFailed := fmt.Errorf("failed")
+		if err := db.Update(func(tx *Tx) error {
+			b := tx.StoreTx.Bucket([]byte("minio/"))
+			if err := b.Put([]byte("dropped"), []byte("dropped")); err != nil {
+				return err
+			}
+			if err := b.Delete([]byte("kept")); err != nil {
+				return err
+			}
+			if _, err := b.CreateBucketIfNotExists([]byte("dropped/")); err != nil {
+				return err
+			}
+			return errFailed
+		}); err != errFailed {
+			t.Fatalf("%s: expected the update to fail, got %v", store.name, err)
+		}
+
+		if err := db.View(func(tx *Tx) error {
+			keys, err := listKeys(tx.StoreTx.Bucket([]byte("minio/")))
+			if err != nil {
+				return err
+			}
+			if expected := []string{"kept"}; !reflect.DeepEqual(keys, expected) {
+				return fmt.Errorf("expected keys %v after the rollback, got %v", expected, keys)
+			}
+			return nil
+		}); err != nil {
+			t.Errorf("%s: %v", store.name, err)
+		}
+
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatalf("%s: %v", store.name, err)
+		}
+		if err = tx.Commit(); err != nil {
+			t.Errorf("%s: %v", store.name, err)
+		}
+		if err = tx.Rollback(); err == nil {
+			t.Errorf("%s: expected rolling back a committed transaction to fail", store.name)
+		}
+
+		db.Close()
+	}
+}
+
+func TestStoreSequence(t *testing.T) {
+	for _, store := range testStores {
+		db := openTestStore(t, store, t.TempDir())
+
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists("minio/")
+			if err != nil {
+				return err
+			}
+			if seq := b.Sequence(); seq != 0 {
+				return fmt.Errorf("expected sequence 0, got %d", seq)
+			}
+			for i := uint64(1); i <= 3; i++ {
+				seq, err := b.NextSequence()
+				if err != nil {
+					return err
+				}
+				if seq != i {
+					return fmt.Errorf("expected sequence %d, got %d", i, seq)
+				}
+			}
+			if err = b.SetSequence(100); err != nil {
+				return err
+			}
+			if seq, _ := b.NextSequence(); seq != 101 {
+				return fmt.Errorf("expected sequence 101, got %d", seq)
+			}
+			return nil
+		}); err != nil {
+			t.Errorf("%s: %v", store.name, err)
+		}
+
+		db.Close()
+	}
+}
+
+// extEntry is registered like the entries of the directories.
+type extEntry struct {
+	Path string
+	Size uint64
+}
+
+var _ = RegisterExt(1, extEntry{})
+
+// TestGetExt decodes values of registered types into interfaces and into
+// pointers of their type.
+func TestGetExt(t *testing.T) {
+	db := OpenMemory()
+	defer db.Close()
+
+	expected := extEntry{Path: "file", Size: 4}
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucketIfNotExists("minio/")
+		if err != nil {
+			return err
+		}
+		return b.Put("file", expected)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		b := tx.Bucket("minio/")
+
+		var o interface{}
+		if err := b.Get("file", &o); err != nil {
+			return err
+		}
+		if o != expected {
+			return fmt.Errorf("expected %+v, got %+v", expected, o)
+		}
+
+		var e extEntry
+		if err := b.Get("file", &e); err != nil {
+			return err
+		}
+		if e != expected {
+			return fmt.Errorf("expected %+v, got %+v", expected, e)
+		}
+
+		// values of other types aren't decoded into the pointer
+		var other benchEntry
+		if err := b.Get("file", &other); err == nil {
+			return fmt.Errorf("expected decoding into %T to fail, got %+v", other, other)
+		}
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestStoreForEachNested iterates more entries than badger reads at once,
+// listing a nested bucket meanwhile.
+func TestStoreForEachNested(t *testing.T) {
+	const n = 3*forEachBatch + 7
+
+	for _, store := range testStores {
+		db := openTestStore(t, store, t.TempDir())
+
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.StoreTx.CreateBucketIfNotExists([]byte("minio/"))
+			if err != nil {
+				return err
+			}
+			nested, err := b.CreateBucketIfNotExists([]byte("nested/"))
+			if err != nil {
+				return err
+			}
+			if err = nested.Put([]byte("child"), []byte("child")); err != nil {
+				return err
+			}
+			for i := 0; i < n; i++ {
+				if err = b.Put([]byte(fmt.Sprintf("%05d", i)), []byte("value")); err != nil {
+					return err
+				}
+			}
+
+			var values [][]byte
+			if err = b.ForEach(func(k, v []byte) error {
+				if _, err := listKeys(nested); err != nil {
+					return err
+				}
+				if v != nil {
+					values = append(values, append([]byte(nil), k...))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if len(values) != n {
+				return fmt.Errorf("expected %d values, got %d", n, len(values))
+			}
+
+			for _, k := range values {
+				if err = b.Delete(k); err != nil {
+					return err
+				}
+			}
+
+			keys, err := listKeys(b)
+			if err != nil {
+				return err
+			}
+			if expected := []string{"nested/*"}; !reflect.DeepEqual(keys, expected) {
+				return fmt.Errorf("expected keys %v after deleting, got %v", expected, keys)
+			}
+			return nil
+		}); err != nil {
+			t.Errorf("%s: %v", store.name, err)
+		}
+
+		db.Close()
+	}
+}
+
+func TestStoreReopen(t *testing.T) {
+	for _, store := range testStores {
+		if !store.persistent {
+			continue
+		}
+
+		dir := t.TempDir()
+		db := openTestStore(t, store, dir)
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists("minio/")
+			if err != nil {
+				return err
+			}
+			if err = b.Shard(4); err != nil {
+				return err
+			}
+			return b.Put("file", "content")
+		}); err != nil {
+			t.Fatalf("%s: %v", store.name, err)
+		}
+		db.Close()
+
+		db = openTestStore(t, store, dir)
+		if err := db.View(func(tx *Tx) error {
+			b := tx.Bucket("minio/")
+			if !b.Sharded() {
+				return fmt.Errorf("expected the bucket to stay sharded")
+			}
+			var v string
+			if err := b.Get("file", &v); err != nil {
+				return err
+			}
+			if v != "content" {
+				return fmt.Errorf("expected content, got %q", v)
+			}
+			return nil
+		}); err != nil {
+			t.Errorf("%s: %v", store.name, err)
+		}
+		db.Close()
+	}
+}
+
+// benchEntry is the size of the meta data of a file.
+type benchEntry struct {
+	Path    string
+	Size    uint64
+	ETag    string
+	Mode    uint32
+	UID     uint32
+	GID     uint32
+	Inode   uint64
+	ModTime time.Time
+}
+
+// benchNamespace is the number of files of the benchmarks, the updates
+// are split across transactions like the listings of a directory.
+const (
+	benchNamespace = 1000000
+	benchBatch     = 10000
+)
+
+func benchName(i int) string {
+	return fmt.Sprintf("file-%07d", i)
+}
+
+// fillNamespace puts the files of the benchmarks in a directory bucket,
+// sharded like the buckets of huge directories.
+func fillNamespace(b *testing.B, db *DB) {
+	for i := 0; i < benchNamespace; i += benchBatch {
+		if err := db.Update(func(tx *Tx) error {
+			dir, err := tx.CreateBucketIfNotExists("minio/")
+			if err != nil {
+				return err
+			}
+			if err = dir.Shard(256); err != nil {
+				return err
+			}
+			for j := i; j < i+benchBatch; j++ {
+				if err = dir.Put(benchName(j), benchEntry{
+					Path:    benchName(j),
+					Size:    uint64(j),
+					ETag:    "d41d8cd98f00b204e9800998ecf8427e",
+					Mode:    0644,
+					Inode:   uint64(j),
+					ModTime: time.Now(),
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkStore compares the backends on a namespace of a million
+// files, run with go test -run - -bench Store -timeout 30m.
+func BenchmarkStore(b *testing.B) {
+	for _, store := range testStores {
+		b.Run(store.name, func(b *testing.B) {
+			db, err := store.open(b.TempDir())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			fillNamespace(b, db)
+
+			b.Run("Get", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if err := db.View(func(tx *Tx) error {
+						var entry benchEntry
+						return tx.Bucket("minio/").Get(benchName(rand.Intn(benchNamespace)), &entry)
+					}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			b.Run("Put", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if err := db.Update(func(tx *Tx) error {
+						n := rand.Intn(benchNamespace)
+						return tx.Bucket("minio/").Put(benchName(n), benchEntry{Path: benchName(n), Size: uint64(i)})
+					}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			b.Run("List", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					var n int
+					if err := db.View(func(tx *Tx) error {
+						return tx.Bucket("minio/").ForEach(func(string, interface{}) error {
+							n++
+							return nil
+						})
+					}); err != nil {
+						b.Fatal(err)
+					}
+					if n != benchNamespace {
+						b.Fatalf("expected %d entries, got %d", benchNamespace, n)
+					}
+				}
+			})
+		})
+	}
+}
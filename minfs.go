@@ -19,33 +19,12 @@
 package main // import "github.com/minio/minfs"
 
 import (
-	"log"
 	"os"
 
 	minfs "github.com/minio/minfs/cmd"
-	daemon "github.com/sevlyar/go-daemon"
 )
 
 func main() {
-	dctx := &daemon.Context{
-		PidFileName: "/var/log/minfs.pid",
-		PidFilePerm: 0644,
-		LogFileName: "/var/log/minfs.log",
-		LogFilePerm: 0640,
-		WorkDir:     "./",
-		Umask:       027,
-		Args:        os.Args,
-	}
-
-	d, err := dctx.Reborn()
-	if err != nil {
-		log.Fatalln("Unable to run: ", err)
-	}
-	if d != nil {
-		return
-	}
-	defer dctx.Release()
-
-	// daemon business logic starts here
+	// the mount is served in the background, unless --foreground is given
 	minfs.Main(os.Args)
 }
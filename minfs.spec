@@ -56,6 +56,7 @@ LDFLAGS="
 -X $prefix.ReleaseTag=$tag
 -X $prefix.CommitID=$commitid
 -X $prefix.ShortCommitID=$scommitid
+-X $prefix.BuildDate=$(date -u +%%Y-%%m-%%dT%%H:%%M:%%SZ)
 "
 
 %gobuild -o %{name}